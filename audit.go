@@ -0,0 +1,255 @@
+package gitdir
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// The audit log is stored under the base dir. When it grows past
+// auditMaxSize, it is rotated to audit.log.1, and any older logs are shifted
+// along until auditMaxBackups is reached.
+const (
+	auditLogPath    = "audit/audit.log"
+	auditMaxSize    = 10 * 1024 * 1024
+	auditMaxBackups = 5
+)
+
+// Audit event types.
+const (
+	AuditEventAuth       = "auth"
+	AuditEventRepoAccess = "repo_access"
+	AuditEventRefUpdate  = "ref_update"
+)
+
+// AuditEvent is a single entry in the audit log. Only the fields relevant to
+// the event type are set.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Allowed bool      `json:"allowed"`
+	Reason  string    `json:"reason,omitempty"`
+	User    string    `json:"user,omitempty"`
+
+	// Auth events
+	Method      string `json:"method,omitempty"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	RemoteUser  string `json:"remote_user,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Repo access and ref update events
+	Repo      string `json:"repo,omitempty"`
+	Requested string `json:"requested,omitempty"`
+	Access    string `json:"access,omitempty"`
+	Ref       string `json:"ref,omitempty"`
+	OldHash   string `json:"old,omitempty"`
+	NewHash   string `json:"new,omitempty"`
+}
+
+// AuditFilter limits which events are returned from the audit log. Any fields
+// which are not set are ignored.
+type AuditFilter struct {
+	User  string
+	Repo  string
+	Since time.Time
+	Until time.Time
+}
+
+// Matches returns true if the given event passes this filter.
+func (f *AuditFilter) Matches(event *AuditEvent) bool {
+	switch {
+	case f.User != "" && event.User != f.User:
+		return false
+	case f.Repo != "" && event.Repo != f.Repo:
+		return false
+	case !f.Since.IsZero() && event.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && event.Time.After(f.Until):
+		return false
+	}
+
+	return true
+}
+
+// AuditLog is an append-only log of access decisions and ref updates, stored
+// as JSON lines. Events may be written by both the server and hooks, which
+// run in separate processes, so each event is written with a single append.
+// Only the server rotates the log, to avoid multiple processes rotating it at
+// the same time.
+type AuditLog struct {
+	lock sync.Mutex
+	fs   billy.Filesystem
+	now  func() time.Time
+
+	// maxSize is the size at which the log is rotated. If it is 0, the log
+	// will never be rotated.
+	maxSize int64
+}
+
+// newAuditLog returns an audit log which will be rotated when it grows past
+// maxSize.
+func newAuditLog(fs billy.Filesystem, maxSize int64) *AuditLog {
+	return &AuditLog{
+		fs:      fs,
+		now:     time.Now,
+		maxSize: maxSize,
+	}
+}
+
+// Record appends the given event to the log. If the time is not set on the
+// event, the current time will be used.
+func (a *AuditLog) Record(event *AuditEvent) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = a.now().UTC()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = a.fs.MkdirAll(path.Dir(auditLogPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	err = a.rotateIfNeeded()
+	if err != nil {
+		return err
+	}
+
+	f, err := a.fs.OpenFile(auditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+
+	return newMultiError(err, f.Close())
+}
+
+func (a *AuditLog) rotateIfNeeded() error {
+	if a.maxSize <= 0 {
+		return nil
+	}
+
+	info, err := a.fs.Stat(auditLogPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Size() < a.maxSize {
+		return nil
+	}
+
+	for i := auditMaxBackups - 1; i > 0; i-- {
+		err = a.fs.Rename(auditBackupPath(i), auditBackupPath(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return a.fs.Rename(auditLogPath, auditBackupPath(1))
+}
+
+func auditBackupPath(n int) string {
+	return fmt.Sprintf("%s.%d", auditLogPath, n)
+}
+
+// Query returns all events matching the given filter, oldest first, including
+// any events in rotated logs.
+func (a *AuditLog) Query(filter *AuditFilter) ([]*AuditEvent, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var ret []*AuditEvent
+
+	for i := auditMaxBackups; i >= 0; i-- {
+		filename := auditLogPath
+		if i > 0 {
+			filename = auditBackupPath(i)
+		}
+
+		events, err := a.readFile(filename, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, events...)
+	}
+
+	return ret, nil
+}
+
+func (a *AuditLog) readFile(filename string, filter *AuditFilter) ([]*AuditEvent, error) {
+	f, err := a.fs.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var ret []*AuditEvent
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var event AuditEvent
+
+		// A line may have been cut short if the disk filled up, so we skip
+		// anything we can't parse rather than hiding the rest of the log.
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+
+		if filter.Matches(&event) {
+			ret = append(ret, &event)
+		}
+	}
+
+	return ret, scanner.Err()
+}
+
+// auditReason returns the reason to record for the given error.
+func auditReason(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(err.Error())
+}
+
+// recordAudit writes the given event to the audit log. Failures are logged
+// rather than returned, so a problem with the audit log doesn't stop the
+// operation being audited. Hooks may run in a separate process from the
+// server, so only the server rotates the log.
+func (c *Config) recordAudit(event *AuditEvent) {
+	err := newAuditLog(c.fs, 0).Record(event)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to write audit log")
+	}
+}
+
+// recordAudit writes the given event to the server's audit log.
+func (serv *Server) recordAudit(event *AuditEvent) {
+	err := serv.audit.Record(event)
+	if err != nil {
+		serv.log.Error().Err(err).Msg("Failed to write audit log")
+	}
+}
@@ -0,0 +1,138 @@
+package gitdir
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+
+	// Use a tiny max size so every event causes a rotation. memfs doesn't
+	// properly support renaming files which are a prefix of other files, so
+	// we need to use a real filesystem.
+	audit := newAuditLog(osfs.New(t.TempDir()), 1)
+	audit.now = func() time.Time { return now }
+
+	record := func(user, repo string) {
+		now = now.Add(time.Hour)
+		require.NoError(t, audit.Record(&AuditEvent{Type: AuditEventRepoAccess, User: user, Repo: repo}))
+	}
+
+	record("user-a", "repo-a")
+	record("user-b", "repo-a")
+	record("user-a", "repo-b")
+	record("user-b", "repo-b")
+
+	var tests = []struct { //nolint:gofumpt
+		Filter AuditFilter
+		Users  []string
+		Repos  []string
+	}{
+		{AuditFilter{}, []string{"user-a", "user-b", "user-a", "user-b"}, []string{"repo-a", "repo-a", "repo-b", "repo-b"}},
+		{AuditFilter{User: "user-a"}, []string{"user-a", "user-a"}, []string{"repo-a", "repo-b"}},
+		{AuditFilter{Repo: "repo-b"}, []string{"user-a", "user-b"}, []string{"repo-b", "repo-b"}},
+		{AuditFilter{User: "user-b", Repo: "repo-a"}, []string{"user-b"}, []string{"repo-a"}},
+		{AuditFilter{Since: start.Add(2 * time.Hour)}, []string{"user-b", "user-a", "user-b"}, []string{"repo-a", "repo-b", "repo-b"}},
+		{AuditFilter{Until: start.Add(2 * time.Hour)}, []string{"user-a", "user-b"}, []string{"repo-a", "repo-a"}},
+		{AuditFilter{User: "missing"}, nil, nil},
+	}
+
+	for _, test := range tests {
+		events, err := audit.Query(&test.Filter)
+		require.NoError(t, err)
+
+		var users, repos []string
+
+		for _, event := range events {
+			users = append(users, event.User)
+			repos = append(repos, event.Repo)
+		}
+
+		assert.Equal(t, test.Users, users, test.Filter)
+		assert.Equal(t, test.Repos, repos, test.Filter)
+	}
+
+	// Older logs should be dropped once we run out of backups.
+	for i := 0; i < auditMaxBackups; i++ {
+		record("user-c", "repo-c")
+	}
+
+	events, err := audit.Query(&AuditFilter{})
+	require.NoError(t, err)
+	assert.Len(t, events, auditMaxBackups+1)
+	assert.Equal(t, "user-b", events[0].User)
+}
+
+func TestAuditRefUpdate(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	c.Repos["test-repo"].Refs = []*models.RefRule{
+		{Pattern: "refs/heads/master"},
+	}
+
+	err := c.RunHook("update", "test-repo", "an-admin", nil, []string{"refs/heads/master", testOldHash, testZeroHash}, nil)
+	require.Error(t, err)
+
+	err = c.RunHook("update", "test-repo", "an-admin", nil, []string{"refs/heads/other", testOldHash, testZeroHash}, nil)
+	require.NoError(t, err)
+
+	events, err := newAuditLog(c.fs, 0).Query(&AuditFilter{Repo: "test-repo"})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	assert.Equal(t, AuditEventRefUpdate, events[0].Type)
+	assert.Equal(t, "an-admin", events[0].User)
+	assert.Equal(t, "refs/heads/master", events[0].Ref)
+	assert.Equal(t, testOldHash, events[0].OldHash)
+	assert.Equal(t, testZeroHash, events[0].NewHash)
+	assert.False(t, events[0].Allowed)
+	assert.NotEmpty(t, events[0].Reason)
+
+	assert.Equal(t, "refs/heads/other", events[1].Ref)
+	assert.True(t, events[1].Allowed)
+	assert.Empty(t, events[1].Reason)
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	filter, err := parseAuditFilter([]string{
+		"--user", "belak",
+		"--repo", "/Go-Gitdir/",
+		"--since", "24h",
+		"--until", "2020-01-01T12:00:00Z",
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, &AuditFilter{
+		User:  "belak",
+		Repo:  "go-gitdir",
+		Since: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+	}, filter)
+
+	filter, err = parseAuditFilter([]string{"--since", "2019-12-31"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC), filter.Since)
+
+	_, err = parseAuditFilter([]string{"--user"}, now)
+	assert.Error(t, err)
+
+	_, err = parseAuditFilter([]string{"--since", "yesterday"}, now)
+	assert.Error(t, err)
+
+	_, err = parseAuditFilter([]string{"--bogus", "value"}, now)
+	assert.Error(t, err)
+}
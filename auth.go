@@ -0,0 +1,287 @@
+package gitdir
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/rs/zerolog/log"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+// Authenticator looks up the user who owns a public key. Authenticators only
+// map keys to usernames. Users still need to be defined in the config, so
+// permission checks are the same no matter which Authenticator was used.
+type Authenticator interface {
+	// LookupUserFromKey returns the user who owns the given key, using the
+	// given config to resolve the user. If the key is unknown,
+	// ErrUserNotFound should be returned so any other authenticators can be
+	// tried.
+	LookupUserFromKey(config *Config, pk models.PublicKey, remoteUser string) (*User, error)
+}
+
+// ConfigAuthenticator looks up keys defined in the config repos. This is the
+// default Authenticator.
+type ConfigAuthenticator struct{}
+
+// LookupUserFromKey implements Authenticator.
+func (ConfigAuthenticator) LookupUserFromKey(config *Config, pk models.PublicKey, remoteUser string) (*User, error) {
+	return config.LookupUserFromKey(pk, remoteUser)
+}
+
+// AuthenticatorChain tries each Authenticator in order, returning the first
+// user found.
+type AuthenticatorChain []Authenticator
+
+// NewAuthenticatorChain returns an Authenticator which tries each of the given
+// authenticators in order.
+func NewAuthenticatorChain(authenticators ...Authenticator) AuthenticatorChain {
+	return AuthenticatorChain(authenticators)
+}
+
+// LookupUserFromKey implements Authenticator. If an authenticator fails with
+// an error other than ErrUserNotFound, the rest are still tried, so one
+// unavailable backend doesn't lock everyone out. If no user was found, the
+// first of those errors is returned.
+func (chain AuthenticatorChain) LookupUserFromKey(config *Config, pk models.PublicKey, remoteUser string) (*User, error) {
+	var firstErr error
+
+	for _, authenticator := range chain {
+		user, err := authenticator.LookupUserFromKey(config, pk, remoteUser)
+		if err == nil {
+			return user, nil
+		}
+
+		if !errors.Is(err, ErrUserNotFound) {
+			log.Warn().Err(err).Msg("authenticator failed")
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return AnonymousUser, firstErr
+	}
+
+	return AnonymousUser, ErrUserNotFound
+}
+
+// lookupKeyOwner resolves the owner of a key found by an external
+// Authenticator to a user in the config. This follows the same rules as keys
+// defined in the config.
+func (c *Config) lookupKeyOwner(username string, remoteUser string) (*User, error) {
+	// The anonymous username always results in an anonymous session, even if
+	// the key would otherwise match a user.
+	if c.Options.AnonymousRead && c.Options.AnonymousUser != "" && remoteUser == c.Options.AnonymousUser {
+		return AnonymousUser, nil
+	}
+
+	// If they weren't the git user make sure their username matches their key.
+	if remoteUser != c.Options.GitUser && remoteUser != username {
+		log.Warn().Msg("key belongs to different user")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	return c.LookupUserFromUsername(username)
+}
+
+// KeyDirAuthenticator looks up keys in a directory of authorized_keys files,
+// similar to the gitolite keydir. Each file is named after the user who owns
+// the keys in it, such as belak.pub. Anything after an @ is ignored, so a user
+// can have multiple files, such as belak@laptop.pub. Subdirectories are also
+// searched. The directory is read on every lookup, so changes take effect
+// right away.
+type KeyDirAuthenticator struct {
+	FS billy.Filesystem
+}
+
+// LookupUserFromKey implements Authenticator.
+func (a *KeyDirAuthenticator) LookupUserFromKey(config *Config, pk models.PublicKey, remoteUser string) (*User, error) {
+	target := pk.Marshal()
+
+	var username string
+
+	err := util.Walk(a.FS, "/", func(filename string, info os.FileInfo, err error) error {
+		if err != nil || username != "" {
+			return err
+		}
+
+		name := path.Base(filename)
+		if info.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".pub") {
+			return nil
+		}
+
+		data, err := util.ReadFile(a.FS, filename)
+		if err != nil {
+			return err
+		}
+
+		if authorizedKeysContain(data, target) {
+			username = strings.SplitN(strings.TrimSuffix(name, ".pub"), "@", 2)[0]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return AnonymousUser, err
+	}
+
+	if username == "" {
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	return config.lookupKeyOwner(username, remoteUser)
+}
+
+// authorizedKeysContain returns true if the given authorized_keys data
+// contains the target key, in wire format.
+func authorizedKeysContain(data []byte, target []byte) bool {
+	for len(data) > 0 {
+		pk, _, _, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			// ParseAuthorizedKey skips invalid lines, so an error means
+			// there are no more keys.
+			return false
+		}
+
+		if bytes.Equal(pk.Marshal(), target) {
+			return true
+		}
+
+		data = rest
+	}
+
+	return false
+}
+
+// DefaultSQLAuthenticatorQuery is the query used by SQLAuthenticator if one
+// isn't set.
+const DefaultSQLAuthenticatorQuery = "SELECT username FROM public_keys WHERE public_key = ?"
+
+// SQLAuthenticator looks up keys in a SQL database. The driver needs to be
+// registered by whoever opens the database, so gitdir doesn't depend on any
+// particular database.
+type SQLAuthenticator struct {
+	DB *sql.DB
+
+	// Query is run with the key in authorized_keys format, without a comment,
+	// as the only argument and should return a single username. If it is not
+	// set, DefaultSQLAuthenticatorQuery is used. This may need to be changed
+	// to use the placeholder syntax of the database being used.
+	Query string
+}
+
+// LookupUserFromKey implements Authenticator.
+func (a *SQLAuthenticator) LookupUserFromKey(config *Config, pk models.PublicKey, remoteUser string) (*User, error) {
+	query := a.Query
+	if query == "" {
+		query = DefaultSQLAuthenticatorQuery
+	}
+
+	var username string
+
+	err := a.DB.QueryRow(query, pk.RawMarshalAuthorizedKey()).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AnonymousUser, ErrUserNotFound
+	} else if err != nil {
+		return AnonymousUser, err
+	}
+
+	return config.lookupKeyOwner(username, remoteUser)
+}
+
+// httpAuthenticatorTimeout is how long HTTPAuthenticator will wait for a
+// response if no client is provided.
+const httpAuthenticatorTimeout = 5 * time.Second
+
+// HTTPAuthenticatorRequest is the body POSTed to the URL of an
+// HTTPAuthenticator.
+type HTTPAuthenticatorRequest struct {
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+	RemoteUser  string `json:"remote_user"`
+}
+
+// HTTPAuthenticatorResponse is the body expected from the URL of an
+// HTTPAuthenticator when a key is found.
+type HTTPAuthenticatorResponse struct {
+	Username string `json:"username"`
+}
+
+// HTTPAuthenticator looks up keys by POSTing them as JSON to an HTTP endpoint.
+// The endpoint should respond with a 200 and the username if the key is known,
+// or a 404 if it isn't. Any other response is treated as an error.
+type HTTPAuthenticator struct {
+	URL string
+
+	// Client is used to make requests. If it is not set, a client with a
+	// short timeout is used.
+	Client *http.Client
+}
+
+// LookupUserFromKey implements Authenticator.
+func (a *HTTPAuthenticator) LookupUserFromKey(config *Config, pk models.PublicKey, remoteUser string) (*User, error) {
+	client := a.Client
+	if client == nil {
+		client = &http.Client{Timeout: httpAuthenticatorTimeout}
+	}
+
+	body, err := json.Marshal(&HTTPAuthenticatorRequest{
+		PublicKey:   pk.RawMarshalAuthorizedKey(),
+		Fingerprint: gossh.FingerprintSHA256(pk),
+		RemoteUser:  remoteUser,
+	})
+	if err != nil {
+		return AnonymousUser, err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return AnonymousUser, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return AnonymousUser, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return AnonymousUser, ErrUserNotFound
+	default:
+		return AnonymousUser, fmt.Errorf("unexpected status from authenticator: %s", resp.Status)
+	}
+
+	var ret HTTPAuthenticatorResponse
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&ret)
+	if err != nil {
+		return AnonymousUser, err
+	}
+
+	if ret.Username == "" {
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	return config.lookupKeyOwner(ret.Username, remoteUser)
+}
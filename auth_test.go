@@ -0,0 +1,172 @@
+package gitdir
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+const (
+	testAuthKey      = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGM+Pq2ysTuyPtWE7HobEw4cBUf2WOg4vOrM5QUsMHKb"
+	testAuthOtherKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIL+yYsrrN2zK0QWIGgvDh2mUjp64Yp1/VTh/vwI2ZMy3"
+)
+
+// testKeyDB is a tiny database/sql driver which maps keys to usernames, so the
+// SQL authenticator can be tested without depending on a real database.
+type testKeyDB map[string]string
+
+func (db testKeyDB) Open(name string) (driver.Conn, error) { return &testKeyConn{db: db}, nil }
+
+type testKeyConn struct{ db testKeyDB }
+
+func (c *testKeyConn) Prepare(query string) (driver.Stmt, error) { return &testKeyStmt{db: c.db}, nil }
+func (c *testKeyConn) Close() error                              { return nil }
+func (c *testKeyConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type testKeyStmt struct{ db testKeyDB }
+
+func (s *testKeyStmt) Close() error  { return nil }
+func (s *testKeyStmt) NumInput() int { return 1 }
+
+func (s *testKeyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *testKeyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	username, ok := s.db[args[0].(string)]
+
+	return &testKeyRows{username: username, done: !ok}, nil
+}
+
+type testKeyRows struct {
+	username string
+	done     bool
+}
+
+func (r *testKeyRows) Columns() []string { return []string{"username"} }
+func (r *testKeyRows) Close() error      { return nil }
+
+func (r *testKeyRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+
+	r.done = true
+	dest[0] = r.username
+
+	return nil
+}
+
+func init() { //nolint:gochecknoinits
+	sql.Register("gitdir-test-keys", testKeyDB{testAuthKey: "non-admin"})
+}
+
+// failingAuthenticator always fails with an error other than
+// ErrUserNotFound.
+type failingAuthenticator struct{}
+
+func (failingAuthenticator) LookupUserFromKey(*Config, models.PublicKey, string) (*User, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func newTestAuthenticators(t *testing.T) map[string]Authenticator {
+	t.Helper()
+
+	fs := memfs.New()
+	require.NoError(t, util.WriteFile(fs, "team/non-admin@laptop.pub", []byte("# laptop\n"+testAuthKey+" comment\n"), 0o644))
+	require.NoError(t, util.WriteFile(fs, "disabled.pub", []byte(testAuthOtherKey+"\n"), 0o644))
+
+	db, err := sql.Open("gitdir-test-keys", "")
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req HTTPAuthenticatorRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.PublicKey != testAuthKey {
+			http.NotFound(w, r)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(&HTTPAuthenticatorResponse{Username: "non-admin"})
+	}))
+	t.Cleanup(server.Close)
+
+	return map[string]Authenticator{
+		"keydir": &KeyDirAuthenticator{FS: fs},
+		"sql":    &SQLAuthenticator{DB: db},
+		"http":   &HTTPAuthenticator{URL: server.URL},
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	pk := mustParsePK(testAuthKey)
+	otherPK := mustParsePK(testAuthOtherKey)
+
+	for name, authenticator := range newTestAuthenticators(t) {
+		user, err := authenticator.LookupUserFromKey(c, pk, "git")
+		require.NoError(t, err, name)
+		assert.Equal(t, &User{Username: "non-admin"}, user, name)
+
+		// The remote user needs to match the key, unless it's the git user.
+		user, err = authenticator.LookupUserFromKey(c, pk, "non-admin")
+		require.NoError(t, err, name)
+		assert.Equal(t, "non-admin", user.Username, name)
+
+		_, err = authenticator.LookupUserFromKey(c, pk, "an-admin")
+		assert.ErrorIs(t, err, ErrUserNotFound, name)
+
+		// Keys which are unknown, or belong to disabled users, are not found.
+		_, err = authenticator.LookupUserFromKey(c, otherPK, "git")
+		assert.ErrorIs(t, err, ErrUserNotFound, name)
+	}
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	authenticators := newTestAuthenticators(t)
+
+	adminPK := c.Users["an-admin"].Keys[0]
+	pk := mustParsePK(testAuthKey)
+	otherPK := mustParsePK(testAuthOtherKey)
+
+	chain := NewAuthenticatorChain(ConfigAuthenticator{}, failingAuthenticator{}, authenticators["http"])
+
+	user, err := chain.LookupUserFromKey(c, adminPK, "git")
+	require.NoError(t, err)
+	assert.Equal(t, &User{Username: "an-admin", IsAdmin: true}, user)
+
+	// Errors from one authenticator shouldn't stop the others from being
+	// tried.
+	user, err = chain.LookupUserFromKey(c, pk, "git")
+	require.NoError(t, err)
+	assert.Equal(t, "non-admin", user.Username)
+
+	// If nothing matched, the backend error should be returned.
+	_, err = chain.LookupUserFromKey(c, otherPK, "git")
+	assert.EqualError(t, err, "backend unavailable")
+
+	_, err = NewAuthenticatorChain(ConfigAuthenticator{}).LookupUserFromKey(c, otherPK, "git")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
@@ -0,0 +1,446 @@
+package gitdir
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+// backupManifestName is the name of the manifest in a backup archive.
+const backupManifestName = "manifest.json"
+
+// backupManifestVersion is the version of the manifest format which is
+// written by Backup.
+const backupManifestVersion = 1
+
+// ErrNoBackupManifest is returned when an archive doesn't contain a manifest.
+var ErrNoBackupManifest = errors.New("backup manifest not found")
+
+// BackupManifest describes the contents of a backup archive.
+type BackupManifest struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+
+	// Incremental is set if the bundles in this backup only contain the
+	// objects added since a previous backup, which needs to be restored
+	// first.
+	Incremental bool `json:"incremental"`
+
+	Repos []*BackupRepo `json:"repos"`
+}
+
+// BackupRepo is a single repo in a backup.
+type BackupRepo struct {
+	// Path is where the repo is stored, relative to the base dir and without
+	// the .git suffix.
+	Path string `json:"path"`
+
+	// Head is the ref HEAD points to, if any.
+	Head string `json:"head,omitempty"`
+
+	// Refs maps every ref in the repo to the hash it points to.
+	Refs map[string]string `json:"refs"`
+
+	// Bundle is the name of the git bundle in the archive. Repos without any
+	// refs don't have a bundle.
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// Backup writes a tar archive of every repo under the base dir to w. Each
+// repo is locked while its refs are read, so the backup of each repo is
+// consistent, even if the server is running. If a previous manifest is given,
+// only objects added since that backup are included.
+func Backup(fs billy.Filesystem, w io.Writer, previous *BackupManifest) (*BackupManifest, error) {
+	repoPaths, err := listRepoDirs(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	previousRepos := make(map[string]*BackupRepo)
+
+	if previous != nil {
+		for _, repo := range previous.Repos {
+			previousRepos[repo.Path] = repo
+		}
+	}
+
+	manifest := &BackupManifest{
+		Version:     backupManifestVersion,
+		Time:        time.Now().UTC(),
+		Incremental: previous != nil,
+	}
+
+	locks := newRepoLocks(fs)
+	tw := tar.NewWriter(w)
+
+	for _, repoPath := range repoPaths {
+		repo, err := backupRepo(fs, locks, tw, repoPath, previousRepos[repoPath])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", repoPath, err)
+		}
+
+		manifest.Repos = append(manifest.Repos, repo)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0o600,
+		Size:    int64(len(data)),
+		ModTime: manifest.Time,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, tw.Close()
+}
+
+// backupRepo adds the bundle for a single repo to the archive. The size of
+// each file needs to be known before it is added, so the bundle is written to
+// a temporary file first.
+func backupRepo(
+	fs billy.Filesystem,
+	locks *repoLocks,
+	tw *tar.Writer,
+	repoPath string,
+	previous *BackupRepo,
+) (*BackupRepo, error) {
+	tmp, err := os.CreateTemp("", "gitdir-backup-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	repo, err := writeRepoBundle(fs, locks, tmp, repoPath, previous)
+	if err != nil || repo.Bundle == "" {
+		return repo, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    repo.Bundle,
+		Mode:    0o600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(tw, tmp)
+
+	return repo, err
+}
+
+func writeRepoBundle(
+	fs billy.Filesystem,
+	locks *repoLocks,
+	w io.Writer,
+	repoPath string,
+	previous *BackupRepo,
+) (*BackupRepo, error) {
+	defer locks.Lock(repoDirLockPath(repoPath))()
+
+	repo, err := git.Open(fs, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &BackupRepo{
+		Path: repoPath,
+		Refs: make(map[string]string),
+	}
+
+	head, err := repo.Repo.Storer.Reference(plumbing.HEAD)
+	if err == nil && head.Type() == plumbing.SymbolicReference {
+		ret.Head = head.Target().String()
+	}
+
+	iter, err := repo.Repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), "refs/") {
+			refs = append(refs, ref)
+			ret.Refs[ref.Name().String()] = ref.Hash().String()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(refs) == 0 {
+		return ret, nil
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	var prerequisites []plumbing.Hash
+
+	if previous != nil {
+		for _, hash := range previous.Refs {
+			prerequisites = append(prerequisites, plumbing.NewHash(hash))
+		}
+	}
+
+	ret.Bundle = path.Join("bundles", repoPath+".bundle")
+
+	return ret, repo.WriteBundle(w, refs, prerequisites)
+}
+
+// listRepoDirs returns the path of every repo under the base dir, without the
+// .git suffix.
+func listRepoDirs(fs billy.Filesystem) ([]string, error) {
+	dirs := []string{"admin", "top-level"}
+
+	for _, parent := range []string{"orgs", "users"} {
+		entries, err := fs.ReadDir(parent)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, path.Join(parent, entry.Name()))
+			}
+		}
+	}
+
+	var ret []string
+
+	for _, dir := range dirs {
+		entries, err := fs.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasSuffix(entry.Name(), ".git") {
+				ret = append(ret, path.Join(dir, strings.TrimSuffix(entry.Name(), ".git")))
+			}
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+// ReadBackupManifest reads the manifest from a backup archive.
+func ReadBackupManifest(r io.Reader) (*BackupManifest, error) {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNoBackupManifest
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name != backupManifestName {
+			continue
+		}
+
+		manifest := &BackupManifest{}
+
+		err = json.NewDecoder(tr).Decode(manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		if manifest.Version != backupManifestVersion {
+			return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+		}
+
+		return manifest, nil
+	}
+}
+
+// Restore restores the repos from a backup archive, recreating the layout of
+// the base dir and the hooks in each repo. A full backup can only be restored
+// if none of its repos exist yet. Incremental backups need to be restored in
+// order, after the full backup they're based on. Refs are set to exactly what
+// they were when the backup was made.
+func Restore(fs billy.Filesystem, archive io.ReadSeeker) (*BackupManifest, error) {
+	manifest, err := ReadBackupManifest(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	bundles := make(map[string]*BackupRepo)
+
+	for _, repo := range manifest.Repos {
+		if !manifest.Incremental && git.Exists(fs, repo.Path) {
+			return nil, fmt.Errorf("%s: repo already exists", repo.Path)
+		}
+
+		if repo.Bundle != "" {
+			bundles[repo.Bundle] = repo
+		}
+	}
+
+	locks := newRepoLocks(fs)
+
+	// Repos are created first, so repos without a bundle are restored as
+	// well.
+	for _, repo := range manifest.Repos {
+		_, err = git.EnsureRepo(fs, repo.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", repo.Path, err)
+		}
+	}
+
+	tr := tar.NewReader(archive)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		repo, ok := bundles[hdr.Name]
+		if !ok {
+			continue
+		}
+
+		err = restoreRepo(fs, locks, repo, tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", repo.Path, err)
+		}
+
+		delete(bundles, hdr.Name)
+	}
+
+	if len(bundles) > 0 {
+		return nil, fmt.Errorf("%d bundles missing from backup", len(bundles))
+	}
+
+	// Repos without a bundle have no refs, but they may have had some when
+	// the previous backup was made.
+	for _, repo := range manifest.Repos {
+		if repo.Bundle == "" {
+			err = restoreRepo(fs, locks, repo, nil)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", repo.Path, err)
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// restoreRepo reads the bundle into the repo, if there is one, and updates the
+// refs to match the backup.
+func restoreRepo(fs billy.Filesystem, locks *repoLocks, backup *BackupRepo, bundle io.Reader) error {
+	defer locks.Lock(repoDirLockPath(backup.Path))()
+
+	repo, err := git.Open(fs, backup.Path)
+	if err != nil {
+		return err
+	}
+
+	var refs []*plumbing.Reference
+
+	if bundle != nil {
+		refs, err = repo.ReadBundle(bundle)
+		if err != nil {
+			return err
+		}
+	}
+
+	wanted := make(map[plumbing.ReferenceName]bool)
+
+	for _, ref := range refs {
+		wanted[ref.Name()] = true
+
+		err = repo.Repo.Storer.SetReference(ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Any refs which were deleted since the last backup need to be removed.
+	iter, err := repo.Repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+
+	var removed []plumbing.ReferenceName
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), "refs/") && !wanted[ref.Name()] {
+			removed = append(removed, ref.Name())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range removed {
+		err = repo.Repo.Storer.RemoveReference(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if backup.Head != "" {
+		return repo.SetHead(plumbing.ReferenceName(backup.Head))
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package gitdir
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+func requireRef(t *testing.T, fs billy.Filesystem, repoPath string, name string, hash string) {
+	t.Helper()
+
+	repo, err := git.Open(fs, repoPath)
+	require.Nil(t, err)
+
+	ref, err := repo.Repo.Reference(plumbing.ReferenceName(name), false)
+	if hash == "" {
+		assert.NotNil(t, err, name)
+		return
+	}
+
+	require.Nil(t, err, name)
+	assert.Equal(t, hash, ref.Hash().String(), name)
+}
+
+func TestBackupRestore(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	fs := osfs.New(t.TempDir())
+
+	repo, err := git.EnsureRepo(fs, "top-level/a-repo")
+	require.Nil(t, err)
+
+	first := newTestCommit(t, repo, "first")
+	require.Nil(t, repo.Repo.Storer.SetReference(
+		plumbing.NewHashReference("refs/heads/other", plumbing.NewHash(first))))
+
+	userRepo, err := git.EnsureRepo(fs, "users/a-user/a-repo")
+	require.Nil(t, err)
+
+	userCommit := newTestCommit(t, userRepo, "user-file")
+
+	_, err = git.EnsureRepo(fs, "orgs/an-org/empty-repo")
+	require.Nil(t, err)
+
+	var full bytes.Buffer
+
+	manifest, err := Backup(fs, &full, nil)
+	require.Nil(t, err)
+	assert.False(t, manifest.Incremental)
+
+	var paths []string
+	for _, repo := range manifest.Repos {
+		paths = append(paths, repo.Path)
+	}
+
+	assert.Equal(t, []string{"orgs/an-org/empty-repo", "top-level/a-repo", "users/a-user/a-repo"}, paths)
+
+	second := newTestCommit(t, repo, "second")
+	require.Nil(t, repo.Repo.Storer.RemoveReference("refs/heads/other"))
+
+	var incremental bytes.Buffer
+
+	incrementalManifest, err := Backup(fs, &incremental, manifest)
+	require.Nil(t, err)
+	assert.True(t, incrementalManifest.Incremental)
+
+	// Incremental backups can't be restored without the previous backup.
+	_, err = Restore(osfs.New(t.TempDir()), bytes.NewReader(incremental.Bytes()))
+	assert.True(t, errors.Is(err, git.ErrMissingPrerequisite), err)
+
+	target := osfs.New(t.TempDir())
+
+	_, err = Restore(target, bytes.NewReader(full.Bytes()))
+	require.Nil(t, err)
+
+	requireRef(t, target, "top-level/a-repo", "refs/heads/master", first)
+	requireRef(t, target, "top-level/a-repo", "refs/heads/other", first)
+	requireRef(t, target, "users/a-user/a-repo", "refs/heads/master", userCommit)
+	assert.True(t, git.Exists(target, "orgs/an-org/empty-repo"))
+	assert.FileExists(t, filepath.Join(target.Root(), "top-level", "a-repo.git", "hooks", "pre-receive"))
+
+	// Full backups won't overwrite existing repos.
+	_, err = Restore(target, bytes.NewReader(full.Bytes()))
+	assert.NotNil(t, err)
+
+	_, err = Restore(target, bytes.NewReader(incremental.Bytes()))
+	require.Nil(t, err)
+
+	requireRef(t, target, "top-level/a-repo", "refs/heads/master", second)
+	requireRef(t, target, "top-level/a-repo", "refs/heads/other", "")
+	requireRef(t, target, "users/a-user/a-repo", "refs/heads/master", userCommit)
+
+	restored, err := git.Open(target, "top-level/a-repo")
+	require.Nil(t, err)
+
+	head, err := restored.Repo.Reference(plumbing.HEAD, false)
+	require.Nil(t, err)
+	assert.Equal(t, plumbing.Master, head.Target())
+}
+
+func TestBackupBundleGitCompatible(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	fs := osfs.New(t.TempDir())
+
+	repo, err := git.EnsureRepo(fs, "top-level/a-repo")
+	require.Nil(t, err)
+
+	hash := newTestCommit(t, repo, "first")
+
+	var archive bytes.Buffer
+
+	_, err = Backup(fs, &archive, nil)
+	require.Nil(t, err)
+
+	tr := tar.NewReader(&archive)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			t.Fatal("bundle not found in backup")
+		}
+
+		require.Nil(t, err)
+
+		if hdr.Name == "bundles/top-level/a-repo.bundle" {
+			break
+		}
+	}
+
+	bundlePath := filepath.Join(t.TempDir(), "a-repo.bundle")
+
+	data, err := io.ReadAll(tr)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(bundlePath, data, 0o600))
+
+	out, err := exec.Command("git", "bundle", "list-heads", bundlePath).CombinedOutput()
+	require.Nil(t, err, string(out))
+	assert.Equal(t, hash+" refs/heads/master\n", string(out))
+
+	target := filepath.Join(t.TempDir(), "a-repo")
+
+	out, err = exec.Command("git", "clone", bundlePath, target).CombinedOutput()
+	require.Nil(t, err, string(out))
+	assert.FileExists(t, filepath.Join(target, "first"))
+}
@@ -0,0 +1,83 @@
+//nolint:forbidigo
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/belak/go-gitdir"
+)
+
+func cmdBackup(c Config) {
+	args := os.Args[2:]
+
+	var previous *gitdir.BackupManifest
+
+	if len(args) == 3 && args[0] == "--incremental" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open previous backup")
+		}
+
+		previous, err = gitdir.ReadBackupManifest(f)
+		_ = f.Close()
+
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read previous backup")
+		}
+
+		args = args[2:]
+	}
+
+	if len(args) != 1 {
+		log.Fatal().Msg("usage: gitdir backup [--incremental <previous-backup>] <file>")
+	}
+
+	// The backup is written to a temporary file first, so a failed backup
+	// never replaces a good one.
+	f, err := os.CreateTemp(filepath.Dir(args[0]), ".gitdir-backup-")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create backup")
+	}
+
+	manifest, err := gitdir.Backup(c.FS(), f, previous)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), args[0])
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+		log.Fatal().Err(err).Msg("failed to create backup")
+	}
+
+	fmt.Printf("Backed up %d repos to %s\n", len(manifest.Repos), args[0])
+}
+
+func cmdRestore(c Config) {
+	if len(os.Args) < 3 {
+		log.Fatal().Msg("usage: gitdir restore <file> [<incremental-file>...]")
+	}
+
+	for _, filename := range os.Args[2:] {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open backup")
+		}
+
+		manifest, err := gitdir.Restore(c.FS(), f)
+		_ = f.Close()
+
+		if err != nil {
+			log.Fatal().Err(err).Str("file", filename).Msg("failed to restore backup")
+		}
+
+		fmt.Printf("Restored %d repos from %s\n", len(manifest.Repos), filename)
+	}
+}
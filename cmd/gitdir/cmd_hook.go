@@ -2,46 +2,98 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/belak/go-gitdir"
+	"github.com/belak/go-gitdir/internal/git"
 	"github.com/belak/go-gitdir/models"
 )
 
-func cmdHook(c Config) {
-	log.Info().Msg("starting hook")
-
+// cmdHook is called by git for every hook. It runs all the hooks in the hook
+// directory, one of which calls back into gitdir to run the built-in hook.
+func cmdHook() {
 	if len(os.Args) < 3 {
 		log.Fatal().Msg("missing hook name")
 	}
 
+	// Git runs hooks from the repo dir, but sets GIT_DIR in most cases.
+	gitDir := os.Getenv("GIT_DIR")
+	if gitDir == "" {
+		gitDir = "."
+	}
+
+	gitDir, err := filepath.Abs(gitDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to find repo")
+	}
+
+	if os.Getenv(git.HookDirEnv) == git.HookDir(gitDir, os.Args[2]) {
+		c, err := NewEnvConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load base config")
+		}
+
+		cmdBuiltinHook(c)
+
+		return
+	}
+
+	timeout := git.DefaultHookTimeout
+
+	if rawTimeout, ok := os.LookupEnv("GITDIR_HOOK_TIMEOUT"); ok {
+		timeout, err = time.ParseDuration(rawTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("GITDIR_HOOK_TIMEOUT")
+		}
+	}
+
+	err = git.RunHooks(context.Background(), gitDir, os.Args[2], os.Args[3:], os.Stdin, os.Stdout, os.Stderr, timeout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func cmdBuiltinHook(c Config) {
+	log.Info().Msg("starting hook")
+
 	path, ok := os.LookupEnv("GITDIR_HOOK_REPO_PATH")
 	if !ok {
 		log.Fatal().Msg("missing repo path")
 	}
 
-	pkData, ok := os.LookupEnv("GITDIR_HOOK_PUBLIC_KEY")
+	username, ok := os.LookupEnv("GITDIR_HOOK_USERNAME")
 	if !ok {
-		log.Fatal().Msg("missing public key")
+		log.Fatal().Msg("missing username")
 	}
 
-	pk, err := models.ParsePublicKey([]byte(pkData))
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse public key")
+	// The public key is optional, as not every transport uses keys.
+	var pk *models.PublicKey
+
+	if pkData, ok := os.LookupEnv("GITDIR_HOOK_PUBLIC_KEY"); ok {
+		var err error
+
+		pk, err = models.ParsePublicKey([]byte(pkData))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to parse public key")
+		}
 	}
 
 	config := gitdir.NewConfig(c.FS())
 
-	err = config.Load()
+	err := config.Load()
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load gitdir")
 	}
 
 	// Call the actual hook
-	err = config.RunHook(os.Args[2], path, pk, os.Args[3:], os.Stdin)
+	err = config.RunHook(os.Args[2], path, username, pk, os.Args[3:], os.Stdin)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir"
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+// TestMain lets the test binary stand in for gitdir when it is called as a
+// hook, as the hooks installed in repos call back into the current binary.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "hook" {
+		main()
+
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+const testHookConfig = `users:
+  a-user:
+    is_admin: true
+    tokens:
+      - a-token
+repos:
+  a-repo:
+    refs:
+      - pattern: refs/tags/*
+        immutable: true
+    hooks:
+      pre-receive:
+        - log
+      update:
+        - log
+`
+
+// testLogHook records which hook directory it was run from, along with its
+// arguments.
+const testLogHook = `#!/usr/bin/env sh
+echo "$(basename "$(dirname "$0")") $*" >> hook.log
+`
+
+func TestExecTransportHooks(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	fs := osfs.New(t.TempDir())
+
+	serv, err := gitdir.NewServer(fs)
+	require.NoError(t, err)
+
+	serv.Transport = gitdir.TransportExec
+
+	adminRepo, err := git.EnsureRepo(fs, "admin/admin")
+	require.NoError(t, err)
+	require.NoError(t, adminRepo.Checkout(""))
+	require.NoError(t, adminRepo.CreateFile("config.yml", []byte(testHookConfig)))
+	require.NoError(t, adminRepo.CreateFile("hooks/log", []byte(testLogHook)))
+	require.NoError(t, adminRepo.Commit("Added a-repo", nil))
+
+	repo, err := git.EnsureRepo(fs, "top-level/a-repo")
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateFile("README.md", []byte("hello world")))
+	require.NoError(t, repo.Commit("Initial commit", nil))
+
+	require.NoError(t, serv.Reload())
+
+	httpServer := httptest.NewServer(serv.HTTPHandler())
+	t.Cleanup(httpServer.Close)
+
+	target := filepath.Join(t.TempDir(), "a-repo")
+	url := "http://a-user:a-token@" + httpServer.Listener.Addr().String() + "/a-repo"
+
+	runGit := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = target
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=a-user", "GIT_AUTHOR_EMAIL=a-user@localhost",
+			"GIT_COMMITTER_NAME=a-user", "GIT_COMMITTER_EMAIL=a-user@localhost",
+		)
+
+		out, err := cmd.CombinedOutput()
+
+		return string(out), err
+	}
+
+	cloneOut, err := exec.Command("git", "clone", url, target).CombinedOutput()
+	require.NoError(t, err, string(cloneOut))
+
+	hookLog := filepath.Join(fs.Root(), "top-level", "a-repo.git", "hook.log")
+
+	// Tags can be created, and the hooks from the config run before the
+	// built-in hooks, with pre-receive first.
+	out, err := runGit("tag", "v1")
+	require.NoError(t, err, out)
+
+	out, err = runGit("push", "origin", "v1")
+	require.NoError(t, err, out)
+
+	head, err := runGit("rev-parse", "HEAD")
+	require.NoError(t, err, head)
+
+	head = strings.TrimSpace(head)
+	zero := strings.Repeat("0", 40)
+
+	data, err := os.ReadFile(hookLog)
+	require.NoError(t, err)
+	assert.Equal(t, "pre-receive.d \nupdate.d refs/tags/v1 "+zero+" "+head+"\n", string(data))
+
+	// Immutable tags can't be moved or deleted.
+	out, err = runGit("commit", "--allow-empty", "-m", "Second commit")
+	require.NoError(t, err, out)
+
+	out, err = runGit("tag", "-f", "v1")
+	require.NoError(t, err, out)
+
+	out, err = runGit("push", "-f", "origin", "v1")
+	require.Error(t, err)
+	assert.Contains(t, out, "refs/tags/v1: this ref is immutable")
+	assert.Contains(t, out, "v1 -> v1 (hook declined)")
+
+	out, err = runGit("push", "origin", ":refs/tags/v1")
+	require.Error(t, err)
+	assert.Contains(t, out, "refs/tags/v1: deleting this ref is not allowed")
+	assert.Contains(t, out, "v1 (hook declined)")
+
+	ref, err := repo.Repo.Reference("refs/tags/v1", false)
+	require.NoError(t, err)
+	assert.Equal(t, head, ref.Hash().String())
+}
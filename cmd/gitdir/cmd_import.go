@@ -0,0 +1,55 @@
+//nolint:forbidigo
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/rs/zerolog/log"
+
+	"github.com/belak/go-gitdir"
+)
+
+func cmdImport(c Config) {
+	args := os.Args[2:]
+
+	if len(args) == 0 || args[0] != "gitolite" {
+		log.Fatal().Msg("usage: gitdir import gitolite [--move] <gitolite-admin-checkout> <repositories-dir>")
+	}
+
+	args = args[1:]
+
+	move := len(args) > 0 && args[0] == "--move"
+	if move {
+		args = args[1:]
+	}
+
+	if len(args) != 2 {
+		log.Fatal().Msg("usage: gitdir import gitolite [--move] <gitolite-admin-checkout> <repositories-dir>")
+	}
+
+	config := gitdir.NewConfig(c.FS())
+
+	err := config.EnsureConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to ensure config")
+	}
+
+	err = config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load config")
+	}
+
+	result, err := config.ImportGitolite(osfs.New(args[0]), osfs.New(args[1]), move)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to import gitolite")
+	}
+
+	for _, warning := range result.Warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+
+	fmt.Printf("Imported %d repos and %d users\n", len(result.Repos), len(result.Users))
+	fmt.Println("Send SIGHUP to a running server to load the new config")
+}
@@ -0,0 +1,44 @@
+//nolint:forbidigo
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/belak/go-gitdir"
+)
+
+func cmdRotateHostKeys(c Config) {
+	grace, err := gitdir.ParseRotateHostKeysArgs(os.Args[2:])
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid arguments")
+	}
+
+	err = gitdir.RotateHostKeys(c.FS(), grace, time.Now())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to rotate host keys")
+	}
+
+	config := gitdir.NewConfig(c.FS())
+
+	err = config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load new host keys")
+	}
+
+	fingerprints, err := gitdir.HostKeyFingerprints(config.NextPrivateKeys)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load new host keys")
+	}
+
+	fmt.Printf("New host keys will replace the current keys at %s\n", config.RotateHostKeysAt.Format(time.RFC3339))
+
+	for _, fingerprint := range fingerprints {
+		fmt.Println(fingerprint)
+	}
+
+	fmt.Println("Send SIGHUP to a running server to start advertising them")
+}
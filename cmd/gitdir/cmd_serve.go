@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/rs/zerolog/log"
 
 	"github.com/belak/go-gitdir"
@@ -26,6 +31,45 @@ func cmdServe(c Config) {
 	}
 
 	serv.Addr = c.BindAddr
+	serv.HTTPAddr = c.HTTPBindAddr
+	serv.MetricsAddr = c.MetricsBindAddr
+	serv.Transport = c.Transport
+
+	go serv.RunWebhooks(context.Background())
+	go serv.RunMirrors(context.Background())
+
+	// Reload the config on SIGHUP, so changes made outside of the admin repo,
+	// such as rotating host keys, can be picked up.
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+
+		for range sighup {
+			log.Info().Msg("reloading config")
+
+			if err := serv.Reload(); err != nil {
+				log.Error().Err(err).Msg("failed to reload config")
+			}
+		}
+	}()
+
+	if serv.HTTPAddr != "" {
+		go func() {
+			err := serv.ListenAndServeHTTP()
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to run HTTP server")
+			}
+		}()
+	}
+
+	if serv.MetricsAddr != "" {
+		go func() {
+			err := serv.ListenAndServeMetrics()
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to run metrics server")
+			}
+		}()
+	}
 
 	err = serv.ListenAndServe()
 	if err != nil {
@@ -12,6 +12,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/belak/go-gitdir"
 	"github.com/belak/go-gitdir/models"
 )
 
@@ -19,12 +20,15 @@ import (
 // runtime. They are only used by the binary and are passed to the proper
 // places.
 type Config struct {
-	BindAddr       string
-	BasePath       string
-	LogFormat      string
-	LogDebug       bool
-	AdminUser      string
-	AdminPublicKey *models.PublicKey
+	BindAddr        string
+	HTTPBindAddr    string
+	MetricsBindAddr string
+	Transport       gitdir.Transport
+	BasePath        string
+	LogFormat       string
+	LogDebug        bool
+	AdminUser       string
+	AdminPublicKey  *models.PublicKey
 }
 
 // FS returns the billy.Filesystem for this base path.
@@ -34,12 +38,15 @@ func (c Config) FS() billy.Filesystem {
 
 // DefaultConfig is used as the base config.
 var DefaultConfig = Config{
-	BindAddr:       ":2222",
-	BasePath:       "./tmp",
-	LogFormat:      "json",
-	LogDebug:       false,
-	AdminUser:      "",
-	AdminPublicKey: nil,
+	BindAddr:        ":2222",
+	HTTPBindAddr:    "",
+	MetricsBindAddr: "",
+	Transport:       gitdir.TransportExec,
+	BasePath:        "./tmp",
+	LogFormat:       "json",
+	LogDebug:        false,
+	AdminUser:       "",
+	AdminPublicKey:  nil,
 }
 
 // NewEnvConfig returns a new Config based on environment variables.
@@ -74,6 +81,23 @@ func NewEnvConfig() (Config, error) { //nolint:cyclop,funlen
 		c.BindAddr = bindAddr
 	}
 
+	// The HTTP server is only started if a bind address is set.
+	if httpBindAddr, ok := os.LookupEnv("GITDIR_HTTP_BIND_ADDR"); ok {
+		c.HTTPBindAddr = httpBindAddr
+	}
+
+	// The metrics server is only started if a bind address is set.
+	if metricsBindAddr, ok := os.LookupEnv("GITDIR_METRICS_BIND_ADDR"); ok {
+		c.MetricsBindAddr = metricsBindAddr
+	}
+
+	if transport, ok := os.LookupEnv("GITDIR_TRANSPORT"); ok {
+		c.Transport, err = gitdir.ParseTransport(transport)
+		if err != nil {
+			return c, fmt.Errorf("GITDIR_TRANSPORT: %w", err)
+		}
+	}
+
 	var ok bool
 
 	if c.BasePath, ok = os.LookupEnv("GITDIR_BASE_DIR"); !ok {
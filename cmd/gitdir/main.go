@@ -10,6 +10,14 @@ import (
 func main() {
 	_ = godotenv.Load()
 
+	// Hooks are dispatched before loading the base config so they still work
+	// when a repo is pushed to outside of gitdir.
+	if len(os.Args) > 1 && os.Args[1] == "hook" {
+		cmdHook()
+
+		return
+	}
+
 	c, err := NewEnvConfig()
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load base config")
@@ -17,8 +25,14 @@ func main() {
 
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
-		case "hook":
-			cmdHook(c)
+		case "rotate-host-keys":
+			cmdRotateHostKeys(c)
+		case "backup":
+			cmdBackup(c)
+		case "restore":
+			cmdRestore(c)
+		case "import":
+			cmdImport(c)
 		default:
 			log.Fatal().Msg("sub-command not found")
 		}
@@ -0,0 +1,226 @@
+package gitdir
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// configLockPath is the lock used for all the config repos. The config is
+// loaded from all of them at once, so only one of them can be changed at a
+// time.
+const configLockPath = "admin"
+
+// repoLockPath returns the path of the lock which needs to be held while
+// writing to the given repo.
+func repoLockPath(repo *RepoLookup) string {
+	return repoDirLockPath(repo.Path())
+}
+
+// repoDirLockPath is the same as repoLockPath, but takes the path of the
+// repo on disk.
+func repoDirLockPath(repoPath string) string {
+	if strings.HasPrefix(repoPath, "admin/") {
+		return configLockPath
+	}
+
+	return repoPath
+}
+
+// repoLocks serializes writes to repos. Locks are created when they're needed
+// and removed once nothing is holding or waiting on them.
+//
+// If there is a filesystem, a lock file under locks/ is also locked, so other
+// processes, like backups, can coordinate with a running server.
+type repoLocks struct {
+	fs billy.Filesystem
+
+	lock  sync.Mutex
+	locks map[string]*repoLock
+}
+
+type repoLock struct {
+	sync.Mutex
+
+	// refs is the number of callers holding or waiting on this lock.
+	refs int
+
+	// file is the lock file, which is only set while the lock is held.
+	file billy.File
+}
+
+func newRepoLocks(fs billy.Filesystem) *repoLocks {
+	return &repoLocks{fs: fs, locks: make(map[string]*repoLock)}
+}
+
+// Lock locks all of the given paths and returns a function which unlocks
+// them. Paths are always locked in the same order, so callers locking
+// overlapping sets of paths can't deadlock.
+func (l *repoLocks) Lock(paths ...string) func() {
+	paths = uniqueSortedStrings(paths)
+
+	locks := make([]*repoLock, 0, len(paths))
+
+	for _, path := range paths {
+		lock := l.acquire(path)
+		lock.Lock()
+		lock.file = l.lockFile(path)
+
+		locks = append(locks, lock)
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			if locks[i].file != nil {
+				_ = locks[i].file.Unlock()
+				_ = locks[i].file.Close()
+				locks[i].file = nil
+			}
+
+			locks[i].Unlock()
+			l.release(paths[i])
+		}
+	}
+}
+
+// lockFile locks the lock file for the given path. Lock files are never
+// removed, as another process could be waiting on them. If the file can't be
+// locked, only the in-process lock is used.
+func (l *repoLocks) lockFile(lockPath string) billy.File {
+	if l.fs == nil {
+		return nil
+	}
+
+	filename := path.Join("locks", lockPath+".lock")
+
+	f, err := l.fs.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0o600)
+	if os.IsNotExist(err) {
+		err = l.fs.MkdirAll(path.Dir(filename), os.ModePerm)
+		if err == nil {
+			f, err = l.fs.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0o600)
+		}
+	}
+
+	if err == nil {
+		err = f.Lock()
+		if err != nil {
+			_ = f.Close()
+		}
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Str("path", lockPath).Msg("Failed to lock repo on disk")
+		return nil
+	}
+
+	return f
+}
+
+func (l *repoLocks) acquire(path string) *repoLock {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lock, ok := l.locks[path]
+	if !ok {
+		lock = &repoLock{}
+		l.locks[path] = lock
+	}
+
+	lock.refs++
+
+	return lock
+}
+
+func (l *repoLocks) release(path string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lock := l.locks[path]
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, path)
+	}
+}
+
+func uniqueSortedStrings(values []string) []string {
+	ret := make([]string, 0, len(values))
+	seen := make(map[string]bool)
+
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			ret = append(ret, value)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// reloadQueue coalesces reload requests. If a reload is already running, any
+// requests made while it runs are handled by a single reload once it
+// finishes, so a burst of config pushes only results in a couple of reloads.
+// Callers always wait for a reload which started after they asked for it.
+type reloadQueue struct {
+	reload func() error
+
+	lock    sync.Mutex
+	running bool
+	next    *reloadResult
+}
+
+type reloadResult struct {
+	done chan struct{}
+	err  error
+}
+
+func newReloadQueue(reload func() error) *reloadQueue {
+	return &reloadQueue{reload: reload}
+}
+
+// Reload requests a reload and waits for it to finish.
+func (q *reloadQueue) Reload() error {
+	q.lock.Lock()
+
+	if q.next == nil {
+		q.next = &reloadResult{done: make(chan struct{})}
+	}
+
+	result := q.next
+
+	if !q.running {
+		q.running = true
+
+		go q.run()
+	}
+
+	q.lock.Unlock()
+
+	<-result.done
+
+	return result.err
+}
+
+func (q *reloadQueue) run() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.next != nil {
+		result := q.next
+		q.next = nil
+
+		q.lock.Unlock()
+		result.err = q.reload()
+		close(result.done)
+		q.lock.Lock()
+	}
+
+	q.running = false
+}
@@ -0,0 +1,368 @@
+package gitdir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+)
+
+func TestRepoLocks(t *testing.T) {
+	t.Parallel()
+
+	locks := newRepoLocks(nil)
+
+	unlock := locks.Lock("b", "a", "a")
+
+	locked := make(chan struct{})
+
+	go func() {
+		defer locks.Lock("a", "c")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock was acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Unrelated repos shouldn't be blocked.
+	locks.Lock("c")()
+
+	unlock()
+	<-locked
+
+	// Once nothing is using a lock, it should be cleaned up.
+	locks.lock.Lock()
+	assert.Empty(t, locks.locks)
+	locks.lock.Unlock()
+}
+
+func TestRepoLocksFile(t *testing.T) {
+	t.Parallel()
+
+	fs := osfs.New(t.TempDir())
+
+	// Separate instances stand in for separate processes.
+	locks := newRepoLocks(fs)
+	other := newRepoLocks(fs)
+
+	unlock := locks.Lock("top-level/a-repo")
+
+	locked := make(chan struct{})
+
+	go func() {
+		defer other.Lock("top-level/a-repo")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock was acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+
+	assert.FileExists(t, filepath.Join(fs.Root(), "locks", "top-level", "a-repo.lock"))
+}
+
+func TestReloadQueue(t *testing.T) {
+	t.Parallel()
+
+	var reloads int32
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	q := newReloadQueue(func() error {
+		started <- struct{}{}
+		<-release
+
+		return fmt.Errorf("reload %d", atomic.AddInt32(&reloads, 1))
+	})
+
+	var wg sync.WaitGroup
+
+	errs := make([]error, 5)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		errs[0] = q.Reload()
+	}()
+
+	<-started
+
+	// Everything requested while the first reload is running should share
+	// the second reload.
+	for i := 1; i < len(errs); i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = q.Reload()
+		}(i)
+	}
+
+	for {
+		q.lock.Lock()
+		next := q.next
+		q.lock.Unlock()
+
+		if next != nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// Give the remaining callers a chance to queue up.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reloads))
+	assert.EqualError(t, errs[0], "reload 1")
+
+	for _, err := range errs[1:] {
+		assert.EqualError(t, err, "reload 2")
+	}
+
+	// Once the queue is idle, a new request should start a new reload.
+	go func() { <-started }()
+	assert.EqualError(t, q.Reload(), "reload 3")
+}
+
+// TestConcurrentRepoActions pushes to and clones from normal and config
+// repos while the config is being changed and reloaded. This is mostly useful
+// when run with the race detector.
+func TestConcurrentRepoActions(t *testing.T) { //nolint:funlen,cyclop
+	t.Parallel()
+
+	serv, httpServer := newTestHTTPServer(t, TransportNative)
+
+	err := serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", AnonymousUser, "Added a-user", func(targetNode *yaml.Node) error {
+			userNode := ensureNodePath(targetNode, []string{"users", "a-user"})
+			userNode.EnsureKey("is_admin", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			tokensNode, _ := userNode.EnsureKey("tokens", yaml.NewSequenceNode(), nil)
+			tokensNode.AppendNode(yaml.NewScalarNode("a-token", ""))
+			ensureNodePath(targetNode, []string{"repos", "a-repo"})
+
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	baseURL := "http://a-user:a-token@" + httpServer.Listener.Addr().String()
+	tmpDir := t.TempDir()
+
+	runGit := func(dir string, args ...string) error {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=a-user", "GIT_AUTHOR_EMAIL=a-user@localhost",
+			"GIT_COMMITTER_NAME=a-user", "GIT_COMMITTER_EMAIL=a-user@localhost",
+		)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %v: %w: %s", args, err, out)
+		}
+
+		return nil
+	}
+
+	const (
+		workers = 4
+		rounds  = 3
+	)
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 100)
+
+	run := func(cb func() error) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := cb(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	for i := 0; i < workers; i++ {
+		i := i
+
+		// Push to separate branches of the same repo.
+		run(func() error {
+			target := filepath.Join(tmpDir, fmt.Sprintf("push-%d", i))
+
+			if err := runGit(tmpDir, "clone", baseURL+"/a-repo", target); err != nil {
+				return err
+			}
+
+			for j := 0; j < rounds; j++ {
+				if err := runGit(target, "commit", "--allow-empty", "-m", fmt.Sprintf("Commit %d", j)); err != nil {
+					return err
+				}
+
+				if err := runGit(target, "push", "origin", fmt.Sprintf("HEAD:refs/heads/branch-%d", i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		// Clone while everything else is happening.
+		run(func() error {
+			for j := 0; j < rounds; j++ {
+				target := filepath.Join(tmpDir, fmt.Sprintf("clone-%d-%d", i, j))
+
+				if err := runGit(tmpDir, "clone", baseURL+"/a-repo", target); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		// Change the config from inside the server.
+		run(func() error {
+			for j := 0; j < rounds; j++ {
+				err := serv.updateConfigRepos([]string{fmt.Sprintf("repo-%d-%d", i, j)}, func(c *Config) error {
+					return c.CreateRepo(&User{Username: "a-user", IsAdmin: true}, fmt.Sprintf("repo-%d-%d", i, j))
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		// Reload the config and read it.
+		run(func() error {
+			for j := 0; j < rounds*5; j++ {
+				if err := serv.Reload(); err != nil {
+					return err
+				}
+
+				if _, ok := serv.GetAdminConfig().Users["a-user"]; !ok {
+					return errors.New("a-user missing from config")
+				}
+			}
+
+			return nil
+		})
+	}
+
+	// Push to the admin repo. This will race with the config changes above,
+	// so a rejected push is retried after pulling in the new commits.
+	run(func() error {
+		target := filepath.Join(tmpDir, "admin")
+
+		if err := runGit(tmpDir, "clone", baseURL+"/admin", target); err != nil {
+			return err
+		}
+
+		for j := 0; j < rounds; j++ {
+			filename := fmt.Sprintf("notes-%d.txt", j)
+
+			if err := os.WriteFile(filepath.Join(target, filename), []byte("notes\n"), 0o600); err != nil {
+				return err
+			}
+
+			if err := runGit(target, "add", filename); err != nil {
+				return err
+			}
+
+			if err := runGit(target, "commit", "-m", "Added "+filename); err != nil {
+				return err
+			}
+
+			var err error
+
+			for attempt := 0; attempt < 10; attempt++ {
+				if err = runGit(target, "push", "origin", "HEAD:refs/heads/master"); err == nil {
+					break
+				}
+
+				if err = runGit(target, "pull", "--rebase", "origin", "master"); err != nil {
+					return err
+				}
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	config := serv.GetAdminConfig()
+
+	for i := 0; i < workers; i++ {
+		for j := 0; j < rounds; j++ {
+			assert.Contains(t, config.Repos, fmt.Sprintf("repo-%d-%d", i, j))
+		}
+	}
+
+	repo, err := git.Open(serv.fs, "top-level/a-repo")
+	require.Nil(t, err)
+
+	for i := 0; i < workers; i++ {
+		ref, err := repo.Repo.Reference(plumbing.ReferenceName(fmt.Sprintf("refs/heads/branch-%d", i)), false)
+		require.Nil(t, err)
+
+		commit, err := repo.Repo.CommitObject(ref.Hash())
+		require.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("Commit %d\n", rounds-1), commit.Message)
+	}
+
+	// Loading the config checks out pushed commits before they're accepted,
+	// which shouldn't change HEAD in the admin repo on disk.
+	adminRepo, err := git.Open(serv.fs, "admin/admin")
+	require.Nil(t, err)
+
+	head, err := adminRepo.Repo.Reference(plumbing.HEAD, false)
+	require.Nil(t, err)
+	assert.Equal(t, plumbing.SymbolicReference, head.Type())
+	assert.Equal(t, plumbing.Master, head.Target())
+
+	for j := 0; j < rounds; j++ {
+		require.Nil(t, adminRepo.Checkout(""))
+		assert.True(t, adminRepo.FileExists(fmt.Sprintf("notes-%d.txt", j)))
+	}
+}
@@ -2,6 +2,7 @@ package gitdir
 
 import (
 	"fmt"
+	"time"
 
 	billy "github.com/go-git/go-billy/v5"
 
@@ -11,17 +12,40 @@ import (
 
 // Config represents the config which has been loaded from all repos.
 type Config struct {
-	Invites     map[string]string
+	Invites     map[string]*models.Invite
 	Groups      map[string][]string
 	Orgs        map[string]*models.OrgConfig
 	Users       map[string]*models.AdminConfigUser
 	Repos       map[string]*models.RepoConfig
+	Quota       models.QuotaConfig
 	Options     models.AdminConfigOptions
 	PrivateKeys []models.PrivateKey
 
+	// Hooks are run for every repo. HookScripts contains the scripts from the
+	// hooks directory of the admin repo, by name, and ApprovedHooks lists the
+	// ones which user and org configs may use.
+	Hooks         models.HookConfig
+	HookScripts   map[string][]byte
+	ApprovedHooks []string
+
+	// NextPrivateKeys are host keys which will replace PrivateKeys at
+	// RotateHostKeysAt. Until then, they are advertised to clients alongside
+	// the current keys.
+	NextPrivateKeys  []models.PrivateKey
+	RotateHostKeysAt time.Time
+
+	// MirrorKey is used to authenticate to mirrors over SSH.
+	MirrorKey models.PrivateKey
+
 	// Internal state
-	fs         billy.Filesystem
-	publicKeys map[string]string `yaml:"-"`
+	fs          billy.Filesystem
+	publicKeys  map[string]string `yaml:"-"`
+	deployKeys  map[string]*DeployKeyAccess
+	revokedKeys *keyRevocationList
+
+	keyRestrictions map[string]models.KeyRestrictions
+
+	mirrorKnownHosts []byte
 
 	// We store any override hashes for repos so this can be used for hooks as
 	// well.
@@ -34,7 +58,7 @@ type Config struct {
 // should be called after creating a new config at a bare minimum.
 func NewConfig(fs billy.Filesystem) *Config {
 	return &Config{
-		Invites: make(map[string]string),
+		Invites: make(map[string]*models.Invite),
 		Groups:  make(map[string][]string),
 		Orgs:    make(map[string]*models.OrgConfig),
 		Users:   make(map[string]*models.AdminConfigUser),
@@ -43,6 +67,9 @@ func NewConfig(fs billy.Filesystem) *Config {
 		orgRepos:   make(map[string]string),
 		userRepos:  make(map[string]string),
 		publicKeys: make(map[string]string),
+		deployKeys: make(map[string]*DeployKeyAccess),
+
+		keyRestrictions: make(map[string]models.KeyRestrictions),
 
 		Options: models.DefaultAdminConfigOptions,
 
@@ -61,7 +88,7 @@ func (c *Config) Load() error {
 }
 
 func (c *Config) openAdminRepo() (*git.Repository, error) {
-	adminRepo, err := git.EnsureRepo(c.fs, "admin/admin")
+	adminRepo, err := c.ensureConfigRepo("admin/admin")
 	if err != nil {
 		return nil, err
 	}
@@ -90,6 +117,12 @@ func (c *Config) loadConfig(adminRepo *git.Repository) error {
 		return err
 	}
 
+	// Invalid branch names would otherwise only fail once a repo is created.
+	err = c.validateDefaultBranches()
+	if err != nil {
+		return err
+	}
+
 	c.flatten()
 
 	return nil
@@ -178,17 +211,25 @@ func (c *Config) EnsureAdminUser(username string, pubKey *models.PublicKey) erro
 }
 
 func (c *Config) flatten() {
+	// Reset any previously flattened values so removed keys don't linger
+	// after a reload.
+	c.publicKeys = make(map[string]string)
+	c.keyRestrictions = make(map[string]models.KeyRestrictions)
+
 	// Add all user public keys to the config.
 	for username, user := range c.Users {
 		for _, key := range user.Keys {
 			c.publicKeys[key.RawMarshalAuthorizedKey()] = username
+			c.keyRestrictions[key.RawMarshalAuthorizedKey()] = key.Restrictions
 		}
 	}
+
+	c.flattenDeployKeys()
 }
 
 // SetHash will set the hash of the admin repo to use when loading.
 func (c *Config) SetHash(hash string) error {
-	adminRepo, err := git.EnsureRepo(c.fs, "admin/admin")
+	adminRepo, err := c.ensureConfigRepo("admin/admin")
 	if err != nil {
 		return err
 	}
@@ -205,7 +246,7 @@ func (c *Config) SetHash(hash string) error {
 
 // SetUserHash will set the hash of the given user repo to use when loading.
 func (c *Config) SetUserHash(username, hash string) error {
-	repo, err := git.EnsureRepo(c.fs, "admin/user-"+username)
+	repo, err := c.ensureConfigRepo("admin/user-" + username)
 	if err != nil {
 		return err
 	}
@@ -222,7 +263,7 @@ func (c *Config) SetUserHash(username, hash string) error {
 
 // SetOrgHash will set the hash of the given org repo to use when loading.
 func (c *Config) SetOrgHash(orgName, hash string) error {
-	repo, err := git.EnsureRepo(c.fs, "admin/org-"+orgName)
+	repo, err := c.ensureConfigRepo("admin/org-" + orgName)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,9 @@
 package gitdir
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/belak/go-gitdir/internal/git"
 	"github.com/belak/go-gitdir/models"
 )
@@ -8,8 +11,8 @@ import (
 func (c *Config) ensureAdminConfig(repo *git.Repository) error {
 	return newMultiError(
 		c.ensureAdminConfigYaml(repo),
-		c.ensureAdminEd25519Key(repo),
-		c.ensureAdminRSAKey(repo),
+		c.ensureAdminHostKeys(repo, time.Now()),
+		c.ensureMirrorKey(repo),
 	)
 }
 
@@ -23,36 +26,6 @@ func (c *Config) ensureAdminUser(repo *git.Repository, user string, pubKey *mode
 	})
 }
 
-func (c *Config) ensureAdminEd25519Key(repo *git.Repository) error {
-	return repo.UpdateFile("ssh/id_ed25519", func(data []byte) ([]byte, error) {
-		if data != nil {
-			return data, nil
-		}
-
-		pk, err := models.GenerateEd25519PrivateKey()
-		if err != nil {
-			return nil, err
-		}
-
-		return pk.MarshalPrivateKey()
-	})
-}
-
-func (c *Config) ensureAdminRSAKey(repo *git.Repository) error {
-	return repo.UpdateFile("ssh/id_rsa", func(data []byte) ([]byte, error) {
-		if data != nil {
-			return data, nil
-		}
-
-		pk, err := models.GenerateRSAPrivateKey()
-		if err != nil {
-			return nil, err
-		}
-
-		return pk.MarshalPrivateKey()
-	})
-}
-
 func (c *Config) loadAdminConfig(adminRepo *git.Repository) error {
 	configData, err := adminRepo.GetFile("config.yml")
 	if err != nil {
@@ -71,34 +44,41 @@ func (c *Config) loadAdminConfig(adminRepo *git.Repository) error {
 	c.Orgs = adminConfig.Orgs
 	c.Users = adminConfig.Users
 	c.Repos = adminConfig.Repos
+	c.Quota = adminConfig.Quota
 	c.Options = adminConfig.Options
+	c.Hooks = adminConfig.Hooks
+	c.ApprovedHooks = adminConfig.ApprovedHooks
 
-	// Load the private keys
-	c.PrivateKeys = nil
-
-	keyData, err := adminRepo.GetFile("ssh/id_ed25519")
+	// Load the host keys
+	err = c.loadHostKeys(adminRepo)
 	if err != nil {
 		return err
 	}
 
-	pk, err := models.ParseEd25519PrivateKey(keyData)
+	err = c.loadMirrorKey(adminRepo)
 	if err != nil {
 		return err
 	}
 
-	c.PrivateKeys = append(c.PrivateKeys, pk)
-
-	keyData, err = adminRepo.GetFile("ssh/id_rsa")
+	err = c.loadHookScripts(adminRepo)
 	if err != nil {
 		return err
 	}
 
-	pk, err = models.ParseRSAPrivateKey(keyData)
-	if err != nil {
-		return err
-	}
+	// The revoked keys are optional.
+	c.revokedKeys = nil
+
+	if adminRepo.FileExists(krlPath) {
+		krlData, err := adminRepo.GetFile(krlPath)
+		if err != nil {
+			return err
+		}
 
-	c.PrivateKeys = append(c.PrivateKeys, pk)
+		c.revokedKeys, err = parseKRL(krlData)
+		if err != nil {
+			return fmt.Errorf("%s: %w", krlPath, err)
+		}
+	}
 
 	return nil
 }
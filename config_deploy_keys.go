@@ -0,0 +1,150 @@
+package gitdir
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+// deployKeyUsername is the username used for sessions which authenticated
+// with a deploy key. It can't conflict with real users and won't match any
+// ref rules.
+const deployKeyUsername = "<deploy-key>"
+
+// deployKeyCommands are the only commands a deploy key may run.
+var deployKeyCommands = []string{"whoami", "git-receive-pack", "git-upload-pack"}
+
+// DeployKeyAccess is the repo a deploy key can access, and how much access it
+// has.
+type DeployKeyAccess struct {
+	Repo     *RepoLookup
+	RepoName string
+	Access   AccessLevel
+}
+
+// repoConfigEntry is an explicitly defined repo along with its config.
+type repoConfigEntry struct {
+	Repo   *RepoLookup
+	Config *models.RepoConfig
+}
+
+// listRepoConfigs returns every explicitly defined repo, sorted by path.
+func (c *Config) listRepoConfigs() []repoConfigEntry {
+	var ret []repoConfigEntry
+
+	for repoName, repo := range c.Repos {
+		ret = append(ret, repoConfigEntry{
+			Repo:   &RepoLookup{Type: RepoTypeTopLevel, PathParts: []string{repoName}},
+			Config: repo,
+		})
+	}
+
+	for orgName, org := range c.Orgs {
+		for repoName, repo := range org.Repos {
+			ret = append(ret, repoConfigEntry{
+				Repo:   &RepoLookup{Type: RepoTypeOrg, PathParts: []string{orgName, repoName}},
+				Config: repo,
+			})
+		}
+	}
+
+	for username, user := range c.Users {
+		for repoName, repo := range user.Repos {
+			ret = append(ret, repoConfigEntry{
+				Repo:   &RepoLookup{Type: RepoTypeUser, PathParts: []string{username, repoName}},
+				Config: repo,
+			})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Repo.Path() < ret[j].Repo.Path()
+	})
+
+	return ret
+}
+
+func deployKeyAccessLevel(key *models.DeployKey) AccessLevel {
+	if key.Mode == models.DeployKeyReadWrite {
+		return AccessLevelWrite
+	}
+
+	return AccessLevelRead
+}
+
+func (c *Config) flattenDeployKeys() {
+	c.deployKeys = make(map[string]*DeployKeyAccess)
+
+	for _, entry := range c.listRepoConfigs() {
+		for _, key := range entry.Config.DeployKeys {
+			c.deployKeys[key.Key.RawMarshalAuthorizedKey()] = &DeployKeyAccess{
+				Repo:     entry.Repo,
+				RepoName: c.RepoName(entry.Repo),
+				Access:   deployKeyAccessLevel(key),
+			}
+			c.keyRestrictions[key.Key.RawMarshalAuthorizedKey()] = key.Key.Restrictions
+		}
+	}
+}
+
+func (c *Config) validateDeployKeys() error {
+	var errors []error
+
+	seen := make(map[string]string)
+
+	for _, entry := range c.listRepoConfigs() {
+		repoName := c.RepoName(entry.Repo)
+
+		for _, key := range entry.Config.DeployKeys {
+			rawKey := key.Key.RawMarshalAuthorizedKey()
+
+			if !key.ValidMode() {
+				errors = append(errors, fmt.Errorf("repo %s: invalid deploy key mode %q", repoName, key.Mode))
+			}
+
+			if username, ok := c.publicKeys[rawKey]; ok {
+				errors = append(errors, fmt.Errorf("repo %s: deploy key %s is also a key for user %s", repoName, rawKey, username))
+			}
+
+			if otherRepo, ok := seen[rawKey]; ok {
+				errors = append(errors, fmt.Errorf("repo %s: deploy key %s is already used by repo %s", repoName, rawKey, otherRepo))
+			}
+
+			seen[rawKey] = repoName
+		}
+	}
+
+	return newMultiError(errors...)
+}
+
+// lookupDeployKey returns a user which can only access the repo the deploy key
+// belongs to. Deploy keys must always connect as the git user.
+func (c *Config) lookupDeployKey(deployKey *DeployKeyAccess, remoteUser string) (*User, error) {
+	if remoteUser != c.Options.GitUser {
+		log.Warn().Msg("deploy key used with a username other than the git user")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	return &User{
+		Username:    deployKeyUsername,
+		IsAnonymous: false,
+		IsAdmin:     false,
+		DeployKey:   deployKey,
+	}, nil
+}
+
+// keyInUse returns true if the given key belongs to a user or is a deploy key.
+func (c *Config) keyInUse(pk *models.PublicKey) bool {
+	rawKey := pk.RawMarshalAuthorizedKey()
+
+	if _, ok := c.publicKeys[rawKey]; ok {
+		return true
+	}
+
+	_, ok := c.deployKeys[rawKey]
+
+	return ok
+}
@@ -0,0 +1,70 @@
+package gitdir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestDeployKeys(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	c.Repos["test-repo"].DeployKeys = []*models.DeployKey{
+		{Key: mustParsePK(testAuthKey)},
+	}
+	c.Orgs["an-org"].Repos["test-repo"].DeployKeys = []*models.DeployKey{
+		{Key: mustParsePK(testAuthOtherKey), Mode: models.DeployKeyReadWrite},
+	}
+	c.flatten()
+
+	// Deploy keys can only be used with the git user.
+	_, err := c.LookupUserFromKey(mustParsePK(testAuthKey), "non-admin")
+	assert.Equal(t, ErrUserNotFound, err)
+
+	var tests = []struct { //nolint:gofumpt
+		Key    string
+		Repo   string
+		Access AccessLevel
+	}{
+		{testAuthKey, "test-repo", AccessLevelRead},
+		{testAuthKey, "public-repo", AccessLevelNone},
+		{testAuthKey, "@an-org/test-repo", AccessLevelNone},
+		{testAuthOtherKey, "@an-org/test-repo", AccessLevelWrite},
+		{testAuthOtherKey, "test-repo", AccessLevelNone},
+		{testAuthOtherKey, "admin", AccessLevelNone},
+	}
+
+	for _, test := range tests {
+		user, err := c.LookupUserFromKey(mustParsePK(test.Key), c.Options.GitUser)
+		require.Nil(t, err)
+		require.NotNil(t, user.DeployKey)
+		assert.False(t, user.IsAdmin)
+
+		repo, err := c.LookupRepoAccess(user, test.Repo)
+		require.Nil(t, err, test.Repo)
+		assert.Equal(t, test.Access, repo.Access, test.Repo)
+	}
+
+	require.Nil(t, c.validateDeployKeys())
+
+	// Keys can't be used by both a user and a deploy key, or by multiple
+	// repos, and the mode needs to be known.
+	c.Users["non-admin"].Keys = []models.PublicKey{mustParsePK(testAuthKey)}
+	c.Repos["public-repo"].DeployKeys = []*models.DeployKey{
+		{Key: mustParsePK(testAuthOtherKey), Mode: "write"},
+	}
+	c.flatten()
+
+	err = c.validateDeployKeys()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "repo test-repo: deploy key "+testAuthKey+" is also a key for user non-admin")
+	assert.Contains(t, err.Error(), "repo public-repo: deploy key "+testAuthOtherKey+" is already used by repo @an-org/test-repo")
+	assert.Contains(t, err.Error(), `repo public-repo: invalid deploy key mode "write"`)
+
+	pk := mustParsePK(testAuthOtherKey)
+	assert.True(t, c.keyInUse(&pk))
+}
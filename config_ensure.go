@@ -34,7 +34,7 @@ func ensureSampleConfigYaml(data []byte) (*yaml.Node, bool, error) {
 
 	// If we had to make any of the modifications, we need to specify the node
 	// was updated.
-	return rootNode, vals[0] || vals[1] || vals[2] || vals[3], nil
+	return rootNode, vals[0] || vals[1] || vals[2] || vals[3] || vals[4], nil
 }
 
 func ensureSampleInvites(targetNode *yaml.Node) bool {
@@ -45,12 +45,17 @@ func ensureSampleInvites(targetNode *yaml.Node) bool {
 			Comment: `
 Invites define temporary codes for a user to get in to the service. They
 can SSH in using ssh invite:invite-code@go-code and it will add that public
-key to their user.
+key to their user. By default, an invite can only be used once, but it can
+optionally have an expiration time and a maximum number of uses.
 #
 Sample invites:
 #
 invites:
-  orai7Quaipoocungah1vee6Ieh8Ien: belak`,
+  orai7Quaipoocungah1vee6Ieh8Ien: belak
+  Ahngeeb6ochei9Oofaevoh6Ieyeiph:
+    user: some-user
+    expires: 2030-01-01T00:00:00Z
+    max_uses: 3`,
 		},
 	)
 
@@ -166,6 +171,11 @@ var sampleOptions = []struct {
 		Comment: "the prefix to use when sshing in with an invite",
 		Value:   models.DefaultAdminConfigOptions.InvitePrefix,
 	},
+	{
+		Name:    "default_branch",
+		Comment: "the branch HEAD points to in new repos",
+		Value:   models.DefaultAdminConfigOptions.DefaultBranch,
+	},
 	{
 		Name: "implicit_repos",
 		Comment: `allow users with admin access to a given area to create repos by simply
@@ -194,6 +204,20 @@ relying on the main admin config.`,
 		Tag:   "!!bool",
 		Value: "false",
 	},
+	{
+		Name: "anonymous_read",
+		Comment: `allows connections with unknown keys to clone any repo marked as public.
+They will never be able to push or read config repos.`,
+		Tag:   "!!bool",
+		Value: "false",
+	},
+	{
+		Name: "anonymous_user",
+		Comment: `a username which is always treated as anonymous when anonymous_read is
+enabled. Leave empty to only use anonymous access for unknown keys.`,
+		Tag:   "!!str",
+		Value: models.DefaultAdminConfigOptions.AnonymousUser,
+	},
 }
 
 func ensureSampleOptions(targetNode *yaml.Node) bool {
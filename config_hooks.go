@@ -0,0 +1,177 @@
+package gitdir
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+// hookScriptDir is the directory in the admin repo containing hook scripts.
+const hookScriptDir = "hooks"
+
+func (c *Config) loadHookScripts(repo *git.Repository) error {
+	c.HookScripts = make(map[string][]byte)
+
+	if !repo.DirExists(hookScriptDir) {
+		return nil
+	}
+
+	entries, err := repo.WorktreeFS.ReadDir(hookScriptDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := repo.GetFile(path.Join(hookScriptDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		c.HookScripts[entry.Name()] = data
+	}
+
+	return nil
+}
+
+// checkApprovedHooks returns an error if any of the given hooks use a script
+// which an admin hasn't approved. This is used for hooks from user and org
+// configs.
+func (c *Config) checkApprovedHooks(hooks models.HookConfig) error {
+	for _, hookName := range sortedKeys(map[string][]string(hooks)) {
+		for _, script := range hooks[hookName] {
+			if !listContainsStr(c.ApprovedHooks, script) {
+				return fmt.Errorf("hook script %q has not been approved by an admin", script)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateHooks() error {
+	var errors []error
+
+	check := func(where string, hooks models.HookConfig) {
+		for _, hookName := range sortedKeys(map[string][]string(hooks)) {
+			if !listContainsStr(git.HookNames(), hookName) {
+				errors = append(errors, fmt.Errorf("%s: unknown hook %q", where, hookName))
+			}
+
+			for _, script := range hooks[hookName] {
+				if _, ok := c.HookScripts[script]; !ok {
+					errors = append(errors, fmt.Errorf("%s: hook script %q not found in %s", where, script, hookScriptDir))
+				}
+			}
+		}
+	}
+
+	check("global hooks", c.Hooks)
+
+	for repoName, repo := range c.Repos {
+		check("repo "+repoName, repo.Hooks)
+	}
+
+	for orgName, org := range c.Orgs {
+		check("org "+orgName, org.Hooks)
+
+		for repoName, repo := range org.Repos {
+			check("repo "+c.Options.OrgPrefix+orgName+"/"+repoName, repo.Hooks)
+		}
+	}
+
+	for username, user := range c.Users {
+		for repoName, repo := range user.Repos {
+			check("repo "+c.Options.UserPrefix+username+"/"+repoName, repo.Hooks)
+		}
+	}
+
+	return newMultiError(errors...)
+}
+
+// repoHooks returns the global, org and repo hooks which should be installed
+// in the given repo. Config repos never have any.
+func (c *Config) repoHooks(repo *RepoLookup) map[string][]git.CustomHook {
+	switch repo.Type {
+	case RepoTypeOrg, RepoTypeUser, RepoTypeTopLevel:
+	default:
+		return nil
+	}
+
+	configs := []models.HookConfig{c.Hooks}
+
+	if repo.Type == RepoTypeOrg {
+		if org, ok := c.Orgs[repo.PathParts[0]]; ok {
+			configs = append(configs, org.Hooks)
+		}
+	}
+
+	if repoConfig := c.lookupRepoConfig(repo); repoConfig != nil {
+		configs = append(configs, repoConfig.Hooks)
+	}
+
+	ret := make(map[string][]git.CustomHook)
+
+	for _, hooks := range configs {
+		for hookName, scripts := range hooks {
+			for _, script := range scripts {
+				data, ok := c.HookScripts[script]
+				if !ok || customHooksContain(ret[hookName], script) {
+					continue
+				}
+
+				ret[hookName] = append(ret[hookName], git.CustomHook{Name: script, Script: data})
+			}
+		}
+	}
+
+	return ret
+}
+
+func customHooksContain(hooks []git.CustomHook, name string) bool {
+	for _, hook := range hooks {
+		if hook.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// installHooks installs the configured hooks in every repo on disk and removes
+// any which are no longer configured.
+func (c *Config) installHooks() error {
+	repoNames, err := c.listReposOnDisk()
+	if err != nil {
+		return err
+	}
+
+	errors := make([]error, 0, len(repoNames))
+
+	for _, repoName := range repoNames {
+		repo, err := c.parseRepoPath(repoName)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s: %w", repoName, err))
+
+			continue
+		}
+
+		errors = append(errors, c.installRepoHooks(repo))
+	}
+
+	return newMultiError(errors...)
+}
+
+func (c *Config) installRepoHooks(repo *RepoLookup) error {
+	err := git.InstallHooks(c.fs, repo.Path(), c.repoHooks(repo))
+	if err != nil {
+		return fmt.Errorf("%s: %w", repo.Path(), err)
+	}
+
+	return nil
+}
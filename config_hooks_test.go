@@ -0,0 +1,136 @@
+package gitdir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestCustomHooks(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	serv := newTestRepoServer(t)
+	admin := &User{Username: "an-admin", IsAdmin: true}
+
+	hookPath := func(repoPath, hook, name string) string {
+		return filepath.Join(serv.fs.Root(), repoPath+".git", "hooks", hook+".d", name)
+	}
+
+	err := serv.updateConfig(func(c *Config) error {
+		adminRepo, err := git.EnsureRepo(c.fs, "admin/admin")
+		if err != nil {
+			return err
+		}
+
+		if err = adminRepo.Checkout(""); err != nil {
+			return err
+		}
+
+		for _, name := range []string{"check", "notify"} {
+			if err = adminRepo.CreateFile("hooks/"+name, []byte("#!/usr/bin/env sh\necho "+name+"\n")); err != nil {
+				return err
+			}
+		}
+
+		if err = adminRepo.Commit("Added hook scripts", nil); err != nil {
+			return err
+		}
+
+		if err = c.Load(); err != nil {
+			return err
+		}
+
+		if err = c.CreateRepo(admin, "a-repo"); err != nil {
+			return err
+		}
+
+		return c.updateConfigFile("admin/admin", admin, "Added hooks", func(targetNode *yaml.Node) error {
+			globalNode := ensureNodePath(targetNode, []string{"hooks"})
+			globalNode.EnsureKey("pre-receive", newScalarSequenceNode([]string{"check"}), nil)
+
+			targetNode.EnsureKey("approved_hooks", newScalarSequenceNode([]string{"notify"}), nil)
+
+			repoNode := ensureNodePath(targetNode, []string{"repos", "a-repo", "hooks"})
+			repoNode.EnsureKey("post-receive", newScalarSequenceNode([]string{"notify", "check"}), nil)
+
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	config := serv.GetAdminConfig()
+	assert.Equal(t, []byte("#!/usr/bin/env sh\necho check\n"), config.HookScripts["check"])
+
+	assert.FileExists(t, hookPath("top-level/a-repo", "pre-receive", "config-check"))
+	assert.FileExists(t, hookPath("top-level/a-repo", "post-receive", "config-notify"))
+	assert.FileExists(t, hookPath("top-level/a-repo", "post-receive", "config-check"))
+	assert.FileExists(t, hookPath("top-level/a-repo", "post-receive", "gitdir"))
+	assert.NoFileExists(t, hookPath("admin/admin", "pre-receive", "config-check"))
+
+	info, err := os.Stat(hookPath("top-level/a-repo", "pre-receive", "config-check"))
+	require.Nil(t, err)
+	assert.NotZero(t, info.Mode()&0o111)
+
+	// Hooks which are no longer configured are removed, but hooks added by
+	// other means are left alone.
+	require.Nil(t, os.WriteFile(hookPath("top-level/a-repo", "post-receive", "manual"), nil, 0o755)) //nolint:gosec
+
+	err = serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Removed hooks", func(targetNode *yaml.Node) error {
+			lookupNodePath(targetNode, []string{"repos", "a-repo"}).RemoveKey("hooks")
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	assert.FileExists(t, hookPath("top-level/a-repo", "pre-receive", "config-check"))
+	assert.NoFileExists(t, hookPath("top-level/a-repo", "post-receive", "config-notify"))
+	assert.FileExists(t, hookPath("top-level/a-repo", "post-receive", "manual"))
+
+	// Unknown hooks and scripts fail validation.
+	config = serv.GetAdminConfig()
+	config.Repos["a-repo"].Hooks = models.HookConfig{
+		"pre-commit":  {"check"},
+		"pre-receive": {"missing"},
+	}
+
+	err = config.Validate(admin, nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `repo a-repo: unknown hook "pre-commit"`)
+	assert.Contains(t, err.Error(), `repo a-repo: hook script "missing" not found`)
+
+	// User configs can only use approved hooks.
+	for _, test := range []struct {
+		Script string
+		Error  bool
+	}{
+		{"notify", false},
+		{"check", true},
+	} {
+		c := NewConfig(serv.fs)
+		require.Nil(t, c.Load())
+		c.Options.UserConfigRepos = true
+		c.Users["non-admin"] = models.NewAdminConfigUser()
+
+		userRepo, err := git.EnsureRepo(serv.fs, "admin/user-non-admin")
+		require.Nil(t, err)
+		require.Nil(t, userRepo.Checkout(""))
+		require.Nil(t, userRepo.CreateFile("config.yml", []byte("repos:\n  a-repo:\n    hooks:\n      post-receive: ["+test.Script+"]\n")))
+		require.Nil(t, userRepo.Commit("Added hooks", nil))
+
+		err = c.loadUserConfig("non-admin")
+		if test.Error {
+			assert.NotNil(t, err, test.Script)
+		} else {
+			assert.Nil(t, err, test.Script)
+			assert.Equal(t, []string{test.Script}, c.Users["non-admin"].Repos["a-repo"].Hooks["post-receive"])
+		}
+	}
+}
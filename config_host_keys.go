@@ -0,0 +1,258 @@
+package gitdir
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+const (
+	hostKeyDir     = "ssh"
+	nextHostKeyDir = "ssh/next"
+	rotateAtPath   = "ssh/next/rotate_at"
+)
+
+// DefaultHostKeyGracePeriod is how long new host keys are advertised alongside
+// the current keys before replacing them, if no grace period is given.
+const DefaultHostKeyGracePeriod = 7 * 24 * time.Hour
+
+// ErrHostKeyRotationPending is returned when trying to rotate the host keys
+// while a previous rotation is still in its grace period.
+var ErrHostKeyRotationPending = errors.New("host key rotation already in progress")
+
+// hostKeyTypes are the host keys which may be stored in the admin repo, in the
+// order they are loaded. Any of them may be removed from the repo, but at least
+// one is required.
+var hostKeyTypes = []struct {
+	Filename string
+	Parse    func([]byte) (models.PrivateKey, error)
+	Generate func() (models.PrivateKey, error)
+}{
+	{"id_ed25519", models.ParseEd25519PrivateKey, models.GenerateEd25519PrivateKey},
+	{"id_ecdsa", models.ParseECDSAPrivateKey, models.GenerateECDSAPrivateKey},
+	{"id_rsa", models.ParseRSAPrivateKey, models.GenerateRSAPrivateKey},
+}
+
+// ensureAdminHostKeys finishes any host key rotation which is past its grace
+// period and generates host keys if there are none.
+func (c *Config) ensureAdminHostKeys(repo *git.Repository, now time.Time) error {
+	if hostKeysExist(repo, nextHostKeyDir) {
+		rotateAt, err := readRotateAt(repo)
+		if err != nil {
+			return err
+		}
+
+		if !now.Before(rotateAt) {
+			err = finishHostKeyRotation(repo)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if hostKeysExist(repo, hostKeyDir) {
+		return nil
+	}
+
+	return generateHostKeys(repo, hostKeyDir)
+}
+
+// hostKeysExist returns true if any host keys exist in the given directory.
+func hostKeysExist(repo *git.Repository, dir string) bool {
+	for _, keyType := range hostKeyTypes {
+		if repo.FileExists(path.Join(dir, keyType.Filename)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func generateHostKeys(repo *git.Repository, dir string) error {
+	for _, keyType := range hostKeyTypes {
+		pk, err := keyType.Generate()
+		if err != nil {
+			return err
+		}
+
+		data, err := pk.MarshalPrivateKey()
+		if err != nil {
+			return err
+		}
+
+		err = repo.CreateFile(path.Join(dir, keyType.Filename), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finishHostKeyRotation replaces the current host keys with the next keys.
+// Any current keys without a replacement are removed.
+func finishHostKeyRotation(repo *git.Repository) error {
+	for _, keyType := range hostKeyTypes {
+		currentPath := path.Join(hostKeyDir, keyType.Filename)
+		nextPath := path.Join(nextHostKeyDir, keyType.Filename)
+
+		var err error
+
+		switch {
+		case repo.FileExists(nextPath):
+			var data []byte
+
+			data, err = repo.GetFile(nextPath)
+			if err == nil {
+				err = repo.CreateFile(currentPath, data)
+			}
+
+			if err == nil {
+				err = repo.RemoveFile(nextPath)
+			}
+		case repo.FileExists(currentPath):
+			err = repo.RemoveFile(currentPath)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if repo.FileExists(rotateAtPath) {
+		return repo.RemoveFile(rotateAtPath)
+	}
+
+	return nil
+}
+
+// readRotateAt returns the time the next host keys should replace the current
+// ones. If it isn't set, they should be replaced right away.
+func readRotateAt(repo *git.Repository) (time.Time, error) {
+	if !repo.FileExists(rotateAtPath) {
+		return time.Time{}, nil
+	}
+
+	data, err := repo.GetFile(rotateAtPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	rotateAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", rotateAtPath, err)
+	}
+
+	return rotateAt, nil
+}
+
+func loadHostKeysFromDir(repo *git.Repository, dir string) ([]models.PrivateKey, error) {
+	var ret []models.PrivateKey
+
+	for _, keyType := range hostKeyTypes {
+		filename := path.Join(dir, keyType.Filename)
+
+		if !repo.FileExists(filename) {
+			continue
+		}
+
+		data, err := repo.GetFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		pk, err := keyType.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		ret = append(ret, pk)
+	}
+
+	return ret, nil
+}
+
+func (c *Config) loadHostKeys(repo *git.Repository) error {
+	var err error
+
+	c.PrivateKeys, err = loadHostKeysFromDir(repo, hostKeyDir)
+	if err != nil {
+		return err
+	}
+
+	if len(c.PrivateKeys) == 0 {
+		return errors.New("no host keys found")
+	}
+
+	c.NextPrivateKeys, err = loadHostKeysFromDir(repo, nextHostKeyDir)
+	if err != nil {
+		return err
+	}
+
+	c.RotateHostKeysAt = time.Time{}
+
+	if len(c.NextPrivateKeys) > 0 {
+		c.RotateHostKeysAt, err = readRotateAt(repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RotateHostKeys is the same as Config.RotateHostKeys, but is meant to be run
+// outside of the server. The config lock is held, so it can't race with a
+// running server changing the admin repo.
+func RotateHostKeys(fs billy.Filesystem, grace time.Duration, now time.Time) error {
+	defer newRepoLocks(fs).Lock(configLockPath)()
+
+	return NewConfig(fs).RotateHostKeys(nil, grace, now)
+}
+
+// RotateHostKeys generates a new set of host keys in the admin repo. They will
+// be advertised to clients alongside the current keys until the grace period
+// is over, at which point they replace the current keys the next time the
+// server is reloaded.
+func (c *Config) RotateHostKeys(user *User, grace time.Duration, now time.Time) error {
+	adminRepo, err := c.ensureConfigRepo("admin/admin")
+	if err != nil {
+		return err
+	}
+
+	err = adminRepo.Checkout("")
+	if err != nil {
+		return err
+	}
+
+	if hostKeysExist(adminRepo, nextHostKeyDir) {
+		return ErrHostKeyRotationPending
+	}
+
+	err = generateHostKeys(adminRepo, nextHostKeyDir)
+	if err != nil {
+		return err
+	}
+
+	rotateAt := now.Add(grace).UTC().Format(time.RFC3339)
+
+	err = adminRepo.CreateFile(rotateAtPath, []byte(rotateAt+"\n"))
+	if err != nil {
+		return err
+	}
+
+	// If there's no user, this was run from the command line, so it's
+	// committed as the server.
+	if user == nil {
+		return adminRepo.Commit("Rotated host keys", nil)
+	}
+
+	return adminRepo.Commit("Rotated host keys", git.NewUserGitSignature(user.Username))
+}
@@ -0,0 +1,189 @@
+package gitdir
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+// ErrUserConfigKeysDisabled is returned when trying to manage keys while
+// user_config_keys is disabled.
+var ErrUserConfigKeysDisabled = errors.New("user config keys are disabled")
+
+// ErrKeyNotFound is returned when trying to remove a key which does not exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyManagedByAdmin is returned when trying to remove a key which is
+// defined in the admin config rather than the user's config.
+var ErrKeyManagedByAdmin = errors.New("key is defined in the admin config")
+
+// ErrCurrentKey is returned when trying to remove the key used for the current
+// session.
+var ErrCurrentKey = errors.New("cannot remove the key used for the current session")
+
+// UserKey represents a single key belonging to a user.
+type UserKey struct {
+	*models.PublicKey
+
+	// Fingerprint is the SHA256 fingerprint of this key, as displayed by
+	// ssh-keygen.
+	Fingerprint string
+
+	// Removable will be true if the key is defined in the user's config repo
+	// and can be managed by the user.
+	Removable bool
+}
+
+// userConfigRepoPath returns the path to the config repo for the given user.
+func userConfigRepoPath(username string) string {
+	return path.Join("admin", "user-"+username)
+}
+
+// userConfigKeys returns the keys defined in the given user's config repo.
+func (c *Config) userConfigKeys(username string) ([]models.PublicKey, error) {
+	userRepo, err := c.ensureConfigRepo(userConfigRepoPath(username))
+	if err != nil {
+		return nil, err
+	}
+
+	err = userRepo.Checkout(c.userRepos[username])
+	if err != nil {
+		return nil, err
+	}
+
+	if !userRepo.FileExists("config.yml") {
+		return nil, nil
+	}
+
+	data, err := userRepo.GetFile("config.yml")
+	if err != nil {
+		return nil, err
+	}
+
+	userConfig, err := models.ParseUserConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return userConfig.Keys, nil
+}
+
+// ListUserKeys returns all the keys belonging to the given user.
+func (c *Config) ListUserKeys(user *User) ([]*UserKey, error) {
+	userConfig, ok := c.Users[user.Username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	removable := make(map[string]bool)
+
+	if c.Options.UserConfigKeys {
+		keys, err := c.userConfigKeys(user.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			removable[key.RawMarshalAuthorizedKey()] = true
+		}
+	}
+
+	ret := make([]*UserKey, 0, len(userConfig.Keys))
+
+	for i := range userConfig.Keys {
+		key := &userConfig.Keys[i]
+
+		ret = append(ret, &UserKey{
+			PublicKey:   key,
+			Fingerprint: gossh.FingerprintSHA256(key),
+			Removable:   removable[key.RawMarshalAuthorizedKey()],
+		})
+	}
+
+	return ret, nil
+}
+
+// AddUserKey adds a key to the given user's config repo. The user must be
+// defined in the config, otherwise the key could be picked up by a user who
+// is added with the same name later.
+func (c *Config) AddUserKey(user *User, pk *models.PublicKey) error {
+	if !c.Options.UserConfigKeys {
+		return ErrUserConfigKeysDisabled
+	}
+
+	if _, ok := c.Users[user.Username]; !ok || user.IsAnonymous {
+		return ErrUserNotFound
+	}
+
+	if c.keyInUse(pk) {
+		return ErrKeyInUse
+	}
+
+	return c.updateConfigFile(
+		userConfigRepoPath(user.Username),
+		user,
+		fmt.Sprintf("Added key %s", gossh.FingerprintSHA256(pk)),
+		func(targetNode *yaml.Node) error {
+			keysNode, _ := targetNode.EnsureKey("keys", yaml.NewSequenceNode(), nil)
+			keysNode.AppendUniqueScalar(yaml.NewScalarNode(pk.MarshalAuthorizedKey(), ""))
+
+			return nil
+		},
+	)
+}
+
+// RemoveUserKey removes the key with the given fingerprint from the given
+// user's config repo. The key used for the current session (if any) cannot be
+// removed.
+func (c *Config) RemoveUserKey(user *User, fingerprint string, current *models.PublicKey) error {
+	if !c.Options.UserConfigKeys {
+		return ErrUserConfigKeysDisabled
+	}
+
+	keys, err := c.ListUserKeys(user)
+	if err != nil {
+		return err
+	}
+
+	var target *UserKey
+
+	for _, key := range keys {
+		if key.Fingerprint == fingerprint {
+			target = key
+			break
+		}
+	}
+
+	switch {
+	case target == nil:
+		return ErrKeyNotFound
+	case !target.Removable:
+		return ErrKeyManagedByAdmin
+	case current != nil && target.RawMarshalAuthorizedKey() == current.RawMarshalAuthorizedKey():
+		return ErrCurrentKey
+	}
+
+	return c.updateConfigFile(
+		userConfigRepoPath(user.Username),
+		user,
+		fmt.Sprintf("Removed key %s", fingerprint),
+		func(targetNode *yaml.Node) error {
+			keysNode := targetNode.ValueNode("keys")
+			if keysNode == nil {
+				return ErrKeyNotFound
+			}
+
+			keysNode.RemoveScalars(func(value string) bool {
+				pk, err := models.ParsePublicKey([]byte(value))
+				return err == nil && gossh.FingerprintSHA256(pk) == fingerprint
+			})
+
+			return nil
+		},
+	)
+}
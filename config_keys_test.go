@@ -0,0 +1,94 @@
+package gitdir
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/internal/yaml"
+)
+
+func TestUserKeys(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	serv := newTestRepoServer(t)
+
+	admin := &User{Username: "an-admin", IsAdmin: true}
+	adminKey := mustParsePK("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILQGpcX2owFW6hdTWHa/CzbTwhUJlmI8gKAgnp/c0NK2 an-admin")
+	newKey := mustParsePK("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBx4DYr9m+EnG0tgFsUIZqrDP7pa+vpVXJJ6/PE9J7Ll laptop")
+	newKeyFingerprint := gossh.FingerprintSHA256(&newKey)
+
+	run := func(cb func(*Config) error) error {
+		return serv.updateConfig(cb)
+	}
+
+	// Keys can't be managed until user_config_keys is enabled.
+	assert.ErrorIs(t, run(func(c *Config) error { return c.AddUserKey(admin, &newKey) }), ErrUserConfigKeysDisabled)
+
+	require.Nil(t, run(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Enabled user config keys", func(targetNode *yaml.Node) error {
+			optionsNode := ensureNodePath(targetNode, []string{"options"})
+			optionsNode.EnsureKey(
+				"user_config_keys",
+				yaml.NewScalarNode("true", yaml.ScalarTagBool),
+				&yaml.EnsureOptions{Force: true},
+			)
+
+			return nil
+		})
+	}))
+
+	// Keys can only be added for users defined in the config, so they can't
+	// be planted for a user who is added later.
+	assert.ErrorIs(t, run(func(c *Config) error { return c.AddUserKey(AnonymousUser, &newKey) }), ErrUserNotFound)
+	assert.ErrorIs(t, run(func(c *Config) error {
+		return c.AddUserKey(&User{Username: "missing-user"}, &newKey)
+	}), ErrUserNotFound)
+	assert.NoDirExists(t, filepath.Join(serv.fs.Root(), "admin", "user-"+AnonymousUser.Username+".git"))
+	assert.NoDirExists(t, filepath.Join(serv.fs.Root(), "admin", "user-missing-user.git"))
+
+	// Add
+	require.Nil(t, run(func(c *Config) error { return c.AddUserKey(admin, &newKey) }))
+
+	user, err := serv.GetAdminConfig().LookupUserFromKey(newKey, "git")
+	require.Nil(t, err)
+	assert.Equal(t, "an-admin", user.Username)
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.AddUserKey(admin, &newKey) }), ErrKeyInUse)
+	assert.ErrorIs(t, run(func(c *Config) error { return c.AddUserKey(admin, &adminKey) }), ErrKeyInUse)
+
+	// List
+	keys, err := serv.GetAdminConfig().ListUserKeys(admin)
+	require.Nil(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "an-admin", keys[0].Comment)
+	assert.False(t, keys[0].Removable)
+	assert.Equal(t, "laptop", keys[1].Comment)
+	assert.Equal(t, newKeyFingerprint, keys[1].Fingerprint)
+	assert.True(t, keys[1].Removable)
+
+	// Remove
+	assert.ErrorIs(
+		t,
+		run(func(c *Config) error { return c.RemoveUserKey(admin, keys[0].Fingerprint, nil) }),
+		ErrKeyManagedByAdmin,
+	)
+	assert.ErrorIs(
+		t,
+		run(func(c *Config) error { return c.RemoveUserKey(admin, newKeyFingerprint, &newKey) }),
+		ErrCurrentKey,
+	)
+	assert.ErrorIs(
+		t,
+		run(func(c *Config) error { return c.RemoveUserKey(admin, "SHA256:invalid", nil) }),
+		ErrKeyNotFound,
+	)
+
+	require.Nil(t, run(func(c *Config) error { return c.RemoveUserKey(admin, newKeyFingerprint, &adminKey) }))
+
+	_, err = serv.GetAdminConfig().LookupUserFromKey(newKey, "git")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
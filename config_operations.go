@@ -1,81 +1,107 @@
 package gitdir
 
-/*
-// AcceptInvite attempts to accept an invite and set up the given user.
-func (serv *Server) AcceptInvite(invite string, key PublicKey) bool { //nolint:funlen
-	serv.lock.Lock()
-	defer serv.lock.Unlock()
-
-	// It's expensive to lock, so we need to do the fast stuff first and bail as
-	// early as possible if it's not valid.
-
-	// Step 1: Look up the invite
-	username, ok := serv.settings.Invites[invite]
-	if !ok {
-		return false
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+// ErrKeyInUse is returned when trying to add a key which already belongs to a
+// user.
+var ErrKeyInUse = errors.New("key is already in use")
+
+// AcceptInvite attempts to accept an invite, adding the given key to the user
+// it belongs to and marking the invite as used. The updated config is
+// committed to the admin repo and loaded into this Config.
+func (c *Config) AcceptInvite(invite string, pk *models.PublicKey) (*User, error) {
+	// It's expensive to update the config, so we need to do the fast stuff
+	// first and bail as early as possible if it's not valid.
+	user, err := c.LookupUserFromInvite(invite)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.keyInUse(pk) {
+		return nil, ErrKeyInUse
 	}
 
-	fmt.Println("found user")
+	inviteConfig := c.Invites[invite]
 
-	adminRepo, err := EnsureRepo("admin/admin", true)
+	adminRepo, err := c.openAdminRepo()
 	if err != nil {
-		log.Warn().Err(err).Msg("Admin repo doesn't exist")
-		return false
+		return nil, err
 	}
 
 	err = adminRepo.UpdateFile("config.yml", func(data []byte) ([]byte, error) {
-		rootNode, _, err := ensureSampleConfigYaml(data) //nolint:govet
-		if err != nil {
-			return nil, err
-		}
-
-		// We can assume the config file is in a valid format because of
-		// ensureSampleConfig
-		targetNode := rootNode.Content[0]
-
-		// Step 2: Ensure the user exists and is not disabled.
-		usersVal := yamlLookupVal(targetNode, "users")
-		userVal, _ := yamlEnsureKey(usersVal, username, &yaml.Node{Kind: yaml.MappingNode}, "", false)
-		_ = yamlRemoveKey(userVal, "disabled")
-
-		// Step 3: Add the key to the user
-		keysVal, _ := yamlEnsureKey(userVal, "keys", &yaml.Node{Kind: yaml.SequenceNode}, "", false)
-		keysVal.Content = append(keysVal.Content, &yaml.Node{
-			Kind:  yaml.ScalarNode,
-			Value: key.MarshalAuthorizedKey(),
-		})
-
-		// Step 4: Remove the invite (and any others this user owns)
-		var staleInvites []string
-		invitesVal := yamlLookupVal(targetNode, "invites")
-
-		for i := 0; i+1 < len(invitesVal.Content); i += 2 {
-			if invitesVal.Content[i+1].Value == username {
-				staleInvites = append(staleInvites, invitesVal.Content[i].Value)
-			}
-		}
-
-		for _, val := range staleInvites {
-			yamlRemoveKey(invitesVal, val)
-		}
-
-		// Step 5: Re-encode back to yaml
-		data, err = yamlEncode(rootNode)
-		return data, err
+		return acceptInvite(data, invite, inviteConfig, user.Username, pk.MarshalAuthorizedKey())
 	})
 	if err != nil {
-		log.Warn().Err(err).Msg("Failed to update config")
-		return false
+		return nil, err
+	}
+
+	// Load config
+	err = c.loadConfig(adminRepo)
+	if err != nil {
+		return nil, err
 	}
 
-	err = adminRepo.Commit("Added "+username+" from invite "+invite, nil)
+	// We only commit at the very end, after everything has been loaded. This
+	// ensures we have a valid config.
+	err = adminRepo.Commit(fmt.Sprintf("Added key for %s from invite %s", user.Username, invite), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func acceptInvite(data []byte, invite string, inviteConfig *models.Invite, username, pubKey string) ([]byte, error) {
+	rootNode, err := acceptInviteYaml(data, invite, inviteConfig, username, pubKey)
 	if err != nil {
-		return false
+		return nil, err
 	}
 
-	err = serv.reloadInternal()
+	return rootNode.Encode()
+}
+
+func acceptInviteYaml(
+	data []byte,
+	invite string,
+	inviteConfig *models.Invite,
+	username string,
+	pubKey string,
+) (*yaml.Node, error) {
+	rootNode, targetNode, err := yaml.EnsureDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 1: Add the key to the user
+	usersNode, _ := targetNode.EnsureKey("users", yaml.NewMappingNode(), nil)
+	userNode, _ := usersNode.EnsureKey(username, yaml.NewMappingNode(), nil)
+	keysNode, _ := userNode.EnsureKey("keys", yaml.NewSequenceNode(), nil)
+	keysNode.AppendUniqueScalar(yaml.NewScalarNode(pubKey, ""))
+
+	// Step 2: Mark the invite as used, removing it if it has no remaining uses.
+	invitesNode, _ := targetNode.EnsureKey("invites", yaml.NewMappingNode(), nil)
+
+	inviteNode := invitesNode.ValueNode(invite)
+	if inviteNode == nil {
+		return nil, fmt.Errorf("invite %s not found in config", invite)
+	}
+
+	if inviteConfig.RemainingUses() <= 1 {
+		invitesNode.RemoveKey(invite)
+	} else {
+		inviteNode.EnsureKey(
+			"uses",
+			yaml.NewScalarNode(strconv.Itoa(inviteConfig.Uses+1), yaml.ScalarTagInt),
+			&yaml.EnsureOptions{Force: true},
+		)
+	}
 
-	// The invite was successfully accepted if the server reloaded properly.
-	return err == nil
+	return rootNode, nil
 }
-*/
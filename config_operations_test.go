@@ -0,0 +1,90 @@
+package gitdir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestAcceptInviteYaml(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	pubKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILQGpcX2owFW6hdTWHa/CzbTwhUJlmI8gKAgnp/c0NK2 an-admin"
+
+	var tests = []struct { //nolint:gofumpt
+		Input    string
+		Invite   *models.Invite
+		Expected string
+	}{
+		{
+			// Single use invites should be removed
+			`# Invites
+invites:
+  an-invite: belak
+users:
+  belak:
+    is_admin: true
+`,
+			models.NewInvite("belak"),
+			`# Invites
+invites: {}
+users:
+  belak:
+    is_admin: true
+    keys:
+      - ` + pubKey + `
+`,
+		},
+		{
+			// Multi-use invites should be updated
+			`invites:
+  an-invite:
+    user: belak
+    max_uses: 3
+    uses: 1
+`,
+			&models.Invite{User: "belak", MaxUses: 3, Uses: 1},
+			`invites:
+  an-invite:
+    user: belak
+    max_uses: 3
+    uses: 2
+users:
+  belak:
+    keys:
+      - ` + pubKey + `
+`,
+		},
+		{
+			// The last use of a multi-use invite should remove it
+			`invites:
+  an-invite:
+    user: belak
+    max_uses: 2
+    uses: 1
+  other-invite: belak
+`,
+			&models.Invite{User: "belak", MaxUses: 2, Uses: 1},
+			`invites:
+  other-invite: belak
+users:
+  belak:
+    keys:
+      - ` + pubKey + `
+`,
+		},
+	}
+
+	for _, test := range tests {
+		output, err := acceptInvite([]byte(test.Input), "an-invite", test.Invite, "belak", pubKey)
+		require.Nil(t, err)
+		assert.Equal(t, test.Expected, string(output))
+	}
+
+	// Invites which don't exist in the config should fail.
+	_, err := acceptInvite([]byte("invites: {}\n"), "an-invite", models.NewInvite("belak"), "belak", pubKey)
+	assert.NotNil(t, err)
+}
@@ -1,7 +1,8 @@
 package gitdir
 
 import (
-	"github.com/belak/go-gitdir/internal/git"
+	"fmt"
+
 	"github.com/belak/go-gitdir/models"
 )
 
@@ -23,7 +24,7 @@ func (c *Config) loadOrgConfigs() error {
 }
 
 func (c *Config) loadOrgConfig(orgName string) error {
-	orgRepo, err := git.EnsureRepo(c.fs, "admin/org-"+orgName)
+	orgRepo, err := c.ensureConfigRepo("admin/org-" + orgName)
 	if err != nil {
 		return err
 	}
@@ -47,6 +48,18 @@ func (c *Config) loadOrgConfig(orgName string) error {
 	c.Orgs[orgName].Write = append(c.Orgs[orgName].Write, orgConfig.Write...)
 	c.Orgs[orgName].Read = append(c.Orgs[orgName].Read, orgConfig.Read...)
 
+	if err := c.checkApprovedHooks(orgConfig.Hooks); err != nil {
+		return err
+	}
+
+	if c.Orgs[orgName].Hooks == nil {
+		c.Orgs[orgName].Hooks = make(models.HookConfig)
+	}
+
+	for hookName, scripts := range orgConfig.Hooks {
+		c.Orgs[orgName].Hooks[hookName] = append(c.Orgs[orgName].Hooks[hookName], scripts...)
+	}
+
 	if c.Options.OrgConfigRepos {
 		for repoName, repo := range orgConfig.Repos {
 			// If it's already defined, skip it.
@@ -56,6 +69,16 @@ func (c *Config) loadOrgConfig(orgName string) error {
 				continue
 			}
 
+			// Mirrors use the server's mirror key and webhooks make the
+			// server send requests to any host, so they can only be
+			// configured by admins.
+			repo.Mirror = models.MirrorConfig{}
+			repo.Webhooks = nil
+
+			if err := c.checkApprovedHooks(repo.Hooks); err != nil {
+				return fmt.Errorf("%s: %w", repoName, err)
+			}
+
 			c.Orgs[orgName].Repos[repoName] = repo
 		}
 	}
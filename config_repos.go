@@ -0,0 +1,662 @@
+package gitdir
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+// ErrRepoExists is returned when trying to create a repo which already
+// exists.
+var ErrRepoExists = errors.New("repo already exists")
+
+// ErrConfigRepo is returned when trying to manage a config repo as if it
+// were a normal repo.
+var ErrConfigRepo = errors.New("config repos cannot be managed")
+
+// ErrInvalidBranch is returned when a branch name isn't valid.
+var ErrInvalidBranch = errors.New("invalid branch name")
+
+// ErrBranchDoesNotExist is returned when pointing HEAD at a branch which
+// doesn't exist.
+var ErrBranchDoesNotExist = errors.New("branch does not exist")
+
+// ErrInvalidBranchConfig is returned when pointing HEAD of a config repo at a
+// branch without a valid config.
+var ErrInvalidBranchConfig = errors.New("branch does not contain a valid config")
+
+// repoConfigLocation points to a place where a repo can be defined.
+type repoConfigLocation struct {
+	// RepoPath is the path of the config repo on disk.
+	RepoPath string
+
+	// Keys is the path to the repos mapping in the config.yml of that repo.
+	Keys []string
+
+	// Name is the key of the repo in the repos mapping.
+	Name string
+}
+
+// repoConfigLocations returns every location the given repo could be defined
+// in. These are returned in the order they are loaded, so if a repo is
+// defined in multiple places, the first one wins.
+func (c *Config) repoConfigLocations(repo *RepoLookup) []repoConfigLocation {
+	switch repo.Type {
+	case RepoTypeOrg:
+		ret := []repoConfigLocation{{
+			RepoPath: "admin/admin",
+			Keys:     []string{"orgs", repo.PathParts[0], "repos"},
+			Name:     repo.PathParts[1],
+		}}
+
+		if c.Options.OrgConfig && c.Options.OrgConfigRepos {
+			ret = append(ret, repoConfigLocation{
+				RepoPath: path.Join("admin", "org-"+repo.PathParts[0]),
+				Keys:     []string{"repos"},
+				Name:     repo.PathParts[1],
+			})
+		}
+
+		return ret
+	case RepoTypeUser:
+		ret := []repoConfigLocation{{
+			RepoPath: "admin/admin",
+			Keys:     []string{"users", repo.PathParts[0], "repos"},
+			Name:     repo.PathParts[1],
+		}}
+
+		if c.Options.UserConfigRepos {
+			ret = append(ret, repoConfigLocation{
+				RepoPath: path.Join("admin", "user-"+repo.PathParts[0]),
+				Keys:     []string{"repos"},
+				Name:     repo.PathParts[1],
+			})
+		}
+
+		return ret
+	case RepoTypeTopLevel:
+		return []repoConfigLocation{{
+			RepoPath: "admin/admin",
+			Keys:     []string{"repos"},
+			Name:     repo.PathParts[0],
+		}}
+	}
+
+	return nil
+}
+
+// defaultRepoConfigLocation returns where a new repo should be defined. If the
+// owner of this area is able to manage their own config, that will be used.
+func (c *Config) defaultRepoConfigLocation(repo *RepoLookup) repoConfigLocation {
+	locations := c.repoConfigLocations(repo)
+	return locations[len(locations)-1]
+}
+
+// findRepoConfigLocations returns every location the given repo is defined
+// in.
+func (c *Config) findRepoConfigLocations(repo *RepoLookup) ([]repoConfigLocation, error) {
+	var ret []repoConfigLocation
+
+	for _, loc := range c.repoConfigLocations(repo) {
+		configRepo, err := c.ensureConfigRepo(loc.RepoPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = configRepo.Checkout("")
+		if err != nil {
+			return nil, err
+		}
+
+		// It's fine for the file to not exist - that just means the repo is
+		// not defined here.
+		data, _ := configRepo.GetFile("config.yml")
+
+		_, targetNode, err := yaml.EnsureDocument(data)
+		if err != nil {
+			return nil, err
+		}
+
+		reposNode := lookupNodePath(targetNode, loc.Keys)
+		if reposNode != nil && reposNode.KeyIndex(loc.Name) != -1 {
+			ret = append(ret, loc)
+		}
+	}
+
+	return ret, nil
+}
+
+// findRepoConfigLocation returns the first location the given repo is defined
+// in, if any.
+func (c *Config) findRepoConfigLocation(repo *RepoLookup) (repoConfigLocation, bool, error) {
+	locs, err := c.findRepoConfigLocations(repo)
+	if err != nil || len(locs) == 0 {
+		return repoConfigLocation{}, false, err
+	}
+
+	return locs[0], true, nil
+}
+
+// lookupNodePath follows the given keys through nested mappings, returning nil
+// if any of them do not exist.
+func lookupNodePath(node *yaml.Node, keys []string) *yaml.Node {
+	for _, key := range keys {
+		if node == nil {
+			return nil
+		}
+
+		node = node.ValueNode(key)
+	}
+
+	return node
+}
+
+// ensureNodePath follows the given keys through nested mappings, creating
+// them if they do not exist.
+func ensureNodePath(node *yaml.Node, keys []string) *yaml.Node {
+	for _, key := range keys {
+		node, _ = node.EnsureKey(key, yaml.NewMappingNode(), nil)
+	}
+
+	return node
+}
+
+// updateConfigFile updates the config.yml in the given config repo and
+// commits it on behalf of the given user. The data will be parsed after the
+// update to ensure it is still valid.
+func (c *Config) updateConfigFile(repoPath string, user *User, msg string, cb func(*yaml.Node) error) error {
+	configRepo, err := c.ensureConfigRepo(repoPath)
+	if err != nil {
+		return err
+	}
+
+	err = configRepo.Checkout("")
+	if err != nil {
+		return err
+	}
+
+	err = configRepo.UpdateFile("config.yml", func(data []byte) ([]byte, error) {
+		rootNode, targetNode, err := yaml.EnsureDocument(data)
+		if err != nil {
+			return nil, err
+		}
+
+		err = cb(targetNode)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = rootNode.Encode()
+		if err != nil {
+			return nil, err
+		}
+
+		return data, validateConfigData(repoPath, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	status, err := configRepo.Worktree.Status()
+	if err != nil {
+		return err
+	}
+
+	if status.IsClean() {
+		return nil
+	}
+
+	state, err := saveConfigRepoState(configRepo)
+	if err != nil {
+		return err
+	}
+
+	err = configRepo.Commit(msg, git.NewUserGitSignature(user.Username))
+	if err != nil {
+		return err
+	}
+
+	// The change needs to pass the same checks as a push to the config repo,
+	// so if it doesn't, the commit is thrown away.
+	err = validateConfigOnDisk(c.fs, user)
+	if err != nil {
+		if restoreErr := state.restore(); restoreErr != nil {
+			return restoreErr
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// configRepoState is the commit the branch of a config repo points to, so
+// changes can be undone.
+type configRepoState struct {
+	repo   *git.Repository
+	branch plumbing.ReferenceName
+
+	// ref is nil if the branch didn't exist yet.
+	ref *plumbing.Reference
+}
+
+func saveConfigRepoState(configRepo *git.Repository) (*configRepoState, error) {
+	head, err := configRepo.RepoFS.Reference(plumbing.HEAD)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := configRepo.RepoFS.Reference(head.Target())
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		ref = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &configRepoState{repo: configRepo, branch: head.Target(), ref: ref}, nil
+}
+
+// restore points the branch back at the saved commit.
+func (s *configRepoState) restore() error {
+	if s.ref == nil {
+		return s.repo.RepoFS.RemoveReference(s.branch)
+	}
+
+	return s.repo.RepoFS.SetReference(s.ref)
+}
+
+// validateConfigOnDisk loads the config from HEAD of the config repos and
+// ensures it is valid. Changes made by the server on behalf of nobody in
+// particular skip the checks for the current user.
+func validateConfigOnDisk(fs billy.Filesystem, user *User) error {
+	config := NewConfig(fs)
+
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	if user.IsAnonymous {
+		return config.validateConfig()
+	}
+
+	return config.Validate(user, nil)
+}
+
+// validateConfigData ensures the given data can be parsed as the config for
+// the given config repo.
+func validateConfigData(repoPath string, data []byte) error {
+	var err error
+
+	switch {
+	case repoPath == "admin/admin":
+		_, err = models.ParseAdminConfig(data)
+	case strings.HasPrefix(repoPath, "admin/org-"):
+		_, err = models.ParseOrgConfig(data)
+	default:
+		_, err = models.ParseUserConfig(data)
+	}
+
+	return err
+}
+
+// lookupRepoForManagement looks up a repo, ensuring it is a repo which can be
+// managed and that the user has at least the given access level. Note that
+// the repo does not need to exist.
+func (c *Config) lookupRepoForManagement(user *User, repoName string, access AccessLevel) (*RepoLookup, error) {
+	repo, err := c.parseRepoPath(repoName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch repo.Type {
+	case RepoTypeOrg, RepoTypeUser, RepoTypeTopLevel:
+	default:
+		return nil, ErrConfigRepo
+	}
+
+	repo.Access = c.checkUserRepoAccess(user, repo)
+
+	// As with any other repo access, we return the same error whether the
+	// repo exists or not so information about what repos exist is not leaked.
+	if repo.Access < access {
+		return nil, ErrRepoDoesNotExist
+	}
+
+	return repo, nil
+}
+
+// repoExists returns true if a repo is either explicitly defined or exists on
+// disk.
+func (c *Config) repoExists(repo *RepoLookup) bool {
+	return c.lookupRepoConfig(repo) != nil || git.Exists(c.fs, repo.Path())
+}
+
+// repoDefaultBranch returns the branch HEAD should point to when the given repo
+// is created.
+func (c *Config) repoDefaultBranch(repo *RepoLookup) string {
+	if repoConfig := c.lookupRepoConfig(repo); repoConfig != nil && repoConfig.DefaultBranch != "" {
+		return repoConfig.DefaultBranch
+	}
+
+	return c.Options.DefaultBranch
+}
+
+// ensureRepo creates the given repo if it doesn't exist yet, with HEAD
+// pointing at its default branch.
+func (c *Config) ensureRepo(repo *RepoLookup) (*git.Repository, error) {
+	return git.EnsureRepoBranch(c.fs, repo.Path(), c.repoDefaultBranch(repo))
+}
+
+// ensureConfigRepo is the same as ensureRepo, but for the config repo at the
+// given path.
+func (c *Config) ensureConfigRepo(repoPath string) (*git.Repository, error) {
+	return git.EnsureRepoBranch(c.fs, repoPath, c.Options.DefaultBranch)
+}
+
+// CreateRepo defines a new repo in the config and creates it on disk.
+func (c *Config) CreateRepo(user *User, repoName string) error {
+	repo, err := c.lookupRepoForManagement(user, repoName, AccessLevelAdmin)
+	if err != nil {
+		return err
+	}
+
+	if c.repoExists(repo) {
+		return ErrRepoExists
+	}
+
+	err = c.defineRepo(user, repo, fmt.Sprintf("Created repo %s", repoName))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.ensureRepo(repo)
+
+	return err
+}
+
+// defineRepo adds an empty definition for the given repo to the default
+// location.
+func (c *Config) defineRepo(user *User, repo *RepoLookup, msg string) error {
+	loc := c.defaultRepoConfigLocation(repo)
+
+	return c.updateConfigFile(loc.RepoPath, user, msg, func(targetNode *yaml.Node) error {
+		reposNode := ensureNodePath(targetNode, loc.Keys)
+		reposNode.EnsureKey(loc.Name, yaml.NewMappingNode(), nil)
+
+		return nil
+	})
+}
+
+// DeleteRepo removes a repo from the config and deletes it from disk.
+func (c *Config) DeleteRepo(user *User, repoName string) error {
+	repo, err := c.lookupRepoForManagement(user, repoName, AccessLevelAdmin)
+	if err != nil {
+		return err
+	}
+
+	if !c.repoExists(repo) {
+		return ErrRepoDoesNotExist
+	}
+
+	locs, err := c.findRepoConfigLocations(repo)
+	if err != nil {
+		return err
+	}
+
+	// The repo could be defined in more than one place, and any definitions
+	// left behind would bring it back.
+	for _, loc := range locs {
+		loc := loc
+
+		err = c.updateConfigFile(loc.RepoPath, user, fmt.Sprintf("Deleted repo %s", repoName), func(targetNode *yaml.Node) error {
+			lookupNodePath(targetNode, loc.Keys).RemoveKey(loc.Name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = util.RemoveAll(c.fs, repo.Path()+".git")
+	if err != nil {
+		return err
+	}
+
+	// Repos may also exist without the .git suffix.
+	if git.Exists(c.fs, repo.Path()) {
+		return util.RemoveAll(c.fs, repo.Path())
+	}
+
+	return nil
+}
+
+// RenameRepo moves a repo and its config to a new path.
+func (c *Config) RenameRepo(user *User, oldName, newName string) error { //nolint:cyclop
+	oldRepo, err := c.lookupRepoForManagement(user, oldName, AccessLevelAdmin)
+	if err != nil {
+		return err
+	}
+
+	newRepo, err := c.lookupRepoForManagement(user, newName, AccessLevelAdmin)
+	if err != nil {
+		return err
+	}
+
+	if !c.repoExists(oldRepo) {
+		return ErrRepoDoesNotExist
+	}
+
+	if c.repoExists(newRepo) {
+		return ErrRepoExists
+	}
+
+	oldLoc, found, err := c.findRepoConfigLocation(oldRepo)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		msg := fmt.Sprintf("Renamed repo %s to %s", oldName, newName)
+		newLoc := c.defaultRepoConfigLocation(newRepo)
+
+		// If both locations are in the same file, we can do this in a single
+		// commit, and if they're in the same mapping, the key can be renamed
+		// in place to keep its position and comments. Otherwise, we need to
+		// remove it from the old location and add it to the new one, undoing
+		// the removal if the second commit fails.
+		var repoNode *yaml.Node
+
+		oldConfigRepo, err := c.ensureConfigRepo(oldLoc.RepoPath)
+		if err != nil {
+			return err
+		}
+
+		oldState, err := saveConfigRepoState(oldConfigRepo)
+		if err != nil {
+			return err
+		}
+
+		err = c.updateConfigFile(oldLoc.RepoPath, user, msg, func(targetNode *yaml.Node) error {
+			oldReposNode := lookupNodePath(targetNode, oldLoc.Keys)
+
+			if oldLoc.RepoPath == newLoc.RepoPath && strings.Join(oldLoc.Keys, "/") == strings.Join(newLoc.Keys, "/") {
+				oldReposNode.RenameKey(oldLoc.Name, newLoc.Name)
+				return nil
+			}
+
+			repoNode = oldReposNode.ValueNode(oldLoc.Name)
+			oldReposNode.RemoveKey(oldLoc.Name)
+
+			if oldLoc.RepoPath == newLoc.RepoPath {
+				ensureNodePath(targetNode, newLoc.Keys).EnsureKey(newLoc.Name, repoNode, nil)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if oldLoc.RepoPath != newLoc.RepoPath {
+			err = c.updateConfigFile(newLoc.RepoPath, user, msg, func(targetNode *yaml.Node) error {
+				ensureNodePath(targetNode, newLoc.Keys).EnsureKey(newLoc.Name, repoNode, nil)
+				return nil
+			})
+			if err != nil {
+				if restoreErr := oldState.restore(); restoreErr != nil {
+					return restoreErr
+				}
+
+				return err
+			}
+		}
+	}
+
+	if !git.Exists(c.fs, oldRepo.Path()) {
+		return nil
+	}
+
+	// Make sure the repo exists with the .git suffix before moving it.
+	_, err = git.EnsureRepo(c.fs, oldRepo.Path())
+	if err != nil {
+		return err
+	}
+
+	err = c.fs.MkdirAll(path.Dir(newRepo.Path()), 0o755)
+	if err != nil {
+		return err
+	}
+
+	return c.fs.Rename(oldRepo.Path()+".git", newRepo.Path()+".git")
+}
+
+// ForkRepo creates a copy of a repo at a new path. The new repo will not copy
+// any of the config from the original repo.
+func (c *Config) ForkRepo(user *User, srcName, dstName string) error {
+	srcRepo, err := c.lookupRepoForManagement(user, srcName, AccessLevelRead)
+	if err != nil {
+		return err
+	}
+
+	dstRepo, err := c.lookupRepoForManagement(user, dstName, AccessLevelAdmin)
+	if err != nil {
+		return err
+	}
+
+	if !c.repoExists(srcRepo) {
+		return ErrRepoDoesNotExist
+	}
+
+	if c.repoExists(dstRepo) {
+		return ErrRepoExists
+	}
+
+	err = c.defineRepo(user, dstRepo, fmt.Sprintf("Forked repo %s to %s", srcName, dstName))
+	if err != nil {
+		return err
+	}
+
+	if git.Exists(c.fs, srcRepo.Path()) {
+		// Make sure the repo exists with the .git suffix before copying it.
+		_, err = git.EnsureRepo(c.fs, srcRepo.Path())
+		if err != nil {
+			return err
+		}
+
+		err = copyDir(c.fs, srcRepo.Path()+".git", dstRepo.Path()+".git")
+		if err != nil {
+			return err
+		}
+	}
+
+	// This ensures the new repo exists and has all the hooks pointing to the
+	// right place.
+	_, err = c.ensureRepo(dstRepo)
+
+	return err
+}
+
+// SetRepoHead points HEAD of an existing repo at the given branch. Unless the
+// repo is empty, the branch must exist. Config repos may also be changed, as
+// long as the config on the new branch is valid.
+func (c *Config) SetRepoHead(user *User, repoName, branch string) error { //nolint:cyclop
+	repo, err := c.parseRepoPath(repoName)
+	if err != nil {
+		return err
+	}
+
+	// As with any other repo access, we return the same error whether the
+	// repo exists or not so information about what repos exist is not leaked.
+	if !c.repoDefined(repo) || c.checkUserRepoAccess(user, repo) < AccessLevelAdmin {
+		return ErrRepoDoesNotExist
+	}
+
+	target := plumbing.NewBranchReferenceName(branch)
+	if branch == "" || target.Validate() != nil {
+		return ErrInvalidBranch
+	}
+
+	gitRepo, err := git.EnsureRepo(c.fs, repo.Path())
+	if err != nil {
+		return err
+	}
+
+	hasBranches, err := gitRepo.HasBranches()
+	if err != nil {
+		return err
+	}
+
+	if hasBranches {
+		_, err = gitRepo.RepoFS.Reference(target)
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return ErrBranchDoesNotExist
+		} else if err != nil {
+			return err
+		}
+	}
+
+	oldHead, err := gitRepo.RepoFS.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+
+	err = gitRepo.SetHead(target)
+	if err != nil {
+		return err
+	}
+
+	switch repo.Type {
+	case RepoTypeAdmin, RepoTypeOrgConfig, RepoTypeUserConfig:
+	default:
+		return nil
+	}
+
+	// Config is always loaded from HEAD, so we need to make sure the new
+	// branch can be loaded before keeping it.
+	newConfig := NewConfig(c.fs)
+
+	err = newConfig.Load()
+	if err == nil {
+		err = newConfig.Validate(user, nil)
+	}
+
+	if err != nil {
+		if restoreErr := gitRepo.RepoFS.SetReference(oldHead); restoreErr != nil {
+			return restoreErr
+		}
+
+		return fmt.Errorf("%w: %s", ErrInvalidBranchConfig, err)
+	}
+
+	return nil
+}
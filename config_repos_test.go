@@ -0,0 +1,395 @@
+package gitdir
+
+import (
+	"strings"
+	"testing"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+)
+
+func newTestRepoServer(t *testing.T) *Server {
+	t.Helper()
+
+	// memfs doesn't properly support renaming directories, so we need to use
+	// a real filesystem.
+	serv, err := NewServer(osfs.New(t.TempDir()))
+	require.Nil(t, err)
+
+	pk := mustParsePK("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILQGpcX2owFW6hdTWHa/CzbTwhUJlmI8gKAgnp/c0NK2 an-admin")
+	require.Nil(t, serv.EnsureAdminUser("an-admin", &pk))
+
+	// Define a user without any special permissions.
+	err = serv.updateConfig(func(c *Config) error {
+		admin := &User{Username: "an-admin", IsAdmin: true}
+
+		return c.updateConfigFile("admin/admin", admin, "Added non-admin", func(targetNode *yaml.Node) error {
+			ensureNodePath(targetNode, []string{"users", "non-admin"})
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	return serv
+}
+
+func TestRepoManagement(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	serv := newTestRepoServer(t)
+
+	admin := &User{Username: "an-admin", IsAdmin: true}
+	nonAdmin := &User{Username: "non-admin"}
+
+	run := func(cb func(*Config) error) error {
+		return serv.updateConfig(cb)
+	}
+
+	// Create
+	require.Nil(t, run(func(c *Config) error { return c.CreateRepo(admin, "test-repo") }))
+	assert.NotNil(t, serv.GetAdminConfig().Repos["test-repo"])
+	assert.True(t, git.Exists(serv.fs, "top-level/test-repo"))
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.CreateRepo(admin, "test-repo") }), ErrRepoExists)
+	assert.ErrorIs(t, run(func(c *Config) error { return c.CreateRepo(nonAdmin, "other-repo") }), ErrRepoDoesNotExist)
+	assert.ErrorIs(t, run(func(c *Config) error { return c.CreateRepo(admin, "admin") }), ErrConfigRepo)
+
+	// Users can manage their own repos.
+	require.Nil(t, run(func(c *Config) error { return c.CreateRepo(nonAdmin, "~non-admin/own-repo") }))
+	assert.True(t, git.Exists(serv.fs, "users/non-admin/own-repo"))
+
+	// Rename
+	require.Nil(t, run(func(c *Config) error { return c.CreateRepo(admin, "later-repo") }))
+	require.Nil(t, run(func(c *Config) error { return c.RenameRepo(admin, "test-repo", "renamed-repo") }))
+	assert.Nil(t, serv.GetAdminConfig().Repos["test-repo"])
+	assert.NotNil(t, serv.GetAdminConfig().Repos["renamed-repo"])
+	assert.False(t, git.Exists(serv.fs, "top-level/test-repo"))
+	assert.True(t, git.Exists(serv.fs, "top-level/renamed-repo"))
+
+	// Renames within the same file keep the repo in the same place.
+	adminRepo, err := git.Open(serv.fs, "admin/admin")
+	require.Nil(t, err)
+	require.Nil(t, adminRepo.Checkout(""))
+
+	adminData, err := adminRepo.GetFile("config.yml")
+	require.Nil(t, err)
+	assert.Less(t, strings.Index(string(adminData), "renamed-repo:"), strings.Index(string(adminData), "later-repo:"))
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.RenameRepo(admin, "test-repo", "other-repo") }), ErrRepoDoesNotExist)
+
+	// Fork
+	repo, err := git.Open(serv.fs, "top-level/renamed-repo")
+	require.Nil(t, err)
+	newTestCommit(t, repo, "README.md")
+
+	require.Nil(t, run(func(c *Config) error { return c.ForkRepo(admin, "renamed-repo", "forked-repo") }))
+	assert.NotNil(t, serv.GetAdminConfig().Repos["forked-repo"])
+
+	forked, err := git.Open(serv.fs, "top-level/forked-repo")
+	require.Nil(t, err)
+	require.Nil(t, forked.Checkout(""))
+
+	data, err := forked.GetFile("README.md")
+	require.Nil(t, err)
+	assert.Equal(t, "README.md", string(data))
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.ForkRepo(nonAdmin, "renamed-repo", "~non-admin/fork") }), ErrRepoDoesNotExist)
+
+	// Delete
+	require.Nil(t, run(func(c *Config) error { return c.DeleteRepo(admin, "forked-repo") }))
+	assert.Nil(t, serv.GetAdminConfig().Repos["forked-repo"])
+	assert.False(t, git.Exists(serv.fs, "top-level/forked-repo"))
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.DeleteRepo(admin, "forked-repo") }), ErrRepoDoesNotExist)
+
+	// Repos without the .git suffix can also be deleted.
+	require.Nil(t, serv.fs.Rename("top-level/later-repo.git", "top-level/later-repo"))
+	require.Nil(t, run(func(c *Config) error { return c.DeleteRepo(admin, "later-repo") }))
+	assert.False(t, git.Exists(serv.fs, "top-level/later-repo"))
+	assert.ErrorIs(t, run(func(c *Config) error { return c.DeleteRepo(nonAdmin, "renamed-repo") }), ErrRepoDoesNotExist)
+}
+
+func requireHead(t *testing.T, fs billy.Filesystem, repoPath string, target string) {
+	t.Helper()
+
+	repo, err := git.Open(fs, repoPath)
+	require.Nil(t, err)
+
+	head, err := repo.RepoFS.Reference(plumbing.HEAD)
+	require.Nil(t, err)
+	assert.Equal(t, plumbing.ReferenceName(target), head.Target(), repoPath)
+}
+
+func TestDefaultBranch(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	serv := newTestRepoServer(t)
+
+	admin := &User{Username: "an-admin", IsAdmin: true}
+	nonAdmin := &User{Username: "non-admin"}
+
+	run := func(cb func(*Config) error) error {
+		return serv.updateConfig(cb)
+	}
+
+	// The admin repo is created before any options are loaded.
+	requireHead(t, serv.fs, "admin/admin", "refs/heads/master")
+
+	require.Nil(t, run(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Set default branch", func(targetNode *yaml.Node) error {
+			optionsNode := ensureNodePath(targetNode, []string{"options"})
+			optionsNode.EnsureKey("default_branch", yaml.NewScalarNode("main", ""), &yaml.EnsureOptions{Force: true})
+			optionsNode.EnsureKey("user_config_keys", yaml.NewScalarNode("true", yaml.ScalarTagBool), &yaml.EnsureOptions{Force: true})
+
+			repoNode := ensureNodePath(targetNode, []string{"repos", "override"})
+			repoNode.EnsureKey("default_branch", yaml.NewScalarNode("trunk", ""), nil)
+
+			return nil
+		})
+	}))
+
+	// New repos, including config repos, use the default branch unless it's
+	// overridden.
+	require.Nil(t, run(func(c *Config) error { return c.CreateRepo(admin, "a-repo") }))
+	requireHead(t, serv.fs, "top-level/a-repo", "refs/heads/main")
+	requireHead(t, serv.fs, "admin/user-non-admin", "refs/heads/main")
+
+	config := serv.GetAdminConfig()
+
+	_, err := config.ensureRepo(&RepoLookup{Type: RepoTypeTopLevel, PathParts: []string{"override"}})
+	require.Nil(t, err)
+	requireHead(t, serv.fs, "top-level/override", "refs/heads/trunk")
+
+	// Checking out follows HEAD.
+	repo, err := git.Open(serv.fs, "top-level/a-repo")
+	require.Nil(t, err)
+	require.Nil(t, repo.Checkout(""))
+
+	first := newTestCommit(t, repo, "first")
+	requireRef(t, serv.fs, "top-level/a-repo", "refs/heads/main", first)
+
+	// HEAD of existing repos can only be pointed at branches which exist.
+	require.Nil(t, repo.Repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/other", plumbing.NewHash(first))))
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.SetRepoHead(admin, "a-repo", "missing") }), ErrBranchDoesNotExist)
+	assert.ErrorIs(t, run(func(c *Config) error { return c.SetRepoHead(admin, "a-repo", "a..b") }), ErrInvalidBranch)
+	assert.ErrorIs(t, run(func(c *Config) error { return c.SetRepoHead(nonAdmin, "a-repo", "other") }), ErrRepoDoesNotExist)
+	assert.ErrorIs(t, run(func(c *Config) error { return c.SetRepoHead(admin, "missing-repo", "other") }), ErrRepoDoesNotExist)
+
+	require.Nil(t, run(func(c *Config) error { return c.SetRepoHead(admin, "a-repo", "other") }))
+	requireHead(t, serv.fs, "top-level/a-repo", "refs/heads/other")
+
+	// Config is loaded from whichever branch HEAD points to, and config repos
+	// can only be pointed at branches with a valid config.
+	userRepo, err := git.Open(serv.fs, "admin/user-non-admin")
+	require.Nil(t, err)
+	require.Nil(t, userRepo.Checkout(""))
+
+	empty := newTestCommit(t, userRepo, "README")
+
+	require.Nil(t, userRepo.CreateFile("config.yml", []byte("keys:\n  - "+testAuthKey+"\n")))
+	require.Nil(t, userRepo.Commit("Added key", nil))
+
+	mainHead, err := userRepo.Repo.Head()
+	require.Nil(t, err)
+
+	require.Nil(t, userRepo.CreateFile("config.yml", []byte("keys: {")))
+	require.Nil(t, userRepo.Commit("Broke config", nil))
+
+	brokenHead, err := userRepo.Repo.Head()
+	require.Nil(t, err)
+
+	require.Nil(t, userRepo.Repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", mainHead.Hash())))
+	require.Nil(t, userRepo.Repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/broken", brokenHead.Hash())))
+	require.Nil(t, userRepo.Repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/empty", plumbing.NewHash(empty))))
+
+	require.Nil(t, serv.Reload())
+	assert.Len(t, serv.GetAdminConfig().Users["non-admin"].Keys, 1)
+
+	assert.ErrorIs(t, run(func(c *Config) error { return c.SetRepoHead(admin, "~non-admin", "broken") }), ErrInvalidBranchConfig)
+	requireHead(t, serv.fs, "admin/user-non-admin", "refs/heads/main")
+
+	require.Nil(t, run(func(c *Config) error { return c.SetRepoHead(admin, "~non-admin", "empty") }))
+	requireHead(t, serv.fs, "admin/user-non-admin", "refs/heads/empty")
+	assert.Len(t, serv.GetAdminConfig().Users["non-admin"].Keys, 0)
+}
+
+func TestValidateDefaultBranch(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	require.Nil(t, c.validateDefaultBranches())
+
+	c.Options.DefaultBranch = "a..b"
+	c.Orgs["an-org"].Repos["test-repo"].DefaultBranch = "with space"
+
+	err := c.validateDefaultBranches()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `options: invalid default_branch "a..b"`)
+	assert.Contains(t, err.Error(), `repo @an-org/test-repo: invalid default_branch "with space"`)
+
+	// Invalid branches should also stop the config from loading.
+	serv := newTestRepoServer(t)
+	admin := &User{Username: "an-admin", IsAdmin: true}
+
+	err = serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Set default branch", func(targetNode *yaml.Node) error {
+			optionsNode := ensureNodePath(targetNode, []string{"options"})
+			optionsNode.EnsureKey("default_branch", yaml.NewScalarNode("a..b", ""), &yaml.EnsureOptions{Force: true})
+
+			return nil
+		})
+	})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `invalid default_branch "a..b"`)
+}
+
+func TestUpdateConfigFileValidate(t *testing.T) {
+	t.Parallel()
+
+	serv := newTestRepoServer(t)
+	admin := &User{Username: "an-admin", IsAdmin: true}
+
+	adminRepo, err := git.Open(serv.fs, "admin/admin")
+	require.Nil(t, err)
+
+	oldHead, err := adminRepo.Repo.Head()
+	require.Nil(t, err)
+
+	// Changes which wouldn't be accepted if they were pushed shouldn't be
+	// committed.
+	err = serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Broke ref rules", func(targetNode *yaml.Node) error {
+			repoNode := ensureNodePath(targetNode, []string{"repos", "a-repo"})
+			repoNode.EnsureKey("refs", yaml.NewSequenceNode(), nil)
+
+			ruleNode := yaml.NewMappingNode()
+			ruleNode.EnsureKey("pattern", yaml.NewScalarNode("refs/tags/*", ""), nil)
+			ruleNode.EnsureKey("immutable", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			ruleNode.EnsureKey("allow_delete", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			repoNode.ValueNode("refs").AppendNode(ruleNode)
+
+			return nil
+		})
+	})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "can't be both immutable and allow_delete")
+
+	newHead, err := adminRepo.Repo.Head()
+	require.Nil(t, err)
+	assert.Equal(t, oldHead.Hash(), newHead.Hash())
+
+	require.Nil(t, serv.Reload())
+	assert.Nil(t, serv.GetAdminConfig().Repos["a-repo"])
+
+	// Removing the current user is also rejected.
+	err = serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Removed an-admin", func(targetNode *yaml.Node) error {
+			lookupNodePath(targetNode, []string{"users"}).RemoveKey("an-admin")
+			return nil
+		})
+	})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot remove current user: an-admin")
+	assert.NotNil(t, serv.GetAdminConfig().Users["an-admin"])
+}
+
+func TestRepoManagementConfigRepos(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	serv := newTestRepoServer(t)
+	admin := &User{Username: "an-admin", IsAdmin: true}
+
+	run := func(cb func(*Config) error) error {
+		return serv.updateConfig(cb)
+	}
+
+	require.Nil(t, run(func(c *Config) error {
+		adminRepo, err := git.EnsureRepo(c.fs, "admin/admin")
+		if err != nil {
+			return err
+		}
+
+		if err = adminRepo.Checkout(""); err != nil {
+			return err
+		}
+
+		if err = adminRepo.CreateFile("hooks/notify", []byte("#!/usr/bin/env sh\necho notify\n")); err != nil {
+			return err
+		}
+
+		if err = adminRepo.Commit("Added hook script", nil); err != nil {
+			return err
+		}
+
+		if err = c.Load(); err != nil {
+			return err
+		}
+
+		return c.updateConfigFile("admin/admin", admin, "Enabled user config repos", func(targetNode *yaml.Node) error {
+			optionsNode := ensureNodePath(targetNode, []string{"options"})
+			optionsNode.EnsureKey("user_config_repos", yaml.NewScalarNode("true", yaml.ScalarTagBool), &yaml.EnsureOptions{Force: true})
+
+			reposNode := ensureNodePath(targetNode, []string{"repos"})
+			reposNode.EnsureKey("public-repo", yaml.NewMappingNode(), nil)
+			reposNode.ValueNode("public-repo").EnsureKey("public", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+
+			hooksNode := ensureNodePath(targetNode, []string{"repos", "hooked-repo", "hooks"})
+			hooksNode.EnsureKey("post-receive", newScalarSequenceNode([]string{"notify"}), nil)
+
+			return nil
+		})
+	}))
+
+	for _, repoPath := range []string{"top-level/public-repo", "top-level/hooked-repo"} {
+		_, err := git.EnsureRepo(serv.fs, repoPath)
+		require.Nil(t, err)
+	}
+
+	// Renaming to a repo defined in another config repo moves the config.
+	require.Nil(t, run(func(c *Config) error { return c.RenameRepo(admin, "public-repo", "~non-admin/moved-repo") }))
+	assert.Nil(t, serv.GetAdminConfig().Repos["public-repo"])
+	require.NotNil(t, serv.GetAdminConfig().Users["non-admin"].Repos["moved-repo"])
+	assert.True(t, serv.GetAdminConfig().Users["non-admin"].Repos["moved-repo"].Public)
+	assert.True(t, git.Exists(serv.fs, "users/non-admin/moved-repo"))
+
+	// If the repo can't be added to the new location, it should be left where
+	// it was. Hooks in user config repos need to be approved.
+	err := run(func(c *Config) error { return c.RenameRepo(admin, "hooked-repo", "~non-admin/hooked-repo") })
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "has not been approved")
+	assert.NotNil(t, serv.GetAdminConfig().Repos["hooked-repo"])
+	assert.Nil(t, serv.GetAdminConfig().Users["non-admin"].Repos["hooked-repo"])
+	assert.True(t, git.Exists(serv.fs, "top-level/hooked-repo"))
+
+	require.Nil(t, serv.Reload())
+	assert.NotNil(t, serv.GetAdminConfig().Repos["hooked-repo"])
+
+	// Deleting a repo removes every definition of it.
+	require.Nil(t, run(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", admin, "Defined moved-repo", func(targetNode *yaml.Node) error {
+			ensureNodePath(targetNode, []string{"users", "non-admin", "repos", "moved-repo"})
+			return nil
+		})
+	}))
+
+	locs, err := serv.GetAdminConfig().findRepoConfigLocations(&RepoLookup{
+		Type:      RepoTypeUser,
+		PathParts: []string{"non-admin", "moved-repo"},
+	})
+	require.Nil(t, err)
+	require.Len(t, locs, 2)
+
+	require.Nil(t, run(func(c *Config) error { return c.DeleteRepo(admin, "~non-admin/moved-repo") }))
+	assert.Nil(t, serv.GetAdminConfig().Users["non-admin"].Repos["moved-repo"])
+	assert.False(t, git.Exists(serv.fs, "users/non-admin/moved-repo"))
+
+	require.Nil(t, serv.Reload())
+	assert.Nil(t, serv.GetAdminConfig().Users["non-admin"].Repos["moved-repo"])
+}
@@ -1,7 +1,8 @@
 package gitdir
 
 import (
-	"github.com/belak/go-gitdir/internal/git"
+	"fmt"
+
 	"github.com/belak/go-gitdir/models"
 )
 
@@ -23,7 +24,7 @@ func (c *Config) loadUserConfigs() error {
 }
 
 func (c *Config) loadUserConfig(username string) error {
-	userRepo, err := git.EnsureRepo(c.fs, "admin/user-"+username)
+	userRepo, err := c.ensureConfigRepo("admin/user-" + username)
 	if err != nil {
 		return err
 	}
@@ -49,6 +50,12 @@ func (c *Config) loadUserConfig(username string) error {
 		}
 
 		if c.Options.UserConfigRepos {
+			// Users defined without any repos in the admin config won't have
+			// the map yet.
+			if c.Users[username].Repos == nil {
+				c.Users[username].Repos = make(map[string]*models.RepoConfig)
+			}
+
 			for repoName, repo := range userConfig.Repos {
 				// If it's already defined, skip it.
 				//
@@ -57,6 +64,16 @@ func (c *Config) loadUserConfig(username string) error {
 					continue
 				}
 
+				// Mirrors use the server's mirror key and webhooks make the
+				// server send requests to any host, so they can only be
+				// configured by admins.
+				repo.Mirror = models.MirrorConfig{}
+				repo.Webhooks = nil
+
+				if err := c.checkApprovedHooks(repo.Hooks); err != nil {
+					return fmt.Errorf("%s: %w", repoName, err)
+				}
+
 				c.Users[username].Repos[repoName] = repo
 			}
 		}
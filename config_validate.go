@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/go-git/go-git/v5/plumbing"
+
 	"github.com/belak/go-gitdir/models"
 )
 
@@ -13,11 +15,47 @@ func (c *Config) Validate(user *User, pk *models.PublicKey) error {
 	return newMultiError(
 		c.validateUser(user),
 		c.validatePublicKey(pk),
+		c.validateConfig(),
+	)
+}
+
+// validateConfig is the same as Validate, but doesn't check anything specific
+// to the user making the change.
+func (c *Config) validateConfig() error {
+	return newMultiError(
 		c.validateAdmins(),
 		c.validateGroupLoop(),
+		c.validateHooks(),
+		c.validateDeployKeys(),
+		c.validateDefaultBranches(),
+		c.validateRefRules(),
 	)
 }
 
+// validateDefaultBranches ensures the default_branch option and any repo
+// overrides are valid branch names.
+func (c *Config) validateDefaultBranches() error {
+	var errors []error
+
+	check := func(where string, branch string) {
+		if branch == "" {
+			return
+		}
+
+		if err := plumbing.NewBranchReferenceName(branch).Validate(); err != nil {
+			errors = append(errors, fmt.Errorf("%s: invalid default_branch %q", where, branch))
+		}
+	}
+
+	check("options", c.Options.DefaultBranch)
+
+	for _, entry := range c.listRepoConfigs() {
+		check("repo "+c.RepoName(entry.Repo), entry.Config.DefaultBranch)
+	}
+
+	return newMultiError(errors...)
+}
+
 func (c *Config) validateUser(u *User) error {
 	if _, ok := c.Users[u.Username]; !ok {
 		return fmt.Errorf("cannot remove current user: %s", u.Username)
@@ -27,6 +65,12 @@ func (c *Config) validateUser(u *User) error {
 }
 
 func (c *Config) validatePublicKey(pk *models.PublicKey) error {
+	// If there's no key, the user didn't authenticate with one, so there's
+	// nothing to check.
+	if pk == nil {
+		return nil
+	}
+
 	if _, ok := c.publicKeys[pk.RawMarshalAuthorizedKey()]; !ok {
 		return fmt.Errorf("cannot remove current private key: %s", pk.MarshalAuthorizedKey())
 	}
@@ -22,6 +22,8 @@ const (
 	contextKeyUser      = contextKey("gitdir-user")
 	contextKeyLogger    = contextKey("gitdir-logger")
 	contextKeyPublicKey = contextKey("gitdir-public-key")
+	contextKeyInvite    = contextKey("gitdir-invite")
+	contextKeyAuthConn  = contextKey("gitdir-auth-conn")
 )
 
 // CtxExtract is a convenience wrapper around the other context convenience
@@ -95,3 +97,18 @@ func CtxPublicKey(ctx context.Context) *models.PublicKey {
 
 	return nil
 }
+
+// CtxSetInvite puts the given invite code into the ssh.Context.
+func CtxSetInvite(parent ssh.Context, invite string) {
+	parent.SetValue(contextKeyInvite, invite)
+}
+
+// CtxInvite pulls the invite code out of the context, or an empty string if
+// not found.
+func CtxInvite(ctx context.Context) string {
+	if invite, ok := ctx.Value(contextKeyInvite).(string); ok {
+		return invite
+	}
+
+	return ""
+}
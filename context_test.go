@@ -44,6 +44,11 @@ func TestContextKey(t *testing.T) {
 			"gitdir-public-key",
 			"Context key: gitdir-public-key",
 		},
+		{
+			contextKeyInvite,
+			"gitdir-invite",
+			"Context key: gitdir-invite",
+		},
 	}
 
 	baseCtx := context.Background()
@@ -164,3 +169,22 @@ func TestCtxPublicKey(t *testing.T) {
 	ctx = context.WithValue(ctx, contextKeyPublicKey, pk)
 	assert.Equal(t, pk, CtxPublicKey(ctx))
 }
+
+func TestCtxSetInvite(t *testing.T) {
+	t.Skip("not implemented")
+
+	t.Parallel()
+}
+
+func TestCtxInvite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// Check the default value
+	assert.Equal(t, "", CtxInvite(ctx))
+
+	// Check that when we set a value, this properly extracts it.
+	ctx = context.WithValue(ctx, contextKeyInvite, "an-invite")
+	assert.Equal(t, "an-invite", CtxInvite(ctx))
+}
@@ -1,7 +1,7 @@
-//nolint:forbidigo
 package gitdir
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,15 +9,17 @@ import (
 	"github.com/belak/go-gitdir/models"
 )
 
-// RunHook will run the given hook.
+// RunHook will run the given hook. If a public key is provided, it will be
+// used to look up the user, otherwise the username will be used.
 func (c *Config) RunHook(
 	hook string,
 	repoPath string,
+	username string,
 	pk *models.PublicKey,
 	args []string,
 	stdin io.Reader,
 ) error {
-	user, err := c.LookupUserFromKey(*pk, c.Options.GitUser)
+	user, err := c.lookupHookUser(username, pk)
 	if err != nil {
 		return err
 	}
@@ -28,10 +30,13 @@ func (c *Config) RunHook(
 	}
 
 	switch hook {
-	case "pre-receive", "post-receive":
-		// Pre and post are here just in case we need them in the future, but
-		// they always succeed right now.
-		return nil
+	case "pre-receive":
+		return c.checkQuota(repo)
+	case "post-receive":
+		return newMultiError(
+			c.runPostReceiveHook(repo, user, stdin),
+			c.pushMirrors(context.Background(), repo),
+		)
 	case "update":
 		if len(args) < 3 {
 			return errors.New("not enough args")
@@ -43,14 +48,33 @@ func (c *Config) RunHook(
 			newHash = args[2]
 		)
 
-		fmt.Println(args)
+		err = c.runUpdateHook(repo, user, pk, oldHash, newHash, ref)
+
+		c.recordAudit(&AuditEvent{
+			Type:    AuditEventRefUpdate,
+			Allowed: err == nil,
+			Reason:  auditReason(err),
+			User:    user.Username,
+			Repo:    c.RepoName(repo),
+			Ref:     ref,
+			OldHash: oldHash,
+			NewHash: newHash,
+		})
 
-		return c.runUpdateHook(repo, user, pk, oldHash, newHash, ref)
+		return err
 	default:
 		return fmt.Errorf("hook %s is not implemented", hook)
 	}
 }
 
+func (c *Config) lookupHookUser(username string, pk *models.PublicKey) (*User, error) {
+	if pk != nil {
+		return c.LookupUserFromKey(*pk, c.Options.GitUser)
+	}
+
+	return c.LookupUserFromUsername(username)
+}
+
 func (c *Config) runUpdateHook(
 	lookup *RepoLookup,
 	user *User,
@@ -69,8 +93,8 @@ func (c *Config) runUpdateHook(
 	case RepoTypeUserConfig:
 		err = c.SetUserHash(lookup.PathParts[0], newHash)
 	default:
-		// Non-admin repos don't need this hook.
-		return nil
+		// Non-admin repos only need to check the ref rules.
+		return c.checkRefRules(lookup, user, ref, oldHash, newHash)
 	}
 
 	if err != nil {
@@ -0,0 +1,91 @@
+package gitdir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+func TestRunHooks(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	gitDir := t.TempDir()
+	hookDir := git.HookDir(gitDir, "pre-receive")
+	require.Nil(t, os.MkdirAll(hookDir, 0o755))
+
+	for name, script := range map[string]string{
+		"10-first": "read line\necho \"first $1 $line\"\n",
+		"20-fail":  "cat >/dev/null\nexit 3\n",
+		"30-last":  "echo \"last $1 $(cat) $" + git.HookDirEnv + "\"\n",
+		"40-slow":  "exec sleep 10\n",
+	} {
+		require.Nil(t, os.WriteFile(filepath.Join(hookDir, name), []byte("#!/usr/bin/env sh\n"+script), 0o755)) //nolint:gosec
+	}
+
+	// Non-executable files should be skipped.
+	require.Nil(t, os.WriteFile(filepath.Join(hookDir, "50-disabled"), []byte("#!/usr/bin/env sh\nexit 1\n"), 0o644)) //nolint:gosec
+
+	var stdout bytes.Buffer
+
+	start := time.Now()
+
+	err := git.RunHooks(
+		context.Background(), gitDir, "pre-receive", []string{"arg"},
+		strings.NewReader("a b c\n"), &stdout, &stdout, time.Second,
+	)
+	require.NotNil(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	assert.Equal(t, "first arg a b c\nlast arg a b c "+hookDir+"\n", stdout.String())
+
+	var hookErr git.HookError
+
+	require.True(t, errors.As(err, &hookErr))
+	require.Len(t, hookErr, 2)
+	assert.Equal(t, "pre-receive.d/20-fail", hookErr[0].Hook)
+	assert.EqualError(t, hookErr[0].Err, "exited with status 3")
+	assert.Equal(t, "pre-receive.d/40-slow", hookErr[1].Hook)
+	assert.EqualError(t, hookErr[1].Err, "timed out after 1s")
+
+	// Hooks which don't exist have nothing to run.
+	err = git.RunHooks(
+		context.Background(), gitDir, "update", nil,
+		strings.NewReader(""), &stdout, &stdout, time.Second,
+	)
+	assert.Nil(t, err)
+}
+
+func TestEnsureHooks(t *testing.T) {
+	t.Parallel()
+
+	fs := osfs.New(t.TempDir())
+
+	_, err := git.EnsureRepo(fs, "a-repo")
+	require.Nil(t, err)
+
+	exe, err := os.Executable()
+	require.Nil(t, err)
+
+	for _, hook := range []string{"pre-receive", "update", "post-receive"} {
+		data, err := os.ReadFile(filepath.Join(fs.Root(), "a-repo.git", "hooks", hook))
+		require.Nil(t, err)
+		assert.Contains(t, string(data), "exec \""+exe+"\" hook "+hook+" \"$@\"")
+		assert.FileExists(t, filepath.Join(fs.Root(), "a-repo.git", "hooks", hook+".d", "gitdir"))
+	}
+}
@@ -0,0 +1,224 @@
+package gitdir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpService represents one of the git services which can be accessed over
+// the smart HTTP protocol.
+type httpService struct {
+	Name   string
+	Access AccessLevel
+}
+
+var httpServices = map[string]httpService{
+	"git-upload-pack":  {Name: "git-upload-pack", Access: AccessLevelRead},
+	"git-receive-pack": {Name: "git-receive-pack", Access: AccessLevelWrite},
+}
+
+// HTTPHandler returns an http.Handler which serves all repos using the git
+// smart HTTP protocol. Users authenticate using HTTP basic auth with one of
+// their tokens as the password.
+func (serv *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(serv.handleHTTP)
+}
+
+// ListenAndServeHTTP listens on the HTTPAddr set on the server struct for new
+// HTTP connections.
+func (serv *Server) ListenAndServeHTTP() error {
+	serv.log.Info().Str("port", serv.HTTPAddr).Msg("Starting HTTP server")
+
+	httpServer := &http.Server{
+		Addr:              serv.HTTPAddr,
+		Handler:           serv.HTTPHandler(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	return httpServer.ListenAndServe()
+}
+
+func (serv *Server) handleHTTP(w http.ResponseWriter, r *http.Request) { //nolint:funlen
+	slog := serv.log.With().
+		Str("remote_addr", r.RemoteAddr).
+		Str("method", r.Method).
+		Str("path", r.URL.Path).Logger()
+
+	defer handlePanic(&slog)
+
+	config := serv.GetAdminConfig()
+
+	user, ok := serv.authenticateHTTP(config, r)
+	if !ok {
+		slog.Warn().Msg("Missing or invalid credentials")
+		requireHTTPAuth(w)
+
+		return
+	}
+
+	tmpLog := slog.With().Str("user", user.Username).Logger()
+	slog = tmpLog
+
+	repoName, service, advertise, ok := parseHTTPPath(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	repoName = sanitizeRepoName(repoName)
+
+	repo, err := serv.lookupRepoForAction(config, user, repoName, service.Access)
+	if err != nil {
+		// Anonymous users get the chance to provide credentials, everyone else
+		// gets the same error whether the repo exists or not.
+		if user.IsAnonymous {
+			requireHTTPAuth(w)
+			return
+		}
+
+		http.Error(w, "Repo does not exist", http.StatusNotFound)
+
+		return
+	}
+
+	req := &gitServiceRequest{
+		Service:       service.Name,
+		Repo:          repo,
+		RepoName:      repoName,
+		User:          user,
+		StatelessRPC:  true,
+		AdvertiseRefs: advertise,
+		GitProtocol:   negotiateGitProtocol(&slog, r.Header.Get("Git-Protocol")),
+		Stdin:         http.NoBody,
+		Stdout:        w,
+		Stderr:        io.Discard,
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if advertise {
+		w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service.Name))
+
+		// As with git-http-backend, the service header is only sent when
+		// protocol v2 isn't being used.
+		if serv.Transport == TransportNative || gitProtocolVersion(req.GitProtocol) != 2 {
+			_, _ = io.WriteString(w, pktLine(fmt.Sprintf("# service=%s\n", service.Name)))
+			_, _ = io.WriteString(w, "0000")
+		}
+
+		returnCode := serv.runGitService(&slog, req)
+		slog.Info().Int("return_code", returnCode).Msg("Return code")
+
+		return
+	}
+
+	body, err := httpRequestBody(r)
+	if err != nil {
+		slog.Warn().Err(err).Msg("Failed to read request body")
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service.Name))
+
+	// Anything written to stderr would corrupt the response, so we only log
+	// it.
+	stderr := &bytes.Buffer{}
+
+	req.Stdin = body
+	req.Stderr = stderr
+
+	returnCode := serv.runGitService(&slog, req)
+	slog.Info().Int("return_code", returnCode).Str("stderr", stderr.String()).Msg("Return code")
+
+	// Only the request which runs the service is counted, as the ref
+	// advertisement is part of the same action.
+	serv.metrics.recordRepoAction(service.Name, returnCode)
+
+	err = serv.afterRepoAction(repo, service.Access)
+	if err != nil {
+		slog.Error().Err(err).Msg("Error when reloading config")
+	}
+}
+
+// authenticateHTTP looks up the user from the basic auth credentials on the
+// request. If no credentials were provided, the anonymous user will be used if
+// anonymous access is enabled.
+func (serv *Server) authenticateHTTP(config *Config, r *http.Request) (*User, bool) {
+	username, token, ok := r.BasicAuth()
+	if !ok {
+		return AnonymousUser, config.Options.AnonymousRead
+	}
+
+	audit := &AuditEvent{
+		Type:       AuditEventAuth,
+		Method:     "token",
+		RemoteAddr: r.RemoteAddr,
+		RemoteUser: username,
+	}
+	defer serv.recordAudit(audit)
+
+	// Every request is authenticated separately, so each one is counted.
+	defer func() { serv.metrics.recordAuth(audit.Method, audit.Allowed) }()
+
+	user, err := config.LookupUserFromToken(username, token)
+	if err != nil {
+		audit.Reason = auditReason(err)
+		return nil, false
+	}
+
+	audit.Allowed = true
+	audit.User = user.Username
+
+	return user, true
+}
+
+func requireHTTPAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="gitdir"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// parseHTTPPath splits a smart HTTP request path into the repo name and the
+// service being requested. advertise will be true if this is a request for the
+// ref advertisement.
+func parseHTTPPath(r *http.Request) (string, httpService, bool, bool) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		service, ok := httpServices[r.URL.Query().Get("service")]
+		if !ok {
+			return "", httpService{}, false, false
+		}
+
+		return strings.TrimSuffix(r.URL.Path, "/info/refs"), service, true, true
+	case r.Method == http.MethodPost:
+		for name, service := range httpServices {
+			if strings.HasSuffix(r.URL.Path, "/"+name) {
+				return strings.TrimSuffix(r.URL.Path, "/"+name), service, false, true
+			}
+		}
+	}
+
+	return "", httpService{}, false, false
+}
+
+// httpRequestBody returns the body of the request, handling any content
+// encoding the git client may have used.
+func httpRequestBody(r *http.Request) (io.ReadCloser, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+
+	return r.Body, nil
+}
+
+// pktLine encodes the given string in the git pkt-line format.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
@@ -0,0 +1,234 @@
+package gitdir
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+// newTestHTTPServer starts an HTTP server using the given transport. The
+// transport has to be set before the server is started to avoid racing with
+// requests.
+func newTestHTTPServer(t *testing.T, transport Transport) (*Server, *httptest.Server) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	serv, err := NewServer(osfs.New(t.TempDir()))
+	require.Nil(t, err)
+
+	serv.Transport = transport
+
+	config := serv.GetAdminConfig()
+
+	config.Users["a-user"] = models.NewAdminConfigUser()
+	config.Users["a-user"].Tokens = []string{"a-token"}
+	config.Users["other-user"] = models.NewAdminConfigUser()
+	config.Users["other-user"].Tokens = []string{
+		// sha256 of other-token
+		"sha256:6c67163bbed989f232b31acc4f04df54b31285bfc01bd022c735b71e041a4754",
+	}
+
+	config.Repos["a-repo"] = models.NewRepoConfig()
+	config.Repos["a-repo"].Read = []string{"a-user"}
+	config.Repos["public-repo"] = models.NewRepoConfig()
+	config.Repos["public-repo"].Public = true
+
+	for _, repoName := range []string{"top-level/a-repo", "top-level/public-repo"} {
+		repo, err := git.EnsureRepo(serv.fs, repoName)
+		require.Nil(t, err)
+
+		require.Nil(t, repo.CreateFile("README.md", []byte("hello world")))
+		require.Nil(t, repo.Commit("Initial commit", nil))
+	}
+
+	httpServer := httptest.NewServer(serv.HTTPHandler())
+	t.Cleanup(httpServer.Close)
+
+	return serv, httpServer
+}
+
+func TestHTTPInfoRefs(t *testing.T) {
+	t.Parallel()
+
+	serv, httpServer := newTestHTTPServer(t, TransportExec)
+
+	var tests = []struct { //nolint:gofumpt
+		Username string
+		Token    string
+		Path     string
+		Status   int
+	}{
+		{"", "", "/a-repo/info/refs?service=git-upload-pack", http.StatusUnauthorized},
+		{"", "", "/public-repo/info/refs?service=git-upload-pack", http.StatusUnauthorized},
+		{"a-user", "a-token", "/a-repo/info/refs?service=git-upload-pack", http.StatusOK},
+		{"git", "a-token", "/a-repo.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"a-user", "wrong-token", "/a-repo/info/refs?service=git-upload-pack", http.StatusUnauthorized},
+		{"other-user", "a-token", "/a-repo/info/refs?service=git-upload-pack", http.StatusUnauthorized},
+		{"other-user", "other-token", "/a-repo/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"other-user", "other-token", "/public-repo/info/refs?service=git-upload-pack", http.StatusOK},
+		{"a-user", "a-token", "/a-repo/info/refs?service=git-receive-pack", http.StatusNotFound},
+		{"a-user", "a-token", "/missing-repo/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"a-user", "a-token", "/a-repo/info/refs?service=invalid", http.StatusNotFound},
+		{"a-user", "a-token", "/public-repo/info/refs?service=git-upload-pack", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, httpServer.URL+test.Path, nil) //nolint:noctx
+		require.Nil(t, err)
+
+		if test.Username != "" {
+			req.SetBasicAuth(test.Username, test.Token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, test.Status, resp.StatusCode, test.Path)
+
+		if test.Status == http.StatusOK {
+			assert.Equal(t, "application/x-git-upload-pack-advertisement", resp.Header.Get("Content-Type"))
+		}
+	}
+
+	// Once anonymous access is enabled, public repos should be readable
+	// without credentials.
+	serv.GetAdminConfig().Options.AnonymousRead = true
+
+	resp, err := http.Get(httpServer.URL + "/public-repo/info/refs?service=git-upload-pack") //nolint:noctx
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHTTPClone(t *testing.T) {
+	t.Parallel()
+
+	for _, transport := range []Transport{TransportExec, TransportNative} {
+		transport := transport
+
+		t.Run(string(transport), func(t *testing.T) {
+			t.Parallel()
+
+			serv, httpServer := newTestHTTPServer(t, transport)
+
+			target := filepath.Join(t.TempDir(), "a-repo")
+
+			// Note that we insert the credentials into the URL, so we don't
+			// need a credential helper.
+			url := "http://a-user:a-token@" + httpServer.Listener.Addr().String() + "/a-repo"
+
+			out, err := exec.Command("git", "clone", url, target).CombinedOutput()
+			require.Nil(t, err, string(out))
+
+			assert.FileExists(t, filepath.Join(target, "README.md"))
+
+			// Repo actions over HTTP are counted in the metrics. Protocol v2
+			// clients may make several requests for a clone.
+			metrics := serv.metrics
+			assert.Greater(t, testutil.ToFloat64(metrics.repoActions.WithLabelValues("git-upload-pack", "0")), float64(0))
+			assert.Greater(t, testutil.ToFloat64(metrics.transferBytes.WithLabelValues("git-upload-pack", "in")), float64(0))
+			assert.Greater(t, testutil.ToFloat64(metrics.transferBytes.WithLabelValues("git-upload-pack", "out")), float64(0))
+		})
+	}
+}
+
+func TestHTTPPushNative(t *testing.T) {
+	t.Parallel()
+
+	serv, httpServer := newTestHTTPServer(t, TransportNative)
+
+	// Hooks load the config from disk, so the user and repo need to be
+	// committed to the admin repo. Hooks from the config should also be run
+	// alongside the built-in hooks.
+	err := serv.updateConfig(func(c *Config) error {
+		adminRepo, err := git.EnsureRepo(c.fs, "admin/admin")
+		if err != nil {
+			return err
+		}
+
+		if err = adminRepo.Checkout(""); err != nil {
+			return err
+		}
+
+		if err = adminRepo.CreateFile("hooks/marker", []byte("#!/usr/bin/env sh\ncat >> \"$GIT_DIR/pushed\"\n")); err != nil {
+			return err
+		}
+
+		if err = adminRepo.Commit("Added hook script", nil); err != nil {
+			return err
+		}
+
+		if err = c.Load(); err != nil {
+			return err
+		}
+
+		return c.updateConfigFile("admin/admin", AnonymousUser, "Added a-user", func(targetNode *yaml.Node) error {
+			userNode := ensureNodePath(targetNode, []string{"users", "a-user"})
+			userNode.EnsureKey("is_admin", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			tokensNode, _ := userNode.EnsureKey("tokens", yaml.NewSequenceNode(), nil)
+			tokensNode.AppendNode(yaml.NewScalarNode("a-token", ""))
+			hooksNode := ensureNodePath(targetNode, []string{"repos", "a-repo", "hooks"})
+			hooksNode.EnsureKey("post-receive", newScalarSequenceNode([]string{"marker"}), nil)
+
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	target := filepath.Join(t.TempDir(), "a-repo")
+	url := "http://a-user:a-token@" + httpServer.Listener.Addr().String() + "/a-repo"
+
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = target
+		cmd.Env = append(cmd.Environ(),
+			"GIT_AUTHOR_NAME=a-user", "GIT_AUTHOR_EMAIL=a-user@localhost",
+			"GIT_COMMITTER_NAME=a-user", "GIT_COMMITTER_EMAIL=a-user@localhost",
+		)
+
+		out, err := cmd.CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+
+	out, err := exec.Command("git", "clone", url, target).CombinedOutput()
+	require.Nil(t, err, string(out))
+
+	runGit("commit", "--allow-empty", "-m", "Second commit")
+	runGit("push", "origin", "HEAD:refs/heads/master", "HEAD:refs/heads/other")
+	runGit("push", "origin", ":refs/heads/other")
+
+	pushed, err := os.ReadFile(filepath.Join(serv.fs.Root(), "top-level", "a-repo.git", "pushed"))
+	require.Nil(t, err)
+	assert.Contains(t, string(pushed), " refs/heads/other\n")
+	assert.Len(t, strings.Split(strings.TrimSpace(string(pushed)), "\n"), 3)
+
+	repo, err := git.Open(serv.fs, "top-level/a-repo")
+	require.Nil(t, err)
+
+	head, err := repo.Repo.Reference("refs/heads/master", false)
+	require.Nil(t, err)
+
+	commit, err := repo.Repo.CommitObject(head.Hash())
+	require.Nil(t, err)
+	assert.Equal(t, "Second commit\n", commit.Message)
+
+	_, err = repo.Repo.Reference("refs/heads/other", false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,875 @@
+package gitdir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+const (
+	gitoliteConfFile  = "conf/gitolite.conf"
+	gitoliteKeyDir    = "keydir"
+	gitoliteAdminRepo = "gitolite-admin"
+	gitoliteAll       = "@all"
+
+	// gitoliteMaxIncludeDepth stops include loops from recursing forever.
+	gitoliteMaxIncludeDepth = 10
+)
+
+// Gitolite permissions, ordered so a higher value grants more access.
+const (
+	gitolitePermRead = iota + 1
+	gitolitePermWrite
+	gitolitePermRewind
+)
+
+var (
+	gitoliteRuleRegexp = regexp.MustCompile(`^(-|C|R|RW\+?)(C?D?M?)$`)
+
+	// gitoliteRepoNameRegexp matches plain repo names. Anything else is a
+	// pattern for wild repos.
+	gitoliteRepoNameRegexp = regexp.MustCompile(`^[\w.@+-][\w./@+-]*$`)
+
+	// gitoliteRefexRegexp matches refexes which can be translated to a glob.
+	// Dots are treated as literal dots, which is stricter than gitolite.
+	gitoliteRefexRegexp = regexp.MustCompile(`^[\w./-]*(\.\*)?\$?$`)
+)
+
+// GitoliteImport describes the result of importing a gitolite installation.
+type GitoliteImport struct {
+	// Repos are the names of the repos which were copied into the top-level
+	// layout.
+	Repos []string
+
+	// Users are the names of all the users which were added to the admin
+	// config.
+	Users []string
+
+	// Warnings describe anything which could not be translated.
+	Warnings []string
+}
+
+func (gi *GitoliteImport) warnf(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+
+	if !listContainsStr(gi.Warnings, warning) {
+		gi.Warnings = append(gi.Warnings, warning)
+	}
+}
+
+type gitoliteRule struct {
+	Pos     string
+	Perm    string
+	Refexes []string
+	Members []string
+}
+
+type gitoliteRepo struct {
+	Name  string
+	Rules []*gitoliteRule
+}
+
+// gitoliteConf is the parsed form of a gitolite.conf. Only the parts which
+// gitdir can represent are kept.
+type gitoliteConf struct {
+	Groups    map[string][]string
+	Repos     map[string]*gitoliteRepo
+	RepoOrder []string
+}
+
+// ImportGitolite imports a gitolite installation, given the gitolite-admin
+// checkout and the directory containing the bare repos. The repos are copied
+// into the top-level layout, or moved if move is set, and the repos, groups,
+// rules and keys are added to the admin config.
+func (c *Config) ImportGitolite(adminFS, reposFS billy.Filesystem, move bool) (*GitoliteImport, error) {
+	ret := &GitoliteImport{}
+
+	conf, err := parseGitoliteConf(adminFS, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := readGitoliteKeyDir(adminFS, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	repoDirs, err := c.findGitoliteRepos(reposFS, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range repoDirs {
+		if git.Exists(c.fs, path.Join("top-level", name)) {
+			return nil, fmt.Errorf("%s: repo already exists", name)
+		}
+	}
+
+	for _, name := range repoDirs {
+		err = importGitoliteRepo(c.fs, reposFS, name, move)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		ret.Repos = append(ret.Repos, name)
+	}
+
+	err = c.updateConfigFile("admin/admin", AnonymousUser, "Imported gitolite config", func(targetNode *yaml.Node) error {
+		c.translateGitoliteConf(targetNode, conf, keys, ret)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// parseGitoliteConf parses the gitolite.conf in the admin checkout, following
+// any includes.
+func parseGitoliteConf(fs billy.Filesystem, gi *GitoliteImport) (*gitoliteConf, error) {
+	conf := &gitoliteConf{
+		Groups: make(map[string][]string),
+		Repos:  make(map[string]*gitoliteRepo),
+	}
+
+	return conf, conf.parseFile(fs, gitoliteConfFile, 0, gi)
+}
+
+func (conf *gitoliteConf) parseFile(fs billy.Filesystem, filename string, depth int, gi *GitoliteImport) error {
+	data, err := util.ReadFile(fs, filename)
+	if err != nil {
+		return err
+	}
+
+	var current []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		pos := fmt.Sprintf("%s:%d", filename, lineNum)
+
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "include" && len(fields) == 2:
+			err = conf.parseInclude(fs, filename, strings.Trim(fields[1], `"'`), depth, gi)
+			if err != nil {
+				return err
+			}
+		case fields[0] == "repo":
+			current = conf.parseRepoLine(pos, fields[1:], gi)
+		case fields[0] == "option" || fields[0] == "config" || fields[0] == "subconf":
+			gi.warnf("%s: %s lines are not supported", pos, fields[0])
+		case strings.HasPrefix(fields[0], "@") && len(fields) > 1 && fields[1] == "=":
+			name := strings.TrimPrefix(fields[0], "@")
+			conf.Groups[name] = append(conf.Groups[name], fields[2:]...)
+		default:
+			conf.parseRuleLine(pos, current, line, gi)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (conf *gitoliteConf) parseInclude(
+	fs billy.Filesystem,
+	filename string,
+	pattern string,
+	depth int,
+	gi *GitoliteImport,
+) error {
+	if depth >= gitoliteMaxIncludeDepth {
+		return fmt.Errorf("%s: includes nested too deeply", filename)
+	}
+
+	matches, err := util.Glob(fs, path.Join(path.Dir(gitoliteConfFile), pattern))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(matches)
+
+	for _, match := range matches {
+		err = conf.parseFile(fs, match, depth+1, gi)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseRepoLine returns the names of the repos a repo line refers to,
+// expanding any repo groups.
+func (conf *gitoliteConf) parseRepoLine(pos string, names []string, gi *GitoliteImport) []string {
+	ret := []string{}
+
+	for _, name := range conf.expandRepoNames(names, make(map[string]bool)) {
+		if name != gitoliteAll && !gitoliteRepoNameRegexp.MatchString(name) {
+			gi.warnf("%s: wild repo %q is not supported", pos, name)
+			continue
+		}
+
+		if _, ok := conf.Repos[name]; !ok {
+			conf.Repos[name] = &gitoliteRepo{Name: name}
+
+			if name != gitoliteAll {
+				conf.RepoOrder = append(conf.RepoOrder, name)
+			}
+		}
+
+		ret = append(ret, name)
+	}
+
+	return ret
+}
+
+func (conf *gitoliteConf) expandRepoNames(names []string, seen map[string]bool) []string {
+	var ret []string
+
+	for _, name := range names {
+		if name == gitoliteAll || !strings.HasPrefix(name, "@") {
+			ret = append(ret, name)
+			continue
+		}
+
+		group := strings.TrimPrefix(name, "@")
+		if !seen[group] {
+			seen[group] = true
+			ret = append(ret, conf.expandRepoNames(conf.Groups[group], seen)...)
+		}
+	}
+
+	return ret
+}
+
+func (conf *gitoliteConf) parseRuleLine(pos string, current []string, line string, gi *GitoliteImport) {
+	parts := strings.SplitN(line, "=", 2)
+	left := strings.Fields(parts[0])
+
+	if len(parts) != 2 || len(left) == 0 || !gitoliteRuleRegexp.MatchString(left[0]) {
+		gi.warnf("%s: unrecognized line %q", pos, strings.TrimSpace(line))
+		return
+	}
+
+	// Rules for repos which were skipped have already been reported.
+	if current == nil {
+		gi.warnf("%s: rule outside of a repo block", pos)
+		return
+	} else if len(current) == 0 {
+		return
+	}
+
+	rule := &gitoliteRule{
+		Pos:     pos,
+		Perm:    left[0],
+		Refexes: left[1:],
+		Members: strings.Fields(parts[1]),
+	}
+
+	for _, name := range current {
+		conf.Repos[name].Rules = append(conf.Repos[name].Rules, rule)
+	}
+}
+
+// readGitoliteKeyDir reads all the keys in the keydir, including any
+// subdirectories, and returns them by username.
+func readGitoliteKeyDir(fs billy.Filesystem, gi *GitoliteImport) (map[string][]*models.PublicKey, error) {
+	keys := make(map[string][]*models.PublicKey)
+
+	err := util.Walk(fs, gitoliteKeyDir, func(filename string, info os.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) && filename == gitoliteKeyDir {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(filename, ".pub") {
+			return nil
+		}
+
+		username := gitoliteKeyUsername(path.Base(filename))
+
+		data, err := util.ReadFile(fs, filename)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			pk, err := models.ParsePublicKey([]byte(line))
+			if err != nil {
+				gi.warnf("%s: invalid key: %s", filename, err)
+				continue
+			}
+
+			keys[username] = append(keys[username], pk)
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
+
+// gitoliteKeyUsername returns the user a key file belongs to. As with
+// gitolite, a suffix starting with @ is ignored unless it looks like the
+// domain of an email address, so alice@laptop.pub belongs to alice.
+func gitoliteKeyUsername(filename string) string {
+	username := strings.TrimSuffix(filename, ".pub")
+
+	if idx := strings.LastIndex(username, "@"); idx != -1 && !strings.Contains(username[idx+1:], ".") {
+		username = username[:idx]
+	}
+
+	return username
+}
+
+// findGitoliteRepos returns the names of all the bare repos in the gitolite
+// repositories dir which can be imported as top level repos.
+func (c *Config) findGitoliteRepos(fs billy.Filesystem, gi *GitoliteImport) ([]string, error) {
+	var ret []string
+
+	err := util.Walk(fs, "/", func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() || !strings.HasSuffix(filename, ".git") {
+			return nil
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.ToSlash(filename), "/"), ".git")
+
+		if name != gitoliteAdminRepo {
+			if lookup, err := c.parseRepoPath(name); err != nil || lookup.Type != RepoTypeTopLevel {
+				gi.warnf("%s: repo can't be imported as a top level repo", name)
+			} else {
+				ret = append(ret, name)
+			}
+		}
+
+		return filepath.SkipDir
+	})
+
+	sort.Strings(ret)
+
+	return ret, err
+}
+
+// importGitoliteRepo copies a bare repo into the top-level layout and
+// installs the gitdir hooks. Gitolite's hooks are not copied.
+func importGitoliteRepo(fs, reposFS billy.Filesystem, name string, move bool) error {
+	src := name + ".git"
+	dst := path.Join("top-level", name+".git")
+
+	err := util.Walk(reposFS, src, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, filename)
+		if err != nil {
+			return err
+		}
+
+		if rel == "hooks" {
+			return filepath.SkipDir
+		}
+
+		target := path.Join(dst, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return fs.MkdirAll(target, info.Mode())
+		}
+
+		return copyFile(fs, reposFS, target, filename, info.Mode())
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = git.EnsureRepo(fs, dst)
+	if err != nil {
+		return err
+	}
+
+	if move {
+		return util.RemoveAll(reposFS, src)
+	}
+
+	return nil
+}
+
+// translateGitoliteConf adds the users, groups and repos from the gitolite
+// config to the admin config.
+func (c *Config) translateGitoliteConf(
+	targetNode *yaml.Node,
+	conf *gitoliteConf,
+	keys map[string][]*models.PublicKey,
+	gi *GitoliteImport,
+) {
+	t := &gitoliteTranslator{
+		conf:   conf,
+		gi:     gi,
+		users:  make(map[string]bool),
+		groups: make(map[string][]string),
+		admins: make(map[string]bool),
+	}
+
+	for username := range keys {
+		t.users[username] = true
+	}
+
+	reposNode := ensureNodePath(targetNode, []string{"repos"})
+
+	for _, name := range conf.RepoOrder {
+		repo := conf.Repos[name]
+
+		var rules []*gitoliteRule
+		if all, ok := conf.Repos[gitoliteAll]; ok {
+			rules = append(rules, all.Rules...)
+		}
+
+		rules = append(rules, repo.Rules...)
+
+		if name == gitoliteAdminRepo {
+			t.translateAdminRules(rules)
+			continue
+		}
+
+		if lookup, err := c.parseRepoPath(name); err != nil || lookup.Type != RepoTypeTopLevel {
+			gi.warnf("%s: repo can't be imported as a top level repo", name)
+			continue
+		}
+
+		reposNode.EnsureKey(name, gitoliteRepoNode(t.translateRepo(name, rules)), &yaml.EnsureOptions{Force: true})
+	}
+
+	groupsNode := ensureNodePath(targetNode, []string{"groups"})
+
+	for _, name := range sortedKeys(t.groups) {
+		groupNode, _ := groupsNode.EnsureKey(name, yaml.NewSequenceNode(), nil)
+
+		for _, member := range t.groups[name] {
+			groupNode.AppendUniqueScalar(yaml.NewScalarNode(member, ""))
+		}
+	}
+
+	usersNode := ensureNodePath(targetNode, []string{"users"})
+
+	for _, username := range sortedKeys(t.users) {
+		userNode := ensureNodePath(usersNode, []string{username})
+
+		if t.admins[username] {
+			userNode.EnsureKey("is_admin", yaml.NewScalarNode("true", yaml.ScalarTagBool), &yaml.EnsureOptions{Force: true})
+		}
+
+		keysNode, _ := userNode.EnsureKey("keys", yaml.NewSequenceNode(), nil)
+
+		for _, pk := range keys[username] {
+			keysNode.AppendUniqueScalar(yaml.NewScalarNode(pk.MarshalAuthorizedKey(), ""))
+		}
+
+		if len(keys[username]) == 0 {
+			gi.warnf("%s: user has no keys in the keydir", username)
+		}
+
+		gi.Users = append(gi.Users, username)
+	}
+}
+
+type gitoliteTranslator struct {
+	conf   *gitoliteConf
+	gi     *GitoliteImport
+	users  map[string]bool
+	groups map[string][]string
+	admins map[string]bool
+}
+
+// member translates a gitolite user or group, recording it so it's added to
+// the admin config. It returns false if the member can't be represented.
+func (t *gitoliteTranslator) member(pos, member string) (string, bool) {
+	switch {
+	case member == gitoliteAll:
+		return member, true
+	case member == "gitweb" || member == "daemon":
+		t.gi.warnf("%s: access for %s is not supported", pos, member)
+		return "", false
+	case strings.HasPrefix(member, "@"):
+		name := strings.TrimPrefix(member, "@")
+		t.addGroup(pos, name)
+
+		return groupPrefix + name, true
+	default:
+		t.users[member] = true
+		return member, true
+	}
+}
+
+func (t *gitoliteTranslator) addGroup(pos, name string) {
+	if _, ok := t.groups[name]; ok {
+		return
+	}
+
+	t.groups[name] = nil
+
+	if _, ok := t.conf.Groups[name]; !ok {
+		t.gi.warnf("%s: group @%s is not defined", pos, name)
+	}
+
+	var members []string
+
+	for _, member := range t.conf.Groups[name] {
+		if member == gitoliteAll {
+			t.gi.warnf("%s: @all can't be a member of group @%s", pos, name)
+			continue
+		}
+
+		member, ok := t.member(pos, member)
+		if ok {
+			members = append(members, member)
+		}
+	}
+
+	t.groups[name] = members
+}
+
+// translateAdminRules makes everyone with write access to the gitolite-admin
+// repo an admin, as gitdir's admin repo replaces it.
+func (t *gitoliteTranslator) translateAdminRules(rules []*gitoliteRule) {
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Perm, "RW") {
+			continue
+		}
+
+		for _, member := range rule.Members {
+			for _, username := range t.expandUsers(member, make(map[string]bool)) {
+				t.users[username] = true
+				t.admins[username] = true
+			}
+		}
+	}
+}
+
+func (t *gitoliteTranslator) expandUsers(member string, seen map[string]bool) []string {
+	if !strings.HasPrefix(member, "@") {
+		return []string{member}
+	}
+
+	name := strings.TrimPrefix(member, "@")
+	if seen[name] {
+		return nil
+	}
+
+	seen[name] = true
+
+	var ret []string
+
+	for _, member := range t.conf.Groups[name] {
+		ret = append(ret, t.expandUsers(member, seen)...)
+	}
+
+	return ret
+}
+
+type gitoliteRefRule struct {
+	Pattern string
+	Perms   map[string]int
+}
+
+// translateRepo converts the rules for a single repo. Read access ignores
+// refexes, as it does in gitolite.
+func (t *gitoliteTranslator) translateRepo(name string, rules []*gitoliteRule) *models.RepoConfig { //nolint:funlen,cyclop
+	var (
+		repoConfig = models.NewRepoConfig()
+		repoPerms  = make(map[string]int)
+		refRules   []*gitoliteRefRule
+		refMembers = make(map[string]bool)
+	)
+
+	for _, rule := range rules {
+		matches := gitoliteRuleRegexp.FindStringSubmatch(rule.Perm)
+		perm := matches[1]
+
+		switch perm {
+		case "-":
+			t.gi.warnf("%s: %s: deny rules are not supported", rule.Pos, name)
+			continue
+		case "C":
+			t.gi.warnf("%s: %s: creating wild repos is not supported", rule.Pos, name)
+			continue
+		}
+
+		if matches[2] != "" {
+			t.gi.warnf("%s: %s: permission modifiers are not supported, treating %s as %s",
+				rule.Pos, name, rule.Perm, perm)
+		}
+
+		level := map[string]int{"R": gitolitePermRead, "RW": gitolitePermWrite, "RW+": gitolitePermRewind}[perm]
+
+		var members []string
+
+		for _, member := range rule.Members {
+			member, ok := t.member(rule.Pos, member)
+			if !ok {
+				continue
+			}
+
+			if member == gitoliteAll && level > gitolitePermRead {
+				t.gi.warnf("%s: %s: write access for @all is not supported", rule.Pos, name)
+				continue
+			}
+
+			members = append(members, member)
+		}
+
+		if len(rule.Refexes) == 0 || level == gitolitePermRead {
+			for _, member := range members {
+				if repoPerms[member] < level {
+					repoPerms[member] = level
+				}
+			}
+
+			continue
+		}
+
+		for _, refex := range rule.Refexes {
+			pattern, ok := gitoliteRefexPattern(refex)
+			if !ok {
+				t.gi.warnf("%s: %s: refex %q can't be translated to a ref pattern", rule.Pos, name, refex)
+				continue
+			}
+
+			refRule := findGitoliteRefRule(refRules, pattern)
+			if refRule == nil {
+				refRule = &gitoliteRefRule{Pattern: pattern, Perms: make(map[string]int)}
+				refRules = append(refRules, refRule)
+			}
+
+			for _, member := range members {
+				refMembers[member] = true
+
+				if refRule.Perms[member] < level {
+					refRule.Perms[member] = level
+				}
+			}
+		}
+	}
+
+	var rewinders, writers []string
+
+	for _, member := range sortedPermKeys(repoPerms) {
+		switch repoPerms[member] {
+		case gitolitePermRead:
+			if member == gitoliteAll {
+				t.gi.warnf("%s: read access for @all makes the repo public, so anonymous users can read it if anonymous_read is enabled",
+					name)
+				repoConfig.Public = true
+			} else {
+				repoConfig.Read = append(repoConfig.Read, member)
+			}
+		case gitolitePermWrite:
+			writers = append(writers, member)
+		case gitolitePermRewind:
+			rewinders = append(rewinders, member)
+		}
+	}
+
+	repoConfig.Write = append(repoConfig.Write, writers...)
+	repoConfig.Write = append(repoConfig.Write, rewinders...)
+	sort.Strings(repoConfig.Write)
+
+	// Members who can only push to some refs still need write access to the
+	// repo, which lets them push to any ref not covered by a rule.
+	for _, member := range sortedKeys(refMembers) {
+		if repoPerms[member] < gitolitePermWrite {
+			t.gi.warnf("%s: %s can only push to some refs, but was given write access to the whole repo", name, member)
+			repoConfig.Write = append(repoConfig.Write, member)
+		}
+	}
+
+	for _, refRule := range refRules {
+		rewind := true
+
+		for member, level := range repoPerms {
+			if level > gitolitePermRead {
+				refRule.Perms[member] = level
+			}
+		}
+
+		for _, level := range refRule.Perms {
+			rewind = rewind && level == gitolitePermRewind
+		}
+
+		repoConfig.Refs = append(repoConfig.Refs, &models.RefRule{
+			Pattern:        refRule.Pattern,
+			Write:          sortedPermKeys(refRule.Perms),
+			AllowForcePush: rewind,
+			AllowDelete:    rewind,
+		})
+	}
+
+	// Without RW+, force pushes and deletes need to be blocked, which can
+	// only be done for everyone who can write to the repo.
+	if len(writers) > 0 {
+		if len(rewinders) > 0 {
+			t.gi.warnf("%s: force pushes can't be limited to some users, so %s can no longer force push",
+				name, strings.Join(rewinders, ", "))
+		}
+
+		for _, pattern := range []string{"refs/heads/**", "refs/tags/**"} {
+			if findGitoliteRefRule(refRules, pattern) == nil {
+				repoConfig.Refs = append(repoConfig.Refs, &models.RefRule{Pattern: pattern})
+			}
+		}
+	}
+
+	return repoConfig
+}
+
+func findGitoliteRefRule(refRules []*gitoliteRefRule, pattern string) *gitoliteRefRule {
+	for _, refRule := range refRules {
+		if refRule.Pattern == pattern {
+			return refRule
+		}
+	}
+
+	return nil
+}
+
+// gitoliteRefexPattern converts a gitolite refex to a ref rule pattern. Only
+// literal refs and prefixes ending in a / are supported. Prefixes become
+// recursive patterns so nested refs are still covered. Note that gitolite
+// refexes match any ref starting with them, so the pattern is stricter.
+func gitoliteRefexPattern(refex string) (string, bool) {
+	if !gitoliteRefexRegexp.MatchString(refex) {
+		return "", false
+	}
+
+	refex = strings.TrimSuffix(refex, "$")
+	refex = strings.TrimSuffix(refex, ".*")
+
+	if refex == "" {
+		return "", false
+	}
+
+	if !strings.HasPrefix(refex, "refs/") {
+		refex = "refs/heads/" + refex
+	}
+
+	if strings.HasSuffix(refex, "/") {
+		refex += "**"
+	}
+
+	return refex, true
+}
+
+func gitoliteRepoNode(repoConfig *models.RepoConfig) *yaml.Node {
+	repoNode := yaml.NewMappingNode()
+
+	if repoConfig.Public {
+		repoNode.EnsureKey("public", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+	}
+
+	if len(repoConfig.Write) > 0 {
+		repoNode.EnsureKey("write", newScalarSequenceNode(repoConfig.Write), nil)
+	}
+
+	if len(repoConfig.Read) > 0 {
+		repoNode.EnsureKey("read", newScalarSequenceNode(repoConfig.Read), nil)
+	}
+
+	if len(repoConfig.Refs) > 0 {
+		refsNode, _ := repoNode.EnsureKey("refs", yaml.NewSequenceNode(), nil)
+
+		for _, rule := range repoConfig.Refs {
+			ruleNode := yaml.NewMappingNode()
+			ruleNode.EnsureKey("pattern", yaml.NewScalarNode(rule.Pattern, ""), nil)
+
+			if len(rule.Write) > 0 {
+				ruleNode.EnsureKey("write", newScalarSequenceNode(rule.Write), nil)
+			}
+
+			if rule.AllowForcePush {
+				ruleNode.EnsureKey("allow_force_push", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			}
+
+			if rule.AllowDelete {
+				ruleNode.EnsureKey("allow_delete", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			}
+
+			refsNode.AppendNode(ruleNode)
+		}
+	}
+
+	return repoNode
+}
+
+func newScalarSequenceNode(values []string) *yaml.Node {
+	node := yaml.NewSequenceNode()
+
+	for _, value := range values {
+		node.AppendNode(yaml.NewScalarNode(value, ""))
+	}
+
+	return node
+}
+
+func sortedKeys(m interface{}) []string {
+	var ret []string
+
+	switch m := m.(type) {
+	case map[string]bool:
+		for key := range m {
+			ret = append(ret, key)
+		}
+	case map[string][]string:
+		for key := range m {
+			ret = append(ret, key)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+func sortedPermKeys(perms map[string]int) []string {
+	ret := make([]string, 0, len(perms))
+
+	for key := range perms {
+		ret = append(ret, key)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
@@ -0,0 +1,173 @@
+package gitdir
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+var testGitoliteConf = `
+@admins    = alice
+@devs      = @admins bob
+@libraries = lib-a lib-b
+
+repo gitolite-admin
+    RW+ = @admins
+
+repo testing
+    RW+ = @all
+
+repo app
+    RW+         = @admins
+    RW          = bob
+    RW  release = carol
+    R           = dave
+    -   secret  = bob
+
+repo @libraries
+    RW  = @devs
+    R   = @all
+
+repo foo/..*
+    C   = @devs
+
+include "extra.conf"
+`
+
+var testGitoliteExtraConf = `
+repo lib-a
+    RW+ refs/tags/v[0-9] = alice
+    option deny-rules = 1
+`
+
+func TestGitoliteRefexPattern(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct { //nolint:gofumpt
+		Input    string
+		Expected string
+		OK       bool
+	}{
+		{"master", "refs/heads/master", true},
+		{"master$", "refs/heads/master", true},
+		{"dev/", "refs/heads/dev/**", true},
+		{"dev/.*", "refs/heads/dev/**", true},
+		{"refs/tags/", "refs/tags/**", true},
+		{"refs/tags/v1.0", "refs/tags/v1.0", true},
+		{"refs/tags/v[0-9]", "", false},
+		{"(dev|test)", "", false},
+		{".*", "", false},
+	}
+
+	for _, test := range tests {
+		pattern, ok := gitoliteRefexPattern(test.Input)
+		assert.Equal(t, test.OK, ok, test.Input)
+		assert.Equal(t, test.Expected, pattern, test.Input)
+	}
+}
+
+func TestGitoliteKeyUsername(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "alice", gitoliteKeyUsername("alice.pub"))
+	assert.Equal(t, "alice", gitoliteKeyUsername("alice@laptop.pub"))
+	assert.Equal(t, "alice@example.com", gitoliteKeyUsername("alice@example.com.pub"))
+	assert.Equal(t, "alice@example.com", gitoliteKeyUsername("alice@example.com@laptop.pub"))
+}
+
+func TestImportGitolite(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	adminFS := memfs.New()
+	require.Nil(t, util.WriteFile(adminFS, "conf/gitolite.conf", []byte(testGitoliteConf), 0o644))
+	require.Nil(t, util.WriteFile(adminFS, "conf/extra.conf", []byte(testGitoliteExtraConf), 0o644))
+	require.Nil(t, util.WriteFile(adminFS, "keydir/alice.pub", []byte(testAuthKey+"\n"), 0o644))
+	require.Nil(t, util.WriteFile(adminFS, "keydir/laptop/alice@laptop.pub", []byte(testAuthOtherKey+"\n"), 0o644))
+	require.Nil(t, util.WriteFile(adminFS, "keydir/bob.pub", []byte("# bob's key\n\n"+testAuthKey+" bob\n"), 0o644))
+
+	reposFS := osfs.New(t.TempDir())
+
+	for _, name := range []string{"gitolite-admin", "app", "lib-a", "team/nested"} {
+		_, err := git.EnsureRepo(reposFS, name)
+		require.Nil(t, err)
+	}
+
+	c := NewConfig(osfs.New(t.TempDir()))
+	require.Nil(t, c.EnsureConfig())
+
+	result, err := c.ImportGitolite(adminFS, reposFS, true)
+	require.Nil(t, err)
+
+	require.Nil(t, c.Load())
+
+	assert.Equal(t, []string{"app", "lib-a"}, result.Repos)
+	assert.True(t, git.Exists(c.fs, "top-level/app"))
+	assert.True(t, git.Exists(c.fs, "top-level/lib-a"))
+	assert.False(t, git.Exists(reposFS, "app"))
+	assert.True(t, git.Exists(reposFS, "team/nested"))
+
+	assert.Equal(t, []string{"alice", "bob", "carol", "dave"}, result.Users)
+	assert.True(t, c.Users["alice"].IsAdmin)
+	assert.False(t, c.Users["bob"].IsAdmin)
+	assert.Len(t, c.Users["alice"].Keys, 2)
+	assert.Len(t, c.Users["bob"].Keys, 1)
+
+	assert.Equal(t, map[string][]string{
+		"admins": {"alice"},
+		"devs":   {"$admins", "bob"},
+	}, c.Groups)
+
+	assert.Equal(t, &models.RepoConfig{
+		Write: []string{"$admins", "bob", "carol"},
+		Read:  []string{"dave"},
+		Refs: []*models.RefRule{
+			{Pattern: "refs/heads/release", Write: []string{"$admins", "bob", "carol"}},
+			{Pattern: "refs/heads/**"},
+			{Pattern: "refs/tags/**"},
+		},
+	}, c.Repos["app"])
+
+	assert.Equal(t, &models.RepoConfig{
+		Public: true,
+		Write:  []string{"$devs"},
+		Refs: []*models.RefRule{
+			{Pattern: "refs/heads/**"},
+			{Pattern: "refs/tags/**"},
+		},
+	}, c.Repos["lib-b"])
+
+	assert.NotContains(t, c.Repos, "gitolite-admin")
+
+	for _, expected := range []string{
+		"write access for @all is not supported",
+		"lib-b: read access for @all makes the repo public",
+		"carol can only push to some refs",
+		"so $admins can no longer force push",
+		"deny rules are not supported",
+		`wild repo "foo/..*" is not supported`,
+		`refex "refs/tags/v[0-9]" can't be translated`,
+		"conf/extra.conf:4: option lines are not supported",
+		"team/nested: repo can't be imported as a top level repo",
+		"carol: user has no keys in the keydir",
+	} {
+		found := false
+
+		for _, warning := range result.Warnings {
+			found = found || strings.Contains(warning, expected)
+		}
+
+		assert.True(t, found, "missing warning %q in %v", expected, result.Warnings)
+	}
+
+	// Importing again would overwrite the imported repos.
+	_, err = c.ImportGitolite(adminFS, osfs.New(c.fs.Root()+"/top-level"), false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,161 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+)
+
+const bundleSignature = "# v2 git bundle\n"
+
+// ErrInvalidBundle is returned when reading something which isn't a v2 git
+// bundle.
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// ErrMissingPrerequisite is returned when reading a bundle which needs
+// objects the repo doesn't have.
+var ErrMissingPrerequisite = errors.New("missing prerequisite")
+
+// WriteBundle writes a git bundle containing the given refs to w. Objects
+// reachable from the prerequisites are left out, so the bundle can only be
+// read into a repo which already has them. Prerequisites which aren't in the
+// repo are ignored.
+func (r *Repository) WriteBundle(w io.Writer, refs []*plumbing.Reference, prerequisites []plumbing.Hash) error {
+	// Bundles can only use commits as prerequisites, so tags are peeled.
+	var commits []plumbing.Hash
+
+	for _, hash := range prerequisites {
+		commit, err := r.peelToCommit(hash)
+		if err == nil {
+			commits = append(commits, commit)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+
+	_, _ = bw.WriteString(bundleSignature)
+
+	for _, hash := range commits {
+		_, _ = fmt.Fprintf(bw, "-%s\n", hash)
+	}
+
+	wants := make([]plumbing.Hash, 0, len(refs))
+
+	for _, ref := range refs {
+		_, _ = fmt.Fprintf(bw, "%s %s\n", ref.Hash(), ref.Name())
+
+		wants = append(wants, ref.Hash())
+	}
+
+	_, _ = bw.WriteString("\n")
+
+	haveObjects, err := revlist.Objects(r.Repo.Storer, commits, nil)
+	if err != nil {
+		return err
+	}
+
+	objects, err := revlist.Objects(r.Repo.Storer, wants, haveObjects)
+	if err != nil {
+		return err
+	}
+
+	encoder := packfile.NewEncoder(bw, r.Repo.Storer, false)
+
+	_, err = encoder.Encode(objects, packWindow)
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func (r *Repository) peelToCommit(hash plumbing.Hash) (plumbing.Hash, error) {
+	obj, err := r.Repo.Object(plumbing.AnyObject, hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	for {
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o.Hash, nil
+		case *object.Tag:
+			obj, err = o.Object()
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+		default:
+			return plumbing.ZeroHash, plumbing.ErrObjectNotFound
+		}
+	}
+}
+
+// ReadBundle reads a git bundle from in, adds all of its objects to the repo
+// and returns the refs it contains. The refs in the repo are not changed.
+func (r *Repository) ReadBundle(in io.Reader) ([]*plumbing.Reference, error) {
+	br := bufio.NewReader(in)
+
+	signature, err := br.ReadString('\n')
+	if err != nil || signature != bundleSignature {
+		return nil, ErrInvalidBundle
+	}
+
+	var refs []*plumbing.Reference
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+
+		// Prerequisites may have a comment after the hash.
+		if strings.HasPrefix(line, "-") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("%w: malformed prerequisite %q", ErrInvalidBundle, line)
+			}
+
+			hash := plumbing.NewHash(fields[0])
+			if r.Repo.Storer.HasEncodedObject(hash) != nil {
+				return nil, fmt.Errorf("%w: %s", ErrMissingPrerequisite, hash)
+			}
+
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: malformed ref %q", ErrInvalidBundle, line)
+		}
+
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(parts[1]), plumbing.NewHash(parts[0])))
+	}
+
+	w, err := r.storage.PackfileWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(w, br)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,345 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// DefaultHookTimeout is how long each hook may run for if no timeout is given.
+const DefaultHookTimeout = 5 * time.Minute
+
+// HookDirEnv is set to the hook directory being run for every hook started by
+// RunHooks. This lets gitdir tell when it is being called as one of the hooks
+// rather than as the dispatcher.
+const HookDirEnv = "GITDIR_HOOK_DIR"
+
+// customHookPrefix is added to the names of hooks installed by InstallHooks
+// so they can be told apart from hooks added by other means.
+const customHookPrefix = "config-"
+
+// hookTemplate is written to hooks/<name> and hands the hook off to gitdir,
+// which runs everything in hooks/<name>.d.
+const hookTemplate = `#!/usr/bin/env sh
+exec %q hook %s "$@"
+`
+
+var hooks = []struct {
+	Name               string
+	GitdirHookTemplate string
+}{
+	{
+		Name: "pre-receive",
+		GitdirHookTemplate: `#!/usr/bin/env sh
+
+if [ -z "$GITDIR_BASE_DIR" ]; then
+	echo "Warning: GITDIR_BASE_DIR not defined. Skipping hooks."
+	exit 0
+fi
+
+%q hook pre-receive
+`,
+	},
+	{
+		Name: "update",
+		GitdirHookTemplate: `#!/usr/bin/env sh
+
+if [ -z "$GITDIR_BASE_DIR" ]; then
+	echo "Warning: GITDIR_BASE_DIR not defined. Skipping hooks."
+	exit 0
+fi
+
+%q hook update $1 $2 $3
+`,
+	},
+	{
+		Name: "post-receive",
+		GitdirHookTemplate: `#!/usr/bin/env sh
+
+if [ -z "$GITDIR_BASE_DIR" ]; then
+	echo "Warning: GITDIR_BASE_DIR not defined. Skipping hooks."
+	exit 0
+fi
+
+%q hook post-receive
+`,
+	},
+}
+
+func ensureHooks(fs billy.Filesystem) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		err := fs.MkdirAll("hooks/"+hook.Name+".d", os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		// Write the gitdir hook
+		err = writeIfDifferent(
+			fs,
+			"hooks/"+hook.Name+".d/gitdir",
+			[]byte(fmt.Sprintf(hook.GitdirHookTemplate, exe)),
+		)
+		if err != nil {
+			return err
+		}
+
+		// Write out the actual hook
+		//
+		// TODO: warn when this would clobber a file
+		err = writeIfDifferent(fs, "hooks/"+hook.Name, []byte(fmt.Sprintf(hookTemplate, exe, hook.Name)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HookNames returns the names of all the git hooks which can have extra hooks
+// installed.
+func HookNames() []string {
+	ret := make([]string, 0, len(hooks))
+
+	for _, hook := range hooks {
+		ret = append(ret, hook.Name)
+	}
+
+	return ret
+}
+
+// CustomHook is an extra hook script to install in a repo.
+type CustomHook struct {
+	Name   string
+	Script []byte
+}
+
+// InstallHooks installs the given hooks into the hook directories of the repo
+// at the given path, keyed by the git hook they should be run for. Any hooks
+// previously installed by InstallHooks which aren't given are removed.
+func InstallHooks(baseFS billy.Filesystem, path string, customHooks map[string][]CustomHook) error {
+	// This lets us sanitize the path and ensure it always has .git on the end.
+	path = strings.TrimSuffix(path, ".git") + ".git"
+
+	fs, err := baseFS.Chroot(path)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		hookDir := "hooks/" + hook.Name + ".d"
+
+		err := fs.MkdirAll(hookDir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		installed := make(map[string]bool)
+
+		for _, customHook := range customHooks[hook.Name] {
+			name := customHookPrefix + customHook.Name
+
+			err = writeIfDifferent(fs, hookDir+"/"+name, customHook.Script)
+			if err != nil {
+				return err
+			}
+
+			installed[name] = true
+		}
+
+		entries, err := fs.ReadDir(hookDir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), customHookPrefix) || installed[entry.Name()] {
+				continue
+			}
+
+			err = fs.Remove(hookDir + "/" + entry.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// HookFailure is a single hook which failed.
+type HookFailure struct {
+	Hook string
+	Err  error
+}
+
+// HookError is returned by RunHooks with every hook which failed.
+type HookError []HookFailure
+
+func (e HookError) Error() string {
+	var b strings.Builder
+
+	for _, failure := range e {
+		fmt.Fprintf(&b, "hook %s failed: %s\n", failure.Hook, failure.Err)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// HookDir returns the directory containing the hooks with the given name for
+// the repo at gitDir.
+func HookDir(gitDir, name string) string {
+	return filepath.Join(gitDir, "hooks", name+".d")
+}
+
+// RunHooks runs every executable in the hook directory for the given hook in
+// order. Every hook gets the same args and a copy of stdin and is killed if it
+// runs longer than the timeout. All the hooks are run, even if one fails.
+func RunHooks(
+	ctx context.Context,
+	gitDir string,
+	name string,
+	args []string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	timeout time.Duration,
+) error {
+	return runHookDir(ctx, gitDir, name, false, args, nil, stdin, stdout, stderr, timeout)
+}
+
+// RunCustomHooks is like RunHooks, but only runs the hooks installed by
+// InstallHooks, with the given extra environment variables. This is used when
+// the built-in hooks are run in-process rather than by git.
+func RunCustomHooks(
+	ctx context.Context,
+	gitDir string,
+	name string,
+	args []string,
+	environ []string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	timeout time.Duration,
+) error {
+	return runHookDir(ctx, gitDir, name, true, args, environ, stdin, stdout, stderr, timeout)
+}
+
+func runHookDir(
+	ctx context.Context,
+	gitDir string,
+	name string,
+	customOnly bool,
+	args []string,
+	environ []string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	timeout time.Duration,
+) error {
+	hookDir := HookDir(gitDir, name)
+
+	entries, err := os.ReadDir(hookDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// stdin can only be read once, so it's written to a file which each hook
+	// reads from the start. This avoids holding all of it in memory.
+	input, err := os.CreateTemp("", "gitdir-hook-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(input.Name())
+	defer input.Close()
+
+	if _, err = io.Copy(input, stdin); err != nil {
+		return err
+	}
+
+	env := append(os.Environ(), environ...)
+	env = append(env, HookDirEnv+"="+hookDir)
+
+	var failures HookError
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// Avoid running non-executable hooks
+		if info.IsDir() || info.Mode()&0o111 == 0 {
+			continue
+		}
+
+		if customOnly && !strings.HasPrefix(entry.Name(), customHookPrefix) {
+			continue
+		}
+
+		if _, err = input.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		err = runHook(ctx, gitDir, filepath.Join(hookDir, entry.Name()), args, env, input, stdout, stderr, timeout)
+		if err != nil {
+			failures = append(failures, HookFailure{Hook: name + ".d/" + entry.Name(), Err: err})
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+
+	return nil
+}
+
+// runHook runs a single hook from the repo dir, the same as git does.
+func runHook(
+	ctx context.Context,
+	dir string,
+	path string,
+	args []string,
+	env []string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...) //nolint:gosec
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exited with status %d", exitErr.ExitCode())
+	}
+
+	return err
+}
@@ -0,0 +1,112 @@
+package git
+
+import (
+	"context"
+	"errors"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// mirrorRemoteName is the name of the anonymous remote used for mirrors.
+const mirrorRemoteName = "mirror"
+
+// mirrorRefSpecs returns the refs which are kept in sync with mirrors. A new
+// slice is returned every time because go-git modifies the refspecs it is
+// given when forcing updates.
+func mirrorRefSpecs() []config.RefSpec {
+	return []config.RefSpec{
+		"refs/heads/*:refs/heads/*",
+		"refs/tags/*:refs/tags/*",
+	}
+}
+
+func (r *Repository) mirrorRemote(url string) *git.Remote {
+	return git.NewRemote(r.Repo.Storer, &config.RemoteConfig{
+		Name: mirrorRemoteName,
+		URLs: []string{url},
+	})
+}
+
+// FetchMirror fetches all branches and tags from the given URL, overwriting
+// any local refs with the same name. Local refs which don't exist on the
+// remote are kept. If HEAD doesn't point to an existing branch, it is set to
+// match the remote.
+func (r *Repository) FetchMirror(ctx context.Context, url string, auth transport.AuthMethod) error {
+	remote := r.mirrorRemote(url)
+
+	err := remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: mirrorRemoteName,
+		RefSpecs:   mirrorRefSpecs(),
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+
+	head, err := r.Repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		return err
+	}
+
+	if _, err = r.Repo.Storer.Reference(head.Target()); !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return err
+	}
+
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			return r.SetHead(ref.Target())
+		}
+	}
+
+	return nil
+}
+
+// PushMirror pushes all branches and tags to the given URL, removing any
+// which don't exist locally, so the remote matches this repo.
+func (r *Repository) PushMirror(ctx context.Context, url string, auth transport.AuthMethod) error {
+	remote := r.mirrorRemote(url)
+
+	// go-git's prune option doesn't work with forced updates, so stale refs
+	// are removed with explicit delete refspecs instead.
+	remoteRefs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return err
+	}
+
+	refSpecs := mirrorRefSpecs()
+
+	for _, ref := range remoteRefs {
+		if ref.Type() != plumbing.HashReference || !config.MatchAny(refSpecs, ref.Name()) {
+			continue
+		}
+
+		_, err = r.Repo.Storer.Reference(ref.Name())
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			refSpecs = append(refSpecs, config.RefSpec(":"+ref.Name().String()))
+		} else if err != nil {
+			return err
+		}
+	}
+
+	err = remote.PushContext(ctx, &git.PushOptions{
+		RemoteName: mirrorRemoteName,
+		RefSpecs:   refSpecs,
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+
+	return nil
+}
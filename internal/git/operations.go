@@ -1,9 +1,11 @@
 package git
 
 import (
+	"errors"
 	"io"
 
 	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
@@ -71,6 +73,14 @@ func (r *Repository) UpdateFile(filename string, cb func([]byte) ([]byte, error)
 	return r.CreateFile(filename, data)
 }
 
+// RemoveFile is a convenience method to remove a file from the repo and stage
+// the removal.
+func (r *Repository) RemoveFile(filename string) error {
+	_, err := r.Worktree.Remove(filename)
+
+	return err
+}
+
 // Commit is a convenience method to make working with the worktree a little
 // bit easier.
 func (r *Repository) Commit(msg string, author *object.Signature) error {
@@ -84,3 +94,24 @@ func (r *Repository) Commit(msg string, author *object.Signature) error {
 
 	return err
 }
+
+// IsAncestor returns true if the commit with the ancestor hash can be reached
+// from the commit with the descendant hash. If either of the hashes do not
+// point to a commit, this will return false.
+func (r *Repository) IsAncestor(ancestor, descendant string) (bool, error) {
+	ancestorCommit, err := r.Repo.CommitObject(plumbing.NewHash(ancestor))
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	descendantCommit, err := r.Repo.CommitObject(plumbing.NewHash(descendant))
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return ancestorCommit.IsAncestor(descendantCommit)
+}
@@ -0,0 +1,455 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+)
+
+// RefUpdate represents a single ref being changed by a push.
+type RefUpdate struct {
+	Name    plumbing.ReferenceName
+	OldHash plumbing.Hash
+	NewHash plumbing.Hash
+
+	// Status is "ok" if the update succeeded, otherwise it contains the
+	// reason it failed.
+	Status string
+}
+
+// IsDelete returns true if this update removes the ref.
+func (u *RefUpdate) IsDelete() bool {
+	return u.NewHash.IsZero()
+}
+
+// ReceivePackOptions are the options available when running ReceivePack.
+type ReceivePackOptions struct {
+	TransportOptions
+
+	// PreReceive is called with all the ref updates before any of them are
+	// applied. If it returns an error, the push is rejected.
+	PreReceive func(updates []*RefUpdate, messages io.Writer) error
+
+	// Update is called for each ref before it is updated. If it returns an
+	// error, that ref will not be updated.
+	Update func(update *RefUpdate, messages io.Writer) error
+
+	// PostReceive is called with all the refs which were successfully
+	// updated.
+	PostReceive func(updates []*RefUpdate, messages io.Writer)
+}
+
+func receivePackCapabilities() *capability.List {
+	caps := capability.NewList()
+
+	_ = caps.Add(capability.ReportStatus)
+	_ = caps.Add(capability.DeleteRefs)
+	_ = caps.Add(capability.OFSDelta)
+	_ = caps.Add(capability.Sideband64k)
+	_ = caps.Add(capability.Quiet)
+	_ = caps.Add("no-thin")
+	_ = caps.Add(capability.Agent, agent)
+
+	return caps
+}
+
+// ReceivePack serves a git-receive-pack request, reading from in and writing
+// to out. Hooks are called as functions provided in the options rather than
+// being run from the repo.
+func (r *Repository) ReceivePack(in io.Reader, out io.Writer, opts *ReceivePackOptions) error { //nolint:cyclop
+	if opts == nil {
+		opts = &ReceivePackOptions{}
+	}
+
+	if !opts.StatelessRPC || opts.AdvertiseRefs {
+		ar, err := r.advertisedRefs(receivePackCapabilities(), false)
+		if err != nil {
+			return err
+		}
+
+		err = ar.Encode(out)
+		if err != nil || opts.AdvertiseRefs {
+			return err
+		}
+	}
+
+	updates, caps, err := readRefUpdates(pktline.NewScanner(in))
+	if err != nil || len(updates) == 0 {
+		return err
+	}
+
+	data, messages := newSidebandWriters(caps, out, opts.Messages)
+
+	unpackStatus := "ok"
+
+	q, err := r.receivePackfile(in, updates)
+	if err != nil {
+		unpackStatus = err.Error()
+
+		for _, update := range updates {
+			update.Status = "unpacker error"
+		}
+	} else {
+		if q != nil {
+			defer func() { _ = q.Remove() }()
+		}
+
+		r.applyRefUpdates(updates, messages, opts, q)
+	}
+
+	if caps.Supports(capability.ReportStatus) {
+		err = writeReportStatus(data, unpackStatus, updates)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.PostReceive != nil {
+		var updated []*RefUpdate
+
+		for _, update := range updates {
+			if update.Status == "ok" {
+				updated = append(updated, update)
+			}
+		}
+
+		if len(updated) > 0 {
+			opts.PostReceive(updated, messages)
+		}
+	}
+
+	if usesSideband(caps) {
+		return writeFlush(out)
+	}
+
+	return nil
+}
+
+// readRefUpdates reads all the commands sent by the client along with the
+// capabilities it requested.
+func readRefUpdates(scanner *pktline.Scanner) ([]*RefUpdate, *capability.List, error) {
+	var updates []*RefUpdate
+
+	caps := capability.NewList()
+
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+		if len(line) == 0 {
+			return updates, caps, nil
+		}
+
+		// The first command also includes the capabilities.
+		if len(updates) == 0 {
+			if idx := bytes.IndexByte(line, 0); idx != -1 {
+				err := caps.Decode(line[idx+1:])
+				if err != nil {
+					return nil, nil, err
+				}
+
+				line = line[:idx]
+			}
+		}
+
+		parts := bytes.SplitN(line, []byte(" "), 3)
+		if len(parts) != 3 {
+			return nil, nil, fmt.Errorf("%w: malformed command %q", ErrProtocol, line)
+		}
+
+		updates = append(updates, &RefUpdate{
+			OldHash: plumbing.NewHash(string(parts[0])),
+			NewHash: plumbing.NewHash(string(parts[1])),
+			Name:    plumbing.ReferenceName(parts[2]),
+		})
+	}
+
+	return updates, caps, scanner.Err()
+}
+
+// receivePackfile writes the packfile sent by the client to a quarantine. A
+// packfile is only sent if at least one of the updates is not a delete, so the
+// quarantine will be nil otherwise.
+func (r *Repository) receivePackfile(in io.Reader, updates []*RefUpdate) (*quarantine, error) {
+	needsPack := false
+
+	for _, update := range updates {
+		if !update.IsDelete() {
+			needsPack = true
+		}
+	}
+
+	if !needsPack {
+		return nil, nil
+	}
+
+	q, err := r.storage.newQuarantine()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := q.PackfileWriter()
+	if err == nil {
+		err = copyPackfile(w, in)
+
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		_ = q.Remove()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// copyPackfile copies a single packfile from in to w.
+func copyPackfile(w io.Writer, in io.Reader) error {
+	// We can't simply copy until EOF because the client waits for our
+	// response before closing the connection, so we need to scan through
+	// the packfile to find the end of it.
+	scanner := packfile.NewScanner(io.TeeReader(in, w))
+
+	_, count, err := scanner.Header()
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		_, err = scanner.NextObjectHeader()
+		if err != nil {
+			return err
+		}
+
+		_, _, err = scanner.NextObject(io.Discard)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = scanner.Checksum()
+
+	return err
+}
+
+// applyRefUpdates runs the hooks and updates all the refs, setting the status
+// on each of the updates. As with git, the received objects are only moved
+// into the repo once the pre-receive hook has accepted the push.
+func (r *Repository) applyRefUpdates(
+	updates []*RefUpdate,
+	messages io.Writer,
+	opts *ReceivePackOptions,
+	q *quarantine,
+) {
+	var valid []*RefUpdate
+
+	for _, update := range updates {
+		update.Status = r.checkRefUpdate(update, q)
+		if update.Status == "" {
+			valid = append(valid, update)
+		}
+	}
+
+	if len(valid) == 0 {
+		return
+	}
+
+	if opts.PreReceive != nil {
+		err := opts.PreReceive(valid, messages)
+		if err != nil {
+			_, _ = fmt.Fprintf(messages, "error: %s\n", err)
+
+			for _, update := range valid {
+				update.Status = "pre-receive hook declined"
+			}
+
+			return
+		}
+	}
+
+	if q != nil {
+		err := q.Migrate()
+		if err != nil {
+			_, _ = fmt.Fprintf(messages, "error: %s\n", err)
+
+			for _, update := range valid {
+				update.Status = "unable to migrate objects"
+			}
+
+			return
+		}
+	}
+
+	for _, update := range valid {
+		if opts.Update != nil {
+			err := opts.Update(update, messages)
+			if err != nil {
+				_, _ = fmt.Fprintf(messages, "error: %s\n", err)
+				update.Status = "hook declined"
+
+				continue
+			}
+		}
+
+		err := r.updateRef(update)
+		if err != nil {
+			update.Status = "failed to update ref"
+			continue
+		}
+
+		update.Status = "ok"
+	}
+}
+
+// checkRefUpdate ensures the given update is valid, returning the reason if
+// it isn't. The new objects may either be in the repo or the quarantine.
+func (r *Repository) checkRefUpdate(update *RefUpdate, q *quarantine) string {
+	if !strings.HasPrefix(update.Name.String(), "refs/") {
+		return "funny refname"
+	}
+
+	if !update.IsDelete() && r.checkConnectivity(update.NewHash, q) != nil {
+		return "missing necessary objects"
+	}
+
+	current, err := r.Repo.Storer.Reference(update.Name)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		current = nil
+	} else if err != nil {
+		return "failed to lock"
+	}
+
+	var currentHash plumbing.Hash
+	if current != nil {
+		currentHash = current.Hash()
+	}
+
+	if currentHash != update.OldHash {
+		return "stale info"
+	}
+
+	return ""
+}
+
+// errMissingObjects is returned by checkConnectivity when an object is missing.
+var errMissingObjects = errors.New("missing necessary objects")
+
+// checkConnectivity ensures every object reachable from hash is either in the
+// repo or in the quarantine. Objects which are already in the repo are assumed
+// to be complete, so only the objects sent by the client are walked.
+func (r *Repository) checkConnectivity(hash plumbing.Hash, q *quarantine) error {
+	pending := []plumbing.Hash{hash}
+	seen := make(map[plumbing.Hash]bool)
+
+	for len(pending) > 0 {
+		hash = pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if seen[hash] {
+			continue
+		}
+
+		seen[hash] = true
+
+		if r.Repo.Storer.HasEncodedObject(hash) == nil {
+			continue
+		}
+
+		if q == nil {
+			return errMissingObjects
+		}
+
+		obj, err := q.EncodedObject(hash)
+		if err != nil {
+			return errMissingObjects
+		}
+
+		children, err := objectChildren(obj)
+		if err != nil {
+			return err
+		}
+
+		pending = append(pending, children...)
+	}
+
+	return nil
+}
+
+// objectChildren returns the hashes of all the objects the given object
+// points to. Submodules are skipped because those commits live in another
+// repo.
+func objectChildren(obj plumbing.EncodedObject) ([]plumbing.Hash, error) {
+	switch obj.Type() {
+	case plumbing.CommitObject:
+		var commit object.Commit
+		if err := commit.Decode(obj); err != nil {
+			return nil, err
+		}
+
+		return append([]plumbing.Hash{commit.TreeHash}, commit.ParentHashes...), nil
+	case plumbing.TreeObject:
+		var tree object.Tree
+		if err := tree.Decode(obj); err != nil {
+			return nil, err
+		}
+
+		ret := make([]plumbing.Hash, 0, len(tree.Entries))
+
+		for _, entry := range tree.Entries {
+			if entry.Mode != filemode.Submodule {
+				ret = append(ret, entry.Hash)
+			}
+		}
+
+		return ret, nil
+	case plumbing.TagObject:
+		var tag object.Tag
+		if err := tag.Decode(obj); err != nil {
+			return nil, err
+		}
+
+		return []plumbing.Hash{tag.Target}, nil
+	}
+
+	return nil, nil
+}
+
+// updateRef applies the given update, ensuring the ref hasn't changed since
+// it was checked.
+func (r *Repository) updateRef(update *RefUpdate) error {
+	if update.IsDelete() {
+		return r.Repo.Storer.RemoveReference(update.Name)
+	}
+
+	var old *plumbing.Reference
+	if !update.OldHash.IsZero() {
+		old = plumbing.NewHashReference(update.Name, update.OldHash)
+	}
+
+	return r.Repo.Storer.CheckAndSetReference(plumbing.NewHashReference(update.Name, update.NewHash), old)
+}
+
+// writeReportStatus writes the status of the push to the client.
+func writeReportStatus(out io.Writer, unpackStatus string, updates []*RefUpdate) error {
+	report := packp.NewReportStatus()
+	report.UnpackStatus = unpackStatus
+
+	for _, update := range updates {
+		report.CommandStatuses = append(report.CommandStatuses, &packp.CommandStatus{
+			ReferenceName: update.Name,
+			Status:        update.Status,
+		})
+	}
+
+	return report.Encode(out)
+}
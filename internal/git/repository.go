@@ -3,7 +3,6 @@ package git
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"strings"
@@ -28,6 +27,8 @@ type Repository struct {
 	RepoFS     *filesystem.Storage
 	Worktree   *git.Worktree
 	WorktreeFS billy.Filesystem
+
+	storage *worktreeStorage
 }
 
 // Open will open a repository if it exists.
@@ -45,7 +46,9 @@ func Open(baseFS billy.Filesystem, path string) (*Repository, error) {
 	// TODO: this probably shouldn't be memfs.
 	worktreeFS := memfs.New()
 
-	repo, err := git.Open(repoFS, worktreeFS)
+	storage := newWorktreeStorage(repoFS)
+
+	repo, err := git.Open(storage, worktreeFS)
 	if err != nil {
 		return nil, err
 	}
@@ -60,12 +63,31 @@ func Open(baseFS billy.Filesystem, path string) (*Repository, error) {
 		RepoFS:     repoFS,
 		Worktree:   worktree,
 		WorktreeFS: worktreeFS,
+		storage:    storage,
 	}, nil
 }
 
+// Exists returns true if a repository exists at the given path.
+func Exists(baseFS billy.Filesystem, path string) bool {
+	path = strings.TrimSuffix(path, ".git")
+
+	return dirExists(baseFS, path+".git") || dirExists(baseFS, path)
+}
+
 // EnsureRepo will open a repository if it exists and try to create it if it
-// doesn't.
+// doesn't. New repos have HEAD pointing at master.
 func EnsureRepo(baseFS billy.Filesystem, path string) (*Repository, error) {
+	return ensureRepo(baseFS, path, "")
+}
+
+// EnsureRepoBranch is the same as EnsureRepo, but HEAD points at the given
+// branch in new repos. Repos without any branches are also updated, so a
+// branch can be chosen before anything is pushed.
+func EnsureRepoBranch(baseFS billy.Filesystem, path string, branch string) (*Repository, error) {
+	return ensureRepo(baseFS, path, branch)
+}
+
+func ensureRepo(baseFS billy.Filesystem, path string, branch string) (*Repository, error) {
 	// This lets us sanitize the path and ensure it always has .git on the end.
 	path = strings.TrimSuffix(path, ".git") + ".git"
 
@@ -87,7 +109,9 @@ func EnsureRepo(baseFS billy.Filesystem, path string) (*Repository, error) {
 			repoFS := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
 
 			// Init the repo without a worktree so it's a bare repo.
-			_, err = git.Init(repoFS, nil)
+			_, err = git.InitWithOptions(repoFS, nil, git.InitOptions{
+				DefaultBranch: branchRefName(branch),
+			})
 			if err != nil {
 				return nil, err
 			}
@@ -99,6 +123,13 @@ func EnsureRepo(baseFS billy.Filesystem, path string) (*Repository, error) {
 		return nil, err
 	}
 
+	if branch != "" {
+		err = repo.ensureEmptyHead(branchRefName(branch))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = ensureHooks(repo.RepoFS.Filesystem())
 	if err != nil {
 		return nil, err
@@ -107,60 +138,111 @@ func EnsureRepo(baseFS billy.Filesystem, path string) (*Repository, error) {
 	return repo, nil
 }
 
-// Checkout will checkout the given hash to the worktreeFS. If an empty string
-// is given, we checkout master.
-func (r *Repository) Checkout(hash string) error {
-	opts := &git.CheckoutOptions{
-		Force: true,
+// branchRefName returns the full ref name for the given branch, defaulting to
+// master.
+func branchRefName(branch string) plumbing.ReferenceName {
+	if branch == "" {
+		return plumbing.Master
 	}
 
-	if hash != "" {
-		opts.Hash = plumbing.NewHash(hash)
+	return plumbing.NewBranchReferenceName(branch)
+}
+
+// ensureEmptyHead points HEAD at the given branch if the repo doesn't have
+// any branches yet.
+func (r *Repository) ensureEmptyHead(target plumbing.ReferenceName) error {
+	head, err := r.RepoFS.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
 	}
 
-	err := r.Worktree.Checkout(opts)
+	if head.Type() == plumbing.SymbolicReference && head.Target() == target {
+		return nil
+	}
 
-	// It's fine to ignore ErrReferenceNotFound because that means this is a
-	// repo without any commits which doesn't matter for our use cases.
-	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+	hasBranches, err := r.HasBranches()
+	if err != nil || hasBranches {
 		return err
 	}
 
-	return nil
+	return r.SetHead(target)
 }
 
-func ensureHooks(fs billy.Filesystem) error {
-	exe, err := os.Executable()
+// HasBranches returns true if the repo contains at least one branch.
+func (r *Repository) HasBranches() (bool, error) {
+	iter, err := r.RepoFS.IterReferences()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	for _, hook := range hooks {
-		err := fs.MkdirAll("hooks/"+hook.Name+".d", os.ModePerm)
-		if err != nil {
-			return err
-		}
+	defer iter.Close()
 
-		// Write the gitdir hook
-		err = writeIfDifferent(
-			fs,
-			"hooks/"+hook.Name+".d/gitdir",
-			[]byte(fmt.Sprintf(hook.GitdirHookTemplate, exe)),
-		)
-		if err != nil {
-			return err
+	for {
+		ref, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		} else if err != nil {
+			return false, err
 		}
 
-		// Write out the actual hook
-		//
-		// TODO: warn when this would clobber a file
-		err = writeIfDifferent(fs, "hooks/"+hook.Name, []byte(hookTemplate))
-		if err != nil {
-			return err
+		if ref.Name().IsBranch() {
+			return true, nil
 		}
 	}
+}
 
-	return nil
+// Checkout will checkout the given hash to the worktreeFS. If an empty string
+// is given, we checkout the branch HEAD points to. This does not change the
+// repo on disk.
+func (r *Repository) Checkout(hash string) error {
+	if hash != "" {
+		return r.Worktree.Checkout(&git.CheckoutOptions{
+			Hash:  plumbing.NewHash(hash),
+			Force: true,
+		})
+	}
+
+	// HEAD is read from disk, rather than the worktree, so we always follow
+	// the repo's actual HEAD.
+	head, err := r.RepoFS.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+
+	if head.Type() != plumbing.SymbolicReference {
+		return r.Worktree.Checkout(&git.CheckoutOptions{
+			Hash:  head.Hash(),
+			Force: true,
+		})
+	}
+
+	// Checking out a branch with go-git resets the branch to the commit it
+	// resolved, which could undo a commit made in the meantime, so we check
+	// out the commit and point HEAD at the branch ourselves.
+	ref, err := r.Repo.Reference(head.Target(), true)
+
+	// It's fine to ignore ErrReferenceNotFound because that means this is a
+	// repo without any commits which doesn't matter for our use cases.
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = r.Worktree.Checkout(&git.CheckoutOptions{
+		Hash:  ref.Hash(),
+		Force: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.Repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, head.Target()))
+}
+
+// SetHead points HEAD in the repo on disk at the given ref.
+func (r *Repository) SetHead(target plumbing.ReferenceName) error {
+	return r.storage.setReference(plumbing.NewSymbolicReference(plumbing.HEAD, target), nil)
 }
 
 func writeIfDifferent(fs billy.Basic, path string, data []byte) error {
@@ -179,76 +261,3 @@ func writeIfDifferent(fs billy.Basic, path string, data []byte) error {
 
 	return nil
 }
-
-// hookTemplate is based on a combination of sources, but allows us to run
-// multiple hooks from a directory (all of them will always be run) and only
-// fail if at least one of them failed. This should support every type of git
-// hook, as it proxies both stdin and arguments.
-var hookTemplate = `#!/usr/bin/env sh
-set -e
-test -n "${GIT_DIR}" || exit 1
-
-stdin=$(cat)
-hookname=$(basename $0)
-exitcodes=""
-
-for hook in ${GIT_DIR}/hooks/${hookname}.d/*; do
-	# Avoid running non-executable hooks
-	test -x "${hook}" || continue
-
-	# Run the actual hook
-	echo "${stdin}" | "${hook}" "$@"
-
-	# Store the exit code for later use
-	exitcodes="${exitcodes} $?"
-done
-
-# Exit on the first non-zero exit code.
-for code in ${exitcodes}; do
-	test ${code} -eq 0 || exit ${i}
-done
-
-exit 0
-`
-
-var hooks = []struct {
-	Name               string
-	GitdirHookTemplate string
-}{
-	{
-		Name: "pre-receive",
-		GitdirHookTemplate: `#!/usr/bin/env sh
-
-if [ -z "$GITDIR_BASE_DIR" ]; then
-	echo "Warning: GITDIR_BASE_DIR not defined. Skipping hooks."
-	exit 0
-fi
-
-%q hook pre-receive
-`,
-	},
-	{
-		Name: "update",
-		GitdirHookTemplate: `#!/usr/bin/env sh
-
-if [ -z "$GITDIR_BASE_DIR" ]; then
-	echo "Warning: GITDIR_BASE_DIR not defined. Skipping hooks."
-	exit 0
-fi
-
-%q hook update $1 $2 $3
-`,
-	},
-	{
-		Name: "post-receive",
-		GitdirHookTemplate: `#!/usr/bin/env sh
-
-if [ -z "$GITDIR_BASE_DIR" ]; then
-	echo "Warning: GITDIR_BASE_DIR not defined. Skipping hooks."
-	exit 0
-fi
-
-%q hook post-receive
-`,
-	},
-}
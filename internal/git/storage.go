@@ -0,0 +1,299 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// worktreeStorage wraps the storage of a bare repo so the index and HEAD,
+// which belong to the worktree, are kept in memory. Every Repository has its
+// own worktree, so checking out a commit doesn't change the repo on disk and
+// multiple Repository values for the same repo can be used at the same time.
+//
+// HEAD is read from disk until it has been set.
+//
+// Other refs and packfiles are written to a temporary location and renamed
+// into place, because go-git writes them in place, so a concurrent reader
+// could see a partially written file.
+type worktreeStorage struct {
+	*filesystem.Storage
+
+	index memory.IndexStorage
+	head  *plumbing.Reference
+}
+
+func newWorktreeStorage(s *filesystem.Storage) *worktreeStorage {
+	return &worktreeStorage{Storage: s}
+}
+
+func (s *worktreeStorage) SetIndex(idx *index.Index) error {
+	return s.index.SetIndex(idx)
+}
+
+func (s *worktreeStorage) Index() (*index.Index, error) {
+	return s.index.Index()
+}
+
+func (s *worktreeStorage) SetReference(ref *plumbing.Reference) error {
+	if ref.Name() == plumbing.HEAD {
+		s.head = ref
+		return nil
+	}
+
+	return s.setReference(ref, nil)
+}
+
+func (s *worktreeStorage) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	if ref.Name() == plumbing.HEAD {
+		s.head = ref
+		return nil
+	}
+
+	return s.setReference(ref, old)
+}
+
+func (s *worktreeStorage) setReference(ref, old *plumbing.Reference) error {
+	if old != nil {
+		current, err := s.Storage.Reference(ref.Name())
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return storage.ErrReferenceHasChanged
+		} else if err != nil {
+			return err
+		}
+
+		if current.Hash() != old.Hash() {
+			return storage.ErrReferenceHasChanged
+		}
+	}
+
+	var content string
+
+	switch ref.Type() {
+	case plumbing.SymbolicReference:
+		content = fmt.Sprintf("ref: %s\n", ref.Target())
+	case plumbing.HashReference:
+		content = ref.Hash().String() + "\n"
+	default:
+		return fmt.Errorf("invalid reference type for %s", ref.Name())
+	}
+
+	fs := s.Storage.Filesystem()
+	filename := ref.Name().String()
+
+	err := fs.MkdirAll(path.Dir(filename), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is kept out of refs/ so it is never mistaken for a
+	// ref.
+	f, err := util.TempFile(fs, "", "tmp_ref_")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte(content))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = fs.Remove(f.Name())
+		return err
+	}
+
+	return fs.Rename(f.Name(), filename)
+}
+
+func (s *worktreeStorage) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if name == plumbing.HEAD && s.head != nil {
+		return s.head, nil
+	}
+
+	return s.Storage.Reference(name)
+}
+
+func (s *worktreeStorage) IterReferences() (storer.ReferenceIter, error) {
+	if s.head == nil {
+		return s.Storage.IterReferences()
+	}
+
+	iter, err := s.Storage.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []*plumbing.Reference{s.head}
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+func (s *worktreeStorage) RemoveReference(name plumbing.ReferenceName) error {
+	if name == plumbing.HEAD && s.head != nil {
+		s.head = nil
+		return nil
+	}
+
+	return s.Storage.RemoveReference(name)
+}
+
+// PackfileWriter writes packfiles to a quarantine directory and moves them
+// into place once they're complete.
+func (s *worktreeStorage) PackfileWriter() (io.WriteCloser, error) {
+	q, err := s.newQuarantine()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := q.PackfileWriter()
+	if err != nil {
+		_ = q.Remove()
+		return nil, err
+	}
+
+	return &migratingPackWriter{PackWriter: w, quarantine: q}, nil
+}
+
+type migratingPackWriter struct {
+	*dotgit.PackWriter
+
+	quarantine *quarantine
+}
+
+func (w *migratingPackWriter) Close() error {
+	defer func() { _ = w.quarantine.Remove() }()
+
+	err := w.PackWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	return w.quarantine.Migrate()
+}
+
+// QuarantinePrefix is the prefix of the directories in objects/ which hold
+// incoming objects until a push has been accepted. This matches what git
+// uses, so hooks can find incoming objects no matter which transport is used.
+const QuarantinePrefix = "tmp_objdir-incoming-"
+
+// quarantine is a temporary directory packfiles are written to before they
+// are moved into the repo, similar to the quarantine directory used by git.
+// Because go-git writes the index of a packfile in place, the same packfile
+// being received twice would otherwise break concurrent readers.
+type quarantine struct {
+	storage *worktreeStorage
+	objects *filesystem.Storage
+	dir     string
+}
+
+func (s *worktreeStorage) newQuarantine() (*quarantine, error) {
+	fs := s.Storage.Filesystem()
+
+	dir, err := util.TempDir(fs, "objects", QuarantinePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFS, err := fs.Chroot(dir)
+	if err == nil {
+		err = tmpFS.MkdirAll(path.Join("objects", "pack"), os.ModePerm)
+	}
+
+	if err != nil {
+		_ = util.RemoveAll(fs, dir)
+		return nil, err
+	}
+
+	return &quarantine{
+		storage: s,
+		objects: filesystem.NewStorage(tmpFS, cache.NewObjectLRUDefault()),
+		dir:     dir,
+	}, nil
+}
+
+// PackfileWriter returns a writer for a packfile in the quarantine.
+func (q *quarantine) PackfileWriter() (*dotgit.PackWriter, error) {
+	return dotgit.New(q.objects.Filesystem()).NewObjectPack()
+}
+
+// EncodedObject returns the object with the given hash from the quarantine.
+func (q *quarantine) EncodedObject(hash plumbing.Hash) (plumbing.EncodedObject, error) {
+	return q.objects.EncodedObject(plumbing.AnyObject, hash)
+}
+
+// Migrate moves all the packfiles in the quarantine into the repo. If the
+// repo already has a packfile, it is kept.
+func (q *quarantine) Migrate() error {
+	fs := q.storage.Storage.Filesystem()
+
+	srcDir := path.Join(q.dir, "objects", "pack")
+	dstDir := path.Join("objects", "pack")
+
+	files, err := fs.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+
+	err = fs.MkdirAll(dstDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Indexes are moved first, because packfiles are only looked for once
+	// they exist.
+	for _, ext := range []string{".idx", ".pack"} {
+		for _, f := range files {
+			name := f.Name()
+			if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ext) {
+				continue
+			}
+
+			_, err = fs.Stat(path.Join(dstDir, strings.TrimSuffix(name, ext)+".pack"))
+			if err == nil {
+				continue
+			}
+
+			err = fs.Rename(path.Join(srcDir, name), path.Join(dstDir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The new packfile needs to be found by anything else using this
+	// storage.
+	q.storage.Reindex()
+
+	return nil
+}
+
+// Remove removes the quarantine along with anything which hasn't been
+// migrated.
+func (q *quarantine) Remove() error {
+	return util.RemoveAll(q.storage.Storage.Filesystem(), q.dir)
+}
@@ -0,0 +1,142 @@
+package git
+
+import (
+	"errors"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+// agent is the value sent in the agent capability when serving repos
+// natively.
+const agent = "gitdir"
+
+// ErrProtocol is returned when the client sends something we don't
+// understand.
+var ErrProtocol = errors.New("protocol error")
+
+// TransportOptions are the options shared between all the services which can
+// be run on a repo.
+type TransportOptions struct {
+	// StatelessRPC should be set when serving a single request from a
+	// stateless protocol, like smart HTTP. The refs will not be advertised
+	// unless AdvertiseRefs is also set.
+	StatelessRPC bool
+
+	// AdvertiseRefs will cause only the refs to be advertised.
+	AdvertiseRefs bool
+
+	// Messages is where any messages for the client will be written if the
+	// client does not support side-band messages.
+	Messages io.Writer
+}
+
+// advertisedRefs builds the list of refs this repo should advertise. HEAD
+// will only be included if requested.
+func (r *Repository) advertisedRefs(caps *capability.List, includeHead bool) (*packp.AdvRefs, error) {
+	ar := packp.NewAdvRefs()
+	ar.Capabilities = caps
+
+	iter, err := r.Repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		ar.References[ref.Name().String()] = ref.Hash()
+
+		// Annotated tags also need to advertise what they point to.
+		if tag, err := r.Repo.TagObject(ref.Hash()); err == nil {
+			ar.Peeled[ref.Name().String()] = tag.Target
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !includeHead {
+		return ar, nil
+	}
+
+	head, err := r.Repo.Storer.Reference(plumbing.HEAD)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return ar, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	resolved := head
+
+	if head.Type() == plumbing.SymbolicReference {
+		resolved, err = r.Repo.Reference(head.Target(), true)
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			// HEAD points to a branch which doesn't exist yet, so there's
+			// nothing to advertise.
+			return ar, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		err = ar.AddReference(head)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := resolved.Hash()
+	ar.Head = &hash
+
+	return ar, nil
+}
+
+// newSidebandWriters returns the writers which should be used for data and
+// messages respectively. If the client doesn't support side-band, data will
+// be written directly to out and messages to the fallback writer.
+func newSidebandWriters(caps *capability.List, out io.Writer, fallback io.Writer) (io.Writer, io.Writer) {
+	var muxer *sideband.Muxer
+
+	switch {
+	case caps.Supports(capability.Sideband64k):
+		muxer = sideband.NewMuxer(sideband.Sideband64k, out)
+	case caps.Supports(capability.Sideband):
+		muxer = sideband.NewMuxer(sideband.Sideband, out)
+	default:
+		if fallback == nil {
+			fallback = io.Discard
+		}
+
+		return out, fallback
+	}
+
+	return muxer, &sidebandChannelWriter{muxer: muxer, channel: sideband.ProgressMessage}
+}
+
+// sidebandChannelWriter writes all data to a single side-band channel.
+type sidebandChannelWriter struct {
+	muxer   *sideband.Muxer
+	channel sideband.Channel
+}
+
+func (w *sidebandChannelWriter) Write(p []byte) (int, error) {
+	return w.muxer.WriteChannel(w.channel, p)
+}
+
+// usesSideband returns true if the given caps request side-band output.
+func usesSideband(caps *capability.List) bool {
+	return caps.Supports(capability.Sideband64k) || caps.Supports(capability.Sideband)
+}
+
+// writeFlush writes a flush-pkt to the given writer.
+func writeFlush(w io.Writer) error {
+	return pktline.NewEncoder(w).Flush()
+}
@@ -0,0 +1,282 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// packWindow is the number of objects to compare against when looking for
+// deltas while encoding a packfile.
+const packWindow = 10
+
+func uploadPackCapabilities() *capability.List {
+	caps := capability.NewList()
+
+	_ = caps.Add(capability.OFSDelta)
+	_ = caps.Add(capability.Sideband)
+	_ = caps.Add(capability.Sideband64k)
+	_ = caps.Add(capability.NoProgress)
+	_ = caps.Add(capability.Agent, agent)
+
+	return caps
+}
+
+// UploadPack serves a git-upload-pack request, reading from in and writing to
+// out. Only the parts of the protocol needed by modern git clients are
+// supported. Notably, shallow clones and multi_ack are not.
+func (r *Repository) UploadPack(in io.Reader, out io.Writer, opts *TransportOptions) error {
+	if opts == nil {
+		opts = &TransportOptions{}
+	}
+
+	// The refs are needed even if they aren't sent, because clients can only
+	// ask for objects which were advertised.
+	ar, err := r.advertisedRefs(uploadPackCapabilities(), true)
+	if err != nil {
+		return err
+	}
+
+	if !opts.StatelessRPC || opts.AdvertiseRefs {
+		err = ar.Encode(out)
+		if err != nil || opts.AdvertiseRefs {
+			return err
+		}
+	}
+
+	scanner := pktline.NewScanner(in)
+
+	wants, caps, err := readWants(scanner)
+	if err != nil || len(wants) == 0 {
+		// If there were no wants, the client only wanted the refs.
+		return err
+	}
+
+	err = r.checkWants(wants, advertisedHashes(ar), opts.StatelessRPC)
+	if err != nil {
+		return err
+	}
+
+	haves, done, err := r.negotiate(scanner, out, opts.StatelessRPC)
+	if err != nil || !done {
+		return err
+	}
+
+	return r.sendPack(out, opts.Messages, wants, haves, caps)
+}
+
+// advertisedHashes returns every object which was advertised, including the
+// targets of annotated tags. These are the only objects clients may want.
+func advertisedHashes(ar *packp.AdvRefs) map[plumbing.Hash]bool {
+	ret := make(map[plumbing.Hash]bool)
+
+	for _, hash := range ar.References {
+		ret[hash] = true
+	}
+
+	for _, hash := range ar.Peeled {
+		ret[hash] = true
+	}
+
+	if ar.Head != nil {
+		ret[*ar.Head] = true
+	}
+
+	return ret
+}
+
+// checkWants ensures the client only wants objects which were advertised.
+// Stateless clients were sent the refs in an earlier request, so the refs may
+// have changed since then. As with git, they may also want anything which can
+// be reached from the current refs.
+func (r *Repository) checkWants(wants []plumbing.Hash, advertised map[plumbing.Hash]bool, statelessRPC bool) error {
+	for _, hash := range wants {
+		if advertised[hash] || (statelessRPC && r.reachableFrom(hash, advertised)) {
+			continue
+		}
+
+		return fmt.Errorf("%w: not our ref %s", ErrProtocol, hash)
+	}
+
+	return nil
+}
+
+// reachableFrom returns true if the given commit is an ancestor of any of the
+// given commits.
+func (r *Repository) reachableFrom(hash plumbing.Hash, tips map[plumbing.Hash]bool) bool {
+	if hash.IsZero() || r.Repo.Storer.HasEncodedObject(hash) != nil {
+		return false
+	}
+
+	for tip := range tips {
+		commit, err := r.Repo.CommitObject(tip)
+		if err != nil {
+			continue
+		}
+
+		found := false
+
+		_ = object.NewCommitPreorderIter(commit, nil, nil).ForEach(func(c *object.Commit) error {
+			if c.Hash == hash {
+				found = true
+				return storer.ErrStop
+			}
+
+			return nil
+		})
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readWants reads all the objects the client wants along with the
+// capabilities it requested.
+func readWants(scanner *pktline.Scanner) ([]plumbing.Hash, *capability.List, error) {
+	var wants []plumbing.Hash
+
+	caps := capability.NewList()
+
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+		if len(line) == 0 {
+			return wants, caps, nil
+		}
+
+		if !bytes.HasPrefix(line, []byte("want ")) {
+			return nil, nil, fmt.Errorf("%w: unexpected line %q", ErrProtocol, line)
+		}
+
+		line = bytes.TrimPrefix(line, []byte("want "))
+
+		// The first want line also includes the capabilities.
+		if len(wants) == 0 {
+			if idx := bytes.IndexByte(line, ' '); idx != -1 {
+				err := caps.Decode(line[idx+1:])
+				if err != nil {
+					return nil, nil, err
+				}
+
+				line = line[:idx]
+			}
+		}
+
+		wants = append(wants, plumbing.NewHash(string(line)))
+	}
+
+	return wants, caps, scanner.Err()
+}
+
+// negotiate reads the objects the client already has. This follows the
+// behavior of git-upload-pack when multi_ack is not enabled. done will only be
+// true if the client is ready for the packfile to be sent.
+func (r *Repository) negotiate(
+	scanner *pktline.Scanner,
+	out io.Writer,
+	statelessRPC bool,
+) ([]plumbing.Hash, bool, error) {
+	var haves []plumbing.Hash
+
+	enc := pktline.NewEncoder(out)
+
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+
+		switch {
+		case len(line) == 0:
+			if len(haves) == 0 {
+				err := enc.EncodeString("NAK\n")
+				if err != nil {
+					return nil, false, err
+				}
+			}
+
+			// Stateless clients will make a new request to continue
+			// negotiation.
+			if statelessRPC {
+				return haves, false, nil
+			}
+		case bytes.HasPrefix(line, []byte("have ")):
+			hash := plumbing.NewHash(string(bytes.TrimPrefix(line, []byte("have "))))
+			if r.Repo.Storer.HasEncodedObject(hash) != nil {
+				continue
+			}
+
+			haves = append(haves, hash)
+
+			// Without multi_ack, we only acknowledge the first common
+			// object, after which the client will stop sending haves.
+			if len(haves) == 1 {
+				err := enc.Encodef("ACK %s\n", hash)
+				if err != nil {
+					return nil, false, err
+				}
+			}
+		case bytes.Equal(line, []byte("done")):
+			if len(haves) == 0 {
+				return haves, true, enc.EncodeString("NAK\n")
+			}
+
+			return haves, true, nil
+		default:
+			return nil, false, fmt.Errorf("%w: unexpected line %q", ErrProtocol, line)
+		}
+	}
+
+	if scanner.Err() != nil {
+		return nil, false, scanner.Err()
+	}
+
+	return nil, false, io.ErrUnexpectedEOF
+}
+
+// sendPack writes a packfile containing all the objects reachable from wants
+// and not reachable from haves.
+func (r *Repository) sendPack(
+	out io.Writer,
+	messages io.Writer,
+	wants []plumbing.Hash,
+	haves []plumbing.Hash,
+	caps *capability.List,
+) error {
+	haveObjects, err := revlist.Objects(r.Repo.Storer, haves, nil)
+	if err != nil {
+		return err
+	}
+
+	objects, err := revlist.Objects(r.Repo.Storer, wants, haveObjects)
+	if err != nil {
+		return err
+	}
+
+	data, progress := newSidebandWriters(caps, out, messages)
+
+	if !caps.Supports(capability.NoProgress) {
+		_, _ = fmt.Fprintf(progress, "Sending %d objects\n", len(objects))
+	}
+
+	encoder := packfile.NewEncoder(data, r.Repo.Storer, !caps.Supports(capability.OFSDelta))
+
+	_, err = encoder.Encode(objects, packWindow)
+	if err != nil {
+		return err
+	}
+
+	if usesSideband(caps) {
+		return writeFlush(out)
+	}
+
+	return nil
+}
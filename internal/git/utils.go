@@ -15,6 +15,16 @@ func newAdminGitSignature() *object.Signature {
 	}
 }
 
+// NewUserGitSignature returns a signature which can be used when making
+// commits on behalf of a user.
+func NewUserGitSignature(username string) *object.Signature {
+	return &object.Signature{
+		Name:  username,
+		Email: username + "@localhost",
+		When:  time.Now(),
+	}
+}
+
 func dirExists(fs billy.Filesystem, path string) bool {
 	info, err := fs.Stat(path)
 	if err != nil {
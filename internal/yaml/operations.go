@@ -21,6 +21,19 @@ func (n *Node) RemoveKey(key string) bool {
 	return true
 }
 
+// RenameKey will rename a given key in a MappingNode, keeping the value and
+// position the same.
+func (n *Node) RenameKey(oldKey, newKey string) bool {
+	idx := n.KeyIndex(oldKey)
+	if idx == -1 {
+		return false
+	}
+
+	n.Content[idx].Value = newKey
+
+	return true
+}
+
 // EnsureOptions are optional settings when using Node.EnsureKey.
 type EnsureOptions struct {
 	// Comment lets you specify a comment for this node, if it's added.
@@ -88,6 +101,25 @@ func (n *Node) AppendUniqueScalar(newNode *Node) bool {
 	return true
 }
 
+// RemoveScalars will remove all scalars from a SequenceNode which match the
+// given function. It returns the number of nodes removed.
+func (n *Node) RemoveScalars(match func(value string) bool) int {
+	content := n.Content[:0]
+
+	for _, iterNode := range n.Content {
+		if iterNode.Kind == yaml.ScalarNode && match(iterNode.Value) {
+			continue
+		}
+
+		content = append(content, iterNode)
+	}
+
+	removed := len(n.Content) - len(content)
+	n.Content = content
+
+	return removed
+}
+
 // EnsureDocument takes data from a yaml file and ensures a basic document
 // structure. It returns the root node, the root content node, or an error if
 // the yaml document isn't in a valid format.
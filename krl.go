@@ -0,0 +1,314 @@
+package gitdir
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// krlPath is where the key revocation list is stored in the admin repo. It is
+// optional.
+const krlPath = "ssh/revoked_keys"
+
+// These values come from PROTOCOL.krl in the OpenSSH source.
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// krlSerialRange is an inclusive range of revoked certificate serials.
+type krlSerialRange struct {
+	min, max uint64
+}
+
+// krlSerialBitmap revokes the serial offset+n for every bit n which is set.
+type krlSerialBitmap struct {
+	offset uint64
+	bitmap *big.Int
+}
+
+// krlCerts contains the certificates revoked for a single CA. An empty CA
+// matches certificates signed by any CA.
+type krlCerts struct {
+	ca      []byte
+	serials map[uint64]bool
+	ranges  []krlSerialRange
+	bitmaps []krlSerialBitmap
+	keyIDs  map[string]bool
+}
+
+// keyRevocationList is a parsed OpenSSH KRL, as generated by ssh-keygen -k.
+// Signatures in the KRL are not checked, because it comes from the admin repo,
+// which is already trusted.
+type keyRevocationList struct {
+	certs  []*krlCerts
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+}
+
+// parseKRL parses an OpenSSH key revocation list in the binary format.
+func parseKRL(data []byte) (*keyRevocationList, error) {
+	if !bytes.HasPrefix(data, []byte(krlMagic)) {
+		return nil, errors.New("krl: invalid magic")
+	}
+
+	r := &wireReader{data: data[len(krlMagic):]}
+
+	version, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	if version != krlFormatVersion {
+		return nil, fmt.Errorf("krl: unsupported format version %d", version)
+	}
+
+	// Skip the krl_version, generated_date and flags.
+	for i := 0; i < 3; i++ {
+		if _, err = r.uint64(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Skip the reserved and comment strings.
+	for i := 0; i < 2; i++ {
+		if _, err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	krl := &keyRevocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+
+	for len(r.data) > 0 {
+		sectionType, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		sectionData, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseKRLCerts(sectionData)
+			if err != nil {
+				return nil, err
+			}
+
+			krl.certs = append(krl.certs, certs)
+		case krlSectionExplicitKey:
+			err = parseKRLBlobs(sectionData, krl.keys)
+		case krlSectionFingerprintSHA1:
+			err = parseKRLBlobs(sectionData, krl.sha1)
+		case krlSectionFingerprintSHA256:
+			err = parseKRLBlobs(sectionData, krl.sha256)
+		case krlSectionSignature:
+			// Signatures are always at the end, so there's nothing else to
+			// read.
+			return krl, nil
+		default:
+			return nil, fmt.Errorf("krl: unsupported section type %d", sectionType)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return krl, nil
+}
+
+func parseKRLBlobs(data []byte, target map[string]bool) error {
+	r := &wireReader{data: data}
+
+	for len(r.data) > 0 {
+		blob, err := r.string()
+		if err != nil {
+			return err
+		}
+
+		target[string(blob)] = true
+	}
+
+	return nil
+}
+
+func parseKRLCerts(data []byte) (*krlCerts, error) {
+	r := &wireReader{data: data}
+
+	ca, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the reserved string.
+	if _, err = r.string(); err != nil {
+		return nil, err
+	}
+
+	certs := &krlCerts{
+		ca:      ca,
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+
+	for len(r.data) > 0 {
+		sectionType, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		sectionData, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+
+		sr := &wireReader{data: sectionData}
+
+		switch sectionType {
+		case krlSectionCertSerialList:
+			for len(sr.data) > 0 {
+				serial, err := sr.uint64()
+				if err != nil {
+					return nil, err
+				}
+
+				certs.serials[serial] = true
+			}
+		case krlSectionCertSerialRange:
+			var serialRange krlSerialRange
+
+			if serialRange.min, err = sr.uint64(); err != nil {
+				return nil, err
+			}
+
+			if serialRange.max, err = sr.uint64(); err != nil {
+				return nil, err
+			}
+
+			certs.ranges = append(certs.ranges, serialRange)
+		case krlSectionCertSerialBitmap:
+			var serialBitmap krlSerialBitmap
+
+			if serialBitmap.offset, err = sr.uint64(); err != nil {
+				return nil, err
+			}
+
+			bitmap, err := sr.string()
+			if err != nil {
+				return nil, err
+			}
+
+			serialBitmap.bitmap = new(big.Int).SetBytes(bitmap)
+			certs.bitmaps = append(certs.bitmaps, serialBitmap)
+		case krlSectionCertKeyID:
+			if err = parseKRLBlobs(sectionData, certs.keyIDs); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("krl: unsupported certificate section type %d", sectionType)
+		}
+	}
+
+	return certs, nil
+}
+
+// isKeyRevoked returns true if a plain key has been revoked, either explicitly
+// or by fingerprint.
+func (krl *keyRevocationList) isKeyRevoked(pk gossh.PublicKey) bool {
+	blob := pk.Marshal()
+	sha1Sum := sha1.Sum(blob) //nolint:gosec
+	sha256Sum := sha256.Sum256(blob)
+
+	return krl.keys[string(blob)] || krl.sha1[string(sha1Sum[:])] || krl.sha256[string(sha256Sum[:])]
+}
+
+// IsRevoked returns true if the given key has been revoked. Certificates are
+// revoked if the certificate, the key it certifies, or the CA which signed it
+// have been revoked.
+func (krl *keyRevocationList) IsRevoked(pk gossh.PublicKey) bool {
+	if krl == nil {
+		return false
+	}
+
+	cert, ok := pk.(*gossh.Certificate)
+	if !ok {
+		return krl.isKeyRevoked(pk)
+	}
+
+	if krl.isKeyRevoked(cert.Key) || krl.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	ca := cert.SignatureKey.Marshal()
+
+	for _, certs := range krl.certs {
+		if len(certs.ca) != 0 && !bytes.Equal(certs.ca, ca) {
+			continue
+		}
+
+		if certs.isRevoked(cert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (certs *krlCerts) isRevoked(cert *gossh.Certificate) bool {
+	if certs.keyIDs[cert.KeyId] {
+		return true
+	}
+
+	// A serial of 0 is the default when the CA didn't set one, so it can't be
+	// revoked by serial. This matches OpenSSH.
+	if cert.Serial == 0 {
+		return false
+	}
+
+	if certs.serials[cert.Serial] {
+		return true
+	}
+
+	for _, serialRange := range certs.ranges {
+		if cert.Serial >= serialRange.min && cert.Serial <= serialRange.max {
+			return true
+		}
+	}
+
+	for _, serialBitmap := range certs.bitmaps {
+		if cert.Serial < serialBitmap.offset {
+			continue
+		}
+
+		bit := cert.Serial - serialBitmap.offset
+		if bit < uint64(serialBitmap.bitmap.BitLen()) && serialBitmap.bitmap.Bit(int(bit)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
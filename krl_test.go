@@ -0,0 +1,161 @@
+package gitdir
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := gossh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	return signer
+}
+
+func newTestCert(t *testing.T, ca gossh.Signer, serial uint64, keyID string, principals ...string) *gossh.Certificate {
+	t.Helper()
+
+	cert := &gossh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		Serial:          serial,
+		CertType:        gossh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	return cert
+}
+
+// The following build KRLs in the same format as ssh-keygen -k.
+
+func krlString(data []byte) []byte {
+	return appendWireString(nil, data)
+}
+
+func krlUint64(values ...uint64) []byte {
+	ret := make([]byte, 8*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint64(ret[8*i:], value)
+	}
+
+	return ret
+}
+
+func krlSection(sectionType byte, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+
+	return append([]byte{sectionType}, krlString(body)...)
+}
+
+func newTestKRL(sections ...[]byte) []byte {
+	ret := []byte(krlMagic)
+	ret = append(ret, 0, 0, 0, krlFormatVersion)
+	ret = append(ret, krlUint64(1, uint64(time.Now().Unix()), 0)...)
+	ret = append(ret, krlString(nil)...)
+	ret = append(ret, krlString([]byte("test krl"))...)
+
+	for _, section := range sections {
+		ret = append(ret, section...)
+	}
+
+	return ret
+}
+
+func TestParseKRL(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	revokedKey := newTestSigner(t).PublicKey()
+	revokedHash := sha256.Sum256(revokedKey.Marshal())
+
+	krl, err := parseKRL(newTestKRL(
+		krlSection(krlSectionCertificates,
+			krlString(ca.PublicKey().Marshal()),
+			krlString(nil),
+			krlSection(krlSectionCertSerialList, krlUint64(1, 2)),
+			krlSection(krlSectionCertSerialRange, krlUint64(10, 20)),
+			// Bits 0 and 2 are set, so 100 and 102 are revoked.
+			krlSection(krlSectionCertSerialBitmap, krlUint64(100), krlString([]byte{0x05})),
+			krlSection(krlSectionCertKeyID, krlString([]byte("revoked-id"))),
+		),
+		// A certificate section without a CA applies to all CAs.
+		krlSection(krlSectionCertificates,
+			krlString(nil),
+			krlString(nil),
+			krlSection(krlSectionCertKeyID, krlString([]byte("revoked-everywhere"))),
+		),
+		krlSection(krlSectionFingerprintSHA256, krlString(revokedHash[:])),
+		krlSection(krlSectionSignature, krlString([]byte("ignored"))),
+	))
+	require.NoError(t, err)
+
+	var tests = []struct { //nolint:gofumpt
+		CA      gossh.Signer
+		Serial  uint64
+		KeyID   string
+		Revoked bool
+	}{
+		{ca, 0, "", false},
+		{ca, 1, "", true},
+		{ca, 3, "", false},
+		{ca, 15, "", true},
+		{ca, 21, "", false},
+		{ca, 100, "", true},
+		{ca, 101, "", false},
+		{ca, 102, "", true},
+		{ca, 103, "", false},
+		{ca, 0, "revoked-id", true},
+		{ca, 0, "revoked-everywhere", true},
+		{otherCA, 1, "", false},
+		{otherCA, 0, "revoked-id", false},
+		{otherCA, 0, "revoked-everywhere", true},
+	}
+
+	for _, test := range tests {
+		cert := newTestCert(t, test.CA, test.Serial, test.KeyID, "non-admin")
+		assert.Equal(t, test.Revoked, krl.IsRevoked(cert), "serial %d, key id %q", test.Serial, test.KeyID)
+	}
+
+	// Revoked keys should be revoked both as plain keys and when certified.
+	assert.True(t, krl.IsRevoked(revokedKey))
+	assert.False(t, krl.IsRevoked(ca.PublicKey()))
+
+	cert := newTestCert(t, otherCA, 0, "")
+	cert.Key = revokedKey
+	require.NoError(t, cert.SignCert(rand.Reader, otherCA))
+	assert.True(t, krl.IsRevoked(cert))
+
+	// A nil KRL doesn't revoke anything.
+	assert.False(t, (*keyRevocationList)(nil).IsRevoked(revokedKey))
+
+	// Invalid KRLs should fail to parse.
+	_, err = parseKRL([]byte("ssh-ed25519 AAAA"))
+	assert.Error(t, err)
+
+	_, err = parseKRL(newTestKRL()[:20])
+	assert.Error(t, err)
+
+	_, err = parseKRL(newTestKRL(krlSection(0x7f)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,248 @@
+package gitdir
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sessionDurationBuckets are the upper bounds, in seconds, of the buckets used
+// for the session duration histogram.
+var sessionDurationBuckets = []float64{0.05, 0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600}
+
+// serverMetrics tracks everything exposed on the metrics endpoint. Each server
+// has its own registry so multiple servers can run in the same process.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	sessions        *prometheus.CounterVec
+	sessionDuration *prometheus.HistogramVec
+	authAttempts    *prometheus.CounterVec
+	repoActions     *prometheus.CounterVec
+	transferBytes   *prometheus.CounterVec
+	reloads         prometheus.Counter
+	reloadFailures  prometheus.Counter
+	lastReload      prometheus.Gauge
+}
+
+func newServerMetrics(config func() *Config) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		sessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gitdir_sessions_total",
+			Help: "Number of SSH sessions, by command.",
+		}, []string{"command"}),
+		sessionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gitdir_session_duration_seconds",
+			Help:    "Duration of SSH sessions, by command.",
+			Buckets: sessionDurationBuckets,
+		}, []string{"command"}),
+		authAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gitdir_auth_attempts_total",
+			Help: "Number of authentication attempts, by method and result.",
+		}, []string{"method", "result"}),
+		repoActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gitdir_repo_actions_total",
+			Help: "Number of git services run, by service and exit code.",
+		}, []string{"service", "code"}),
+		transferBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gitdir_transfer_bytes_total",
+			Help: "Bytes transferred by git services, by service and direction.",
+		}, []string{"service", "direction"}),
+		reloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gitdir_config_reloads_total",
+			Help: "Number of successful config reloads.",
+		}),
+		reloadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gitdir_config_reload_failures_total",
+			Help: "Number of failed config reloads.",
+		}),
+		lastReload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gitdir_config_last_reload_timestamp_seconds",
+			Help: "Time of the last successful config reload.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.sessions,
+		m.sessionDuration,
+		m.authAttempts,
+		m.repoActions,
+		m.transferBytes,
+		m.reloads,
+		m.reloadFailures,
+		m.lastReload,
+		&configCollector{config: config},
+	)
+
+	return m
+}
+
+func (m *serverMetrics) recordSession(command string, duration time.Duration) {
+	m.sessions.WithLabelValues(command).Inc()
+	m.sessionDuration.WithLabelValues(command).Observe(duration.Seconds())
+}
+
+func (m *serverMetrics) recordAuth(method string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+
+	m.authAttempts.WithLabelValues(method, result).Inc()
+}
+
+func (m *serverMetrics) recordRepoAction(service string, code int) {
+	m.repoActions.WithLabelValues(service, strconv.Itoa(code)).Inc()
+}
+
+func (m *serverMetrics) recordTransfer(service string, in, out int64) {
+	m.transferBytes.WithLabelValues(service, "in").Add(float64(in))
+	m.transferBytes.WithLabelValues(service, "out").Add(float64(out))
+}
+
+func (m *serverMetrics) recordReload(err error, now time.Time) {
+	if err != nil {
+		m.reloadFailures.Inc()
+		return
+	}
+
+	m.reloads.Inc()
+	m.lastReload.Set(float64(now.UnixNano()) / float64(time.Second))
+}
+
+var (
+	configUsersDesc = prometheus.NewDesc("gitdir_users", "Number of users in the config.", nil, nil)
+	configOrgsDesc  = prometheus.NewDesc("gitdir_orgs", "Number of orgs in the config.", nil, nil)
+	configReposDesc = prometheus.NewDesc("gitdir_repos", "Number of repos defined in the config.", nil, nil)
+)
+
+// configCollector exports counts from the current config. They're always
+// current, so they're calculated when scraped rather than being tracked.
+type configCollector struct {
+	config func() *Config
+}
+
+func (cc *configCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- configUsersDesc
+	ch <- configOrgsDesc
+	ch <- configReposDesc
+}
+
+func (cc *configCollector) Collect(ch chan<- prometheus.Metric) {
+	config := cc.config()
+	if config == nil {
+		return
+	}
+
+	repos := len(config.Repos)
+
+	for _, org := range config.Orgs {
+		repos += len(org.Repos)
+	}
+
+	for _, user := range config.Users {
+		repos += len(user.Repos)
+	}
+
+	ch <- prometheus.MustNewConstMetric(configUsersDesc, prometheus.GaugeValue, float64(len(config.Users)))
+	ch <- prometheus.MustNewConstMetric(configOrgsDesc, prometheus.GaugeValue, float64(len(config.Orgs)))
+	ch <- prometheus.MustNewConstMetric(configReposDesc, prometheus.GaugeValue, float64(repos))
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(&cr.count, int64(n))
+
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.count, int64(n))
+
+	return n, err
+}
+
+// authConn wraps an SSH connection so the result of authentication is counted
+// once, when the connection is closed, rather than once for every key the
+// client offers.
+type authConn struct {
+	net.Conn
+
+	ctx     ssh.Context
+	metrics *serverMetrics
+	once    sync.Once
+
+	lock   sync.Mutex
+	method string
+}
+
+// setMethod records the method of the latest authentication attempt.
+func (ac *authConn) setMethod(method string) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	ac.method = method
+}
+
+func (ac *authConn) Close() error {
+	ac.once.Do(func() {
+		ac.lock.Lock()
+		defer ac.lock.Unlock()
+
+		// Connections closed before any attempt to authenticate aren't
+		// counted. The SSH connection is only set on the context once the
+		// handshake has succeeded.
+		if ac.method != "" {
+			_, ok := ac.ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+			ac.metrics.recordAuth(ac.method, ok)
+		}
+	})
+
+	return ac.Conn.Close()
+}
+
+// MetricsHandler returns an http.Handler which serves the server metrics in
+// the Prometheus text format.
+func (serv *Server) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(serv.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServeMetrics listens on the MetricsAddr set on the server struct
+// and serves the metrics on /metrics.
+func (serv *Server) ListenAndServeMetrics() error {
+	serv.log.Info().Str("port", serv.MetricsAddr).Msg("Starting metrics server")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", serv.MetricsHandler())
+
+	httpServer := &http.Server{
+		Addr:              serv.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	return httpServer.ListenAndServe()
+}
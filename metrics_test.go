@@ -0,0 +1,123 @@
+package gitdir
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestServerMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := newServerMetrics(newTestConfig)
+
+	m.recordSession("git-upload-pack", 2*time.Second)
+	m.recordSession("git-upload-pack", 20*time.Second)
+	m.recordAuth("publickey", true)
+	m.recordAuth("publickey", false)
+	m.recordAuth("publickey", false)
+	m.recordRepoAction("git-receive-pack", 1)
+	m.recordTransfer("git-upload-pack", 10, 2048)
+	m.recordReload(nil, time.Unix(1500000000, 0))
+	m.recordReload(errors.New("failed"), time.Unix(1600000000, 0))
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	out := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE gitdir_sessions_total counter",
+		`gitdir_sessions_total{command="git-upload-pack"} 2`,
+		"# TYPE gitdir_session_duration_seconds histogram",
+		`gitdir_session_duration_seconds_bucket{command="git-upload-pack",le="1"} 0`,
+		`gitdir_session_duration_seconds_bucket{command="git-upload-pack",le="5"} 1`,
+		`gitdir_session_duration_seconds_bucket{command="git-upload-pack",le="60"} 2`,
+		`gitdir_session_duration_seconds_bucket{command="git-upload-pack",le="+Inf"} 2`,
+		`gitdir_session_duration_seconds_sum{command="git-upload-pack"} 22`,
+		`gitdir_session_duration_seconds_count{command="git-upload-pack"} 2`,
+		`gitdir_auth_attempts_total{method="publickey",result="failure"} 2`,
+		`gitdir_auth_attempts_total{method="publickey",result="success"} 1`,
+		`gitdir_repo_actions_total{code="1",service="git-receive-pack"} 1`,
+		`gitdir_transfer_bytes_total{direction="in",service="git-upload-pack"} 10`,
+		`gitdir_transfer_bytes_total{direction="out",service="git-upload-pack"} 2048`,
+		"gitdir_config_reloads_total 1",
+		"gitdir_config_reload_failures_total 1",
+		"gitdir_config_last_reload_timestamp_seconds 1.5e+09",
+		"gitdir_users 9",
+		"gitdir_orgs 1",
+		"gitdir_repos 6",
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	t.Parallel()
+
+	serv, err := NewServer(memfs.New())
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	serv.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// Creating the server loads the config.
+	assert.Contains(t, w.Body.String(), "gitdir_config_reloads_total 1\n")
+	assert.Contains(t, w.Body.String(), "gitdir_config_reload_failures_total 0\n")
+}
+
+func TestAuthMetricsPerConnection(t *testing.T) {
+	t.Parallel()
+
+	serv, err := NewServer(memfs.New())
+	require.NoError(t, err)
+
+	adminSigner := newTestSigner(t)
+	require.NoError(t, serv.EnsureAdminUser("an-admin", &models.PublicKey{PublicKey: adminSigner.PublicKey()}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() { _ = serv.Serve(l) }()
+
+	t.Cleanup(func() { _ = serv.ssh.Close() })
+
+	dial := func(signers ...gossh.Signer) (*gossh.Client, error) {
+		return gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+			User:            "an-admin",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(signers...)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(), //nolint:gosec
+		})
+	}
+
+	authCount := func(result string) float64 {
+		return testutil.ToFloat64(serv.metrics.authAttempts.WithLabelValues("publickey", result))
+	}
+
+	// Offering several keys which are all rejected is a single failure.
+	_, err = dial(newTestSigner(t), newTestSigner(t))
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool { return authCount("failure") == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// A connection which is allowed after rejected keys is a single success.
+	client, err := dial(newTestSigner(t), adminSigner)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	require.Eventually(t, func() bool { return authCount("success") == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), authCount("failure"))
+}
@@ -0,0 +1,482 @@
+package gitdir
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+const (
+	// mirrorKeyPath is the private key used to authenticate to mirrors over
+	// SSH. It's stored in the admin repo next to the host keys.
+	mirrorKeyPath = "ssh/mirror_ed25519"
+
+	// mirrorKnownHostsPath is an optional known_hosts file in the admin repo
+	// used to verify mirror host keys.
+	mirrorKnownHostsPath = "ssh/known_hosts"
+
+	// mirrorStatusDir is where the result of the last sync of each mirror is
+	// stored, relative to the base dir.
+	mirrorStatusDir = "mirrors"
+
+	// mirrorPollInterval is how often pull mirrors are checked to see if
+	// they're due to be fetched.
+	mirrorPollInterval = 30 * time.Second
+
+	// mirrorTimeout is how long a single fetch or push may take.
+	mirrorTimeout = 10 * time.Minute
+)
+
+// Mirror directions.
+const (
+	MirrorDirectionPull = "pull"
+	MirrorDirectionPush = "push"
+)
+
+// ErrMirrorNotFound is returned when syncing a repo without a pull mirror.
+var ErrMirrorNotFound = errors.New("repo has no pull mirror")
+
+// MirrorStatus is the result of the last sync of a mirror.
+type MirrorStatus struct {
+	Repo        string    `json:"repo"`
+	Direction   string    `json:"direction"`
+	URL         string    `json:"url"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// repoMirror is a single mirror from the config.
+type repoMirror struct {
+	Repo      *RepoLookup
+	Direction string
+	URL       string
+	Interval  time.Duration
+}
+
+// repoMirrors returns every mirror defined in the config, ordered by repo.
+func (c *Config) repoMirrors() []*repoMirror {
+	var repos []*RepoLookup
+
+	for name := range c.Repos {
+		repos = append(repos, &RepoLookup{Type: RepoTypeTopLevel, PathParts: []string{name}})
+	}
+
+	for username, user := range c.Users {
+		for name := range user.Repos {
+			repos = append(repos, &RepoLookup{Type: RepoTypeUser, PathParts: []string{username, name}})
+		}
+	}
+
+	for orgName, org := range c.Orgs {
+		for name := range org.Repos {
+			repos = append(repos, &RepoLookup{Type: RepoTypeOrg, PathParts: []string{orgName, name}})
+		}
+	}
+
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Path() < repos[j].Path() })
+
+	var ret []*repoMirror
+
+	for _, repo := range repos {
+		ret = append(ret, c.lookupMirrors(repo)...)
+	}
+
+	return ret
+}
+
+// lookupMirrors returns the mirrors of a single repo, with the pull mirror
+// first.
+func (c *Config) lookupMirrors(repo *RepoLookup) []*repoMirror {
+	repoConfig := c.lookupRepoConfig(repo)
+	if repoConfig == nil {
+		return nil
+	}
+
+	var ret []*repoMirror
+
+	if pull := repoConfig.Mirror.Pull; pull != nil {
+		interval := pull.Interval
+		if interval <= 0 {
+			interval = models.DefaultMirrorInterval
+		}
+
+		ret = append(ret, &repoMirror{Repo: repo, Direction: MirrorDirectionPull, URL: pull.URL, Interval: interval})
+	}
+
+	for _, push := range repoConfig.Mirror.Push {
+		ret = append(ret, &repoMirror{Repo: repo, Direction: MirrorDirectionPush, URL: push.URL})
+	}
+
+	return ret
+}
+
+// ensureMirrorKey generates the mirror key if it doesn't exist yet.
+func (c *Config) ensureMirrorKey(repo *git.Repository) error {
+	if repo.FileExists(mirrorKeyPath) {
+		return nil
+	}
+
+	pk, err := models.GenerateEd25519PrivateKey()
+	if err != nil {
+		return err
+	}
+
+	data, err := pk.MarshalPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	return repo.CreateFile(mirrorKeyPath, data)
+}
+
+func (c *Config) loadMirrorKey(repo *git.Repository) error {
+	c.MirrorKey = nil
+	c.mirrorKnownHosts = nil
+
+	if repo.FileExists(mirrorKeyPath) {
+		data, err := repo.GetFile(mirrorKeyPath)
+		if err != nil {
+			return err
+		}
+
+		c.MirrorKey, err = models.ParseEd25519PrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", mirrorKeyPath, err)
+		}
+	}
+
+	if repo.FileExists(mirrorKnownHostsPath) {
+		var err error
+
+		c.mirrorKnownHosts, err = repo.GetFile(mirrorKnownHostsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MirrorPublicKey returns the public half of the mirror key in the
+// authorized_keys format, so it can be added to remotes as a deploy key.
+func (c *Config) MirrorPublicKey() (string, error) {
+	if c.MirrorKey == nil {
+		return "", errors.New("no mirror key found")
+	}
+
+	pub, err := gossh.NewPublicKey(c.MirrorKey.Public())
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(pub))), nil
+}
+
+// mirrorAuth returns the auth method for the given URL. SSH remotes use the
+// mirror key, and everything else uses any credentials in the URL.
+func (c *Config) mirrorAuth(url string) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if ep.Protocol != "ssh" {
+		return nil, nil
+	}
+
+	if c.MirrorKey == nil {
+		return nil, errors.New("no mirror key found")
+	}
+
+	signer, err := gossh.NewSignerFromSigner(c.MirrorKey)
+	if err != nil {
+		return nil, err
+	}
+
+	user := ep.User
+	if user == "" {
+		user = "git"
+	}
+
+	auth := &gitssh.PublicKeys{User: user, Signer: signer}
+
+	// Without a known_hosts file in the admin repo, the default known_hosts
+	// file for the user running gitdir is used.
+	if c.mirrorKnownHosts != nil {
+		auth.HostKeyCallback = knownHostsCallback(c.mirrorKnownHosts)
+	}
+
+	return auth, nil
+}
+
+// knownHostsCallback verifies host keys against the given known_hosts data.
+// Hashed hostnames and markers are not supported.
+func knownHostsCallback(data []byte) gossh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		host := knownhosts.Normalize(hostname)
+		rest := data
+
+		for len(rest) > 0 {
+			marker, hosts, pk, _, next, err := gossh.ParseKnownHosts(rest)
+			if err != nil {
+				break
+			}
+
+			rest = next
+
+			if marker != "" || !bytes.Equal(pk.Marshal(), key.Marshal()) {
+				continue
+			}
+
+			if listContainsStr(hosts, host) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("host key for %s not found in %s", host, mirrorKnownHostsPath)
+	}
+}
+
+func mirrorStatusPath(mirror *repoMirror) string {
+	sum := sha256.Sum256([]byte(mirror.URL))
+
+	return path.Join(mirrorStatusDir, mirror.Repo.Path(), mirror.Direction+"-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+func (c *Config) readMirrorStatus(mirror *repoMirror) (*MirrorStatus, error) {
+	status := &MirrorStatus{
+		Repo:      c.RepoName(mirror.Repo),
+		Direction: mirror.Direction,
+		URL:       mirror.URL,
+	}
+
+	data, err := util.ReadFile(c.fs, mirrorStatusPath(mirror))
+	if errors.Is(err, os.ErrNotExist) {
+		return status, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, status)
+	if err != nil {
+		return nil, err
+	}
+
+	// The repo name depends on the current prefixes, so it's always set from
+	// the config.
+	status.Repo = c.RepoName(mirror.Repo)
+
+	return status, nil
+}
+
+// writeMirrorStatus replaces the status of a mirror. As with webhook
+// deliveries, a temp file is renamed so readers never see a partial write.
+func (c *Config) writeMirrorStatus(mirror *repoMirror, status *MirrorStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	filename := mirrorStatusPath(mirror)
+
+	err = c.fs.MkdirAll(path.Dir(filename), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmpName := path.Join(path.Dir(filename), "."+path.Base(filename)+".tmp")
+
+	err = util.WriteFile(c.fs, tmpName, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return c.fs.Rename(tmpName, filename)
+}
+
+// MirrorStatuses returns the status of every mirror in the config.
+func (c *Config) MirrorStatuses() ([]*MirrorStatus, error) {
+	var ret []*MirrorStatus
+
+	for _, mirror := range c.repoMirrors() {
+		status, err := c.readMirrorStatus(mirror)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, status)
+	}
+
+	return ret, nil
+}
+
+// syncMirror fetches from or pushes to a single mirror and records the
+// result. The repo should be locked by the caller when fetching.
+func (c *Config) syncMirror(ctx context.Context, mirror *repoMirror, now time.Time) error {
+	status, err := c.readMirrorStatus(mirror)
+	if err != nil {
+		return err
+	}
+
+	syncErr := c.runMirror(ctx, mirror)
+
+	status.LastAttempt = now
+	status.LastError = ""
+
+	if syncErr != nil {
+		status.LastError = syncErr.Error()
+	} else {
+		status.LastSuccess = now
+	}
+
+	err = c.writeMirrorStatus(mirror, status)
+	if syncErr != nil {
+		return fmt.Errorf("%s mirror %s: %w", mirror.Direction, mirror.URL, syncErr)
+	}
+
+	return err
+}
+
+func (c *Config) runMirror(ctx context.Context, mirror *repoMirror) error {
+	ctx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	defer cancel()
+
+	auth, err := c.mirrorAuth(mirror.URL)
+	if err != nil {
+		return err
+	}
+
+	if mirror.Direction == MirrorDirectionPush {
+		repo, err := git.Open(c.fs, mirror.Repo.Path())
+		if err != nil {
+			return err
+		}
+
+		return repo.PushMirror(ctx, mirror.URL, auth)
+	}
+
+	// Pull mirrors are created if they don't exist yet.
+	repo, err := c.ensureRepo(mirror.Repo)
+	if err != nil {
+		return err
+	}
+
+	return repo.FetchMirror(ctx, mirror.URL, auth)
+}
+
+// pushMirrors pushes the given repo to all of its push mirrors. Every mirror
+// is attempted, even if an earlier one fails.
+func (c *Config) pushMirrors(ctx context.Context, repo *RepoLookup) error {
+	var errors []error
+
+	for _, mirror := range c.lookupMirrors(repo) {
+		if mirror.Direction == MirrorDirectionPush {
+			errors = append(errors, c.syncMirror(ctx, mirror, time.Now()))
+		}
+	}
+
+	return newMultiError(errors...)
+}
+
+// SyncMirror fetches the pull mirror of the given repo, then pushes the repo
+// to any push mirrors.
+func (serv *Server) SyncMirror(ctx context.Context, repoName string) error {
+	config := serv.GetAdminConfig()
+
+	repo, err := config.lookupRepo(repoName)
+	if err != nil {
+		return err
+	}
+
+	for _, mirror := range config.lookupMirrors(repo) {
+		if mirror.Direction == MirrorDirectionPull {
+			return serv.syncPullMirror(ctx, config, mirror, time.Now())
+		}
+	}
+
+	return ErrMirrorNotFound
+}
+
+func (serv *Server) syncPullMirror(ctx context.Context, config *Config, mirror *repoMirror, now time.Time) error {
+	defer serv.repos.Lock(repoLockPath(mirror.Repo))()
+
+	err := config.syncMirror(ctx, mirror, now)
+	if err != nil {
+		return err
+	}
+
+	return config.pushMirrors(ctx, mirror.Repo)
+}
+
+// syncDueMirrors fetches every pull mirror whose interval has passed since
+// it was last attempted.
+func (serv *Server) syncDueMirrors(ctx context.Context, now time.Time) {
+	config := serv.GetAdminConfig()
+
+	for _, mirror := range config.repoMirrors() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if mirror.Direction != MirrorDirectionPull {
+			continue
+		}
+
+		slog := serv.log.With().Str("repo", config.RepoName(mirror.Repo)).Str("url", mirror.URL).Logger()
+
+		status, err := config.readMirrorStatus(mirror)
+		if err != nil {
+			slog.Error().Err(err).Msg("Failed to read mirror status")
+			continue
+		}
+
+		if now.Sub(status.LastAttempt) < mirror.Interval {
+			continue
+		}
+
+		err = serv.syncPullMirror(ctx, config, mirror, now)
+		if err != nil {
+			slog.Warn().Err(err).Msg("Failed to sync mirror")
+		} else {
+			slog.Info().Msg("Synced mirror")
+		}
+	}
+}
+
+// RunMirrors fetches pull mirrors on their schedule until the given context
+// is cancelled.
+func (serv *Server) RunMirrors(ctx context.Context) {
+	serv.log.Info().Msg("Starting mirror worker")
+
+	ticker := time.NewTicker(mirrorPollInterval)
+	defer ticker.Stop()
+
+	for {
+		serv.syncDueMirrors(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package gitdir
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestKnownHostsCallback(t *testing.T) {
+	t.Parallel()
+
+	pk, err := models.GenerateEd25519PrivateKey()
+	require.Nil(t, err)
+
+	key, err := gossh.NewPublicKey(pk.Public())
+	require.Nil(t, err)
+
+	other, err := models.GenerateEd25519PrivateKey()
+	require.Nil(t, err)
+
+	otherKey, err := gossh.NewPublicKey(other.Public())
+	require.Nil(t, err)
+
+	line := string(gossh.MarshalAuthorizedKey(key))
+	data := []byte("# comment\n" + "example.com " + line + "[example.com]:2222 " + line)
+	cb := knownHostsCallback(data)
+	addr := &net.TCPAddr{}
+
+	assert.Nil(t, cb("example.com:22", addr, key))
+	assert.Nil(t, cb("example.com:2222", addr, key))
+	assert.NotNil(t, cb("example.com:22", addr, otherKey))
+	assert.NotNil(t, cb("example.org:22", addr, key))
+}
+
+func TestMirrors(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	// The file transport runs the git binaries.
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	serv := newTestRepoServer(t)
+
+	remoteFS := osfs.New(t.TempDir())
+
+	upstream, err := git.EnsureRepo(remoteFS, "upstream")
+	require.Nil(t, err)
+
+	offsite, err := git.EnsureRepo(remoteFS, "offsite")
+	require.Nil(t, err)
+
+	// The offsite repo isn't served by gitdir, so it shouldn't run our hooks.
+	require.Nil(t, os.RemoveAll(filepath.Join(remoteFS.Root(), "offsite.git", "hooks")))
+
+	first := newTestCommit(t, upstream, "first")
+
+	// Push mirrors are overwritten to match the repo, and anything which
+	// doesn't exist in the repo is removed.
+	stale := newTestCommit(t, offsite, "stale")
+	require.Nil(t, offsite.Repo.Storer.SetReference(
+		plumbing.NewHashReference("refs/heads/stale", plumbing.NewHash(stale))))
+
+	upstreamURL := "file://" + filepath.Join(remoteFS.Root(), "upstream.git")
+	offsiteURL := "file://" + filepath.Join(remoteFS.Root(), "offsite.git")
+	missingURL := "file://" + filepath.Join(remoteFS.Root(), "missing.git")
+
+	err = serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", AnonymousUser, "Added mirrors", func(targetNode *yaml.Node) error {
+			mirrorNode := ensureNodePath(targetNode, []string{"repos", "mirrored", "mirror"})
+
+			pullNode := ensureNodePath(mirrorNode, []string{"pull"})
+			pullNode.EnsureKey("url", yaml.NewScalarNode(upstreamURL, ""), nil)
+			pullNode.EnsureKey("interval", yaml.NewScalarNode("1h", ""), nil)
+
+			pushNode, _ := mirrorNode.EnsureKey("push", yaml.NewSequenceNode(), nil)
+
+			for _, url := range []string{offsiteURL, missingURL} {
+				node := yaml.NewMappingNode()
+				node.EnsureKey("url", yaml.NewScalarNode(url, ""), nil)
+				pushNode.AppendNode(node)
+			}
+
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	config := serv.GetAdminConfig()
+	require.NotNil(t, config.MirrorKey)
+
+	key, err := config.MirrorPublicKey()
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(key, "ssh-ed25519 "))
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// Pull mirrors are created on the first sync and pushed to all the push
+	// mirrors.
+	serv.syncDueMirrors(context.Background(), now)
+
+	requireRef(t, serv.fs, "top-level/mirrored", "refs/heads/master", first)
+	requireRef(t, remoteFS, "offsite", "refs/heads/master", first)
+	requireRef(t, remoteFS, "offsite", "refs/heads/stale", "")
+
+	statuses, err := config.MirrorStatuses()
+	require.Nil(t, err)
+	require.Len(t, statuses, 3)
+
+	assert.Equal(t, MirrorDirectionPull, statuses[0].Direction)
+	assert.Equal(t, "mirrored", statuses[0].Repo)
+	assert.Equal(t, now, statuses[0].LastSuccess.UTC())
+	assert.False(t, statuses[1].LastSuccess.IsZero())
+	assert.Empty(t, statuses[1].LastError)
+	assert.Equal(t, missingURL, statuses[2].URL)
+	assert.True(t, statuses[2].LastSuccess.IsZero())
+	assert.NotEmpty(t, statuses[2].LastError)
+
+	// Pull mirrors aren't fetched again until their interval has passed.
+	second := newTestCommit(t, upstream, "second")
+
+	serv.syncDueMirrors(context.Background(), now.Add(time.Minute))
+	requireRef(t, serv.fs, "top-level/mirrored", "refs/heads/master", first)
+
+	serv.syncDueMirrors(context.Background(), now.Add(time.Hour))
+	requireRef(t, serv.fs, "top-level/mirrored", "refs/heads/master", second)
+	requireRef(t, remoteFS, "offsite", "refs/heads/master", second)
+
+	// Push mirrors are also updated from post-receive.
+	mirrored, err := git.Open(serv.fs, "top-level/mirrored")
+	require.Nil(t, err)
+	require.Nil(t, mirrored.Checkout(""))
+
+	third := newTestCommit(t, mirrored, "third")
+
+	err = config.RunHook("post-receive", "mirrored", "an-admin", nil, nil, strings.NewReader(""))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), missingURL)
+
+	requireRef(t, remoteFS, "offsite", "refs/heads/master", third)
+
+	// Mirrors can only be configured by admins.
+	c := NewConfig(serv.fs)
+	c.Options.UserConfigRepos = true
+	c.Users["non-admin"] = models.NewAdminConfigUser()
+
+	userRepo, err := git.EnsureRepo(serv.fs, "admin/user-non-admin")
+	require.Nil(t, err)
+	require.Nil(t, userRepo.Checkout(""))
+	require.Nil(t, userRepo.CreateFile("config.yml", []byte("repos:\n  a-repo:\n    mirror:\n      pull:\n        url: "+upstreamURL+"\n")))
+	require.Nil(t, userRepo.Commit("Added mirror", nil))
+
+	require.Nil(t, c.loadUserConfig("non-admin"))
+	assert.Nil(t, c.Users["non-admin"].Repos["a-repo"].Mirror.Pull)
+}
@@ -1,17 +1,26 @@
 package models
 
 import (
+	"time"
+
 	yaml "gopkg.in/yaml.v3"
 )
 
 // AdminConfig is the config.yml that comes from the admin repo.
 type AdminConfig struct {
-	Invites map[string]string           `yaml:"invites"`
+	Invites map[string]*Invite          `yaml:"invites"`
 	Users   map[string]*AdminConfigUser `yaml:"users"`
 	Orgs    map[string]*OrgConfig       `yaml:"orgs"`
 	Repos   map[string]*RepoConfig      `yaml:"repos"`
 	Groups  map[string][]string         `yaml:"groups"`
+	Quota   QuotaConfig                 `yaml:"quota"`
 	Options AdminConfigOptions          `yaml:"options"`
+
+	// Hooks are run for every repo.
+	Hooks HookConfig `yaml:"hooks"`
+
+	// ApprovedHooks are the hook scripts which user and org configs may use.
+	ApprovedHooks []string `yaml:"approved_hooks"`
 }
 
 // AdminConfigUser defines additional fields which main be loaded from the admin
@@ -21,7 +30,10 @@ type AdminConfigUser struct {
 
 	IsAdmin  bool `yaml:"is_admin"`
 	Disabled bool `yaml:"disabled"`
-	// Invites  []string `yaml:"invites"`
+
+	// Tokens are used to authenticate this user over HTTP. They can either be
+	// stored as-is or as a hex encoded sha256 hash prefixed with "sha256:".
+	Tokens []string `yaml:"tokens"`
 }
 
 // NewAdminConfigUser returns a blank AdminConfigUser.
@@ -65,20 +77,41 @@ type AdminConfigOptions struct {
 	// OrgConfigRepos allows org admins to specify repos in their own config,
 	// rather than relying on the main admin config.
 	OrgConfigRepos bool `yaml:"org_config_repos"`
+
+	// AnonymousRead allows connections with unknown keys to read any repo
+	// marked as public.
+	AnonymousRead bool `yaml:"anonymous_read"`
+
+	// AnonymousUser is a username which will always be treated as anonymous
+	// when AnonymousRead is enabled, even if the key is known.
+	AnonymousUser string `yaml:"anonymous_user"`
+
+	// TrustedUserCAKeys are CA keys which may sign user certificates. A
+	// certificate's principals are used as usernames.
+	TrustedUserCAKeys []PublicKey `yaml:"trusted_user_ca_keys"`
+
+	// DefaultBranch is the branch HEAD points to in new repos, including new
+	// user and org config repos.
+	DefaultBranch string `yaml:"default_branch"`
+
+	// HookTimeout is how long each hook in a repo's hook directories may run
+	// for before it is killed.
+	HookTimeout time.Duration `yaml:"hook_timeout"`
 }
 
 // DefaultAdminConfigOptions is an object with all values set to their default.
 var DefaultAdminConfigOptions = AdminConfigOptions{
-	GitUser:      "git",
-	OrgPrefix:    "@",
-	UserPrefix:   "~",
-	InvitePrefix: "invite:",
+	GitUser:       "git",
+	OrgPrefix:     "@",
+	UserPrefix:    "~",
+	InvitePrefix:  "invite:",
+	DefaultBranch: "master",
 }
 
 // NewAdminConfig returns a blank admin config with any defaults set.
 func NewAdminConfig() *AdminConfig {
 	return &AdminConfig{
-		Invites: make(map[string]string),
+		Invites: make(map[string]*Invite),
 		Users:   make(map[string]*AdminConfigUser),
 		Orgs:    make(map[string]*OrgConfig),
 		Repos:   make(map[string]*RepoConfig),
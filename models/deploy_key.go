@@ -0,0 +1,30 @@
+package models
+
+// Deploy key modes.
+const (
+	// DeployKeyReadOnly only allows cloning and fetching. This is the default.
+	DeployKeyReadOnly = "read-only"
+
+	// DeployKeyReadWrite also allows pushing.
+	DeployKeyReadWrite = "read-write"
+)
+
+// DeployKey is a key which only has access to a single repo, rather than
+// belonging to a user. This is mostly useful for CI machines.
+type DeployKey struct {
+	Key PublicKey `yaml:"key"`
+
+	// Mode is either read-only or read-write. If it is empty, the key is
+	// read-only.
+	Mode string `yaml:"mode"`
+}
+
+// ValidMode returns true if the mode of this deploy key is known.
+func (k *DeployKey) ValidMode() bool {
+	switch k.Mode {
+	case "", DeployKeyReadOnly, DeployKeyReadWrite:
+		return true
+	}
+
+	return false
+}
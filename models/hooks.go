@@ -0,0 +1,5 @@
+package models
+
+// HookConfig maps a git hook, such as pre-receive, to the scripts from the
+// hooks directory of the admin repo which should be run for it.
+type HookConfig map[string][]string
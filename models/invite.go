@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+)
+
+// Invite represents a code which can be used to add a public key to a user.
+// In the config, an invite can either be a plain username or a mapping with
+// additional restrictions.
+type Invite struct {
+	// User is the user this invite will add a key to.
+	User string `yaml:"user"`
+
+	// Expires is the time after which this invite can no longer be used. A
+	// zero value means it never expires.
+	Expires time.Time `yaml:"expires"`
+
+	// MaxUses is the number of times this invite can be used before it is
+	// removed. If not set, an invite can only be used once.
+	MaxUses int `yaml:"max_uses"`
+
+	// Uses is the number of times this invite has already been used.
+	Uses int `yaml:"uses"`
+}
+
+// NewInvite returns a single use invite for the given user.
+func NewInvite(user string) *Invite {
+	return &Invite{
+		User: user,
+	}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.UnmarshalYAML.
+func (i *Invite) UnmarshalYAML(unmarshal func(v interface{}) error) error {
+	// The short form of an invite is simply the username.
+	var username string
+	if err := unmarshal(&username); err == nil {
+		*i = *NewInvite(username)
+		return nil
+	}
+
+	// We use a type alias here so we don't recurse back into this method.
+	type rawInvite Invite
+
+	var raw rawInvite
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*i = Invite(raw)
+
+	return nil
+}
+
+// RemainingUses returns how many more times this invite can be used.
+func (i *Invite) RemainingUses() int {
+	maxUses := i.MaxUses
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+
+	return maxUses - i.Uses
+}
+
+// Expired returns true if this invite can no longer be used at the given time.
+func (i *Invite) Expired(now time.Time) bool {
+	if i.RemainingUses() <= 0 {
+		return true
+	}
+
+	return !i.Expires.IsZero() && now.After(i.Expires)
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ignoredKeyOptions are authorized_keys options which only restrict features
+// gitdir doesn't provide, so they can safely be ignored.
+var ignoredKeyOptions = map[string]bool{
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-x11-forwarding":   true,
+	"restrict":            true,
+}
+
+// KeyRestrictions are the authorized_keys options gitdir supports on a key.
+type KeyRestrictions struct {
+	// From and NotFrom come from the from option. If either is set, the key
+	// can only be used from an address in From which isn't in NotFrom.
+	From    []*net.IPNet
+	NotFrom []*net.IPNet
+
+	// ExpiresAt comes from the expiry-time option. If it is zero, the key
+	// never expires.
+	ExpiresAt time.Time
+
+	// ReadOnly comes from the read-only option, which is specific to gitdir.
+	// Sessions using the key will only have read access.
+	ReadOnly bool
+}
+
+// ParseKeyRestrictions parses the given authorized_keys options. Options
+// which restrict something gitdir doesn't support are an error, so keys
+// aren't accidentally less restricted than expected.
+func ParseKeyRestrictions(options []string) (KeyRestrictions, error) {
+	var ret KeyRestrictions
+
+	for _, option := range options {
+		name, value := option, ""
+
+		if idx := strings.Index(option, "="); idx != -1 {
+			name = option[:idx]
+			value = strings.TrimSuffix(strings.TrimPrefix(option[idx+1:], `"`), `"`)
+		}
+
+		name = strings.ToLower(name)
+
+		var err error
+
+		switch name {
+		case "from":
+			ret.From, ret.NotFrom, err = parseFromOption(value)
+		case "expiry-time":
+			ret.ExpiresAt, err = parseExpiryTime(value)
+		case "read-only":
+			ret.ReadOnly = true
+		default:
+			if !ignoredKeyOptions[name] {
+				err = fmt.Errorf("unsupported key option %q", name)
+			}
+		}
+
+		if err != nil {
+			return KeyRestrictions{}, err
+		}
+	}
+
+	return ret, nil
+}
+
+// parseFromOption parses a comma separated list of addresses and CIDR ranges,
+// any of which may be negated with a !. Unlike OpenSSH, host names and
+// wildcards are not supported.
+func parseFromOption(value string) ([]*net.IPNet, []*net.IPNet, error) {
+	var from, notFrom []*net.IPNet
+
+	for _, pattern := range strings.Split(value, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		ipNet, err := parseIPNet(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if negated {
+			notFrom = append(notFrom, ipNet)
+		} else {
+			from = append(from, ipNet)
+		}
+	}
+
+	return from, notFrom, nil
+}
+
+func parseIPNet(pattern string) (*net.IPNet, error) {
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q in from option", pattern)
+		}
+
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(pattern)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q in from option", pattern)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseExpiryTime parses a time in the same format as OpenSSH, YYYYMMDD or
+// YYYYMMDDHHMM[SS]. Times are in the local time zone unless they end with a Z.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+
+	if strings.HasSuffix(value, "Z") {
+		value = strings.TrimSuffix(value, "Z")
+		loc = time.UTC
+	}
+
+	var layout string
+
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+
+	ret, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+
+	return ret, nil
+}
+
+// AllowsIP returns true if the key can be used from the given address.
+func (r *KeyRestrictions) AllowsIP(ip net.IP) bool {
+	if len(r.From) == 0 && len(r.NotFrom) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range r.NotFrom {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, ipNet := range r.From {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expired returns true if the key has expired as of the given time.
+func (r *KeyRestrictions) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// DefaultMirrorInterval is how often a pull mirror is fetched if no interval
+// is given.
+const DefaultMirrorInterval = time.Hour
+
+// MirrorConfig configures which remotes a repo is mirrored from and to.
+type MirrorConfig struct {
+	// Pull is a remote which will be fetched on a schedule. Branches and tags
+	// which exist on the remote will overwrite the local copies.
+	Pull *PullMirror `yaml:"pull"`
+
+	// Push are remotes which will be pushed to after every push to this repo.
+	// They will be updated to exactly match this repo.
+	Push []*PushMirror `yaml:"push"`
+}
+
+// PullMirror is a remote a repo is fetched from.
+type PullMirror struct {
+	URL string `yaml:"url"`
+
+	// Interval is how long to wait between fetches. If it is 0,
+	// DefaultMirrorInterval will be used.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// PushMirror is a remote a repo is pushed to.
+type PushMirror struct {
+	URL string `yaml:"url"`
+}
@@ -11,6 +11,12 @@ type OrgConfig struct {
 	Write []string               `yaml:"write"`
 	Read  []string               `yaml:"read"`
 	Repos map[string]*RepoConfig `yaml:"repos"`
+
+	// Webhooks will be notified whenever any repo in this org is pushed to.
+	Webhooks []*Webhook `yaml:"webhooks"`
+
+	// Hooks are run for every repo in this org.
+	Hooks HookConfig `yaml:"hooks"`
 }
 
 // NewOrgConfig returns a new, empty OrgConfig.
@@ -2,7 +2,9 @@ package models
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -72,6 +74,57 @@ func (pk *ed25519PrivateKey) MarshalPrivateKey() ([]byte, error) {
 	return privatePEM, nil
 }
 
+type ecdsaPrivateKey struct {
+	*ecdsa.PrivateKey
+}
+
+// ParseECDSAPrivateKey parses an ECDSA private key.
+func ParseECDSAPrivateKey(data []byte) (PrivateKey, error) {
+	privateKey, err := gossh.ParseRawPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA key")
+	}
+
+	return &ecdsaPrivateKey{ecdsaKey}, nil
+}
+
+// GenerateECDSAPrivateKey generates a new ECDSA private key using the P-256
+// curve.
+func GenerateECDSAPrivateKey() (PrivateKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdsaPrivateKey{privateKey}, nil
+}
+
+// MarshalPrivateKey implements PrivateKey.MarshalPrivateKey.
+func (pk *ecdsaPrivateKey) MarshalPrivateKey() ([]byte, error) {
+	// Get ASN.1 DER format
+	privDER, err := x509.MarshalECPrivateKey(pk.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// pem.Block
+	privBlock := pem.Block{
+		Type:    "EC PRIVATE KEY",
+		Headers: nil,
+		Bytes:   privDER,
+	}
+
+	// Private key in PEM format
+	privatePEM := pem.EncodeToMemory(&privBlock)
+
+	return privatePEM, nil
+}
+
 type rsaPrivateKey struct {
 	*rsa.PrivateKey
 }
@@ -2,27 +2,31 @@ package models
 
 import (
 	"bytes"
+	"strings"
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 )
 
-// PublicKey is a wrapper around gossh.PublicKey to also store the comment.
-// Note when using that pk.Marshal() handles the wire format, not the
-// authorized keys format.
+// PublicKey is a wrapper around gossh.PublicKey to also store the comment and
+// any options. Note when using that pk.Marshal() handles the wire format, not
+// the authorized keys format.
 type PublicKey struct {
 	ssh.PublicKey
 
 	Comment string
+
+	// Options are the authorized keys options given before the key, and
+	// Restrictions are what was parsed from them.
+	Options      []string
+	Restrictions KeyRestrictions
 }
 
 // ParsePublicKey will return a PublicKey from the given data.
 func ParsePublicKey(data []byte) (*PublicKey, error) {
-	var err error
-
 	var pk PublicKey
 
-	pk.PublicKey, pk.Comment, _, _, err = ssh.ParseAuthorizedKey(data)
+	err := pk.parse(data)
 	if err != nil {
 		return nil, err
 	}
@@ -30,21 +34,29 @@ func ParsePublicKey(data []byte) (*PublicKey, error) {
 	return &pk, nil
 }
 
-// UnmarshalYAML implements yaml.Unmarshaler.UnmarshalYAML.
-func (pk *PublicKey) UnmarshalYAML(unmarshal func(v interface{}) error) error {
-	var rawData string
+func (pk *PublicKey) parse(data []byte) error {
+	var err error
 
-	err := unmarshal(&rawData)
+	pk.PublicKey, pk.Comment, pk.Options, _, err = ssh.ParseAuthorizedKey(data)
 	if err != nil {
 		return err
 	}
 
-	pk.PublicKey, pk.Comment, _, _, err = ssh.ParseAuthorizedKey([]byte(rawData))
+	pk.Restrictions, err = ParseKeyRestrictions(pk.Options)
+
+	return err
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.UnmarshalYAML.
+func (pk *PublicKey) UnmarshalYAML(unmarshal func(v interface{}) error) error {
+	var rawData string
+
+	err := unmarshal(&rawData)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return pk.parse([]byte(rawData))
 }
 
 // String implements fmt.Stringer.
@@ -63,10 +75,14 @@ func (pk *PublicKey) RawMarshalAuthorizedKey() string {
 }
 
 // MarshalAuthorizedKey converts a key to the authorized keys format,
-// including a comment.
+// including any options and a comment.
 func (pk *PublicKey) MarshalAuthorizedKey() string {
 	key := pk.RawMarshalAuthorizedKey()
 
+	if len(pk.Options) > 0 {
+		key = strings.Join(pk.Options, ",") + " " + key
+	}
+
 	if pk.Comment != "" {
 		return key + " " + pk.Comment
 	}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a size on disk. In the config, it can either be a number of
+// bytes or a number with a unit, such as 500MB or 2GiB.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	Suffix string
+	Size   ByteSize
+}{
+	// Longer suffixes need to come first so they're matched before the
+	// shorter ones.
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"TIB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size in bytes with an optional unit. Units are not
+// case sensitive.
+func ParseByteSize(raw string) (ByteSize, error) {
+	value := strings.ToUpper(strings.TrimSpace(raw))
+	unit := ByteSize(1)
+
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(value, u.Suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.Suffix))
+			unit = u.Size
+
+			break
+		}
+	}
+
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+
+	return ByteSize(size * float64(unit)), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.UnmarshalYAML.
+func (s *ByteSize) UnmarshalYAML(unmarshal func(v interface{}) error) error {
+	var rawData string
+
+	err := unmarshal(&rawData)
+	if err != nil {
+		return err
+	}
+
+	*s, err = ParseByteSize(rawData)
+
+	return err
+}
+
+// String implements fmt.Stringer.
+func (s ByteSize) String() string {
+	if s < 1<<10 {
+		return fmt.Sprintf("%dB", int64(s))
+	}
+
+	size := float64(s)
+	suffix := "KiB"
+
+	for _, next := range []string{"MiB", "GiB", "TiB"} {
+		if size < 1<<20 {
+			break
+		}
+
+		size /= 1 << 10
+		suffix = next
+	}
+
+	return fmt.Sprintf("%.1f%s", size/(1<<10), suffix)
+}
+
+// QuotaConfig limits how much disk space can be used by repos. A limit of 0
+// means there is no limit.
+type QuotaConfig struct {
+	// Default is the limit for every user and org without their own limit.
+	// It applies to all of their repos combined.
+	Default ByteSize `yaml:"default"`
+
+	// Users and Orgs override the default for specific users and orgs.
+	Users map[string]ByteSize `yaml:"users"`
+	Orgs  map[string]ByteSize `yaml:"orgs"`
+
+	// Repos limits individual repos, in addition to any user or org limits.
+	// They are keyed by the name used when cloning them.
+	Repos map[string]ByteSize `yaml:"repos"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"path"
+	"strings"
+)
+
+// RefRule restricts what can be done to any refs matching a pattern. Note that
+// by default, a rule will disallow force pushes and deleting refs.
+type RefRule struct {
+	// Pattern is a glob matched against the full ref name, such as
+	// refs/heads/main or refs/tags/*. Note that as with path.Match, a * will
+	// not match a /. A pattern ending in /** matches any ref nested under the
+	// rest of the pattern, such as refs/heads/release/**.
+	Pattern string `yaml:"pattern"`
+
+	// Write is the list of users and groups who may push to matching refs. If
+	// it is empty, anyone with write access to the repo may push.
+	Write []string `yaml:"write"`
+
+	// AllowForcePush allows non-fast-forward updates to matching refs.
+	AllowForcePush bool `yaml:"allow_force_push"`
+
+	// AllowDelete allows matching refs to be deleted.
+	AllowDelete bool `yaml:"allow_delete"`
+
+	// Immutable stops matching refs from being changed once they have been
+	// created. This is mostly useful for tags. It can't be combined with
+	// AllowDelete, as that would let a ref be deleted and recreated elsewhere.
+	Immutable bool `yaml:"immutable"`
+}
+
+// Matches returns true if the given ref name matches this rule.
+func (r *RefRule) Matches(ref string) bool {
+	prefix := strings.TrimSuffix(r.Pattern, "/**")
+	if prefix == r.Pattern {
+		matched, err := path.Match(r.Pattern, ref)
+		return err == nil && matched
+	}
+
+	// The prefix is matched against the same number of segments of the ref,
+	// and there must be at least one segment left over.
+	segments := strings.Count(prefix, "/") + 1
+	parts := strings.SplitN(ref, "/", segments+1)
+
+	if len(parts) <= segments {
+		return false
+	}
+
+	matched, err := path.Match(prefix, strings.Join(parts[:segments], "/"))
+
+	return err == nil && matched
+}
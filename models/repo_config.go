@@ -5,13 +5,33 @@ package models
 type RepoConfig struct {
 	// Public allows any user of the service to access this repository for
 	// reading
-	Public bool
+	Public bool `yaml:"public"`
 
 	// Any user or group who explicitly has write access
-	Write []string
+	Write []string `yaml:"write"`
 
 	// Any user or group who explicitly has read access
-	Read []string
+	Read []string `yaml:"read"`
+
+	// Refs contains additional restrictions on specific branches or tags.
+	Refs []*RefRule `yaml:"refs"`
+
+	// Webhooks will be notified whenever this repo is pushed to.
+	Webhooks []*Webhook `yaml:"webhooks"`
+
+	// Mirror configures remotes this repo is mirrored from and to. It may
+	// only be set in the admin config.
+	Mirror MirrorConfig `yaml:"mirror"`
+
+	// DefaultBranch overrides the default_branch option when this repo is
+	// created.
+	DefaultBranch string `yaml:"default_branch"`
+
+	// Hooks are run for this repo in addition to any org or global hooks.
+	Hooks HookConfig `yaml:"hooks"`
+
+	// DeployKeys can access only this repo.
+	DeployKeys []*DeployKey `yaml:"deploy_keys"`
 }
 
 // NewRepoConfig returns a blank RepoConfig.
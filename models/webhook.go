@@ -0,0 +1,45 @@
+package models
+
+// Webhook events which can be used to filter what a webhook is sent for.
+const (
+	// WebhookEventPush is sent when any branch is created or updated.
+	WebhookEventPush = "push"
+
+	// WebhookEventTag is sent when a tag is created, updated or deleted.
+	WebhookEventTag = "tag"
+
+	// WebhookEventBranchCreate is sent when a branch is created.
+	WebhookEventBranchCreate = "branch_create"
+
+	// WebhookEventBranchDelete is sent when a branch is deleted.
+	WebhookEventBranchDelete = "branch_delete"
+)
+
+// Webhook represents a URL which will be notified when a repo is pushed to.
+type Webhook struct {
+	// URL is where the payload will be POSTed to.
+	URL string `yaml:"url"`
+
+	// Secret is used to sign the payload with HMAC-SHA256. If it is empty, the
+	// payload will not be signed.
+	Secret string `yaml:"secret"`
+
+	// Events limits which events this webhook will be sent for. If it is
+	// empty, it will be sent for all events.
+	Events []string `yaml:"events"`
+}
+
+// WantsEvent returns true if this webhook should be sent for the given event.
+func (w *Webhook) WantsEvent(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
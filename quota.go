@@ -0,0 +1,232 @@
+package gitdir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+// QuotaUsage is the disk space used by an area of the server. Limit is 0 if
+// the area has no quota.
+type QuotaUsage struct {
+	Area  string
+	Used  models.ByteSize
+	Limit models.ByteSize
+}
+
+// QuotaReport returns the disk usage of the config repos, the top level repos
+// and every user and org which has repos on disk.
+func (c *Config) QuotaReport() ([]QuotaUsage, error) {
+	admin, err := dirSize(c.fs, "admin")
+	if err != nil {
+		return nil, err
+	}
+
+	topLevel, err := dirSize(c.fs, "top-level")
+	if err != nil {
+		return nil, err
+	}
+
+	report := []QuotaUsage{
+		{Area: "admin", Used: admin},
+		{Area: "top-level", Used: topLevel},
+	}
+
+	users, err := c.quotaAreaUsage("users", c.Options.UserPrefix, c.userQuota)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs, err := c.quotaAreaUsage("orgs", c.Options.OrgPrefix, c.orgQuota)
+	if err != nil {
+		return nil, err
+	}
+
+	report = append(report, users...)
+	report = append(report, orgs...)
+
+	return report, nil
+}
+
+func (c *Config) quotaAreaUsage(
+	dir string,
+	prefix string,
+	quota func(name string) models.ByteSize,
+) ([]QuotaUsage, error) {
+	entries, err := c.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var ret []QuotaUsage
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		used, err := dirSize(c.fs, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, QuotaUsage{
+			Area:  prefix + entry.Name(),
+			Used:  used,
+			Limit: quota(entry.Name()),
+		})
+	}
+
+	return ret, nil
+}
+
+func (c *Config) userQuota(username string) models.ByteSize {
+	if limit, ok := c.Quota.Users[username]; ok {
+		return limit
+	}
+
+	return c.Quota.Default
+}
+
+func (c *Config) orgQuota(orgName string) models.ByteSize {
+	if limit, ok := c.Quota.Orgs[orgName]; ok {
+		return limit
+	}
+
+	return c.Quota.Default
+}
+
+func (c *Config) repoQuota(repo *RepoLookup) models.ByteSize {
+	for name, limit := range c.Quota.Repos {
+		lookup, err := c.parseRepoPath(sanitizeRepoName(name))
+		if err == nil && lookup.Path() == repo.Path() {
+			return limit
+		}
+	}
+
+	return 0
+}
+
+// checkQuota ensures a push to the given repo doesn't put the repo or its
+// owner over their quota. This is meant to be run from the pre-receive hook,
+// where the incoming objects are in the quarantine, so they're already
+// counted as part of the repo.
+func (c *Config) checkQuota(repo *RepoLookup) error {
+	incoming, err := incomingSize(c.fs, repo.Path()+".git")
+	if err != nil {
+		return err
+	}
+
+	// Pushes without any new objects can't use any more space.
+	if incoming == 0 {
+		return nil
+	}
+
+	checks := []QuotaUsage{
+		{Area: c.RepoName(repo), Limit: c.repoQuota(repo)},
+	}
+	dirs := []string{repo.Path() + ".git"}
+
+	switch repo.Type {
+	case RepoTypeUser:
+		checks = append(checks, QuotaUsage{
+			Area:  c.Options.UserPrefix + repo.PathParts[0],
+			Limit: c.userQuota(repo.PathParts[0]),
+		})
+		dirs = append(dirs, path.Join("users", repo.PathParts[0]))
+	case RepoTypeOrg:
+		checks = append(checks, QuotaUsage{
+			Area:  c.Options.OrgPrefix + repo.PathParts[0],
+			Limit: c.orgQuota(repo.PathParts[0]),
+		})
+		dirs = append(dirs, path.Join("orgs", repo.PathParts[0]))
+	}
+
+	var errors []error
+
+	for i, check := range checks {
+		if check.Limit == 0 {
+			continue
+		}
+
+		check.Used, err = dirSize(c.fs, dirs[i])
+		if err != nil {
+			return err
+		}
+
+		if check.Used > check.Limit {
+			errors = append(errors, fmt.Errorf(
+				"push would put %s over its quota: %s of %s used with %s pushed",
+				check.Area, check.Used, check.Limit, incoming))
+		}
+	}
+
+	return newMultiError(errors...)
+}
+
+// incomingSize returns the size of the objects waiting in the quarantine of
+// the given repo.
+func incomingSize(fs billy.Filesystem, repoDir string) (models.ByteSize, error) {
+	objectsDir := path.Join(repoDir, "objects")
+
+	entries, err := fs.ReadDir(objectsDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var size models.ByteSize
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), git.QuarantinePrefix) {
+			continue
+		}
+
+		dirSize, err := dirSize(fs, path.Join(objectsDir, entry.Name()))
+		if err != nil {
+			return 0, err
+		}
+
+		size += dirSize
+	}
+
+	return size, nil
+}
+
+// dirSize returns the total size of all files in the given directory. If the
+// directory doesn't exist, the size is 0.
+func dirSize(fs billy.Filesystem, dir string) (models.ByteSize, error) {
+	var size models.ByteSize
+
+	err := util.Walk(fs, dir, func(filename string, info os.FileInfo, err error) error {
+		// Files can be removed while we're walking, such as when a push
+		// finishes, which is fine to ignore.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += models.ByteSize(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
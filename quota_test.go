@@ -0,0 +1,219 @@
+package gitdir
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/internal/yaml"
+	"github.com/belak/go-gitdir/models"
+)
+
+func TestParseByteSize(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct { //nolint:gofumpt
+		Input    string
+		Expected models.ByteSize
+		Error    bool
+	}{
+		{"0", 0, false},
+		{"1234", 1234, false},
+		{"10B", 10, false},
+		{"2KB", 2000, false},
+		{"2kib", 2048, false},
+		{"1.5 MiB", 1536 * 1024, false},
+		{"1G", 1 << 30, false},
+		{"3TB", 3e12, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"ten", 0, true},
+		{"10XB", 0, true},
+	}
+
+	for _, test := range tests {
+		size, err := models.ParseByteSize(test.Input)
+		if test.Error {
+			assert.NotNil(t, err, test.Input)
+			continue
+		}
+
+		require.Nil(t, err, test.Input)
+		assert.Equal(t, test.Expected, size, test.Input)
+	}
+
+	assert.Equal(t, "512B", models.ByteSize(512).String())
+	assert.Equal(t, "1.5KiB", models.ByteSize(1536).String())
+	assert.Equal(t, "2.0GiB", models.ByteSize(2<<30).String())
+}
+
+func newTestQuotaConfig(t *testing.T) *Config {
+	t.Helper()
+
+	c := NewConfig(osfs.New(t.TempDir()))
+	c.Users["a-user"] = models.NewAdminConfigUser()
+	c.Orgs["an-org"] = models.NewOrgConfig()
+
+	for _, repoPath := range []string{"users/a-user/a-repo", "orgs/an-org/a-repo", "top-level/a-repo"} {
+		_, err := git.EnsureRepo(c.fs, repoPath)
+		require.Nil(t, err)
+	}
+
+	return c
+}
+
+// addIncoming simulates a push in progress by writing a file of the given
+// size to the quarantine of the repo.
+func addIncoming(t *testing.T, c *Config, repoPath string, size int) {
+	t.Helper()
+
+	filename := path.Join(repoPath+".git", "objects", git.QuarantinePrefix+"test", "objects", "pack", "pack-test.pack")
+	require.Nil(t, util.WriteFile(c.fs, filename, make([]byte, size), 0o644))
+}
+
+func TestCheckQuota(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	c := newTestQuotaConfig(t)
+
+	userRepo, err := c.parseRepoPath("~a-user/a-repo")
+	require.Nil(t, err)
+
+	orgRepo, err := c.parseRepoPath("@an-org/a-repo")
+	require.Nil(t, err)
+
+	topLevelRepo, err := c.parseRepoPath("a-repo")
+	require.Nil(t, err)
+
+	repoSize, err := dirSize(c.fs, "users/a-user/a-repo.git")
+	require.Nil(t, err)
+
+	// Without anything incoming, pushes are always allowed, even if the repo
+	// is already over its quota.
+	c.Quota.Default = 1
+	assert.Nil(t, c.checkQuota(userRepo))
+
+	addIncoming(t, c, "users/a-user/a-repo", 1000)
+	addIncoming(t, c, "orgs/an-org/a-repo", 1000)
+	addIncoming(t, c, "top-level/a-repo", 1000)
+
+	incoming, err := incomingSize(c.fs, "users/a-user/a-repo.git")
+	require.Nil(t, err)
+	assert.Equal(t, models.ByteSize(1000), incoming)
+
+	// The default applies to users and orgs, but not top level repos.
+	assert.NotNil(t, c.checkQuota(userRepo))
+	assert.NotNil(t, c.checkQuota(orgRepo))
+	assert.Nil(t, c.checkQuota(topLevelRepo))
+
+	// Pushes which fit are allowed.
+	c.Quota.Default = repoSize + 1000
+	assert.Nil(t, c.checkQuota(userRepo))
+
+	c.Quota.Default = repoSize + 999
+	assert.NotNil(t, c.checkQuota(userRepo))
+
+	// Users and orgs can be given their own limits, including no limit.
+	c.Quota.Users = map[string]models.ByteSize{"a-user": 0}
+	c.Quota.Orgs = map[string]models.ByteSize{"an-org": 1 << 30}
+	assert.Nil(t, c.checkQuota(userRepo))
+	assert.Nil(t, c.checkQuota(orgRepo))
+
+	// Repo limits apply in addition to the user and org limits.
+	c.Quota.Repos = map[string]models.ByteSize{
+		"~a-user/a-repo": 1,
+		"a-repo":         1,
+	}
+	assert.NotNil(t, c.checkQuota(userRepo))
+	assert.Nil(t, c.checkQuota(orgRepo))
+	assert.NotNil(t, c.checkQuota(topLevelRepo))
+}
+
+func TestQuotaReport(t *testing.T) {
+	t.Parallel()
+
+	c := newTestQuotaConfig(t)
+	c.Quota.Default = 1 << 30
+	c.Quota.Orgs = map[string]models.ByteSize{"an-org": 0}
+
+	report, err := c.QuotaReport()
+	require.Nil(t, err)
+
+	var areas []string
+
+	for _, usage := range report {
+		areas = append(areas, usage.Area)
+
+		if usage.Area != "admin" {
+			assert.NotZero(t, usage.Used, usage.Area)
+		}
+	}
+
+	assert.Equal(t, []string{"admin", "top-level", "~a-user", "@an-org"}, areas)
+	assert.Equal(t, models.ByteSize(0), report[1].Limit)
+	assert.Equal(t, models.ByteSize(1<<30), report[2].Limit)
+	assert.Equal(t, models.ByteSize(0), report[3].Limit)
+}
+
+func TestHTTPPushNativeQuota(t *testing.T) {
+	t.Parallel()
+
+	serv, httpServer := newTestHTTPServer(t, TransportNative)
+
+	err := serv.updateConfig(func(c *Config) error {
+		return c.updateConfigFile("admin/admin", AnonymousUser, "Added a-user", func(targetNode *yaml.Node) error {
+			userNode := ensureNodePath(targetNode, []string{"users", "a-user"})
+			userNode.EnsureKey("is_admin", yaml.NewScalarNode("true", yaml.ScalarTagBool), nil)
+			tokensNode, _ := userNode.EnsureKey("tokens", yaml.NewSequenceNode(), nil)
+			tokensNode.AppendNode(yaml.NewScalarNode("a-token", ""))
+			ensureNodePath(targetNode, []string{"repos", "a-repo"})
+
+			reposNode := ensureNodePath(targetNode, []string{"quota", "repos"})
+			reposNode.EnsureKey("a-repo", yaml.NewScalarNode("1KB", ""), nil)
+
+			return nil
+		})
+	})
+	require.Nil(t, err)
+
+	target := filepath.Join(t.TempDir(), "a-repo")
+	url := "http://a-user:a-token@" + httpServer.Listener.Addr().String() + "/a-repo"
+
+	out, err := exec.Command("git", "clone", url, target).CombinedOutput()
+	require.Nil(t, err, string(out))
+
+	require.Nil(t, os.WriteFile(filepath.Join(target, "big.txt"), make([]byte, 64*1024), 0o600))
+
+	for _, args := range [][]string{
+		{"add", "big.txt"},
+		{"-c", "user.name=a-user", "-c", "user.email=a-user@localhost", "commit", "-m", "Big commit"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = target
+		out, err = cmd.CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+
+	cmd := exec.Command("git", "push", "origin", "HEAD:refs/heads/master")
+	cmd.Dir = target
+	out, err = cmd.CombinedOutput()
+	require.NotNil(t, err)
+	assert.Contains(t, string(out), "over its quota")
+
+	// Objects from the rejected push should not be kept.
+	files, err := serv.fs.ReadDir("top-level/a-repo.git/objects/pack")
+	require.Nil(t, err)
+	assert.Empty(t, files)
+
+	incoming, err := incomingSize(serv.fs, "top-level/a-repo.git")
+	require.Nil(t, err)
+	assert.Zero(t, incoming)
+}
@@ -0,0 +1,105 @@
+package gitdir
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+// checkRefRules ensures the given ref update is allowed by all the ref rules
+// defined on the repo. An error describing every violated rule will be
+// returned if it is not.
+func (c *Config) checkRefRules(
+	lookup *RepoLookup,
+	user *User,
+	ref string,
+	oldHash string,
+	newHash string,
+) error {
+	repoConfig := c.lookupRepoConfig(lookup)
+	if repoConfig == nil {
+		return nil
+	}
+
+	var (
+		isCreate = oldHash == plumbing.ZeroHash.String()
+		isDelete = newHash == plumbing.ZeroHash.String()
+
+		// We only want to look up if this is a fast forward if we actually
+		// need it, as it can be fairly expensive.
+		isFastForward *bool
+	)
+
+	var errors []error
+
+	for _, rule := range repoConfig.Refs {
+		if !rule.Matches(ref) {
+			continue
+		}
+
+		// Repo admins are always allowed to push, but they are still bound by
+		// all the other rules.
+		if len(rule.Write) > 0 && lookup.Access < AccessLevelAdmin &&
+			!c.checkListsForUser(user.Username, rule.Write) {
+			errors = append(errors, fmt.Errorf("%s: you do not have permission to push to this ref", ref))
+			continue
+		}
+
+		switch {
+		case isCreate:
+			// Creating a ref is allowed by every rule other than write.
+		case isDelete:
+			if !rule.AllowDelete {
+				errors = append(errors, fmt.Errorf("%s: deleting this ref is not allowed", ref))
+			}
+		case rule.Immutable:
+			errors = append(errors, fmt.Errorf("%s: this ref is immutable", ref))
+		case !rule.AllowForcePush:
+			if isFastForward == nil {
+				ff, err := c.isFastForward(lookup, oldHash, newHash)
+				if err != nil {
+					return err
+				}
+
+				isFastForward = &ff
+			}
+
+			if !*isFastForward {
+				errors = append(errors, fmt.Errorf("%s: force pushing to this ref is not allowed", ref))
+			}
+		}
+	}
+
+	return newMultiError(errors...)
+}
+
+// validateRefRules ensures no ref rule combines options which would undermine
+// each other. Allowing immutable refs to be deleted would let them be
+// recreated pointing somewhere else.
+func (c *Config) validateRefRules() error {
+	var errors []error
+
+	for _, entry := range c.listRepoConfigs() {
+		for _, rule := range entry.Config.Refs {
+			if rule.Immutable && rule.AllowDelete {
+				errors = append(errors, fmt.Errorf(
+					"repo %s: ref rule %s can't be both immutable and allow_delete",
+					c.RepoName(entry.Repo), rule.Pattern,
+				))
+			}
+		}
+	}
+
+	return newMultiError(errors...)
+}
+
+func (c *Config) isFastForward(lookup *RepoLookup, oldHash, newHash string) (bool, error) {
+	repo, err := git.Open(c.fs, lookup.Path())
+	if err != nil {
+		return false, err
+	}
+
+	return repo.IsAncestor(oldHash, newHash)
+}
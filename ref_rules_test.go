@@ -0,0 +1,127 @@
+package gitdir
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+func newTestCommit(t *testing.T, repo *git.Repository, filename string) string {
+	t.Helper()
+
+	require.Nil(t, repo.CreateFile(filename, []byte(filename)))
+	require.Nil(t, repo.Commit("Added "+filename, nil))
+
+	head, err := repo.Repo.Head()
+	require.Nil(t, err)
+
+	return head.Hash().String()
+}
+
+func TestCheckRefRules(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	c := newTestConfig()
+
+	c.Repos["test-repo"].Refs = []*models.RefRule{
+		{
+			Pattern: "refs/heads/main",
+			Write:   []string{"$admins", "write-user"},
+		},
+		{
+			Pattern:        "refs/heads/feature-*",
+			AllowForcePush: true,
+			AllowDelete:    true,
+		},
+		{
+			Pattern:   "refs/tags/*",
+			Immutable: true,
+		},
+		{
+			Pattern: "refs/heads/release/**",
+			Write:   []string{"$admins"},
+		},
+	}
+
+	repo, err := git.EnsureRepo(c.fs, "top-level/test-repo")
+	require.Nil(t, err)
+
+	first := newTestCommit(t, repo, "first")
+	second := newTestCommit(t, repo, "second")
+	zero := plumbing.ZeroHash.String()
+
+	var tests = []struct { //nolint:gofumpt
+		Username string
+		Ref      string
+		OldHash  string
+		NewHash  string
+		Allowed  bool
+	}{
+		// Refs with no rules can do anything.
+		{"write-user", "refs/heads/other", first, second, true},
+		{"write-user", "refs/heads/other", second, first, true},
+		{"write-user", "refs/heads/other", second, zero, true},
+
+		// Protected branches
+		{"write-user", "refs/heads/main", zero, first, true},
+		{"write-user", "refs/heads/main", first, second, true},
+		{"write-user", "refs/heads/main", second, first, false},
+		{"write-user", "refs/heads/main", second, zero, false},
+		{"read-user", "refs/heads/main", first, second, false},
+		{"an-admin", "refs/heads/main", first, second, true},
+		{"an-admin", "refs/heads/main", second, first, false},
+
+		// Feature branches can be force pushed and deleted.
+		{"write-user", "refs/heads/feature-1", second, first, true},
+		{"write-user", "refs/heads/feature-1", second, zero, true},
+
+		// Tags can be created, but not modified or deleted.
+		{"write-user", "refs/tags/v1.0.0", zero, first, true},
+		{"write-user", "refs/tags/v1.0.0", first, second, false},
+		{"write-user", "refs/tags/v1.0.0", first, zero, false},
+
+		// Recursive patterns match nested refs, but not the prefix itself.
+		{"write-user", "refs/heads/release/v1/hotfix", zero, first, false},
+		{"an-admin", "refs/heads/release/v1/hotfix", zero, first, true},
+		{"write-user", "refs/heads/release", zero, first, true},
+	}
+
+	for _, test := range tests {
+		user, err := c.LookupUserFromUsername(test.Username)
+		require.Nil(t, err)
+
+		lookup, err := c.LookupRepoAccess(user, "test-repo")
+		require.Nil(t, err)
+
+		err = c.checkRefRules(lookup, user, test.Ref, test.OldHash, test.NewHash)
+		if test.Allowed {
+			assert.Nil(t, err, "%s %s %s..%s", test.Username, test.Ref, test.OldHash, test.NewHash)
+		} else {
+			assert.NotNil(t, err, "%s %s %s..%s", test.Username, test.Ref, test.OldHash, test.NewHash)
+		}
+	}
+}
+
+func TestValidateRefRules(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	c.Repos["test-repo"].Refs = []*models.RefRule{
+		{Pattern: "refs/tags/*", Immutable: true},
+		{Pattern: "refs/heads/*", AllowDelete: true},
+	}
+	require.Nil(t, c.validateRefRules())
+
+	c.Orgs["an-org"].Repos["test-repo"].Refs = []*models.RefRule{
+		{Pattern: "refs/tags/*", Immutable: true, AllowDelete: true},
+	}
+
+	err := c.validateRefRules()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "repo @an-org/test-repo: ref rule refs/tags/* can't be both immutable and allow_delete")
+}
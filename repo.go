@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"path"
 	"strings"
+
+	"github.com/belak/go-gitdir/models"
 )
 
 // RepoType represents the different types of repositories that can be accessed.
@@ -70,6 +72,25 @@ func (repo RepoLookup) Path() string {
 	return "/dev/null"
 }
 
+// lookupRepoConfig returns the explicitly defined config for the given repo,
+// or nil if it is a config repo or was implicitly created.
+func (c *Config) lookupRepoConfig(repo *RepoLookup) *models.RepoConfig {
+	switch repo.Type {
+	case RepoTypeOrg:
+		if org, ok := c.Orgs[repo.PathParts[0]]; ok {
+			return org.Repos[repo.PathParts[1]]
+		}
+	case RepoTypeUser:
+		if user, ok := c.Users[repo.PathParts[0]]; ok {
+			return user.Repos[repo.PathParts[1]]
+		}
+	case RepoTypeTopLevel:
+		return c.Repos[repo.PathParts[0]]
+	}
+
+	return nil
+}
+
 // ErrInvalidRepoFormat is returned when a repo is looked up which cannot
 // exist based on the parsed format.
 var ErrInvalidRepoFormat = errors.New("invalid repo format")
@@ -92,6 +113,34 @@ func (c *Config) LookupRepoAccess(user *User, path string) (*RepoLookup, error)
 }
 
 func (c *Config) lookupRepo(path string) (*RepoLookup, error) {
+	repo, err := c.parseRepoPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.repoDefined(repo) {
+		return nil, ErrRepoDoesNotExist
+	}
+
+	return repo, nil
+}
+
+// repoDefined returns true if the given repo exists based on the config.
+func (c *Config) repoDefined(repo *RepoLookup) bool {
+	switch repo.Type {
+	case RepoTypeOrg, RepoTypeUser, RepoTypeTopLevel:
+		// If implicit repos are enabled, it exists no matter what. Otherwise,
+		// it needs to be explicitly defined.
+		return c.Options.ImplicitRepos || c.lookupRepoConfig(repo) != nil
+	}
+
+	// All config repos exist as long as the path could be parsed.
+	return true
+}
+
+// parseRepoPath converts the given path to a RepoLookup. Note that this only
+// ensures the owning user or org exist, not the repo itself.
+func (c *Config) parseRepoPath(path string) (*RepoLookup, error) {
 	// Chop off .git for looking up the repo
 	path = strings.TrimSuffix(path, ".git")
 
@@ -103,17 +152,17 @@ func (c *Config) lookupRepo(path string) (*RepoLookup, error) {
 	}
 
 	if strings.HasPrefix(path, c.Options.OrgPrefix) {
-		return c.lookupOrgRepo(strings.TrimPrefix(path, c.Options.OrgPrefix))
+		return c.parseOrgRepoPath(strings.TrimPrefix(path, c.Options.OrgPrefix))
 	}
 
 	if strings.HasPrefix(path, c.Options.UserPrefix) {
-		return c.lookupUserRepo(strings.TrimPrefix(path, c.Options.UserPrefix))
+		return c.parseUserRepoPath(strings.TrimPrefix(path, c.Options.UserPrefix))
 	}
 
-	return c.lookupTopLevelRepo(path)
+	return c.parseTopLevelRepoPath(path)
 }
 
-func (c *Config) lookupOrgRepo(path string) (*RepoLookup, error) {
+func (c *Config) parseOrgRepoPath(path string) (*RepoLookup, error) {
 	ret := &RepoLookup{
 		PathParts: strings.Split(path, "/"),
 	}
@@ -125,8 +174,7 @@ func (c *Config) lookupOrgRepo(path string) (*RepoLookup, error) {
 	}
 
 	// If the org doesn't exist, nobody has access.
-	org, ok := c.Orgs[ret.PathParts[0]]
-	if !ok {
+	if _, ok := c.Orgs[ret.PathParts[0]]; !ok {
 		return nil, ErrRepoDoesNotExist
 	}
 
@@ -138,21 +186,14 @@ func (c *Config) lookupOrgRepo(path string) (*RepoLookup, error) {
 	// Past this point, it has to be an org repo.
 	ret.Type = RepoTypeOrg
 
-	// If implicit repos are enabled, it exists no matter what.
-	if c.Options.ImplicitRepos {
-		return ret, nil
-	}
-
-	// If the repo explicitly exists in the admin config, this repo exists.
-	_, ok = org.Repos[ret.PathParts[1]]
-	if ok {
-		return ret, nil
+	if ret.PathParts[1] == "" {
+		return nil, ErrInvalidRepoFormat
 	}
 
-	return nil, ErrRepoDoesNotExist
+	return ret, nil
 }
 
-func (c *Config) lookupUserRepo(path string) (*RepoLookup, error) {
+func (c *Config) parseUserRepoPath(path string) (*RepoLookup, error) {
 	ret := &RepoLookup{
 		PathParts: strings.Split(path, "/"),
 	}
@@ -164,8 +205,7 @@ func (c *Config) lookupUserRepo(path string) (*RepoLookup, error) {
 	}
 
 	// If the user doesn't exist, nobody has access.
-	user, ok := c.Users[ret.PathParts[0]]
-	if !ok {
+	if _, ok := c.Users[ret.PathParts[0]]; !ok {
 		return nil, ErrRepoDoesNotExist
 	}
 
@@ -174,42 +214,24 @@ func (c *Config) lookupUserRepo(path string) (*RepoLookup, error) {
 		return ret, nil
 	}
 
-	// Past this point, it has to be an org repo.
+	// Past this point, it has to be a user repo.
 	ret.Type = RepoTypeUser
 
-	// If implicit repos are enabled, it exists no matter what.
-	if c.Options.ImplicitRepos {
-		return ret, nil
-	}
-
-	// If the repo explicitly exists in the admin config, this repo exists.
-	_, ok = user.Repos[ret.PathParts[1]]
-	if ok {
-		return ret, nil
+	if ret.PathParts[1] == "" {
+		return nil, ErrInvalidRepoFormat
 	}
 
-	return nil, ErrRepoDoesNotExist
+	return ret, nil
 }
 
-func (c *Config) lookupTopLevelRepo(path string) (*RepoLookup, error) {
+func (c *Config) parseTopLevelRepoPath(path string) (*RepoLookup, error) {
 	repoPath := strings.Split(path, "/")
-	if len(repoPath) != 1 {
+	if len(repoPath) != 1 || repoPath[0] == "" {
 		return nil, ErrInvalidRepoFormat
 	}
 
-	ret := &RepoLookup{
+	return &RepoLookup{
 		Type:      RepoTypeTopLevel,
 		PathParts: repoPath,
-	}
-
-	// If implicit repos are enabled, it exists no matter what.
-	if c.Options.ImplicitRepos {
-		return ret, nil
-	}
-
-	if _, ok := c.Repos[repoPath[0]]; ok {
-		return ret, nil
-	}
-
-	return nil, ErrRepoDoesNotExist
+	}, nil
 }
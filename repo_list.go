@@ -0,0 +1,145 @@
+package gitdir
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ListRepos returns every repo the given user has access to, sorted by name.
+// This includes both explicitly defined repos and implicit repos which exist
+// on disk.
+func (c *Config) ListRepos(user *User) ([]*RepoLookup, error) {
+	var names []string
+
+	for repoName := range c.Repos {
+		names = append(names, repoName)
+	}
+
+	for orgName, org := range c.Orgs {
+		for repoName := range org.Repos {
+			names = append(names, c.Options.OrgPrefix+orgName+"/"+repoName)
+		}
+	}
+
+	for username, userConfig := range c.Users {
+		for repoName := range userConfig.Repos {
+			names = append(names, c.Options.UserPrefix+username+"/"+repoName)
+		}
+	}
+
+	implicitNames, err := c.listReposOnDisk()
+	if err != nil {
+		return nil, err
+	}
+
+	names = append(names, implicitNames...)
+
+	sort.Strings(names)
+
+	var ret []*RepoLookup
+
+	for i, repoName := range names {
+		// Repos which are defined and on disk will show up twice, so we skip
+		// any duplicates.
+		if i > 0 && names[i-1] == repoName {
+			continue
+		}
+
+		repo, err := c.LookupRepoAccess(user, repoName)
+		if err != nil || repo.Access == AccessLevelNone {
+			continue
+		}
+
+		ret = append(ret, repo)
+	}
+
+	return ret, nil
+}
+
+// listReposOnDisk returns the names of all org, user and top-level repos which
+// exist on disk.
+func (c *Config) listReposOnDisk() ([]string, error) {
+	var ret []string
+
+	topLevel, err := c.listRepoDir("top-level")
+	if err != nil {
+		return nil, err
+	}
+
+	ret = append(ret, topLevel...)
+
+	for _, area := range []struct {
+		Dir    string
+		Prefix string
+	}{
+		{"orgs", c.Options.OrgPrefix},
+		{"users", c.Options.UserPrefix},
+	} {
+		owners, err := c.fs.ReadDir(area.Dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, owner := range owners {
+			if !owner.IsDir() {
+				continue
+			}
+
+			repos, err := c.listRepoDir(path.Join(area.Dir, owner.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, repoName := range repos {
+				ret = append(ret, area.Prefix+owner.Name()+"/"+repoName)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// listRepoDir returns the names of all bare repos in the given directory,
+// without the .git suffix.
+func (c *Config) listRepoDir(dir string) ([]string, error) {
+	entries, err := c.fs.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var ret []string
+
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), ".git") {
+			ret = append(ret, strings.TrimSuffix(entry.Name(), ".git"))
+		}
+	}
+
+	return ret, nil
+}
+
+// RepoName returns the name used to access the given repo.
+func (c *Config) RepoName(repo *RepoLookup) string {
+	switch repo.Type {
+	case RepoTypeAdmin:
+		return "admin"
+	case RepoTypeOrgConfig:
+		return c.Options.OrgPrefix + repo.PathParts[0]
+	case RepoTypeOrg:
+		return c.Options.OrgPrefix + path.Join(repo.PathParts...)
+	case RepoTypeUserConfig:
+		return c.Options.UserPrefix + repo.PathParts[0]
+	case RepoTypeUser:
+		return c.Options.UserPrefix + path.Join(repo.PathParts...)
+	case RepoTypeTopLevel:
+		return repo.PathParts[0]
+	}
+
+	return ""
+}
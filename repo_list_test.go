@@ -0,0 +1,72 @@
+package gitdir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+func TestListRepos(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	c.Options.ImplicitRepos = true
+
+	for _, repoPath := range []string{"top-level/implicit", "users/non-admin/implicit", "top-level/test-repo"} {
+		_, err := git.EnsureRepo(c.fs, repoPath)
+		require.Nil(t, err)
+	}
+
+	var tests = []struct { //nolint:gofumpt
+		Username string
+		Repos    []string
+	}{
+		{
+			"an-admin",
+			[]string{
+				"@an-org/public-repo", "@an-org/test-repo",
+				"implicit", "public-repo", "test-repo",
+				"~non-admin/implicit", "~non-admin/public-repo", "~non-admin/test-repo",
+			},
+		},
+		{
+			"non-admin",
+			[]string{
+				"@an-org/public-repo", "public-repo",
+				"~non-admin/implicit", "~non-admin/public-repo", "~non-admin/test-repo",
+			},
+		},
+		{
+			"org-read",
+			[]string{"@an-org/public-repo", "@an-org/test-repo", "public-repo", "~non-admin/public-repo"},
+		},
+	}
+
+	for _, test := range tests {
+		user, err := c.LookupUserFromUsername(test.Username)
+		require.Nil(t, err)
+
+		repos, err := c.ListRepos(user)
+		require.Nil(t, err)
+
+		var names []string
+		for _, repo := range repos {
+			names = append(names, c.RepoName(repo))
+		}
+
+		assert.Equal(t, test.Repos, names, test.Username)
+	}
+
+	// Spot check the access levels.
+	user, err := c.LookupUserFromUsername("write-user")
+	require.Nil(t, err)
+
+	repos, err := c.ListRepos(user)
+	require.Nil(t, err)
+	require.NotEmpty(t, repos)
+	assert.Equal(t, "@an-org/public-repo", c.RepoName(repos[0]))
+	assert.Equal(t, "RW", repos[0].Access.Abbrev())
+}
@@ -37,6 +37,23 @@ func (a AccessLevel) String() string {
 	}
 }
 
+// Abbrev returns a short version of the access level, similar to the one
+// gitolite uses.
+func (a AccessLevel) Abbrev() string {
+	switch a {
+	case AccessLevelNone:
+		return "-"
+	case AccessLevelRead:
+		return "R"
+	case AccessLevelWrite:
+		return "RW"
+	case AccessLevelAdmin:
+		return "Admin"
+	default:
+		return "?"
+	}
+}
+
 const groupPrefix = "$"
 
 func (c *Config) doesGroupContainUser(username string, groupName string, groupPath []string) bool {
@@ -83,8 +100,50 @@ func (c *Config) checkListsForUser(username string, userLists ...[]string) bool
 	return false
 }
 
+// checkAnonymousRepoAccess returns the access level an anonymous user has on
+// the given repo. At most, this will be read access to explicitly defined
+// public repos.
+func (c *Config) checkAnonymousRepoAccess(repo *RepoLookup) AccessLevel {
+	if !c.Options.AnonymousRead {
+		return AccessLevelNone
+	}
+
+	repoConfig := c.lookupRepoConfig(repo)
+	if repoConfig != nil && repoConfig.Public {
+		return AccessLevelRead
+	}
+
+	return AccessLevelNone
+}
+
 // TODO: clean up nolint here.
 func (c *Config) checkUserRepoAccess(user *User, repo *RepoLookup) AccessLevel { //nolint:cyclop,funlen
+	// Anonymous users have their own, much more limited, set of rules.
+	if user.IsAnonymous {
+		return c.checkAnonymousRepoAccess(repo)
+	}
+
+	// Read-only keys cap the access for the whole session.
+	if user.ReadOnly {
+		unrestricted := *user
+		unrestricted.ReadOnly = false
+
+		if access := c.checkUserRepoAccess(&unrestricted, repo); access < AccessLevelRead {
+			return access
+		}
+
+		return AccessLevelRead
+	}
+
+	// Deploy keys only have access to the repo they belong to.
+	if user.DeployKey != nil {
+		if user.DeployKey.Repo.Path() == repo.Path() {
+			return user.DeployKey.Access
+		}
+
+		return AccessLevelNone
+	}
+
 	// Admins always have access to everything.
 	if user.IsAdmin {
 		return AccessLevelAdmin
@@ -130,7 +189,7 @@ func (c *Config) checkUserRepoAccess(user *User, repo *RepoLookup) AccessLevel {
 		switch {
 		case c.checkListsForUser(user.Username, org.Write, repo.Write):
 			return AccessLevelWrite
-		case c.checkListsForUser(user.Username, org.Read, repo.Read):
+		case c.checkListsForUser(user.Username, org.Read, repo.Read), repo.Public:
 			return AccessLevelRead
 		}
 
@@ -160,7 +219,7 @@ func (c *Config) checkUserRepoAccess(user *User, repo *RepoLookup) AccessLevel {
 		switch {
 		case c.checkListsForUser(user.Username, repo.Write):
 			return AccessLevelWrite
-		case c.checkListsForUser(user.Username, repo.Read):
+		case c.checkListsForUser(user.Username, repo.Read), repo.Public:
 			return AccessLevelRead
 		}
 	case RepoTypeTopLevel:
@@ -173,7 +232,7 @@ func (c *Config) checkUserRepoAccess(user *User, repo *RepoLookup) AccessLevel {
 		switch {
 		case c.checkListsForUser(user.Username, repo.Write):
 			return AccessLevelWrite
-		case c.checkListsForUser(user.Username, repo.Read):
+		case c.checkListsForUser(user.Username, repo.Read), repo.Public:
 			return AccessLevelRead
 		}
 	}
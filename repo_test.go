@@ -2,6 +2,7 @@ package gitdir
 
 import (
 	"testing"
+	"time"
 
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/stretchr/testify/assert"
@@ -27,6 +28,13 @@ func newTestRepoConfig() *models.RepoConfig {
 	return repo
 }
 
+func newTestPublicRepoConfig() *models.RepoConfig {
+	repo := newTestRepoConfig()
+	repo.Public = true
+
+	return repo
+}
+
 func newTestConfig() *Config { //nolint:funlen
 	c := NewConfig(memfs.New())
 
@@ -39,6 +47,7 @@ func newTestConfig() *Config { //nolint:funlen
 
 	c.Users["non-admin"] = models.NewAdminConfigUser()
 	c.Users["non-admin"].Repos["test-repo"] = newTestRepoConfig()
+	c.Users["non-admin"].Repos["public-repo"] = newTestPublicRepoConfig()
 
 	// Org-level permissions
 	c.Users["org-admin"] = models.NewAdminConfigUser()
@@ -71,12 +80,16 @@ func newTestConfig() *Config { //nolint:funlen
 	c.Orgs["an-org"].Write = []string{"org-write"}
 	c.Orgs["an-org"].Read = []string{"org-read"}
 	c.Orgs["an-org"].Repos["test-repo"] = newTestRepoConfig()
+	c.Orgs["an-org"].Repos["public-repo"] = newTestPublicRepoConfig()
 
 	c.Repos["test-repo"] = newTestRepoConfig()
+	c.Repos["public-repo"] = newTestPublicRepoConfig()
 
-	c.Invites["valid-invite"] = "an-admin"
-	c.Invites["user-missing"] = "invalid-user"
-	c.Invites["user-disabled"] = "disabled"
+	c.Invites["valid-invite"] = models.NewInvite("an-admin")
+	c.Invites["user-missing"] = models.NewInvite("invalid-user")
+	c.Invites["user-disabled"] = models.NewInvite("disabled")
+	c.Invites["expired"] = &models.Invite{User: "an-admin", Expires: time.Now().Add(-time.Hour)}
+	c.Invites["used-up"] = &models.Invite{User: "an-admin", MaxUses: 2, Uses: 2}
 
 	// Force all settings repos to "on"
 	c.Options.UserConfigRepos = true
@@ -111,6 +124,12 @@ func TestAccessLevelStringer(t *testing.T) {
 	assert.Equal(t, "Write", AccessLevelWrite.String())
 	assert.Equal(t, "Admin", AccessLevelAdmin.String())
 	assert.Equal(t, "Unknown(42)", AccessLevel(42).String())
+
+	assert.Equal(t, "-", AccessLevelNone.Abbrev())
+	assert.Equal(t, "R", AccessLevelRead.Abbrev())
+	assert.Equal(t, "RW", AccessLevelWrite.Abbrev())
+	assert.Equal(t, "Admin", AccessLevelAdmin.Abbrev())
+	assert.Equal(t, "?", AccessLevel(42).Abbrev())
 }
 
 func TestRepoLookup(t *testing.T) { //nolint:funlen
@@ -441,3 +460,46 @@ func TestCheckUserRepoAccess(t *testing.T) { //nolint:funlen
 	require.Equal(t, ErrRepoDoesNotExist, err)
 	require.Nil(t, repo)
 }
+
+func TestCheckPublicRepoAccess(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+
+	// Any logged in user can read public repos, but they still need to be
+	// explicitly granted write access.
+	user, err := c.LookupUserFromUsername("nothing-user")
+	require.Nil(t, err)
+
+	lookupAndCheck(t, c, user, "public-repo", AccessLevelRead)
+	lookupAndCheck(t, c, user, "@an-org/public-repo", AccessLevelRead)
+	lookupAndCheck(t, c, user, "~non-admin/public-repo", AccessLevelRead)
+
+	user, err = c.LookupUserFromUsername("write-user")
+	require.Nil(t, err)
+
+	lookupAndCheck(t, c, user, "public-repo", AccessLevelWrite)
+	lookupAndCheck(t, c, user, "@an-org/public-repo", AccessLevelWrite)
+	lookupAndCheck(t, c, user, "~non-admin/public-repo", AccessLevelWrite)
+}
+
+func TestCheckAnonymousRepoAccess(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+
+	// With anonymous access disabled, nothing should be accessible.
+	testCheckRepoAccess(t, c, AnonymousUser, allRepoAccessLevels{})
+	lookupAndCheck(t, c, AnonymousUser, "public-repo", AccessLevelNone)
+	lookupAndCheck(t, c, AnonymousUser, "@an-org/public-repo", AccessLevelNone)
+	lookupAndCheck(t, c, AnonymousUser, "~non-admin/public-repo", AccessLevelNone)
+
+	c.Options.AnonymousRead = true
+
+	// With anonymous access enabled, only public repos should be readable.
+	testCheckRepoAccess(t, c, AnonymousUser, allRepoAccessLevels{})
+	testImplicitRepoAccess(t, c, AnonymousUser, allImplicitAccessLevels{})
+	lookupAndCheck(t, c, AnonymousUser, "public-repo", AccessLevelRead)
+	lookupAndCheck(t, c, AnonymousUser, "@an-org/public-repo", AccessLevelRead)
+	lookupAndCheck(t, c, AnonymousUser, "~non-admin/public-repo", AccessLevelRead)
+}
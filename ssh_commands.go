@@ -2,21 +2,95 @@ package gitdir
 
 import (
 	"context"
-	"path"
-	"strings"
+	"encoding/json"
 
 	"github.com/gliderlabs/ssh"
 
-	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
 )
 
 func cmdWhoami(ctx context.Context, s ssh.Session, cmd []string) int { //nolint:interfacer
 	user := CtxUser(ctx)
+
+	if user.DeployKey != nil {
+		_ = writeStringFmt(
+			s, "logged in with a %s deploy key for %s\r\n",
+			user.DeployKey.Access.Abbrev(), user.DeployKey.RepoName,
+		)
+
+		return 0
+	}
+
+	if user.ReadOnly {
+		_ = writeStringFmt(s, "logged in as %s with a read-only key\r\n", user.Username)
+		return 0
+	}
+
 	_ = writeStringFmt(s, "logged in as %s\r\n", user.Username)
 
 	return 0
 }
 
+// repoInfo is the JSON representation of a repo in the output of the info
+// command.
+type repoInfo struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Access string `json:"access"`
+}
+
+func cmdInfo(ctx context.Context, s ssh.Session, cmd []string) int {
+	var asJSON bool
+
+	for _, arg := range cmd[1:] {
+		switch arg {
+		case "--json":
+			asJSON = true
+		default:
+			_ = writeStringFmt(s.Stderr(), "Usage: %s [--json]\r\n", cmd[0])
+			return 1
+		}
+	}
+
+	log, config, user := CtxExtract(ctx)
+
+	repos, err := config.ListRepos(user)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list repos")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+
+		return 1
+	}
+
+	if asJSON {
+		// Make sure we output an empty list rather than null.
+		infos := []repoInfo{}
+
+		for _, repo := range repos {
+			infos = append(infos, repoInfo{
+				Path:   config.RepoName(repo),
+				Type:   repo.Type.String(),
+				Access: repo.Access.String(),
+			})
+		}
+
+		err = json.NewEncoder(s).Encode(infos)
+		if err != nil {
+			return 1
+		}
+
+		return 0
+	}
+
+	_ = writeStringFmt(s, "logged in as %s\r\n\r\n", user.Username)
+
+	for _, repo := range repos {
+		_ = writeStringFmt(s, " %-6s %-9s %s\r\n", repo.Access.Abbrev(), repo.Type, config.RepoName(repo))
+	}
+
+	return 0
+}
+
 func cmdNotFound(ctx context.Context, s ssh.Session, cmd []string) int {
 	_ = writeStringFmt(s.Stderr(), "command %q not found\r\n", cmd[0])
 	return 1
@@ -39,53 +113,127 @@ func (serv *Server) cmdRepoAction(ctx context.Context, s ssh.Session, cmd []stri
 	log, config, user := CtxExtract(ctx)
 	pk := CtxPublicKey(ctx)
 
-	// Sanitize the repo name
-	//   - Trim all slashes from beginning and end
-	//   - Add a root slash (so path.Clean works correctly)
-	//   - path.Clean
-	//   - Remove the initial slash
-	//   - Sanitize the name
-	repoName := sanitize(path.Clean("/" + strings.Trim(cmd[1], "/"))[1:])
+	// Hooks check the key against the config, so keys which came from another
+	// Authenticator aren't passed along and the hooks fall back to the
+	// username.
+	if !config.keyInUse(pk) {
+		pk = nil
+	}
+
+	repoName := sanitizeRepoName(cmd[1])
 
 	// Repo does not exist and permission checks should give the same error, so
 	// information about what repos are defined is not leaked.
-	repo, err := config.LookupRepoAccess(user, repoName)
+	repo, err := serv.lookupRepoForAction(config, user, repoName, access)
 	if err != nil {
 		_ = writeStringFmt(s.Stderr(), "Repo does not exist\r\n")
 		return -1
 	}
 
+	returnCode := serv.runGitService(log, &gitServiceRequest{
+		Service:     cmd[0],
+		Repo:        repo,
+		RepoName:    repoName,
+		User:        user,
+		PublicKey:   pk,
+		GitProtocol: negotiateGitProtocol(log, lookupEnv(s.Environ(), "GIT_PROTOCOL")),
+		Stdin:       s,
+		Stdout:      s,
+		Stderr:      s.Stderr(),
+	})
+
+	serv.metrics.recordRepoAction(cmd[0], returnCode)
+
+	err = serv.afterRepoAction(repo, access)
+	if err != nil {
+		_ = writeStringFmt(s.Stderr(), "Error when reloading config: %s\r\n", err)
+	}
+
+	return returnCode
+}
+
+// lookupRepoForAction looks up the given repo and ensures the user has the
+// requested access level. If they don't, ErrRepoDoesNotExist is returned so
+// information about what repos are defined is not leaked.
+func (serv *Server) lookupRepoForAction(
+	config *Config,
+	user *User,
+	repoName string,
+	access AccessLevel,
+) (*RepoLookup, error) {
+	audit := &AuditEvent{
+		Type:      AuditEventRepoAccess,
+		User:      user.Username,
+		Repo:      repoName,
+		Requested: access.String(),
+	}
+	defer serv.recordAudit(audit)
+
+	repo, err := config.LookupRepoAccess(user, repoName)
+	if err != nil {
+		audit.Reason = auditReason(err)
+		return nil, err
+	}
+
+	audit.Repo = config.RepoName(repo)
+	audit.Access = repo.Access.String()
+
 	if repo.Access < access {
-		_ = writeStringFmt(s.Stderr(), "Repo does not exist\r\n")
-		return -1
+		audit.Reason = "insufficient access"
+		return nil, ErrRepoDoesNotExist
 	}
 
+	audit.Allowed = true
+
 	// Because we check ImplicitRepos earlier, if they have admin access, it's
 	// safe to ensure this repo exists.
 	if repo.Access >= AccessLevelAdmin {
-		_, err = git.EnsureRepo(serv.config.fs, repo.Path())
+		_, err = config.ensureRepo(repo)
 		if err != nil {
-			return -1
+			return nil, err
+		}
+
+		// Repos created by pushing need their hooks before the push runs.
+		err = config.installRepoHooks(repo)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	returnCode := runCommand(log, serv.fs.Root(), s, []string{cmd[0], repo.Path()}, []string{
+	return repo, nil
+}
+
+// repoActionEnviron returns the environment variables needed for the hooks to
+// be able to find the current repo and user.
+func (serv *Server) repoActionEnviron(repoName string, user *User, pk *models.PublicKey) []string {
+	environ := []string{
 		"GITDIR_BASE_DIR=" + serv.fs.Root(),
 		"GITDIR_HOOK_REPO_PATH=" + repoName,
-		"GITDIR_HOOK_PUBLIC_KEY=" + pk.String(),
+		"GITDIR_HOOK_USERNAME=" + user.Username,
 		"GITDIR_LOG_FORMAT=console",
-	})
+	}
 
-	// Reload the server config if a config repo was changed.
-	if access == AccessLevelWrite {
-		switch repo.Type {
-		case RepoTypeAdmin, RepoTypeOrgConfig, RepoTypeUserConfig:
-			err = serv.Reload()
-			if err != nil {
-				_ = writeStringFmt(s.Stderr(), "Error when reloading config: %s\r\n", err)
-			}
-		}
+	if pk != nil {
+		environ = append(environ, "GITDIR_HOOK_PUBLIC_KEY="+pk.String())
 	}
 
-	return returnCode
+	if timeout := serv.GetAdminConfig().Options.HookTimeout; timeout > 0 {
+		environ = append(environ, "GITDIR_HOOK_TIMEOUT="+timeout.String())
+	}
+
+	return environ
+}
+
+// afterRepoAction reloads the server config if a config repo was changed.
+func (serv *Server) afterRepoAction(repo *RepoLookup, access AccessLevel) error {
+	if access != AccessLevelWrite {
+		return nil
+	}
+
+	switch repo.Type {
+	case RepoTypeAdmin, RepoTypeOrgConfig, RepoTypeUserConfig:
+		return serv.Reload()
+	}
+
+	return nil
 }
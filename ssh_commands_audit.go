@@ -0,0 +1,99 @@
+package gitdir
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const auditUsage = "Usage: audit [--user <user>] [--repo <repo>] [--since <time>] [--until <time>]\r\n"
+
+func (serv *Server) cmdAudit(ctx context.Context, s ssh.Session, cmd []string) int {
+	if !CtxUser(ctx).IsAdmin {
+		_ = writeStringFmt(s.Stderr(), "The audit log can only be read by admins\r\n")
+		return 1
+	}
+
+	filter, err := parseAuditFilter(cmd[1:], time.Now())
+	if err != nil {
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", err)
+		_ = writeStringFmt(s.Stderr(), auditUsage)
+
+		return 1
+	}
+
+	events, err := serv.audit.Query(filter)
+	if err != nil {
+		CtxLogger(ctx).Error().Err(err).Msg("Failed to read audit log")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+
+		return 1
+	}
+
+	enc := json.NewEncoder(s)
+
+	for _, event := range events {
+		err = enc.Encode(event)
+		if err != nil {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// parseAuditFilter parses the arguments to the audit command.
+func parseAuditFilter(args []string, now time.Time) (*AuditFilter, error) {
+	filter := &AuditFilter{}
+
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("missing value for %s", args[len(args)-1])
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		var err error
+
+		flag, value := args[i], args[i+1]
+
+		switch flag {
+		case "--user":
+			filter.User = value
+		case "--repo":
+			filter.Repo = sanitizeRepoName(value)
+		case "--since":
+			filter.Since, err = parseAuditTime(value, now)
+		case "--until":
+			filter.Until, err = parseAuditTime(value, now)
+		default:
+			return nil, fmt.Errorf("unknown argument %s", flag)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", flag, err)
+		}
+	}
+
+	return filter, nil
+}
+
+// parseAuditTime parses a time given to the audit command. This can either be
+// an absolute time in RFC 3339 format, a date, or a duration, which is
+// relative to now.
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
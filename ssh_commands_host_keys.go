@@ -0,0 +1,110 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+const rotateHostKeysUsage = "Usage: rotate-host-keys [--grace <duration>]\r\n"
+
+func (serv *Server) cmdRotateHostKeys(ctx context.Context, s ssh.Session, cmd []string) int {
+	slog, _, user := CtxExtract(ctx)
+
+	if !user.IsAdmin {
+		_ = writeStringFmt(s.Stderr(), "Host keys can only be rotated by admins\r\n")
+		return 1
+	}
+
+	grace, err := ParseRotateHostKeysArgs(cmd[1:])
+	if err != nil {
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", err)
+		_ = writeStringFmt(s.Stderr(), rotateHostKeysUsage)
+
+		return 1
+	}
+
+	err = serv.RotateHostKeys(user, grace)
+	if errors.Is(err, ErrHostKeyRotationPending) {
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", err)
+		return 1
+	} else if err != nil {
+		slog.Error().Err(err).Msg("Failed to rotate host keys")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+
+		return 1
+	}
+
+	config := serv.GetAdminConfig()
+
+	fingerprints, err := HostKeyFingerprints(config.NextPrivateKeys)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to load new host keys")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+
+		return 1
+	}
+
+	_ = writeStringFmt(s, "New host keys will replace the current keys at %s\r\n", config.RotateHostKeysAt.Format(time.RFC3339))
+
+	for _, fingerprint := range fingerprints {
+		_ = writeStringFmt(s, "%s\r\n", fingerprint)
+	}
+
+	return 0
+}
+
+// ParseRotateHostKeysArgs parses the arguments to the rotate-host-keys
+// command, returning the grace period.
+func ParseRotateHostKeysArgs(args []string) (time.Duration, error) {
+	grace := DefaultHostKeyGracePeriod
+
+	if len(args)%2 != 0 {
+		return 0, fmt.Errorf("missing value for %s", args[len(args)-1])
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		flag, value := args[i], args[i+1]
+
+		switch flag {
+		case "--grace":
+			var err error
+
+			grace, err = time.ParseDuration(value)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %w", flag, err)
+			}
+
+			if grace < 0 {
+				return 0, fmt.Errorf("%s: must not be negative", flag)
+			}
+		default:
+			return 0, fmt.Errorf("unknown argument %s", flag)
+		}
+	}
+
+	return grace, nil
+}
+
+// HostKeyFingerprints returns the type and SHA256 fingerprint of each of the
+// given keys, in the same format as ssh-keygen.
+func HostKeyFingerprints(keys []models.PrivateKey) ([]string, error) {
+	ret := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		pk, err := gossh.NewPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, pk.Type()+" "+gossh.FingerprintSHA256(pk))
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,137 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+// maxKeySize is the largest public key we will read from stdin. This is much
+// larger than any key we expect, but stops anyone from sending us arbitrary
+// amounts of data.
+const maxKeySize = 16 * 1024
+
+func (serv *Server) cmdKeys(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) < 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: keys <list|add|remove> <args>\r\n")
+		return 1
+	}
+
+	switch cmd[1] {
+	case "list":
+		return cmdKeysList(ctx, s, cmd)
+	case "add":
+		return serv.cmdKeysAdd(ctx, s, cmd)
+	case "remove":
+		return serv.cmdKeysRemove(ctx, s, cmd)
+	}
+
+	_ = writeStringFmt(s.Stderr(), "keys command %q not found\r\n", cmd[1])
+
+	return 1
+}
+
+func cmdKeysList(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: keys list\r\n")
+		return 1
+	}
+
+	_, config, user := CtxExtract(ctx)
+
+	keys, err := config.ListUserKeys(user)
+	if err != nil {
+		return writeKeysCommandError(ctx, s, err)
+	}
+
+	for _, key := range keys {
+		source := "admin"
+		if key.Removable {
+			source = "user"
+		}
+
+		_ = writeStringFmt(s, "%s %-5s %s %s\r\n", key.Fingerprint, source, key.Type(), key.Comment)
+	}
+
+	return 0
+}
+
+func (serv *Server) cmdKeysAdd(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: keys add < key.pub\r\n")
+		return 1
+	}
+
+	user := CtxUser(ctx)
+	if user.IsAnonymous {
+		return writeKeysCommandError(ctx, s, ErrUserNotFound)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(s, maxKeySize))
+	if err != nil {
+		return writeKeysCommandError(ctx, s, err)
+	}
+
+	pk, err := models.ParsePublicKey(data)
+	if err != nil {
+		_ = writeStringFmt(s.Stderr(), "Invalid public key\r\n")
+		return 1
+	}
+
+	err = serv.updateConfig(func(config *Config) error {
+		return config.AddUserKey(user, pk)
+	})
+	if err != nil {
+		return writeKeysCommandError(ctx, s, err)
+	}
+
+	_ = writeStringFmt(s, "Done\r\n")
+
+	return 0
+}
+
+func (serv *Server) cmdKeysRemove(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 3 {
+		_ = writeStringFmt(s.Stderr(), "Usage: keys remove <fingerprint>\r\n")
+		return 1
+	}
+
+	user := CtxUser(ctx)
+	pk := CtxPublicKey(ctx)
+
+	err := serv.updateConfig(func(config *Config) error {
+		return config.RemoveUserKey(user, cmd[2], pk)
+	})
+	if err != nil {
+		return writeKeysCommandError(ctx, s, err)
+	}
+
+	_ = writeStringFmt(s, "Done\r\n")
+
+	return 0
+}
+
+// writeKeysCommandError writes a user-friendly version of the given error to
+// the session. Unknown errors are logged, rather than displayed, because they
+// may leak information about the server.
+func writeKeysCommandError(ctx context.Context, s ssh.Session, err error) int {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		_ = writeStringFmt(s.Stderr(), "Keys can only be managed by known users\r\n")
+	case errors.Is(err, ErrUserConfigKeysDisabled),
+		errors.Is(err, ErrKeyInUse),
+		errors.Is(err, ErrKeyNotFound),
+		errors.Is(err, ErrKeyManagedByAdmin),
+		errors.Is(err, ErrCurrentKey):
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", err)
+	default:
+		CtxLogger(ctx).Error().Err(err).Msg("Failed to run keys command")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+	}
+
+	return 1
+}
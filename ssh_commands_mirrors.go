@@ -0,0 +1,122 @@
+package gitdir
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+func (serv *Server) cmdMirrors(ctx context.Context, s ssh.Session, cmd []string) int {
+	if !CtxUser(ctx).IsAdmin {
+		_ = writeStringFmt(s.Stderr(), "Mirrors can only be managed by admins\r\n")
+		return 1
+	}
+
+	if len(cmd) < 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: mirrors <status|key|sync> <args>\r\n")
+		return 1
+	}
+
+	switch cmd[1] {
+	case "status":
+		return cmdMirrorsStatus(ctx, s, cmd)
+	case "key":
+		return cmdMirrorsKey(ctx, s, cmd)
+	case "sync":
+		return serv.cmdMirrorsSync(ctx, s, cmd)
+	}
+
+	_ = writeStringFmt(s.Stderr(), "mirrors command %q not found\r\n", cmd[1])
+
+	return 1
+}
+
+func cmdMirrorsStatus(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: mirrors status\r\n")
+		return 1
+	}
+
+	statuses, err := CtxConfig(ctx).MirrorStatuses()
+	if err != nil {
+		return writeMirrorsCommandError(ctx, s, err)
+	}
+
+	for _, status := range statuses {
+		result := "ok"
+
+		switch {
+		case status.LastAttempt.IsZero():
+			result = "pending"
+		case status.LastError != "":
+			result = "failed"
+		}
+
+		_ = writeStringFmt(s, "%-4s %-7s %s %s %s\r\n",
+			status.Direction,
+			result,
+			formatMirrorTime(status.LastSuccess),
+			status.Repo,
+			status.URL)
+
+		if status.LastError != "" {
+			_ = writeStringFmt(s, "     %s\r\n", status.LastError)
+		}
+	}
+
+	return 0
+}
+
+func formatMirrorTime(t time.Time) string {
+	if t.IsZero() {
+		return "never               "
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func cmdMirrorsKey(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: mirrors key\r\n")
+		return 1
+	}
+
+	key, err := CtxConfig(ctx).MirrorPublicKey()
+	if err != nil {
+		return writeMirrorsCommandError(ctx, s, err)
+	}
+
+	_ = writeStringFmt(s, "%s\r\n", key)
+
+	return 0
+}
+
+func (serv *Server) cmdMirrorsSync(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 3 {
+		_ = writeStringFmt(s.Stderr(), "Usage: mirrors sync <repo>\r\n")
+		return 1
+	}
+
+	// This is only available to admins, so errors from the remote are shown
+	// as-is to help debug the mirror.
+	err := serv.SyncMirror(ctx, sanitizeRepoName(cmd[2]))
+	if err != nil {
+		CtxLogger(ctx).Warn().Err(err).Msg("Failed to sync mirror")
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", strings.TrimSpace(err.Error()))
+
+		return 1
+	}
+
+	_ = writeStringFmt(s, "Synced %s\r\n", cmd[2])
+
+	return 0
+}
+
+func writeMirrorsCommandError(ctx context.Context, s ssh.Session, err error) int {
+	CtxLogger(ctx).Error().Err(err).Msg("Failed to run mirrors command")
+	_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+
+	return 1
+}
@@ -0,0 +1,40 @@
+package gitdir
+
+import (
+	"context"
+
+	"github.com/gliderlabs/ssh"
+)
+
+func cmdQuota(ctx context.Context, s ssh.Session, cmd []string) int {
+	slog, config, user := CtxExtract(ctx)
+
+	if !user.IsAdmin {
+		_ = writeStringFmt(s.Stderr(), "Quotas can only be viewed by admins\r\n")
+		return 1
+	}
+
+	if len(cmd) != 2 || cmd[1] != "report" {
+		_ = writeStringFmt(s.Stderr(), "Usage: quota report\r\n")
+		return 1
+	}
+
+	report, err := config.QuotaReport()
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to compute disk usage")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+
+		return 1
+	}
+
+	for _, usage := range report {
+		limit := "-"
+		if usage.Limit > 0 {
+			limit = usage.Limit.String()
+		}
+
+		_ = writeStringFmt(s, " %10s %10s  %s\r\n", usage.Used, limit, usage.Area)
+	}
+
+	return 0
+}
@@ -0,0 +1,106 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gliderlabs/ssh"
+)
+
+func (serv *Server) cmdRepo(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) < 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: repo <create|delete|rename|fork|set-head> <args>\r\n")
+		return 1
+	}
+
+	var (
+		err  error
+		argc int
+	)
+
+	user := CtxUser(ctx)
+	args := cmd[2:]
+
+	for i, arg := range args {
+		// The branch for set-head isn't a repo name, so it's validated
+		// separately.
+		if cmd[1] == "set-head" && i == 1 {
+			continue
+		}
+
+		args[i] = sanitizeRepoName(arg)
+	}
+
+	switch cmd[1] {
+	case "create":
+		argc = 1
+		if len(args) == argc {
+			err = serv.updateConfigRepos(args, func(config *Config) error {
+				return config.CreateRepo(user, args[0])
+			})
+		}
+	case "delete":
+		argc = 1
+		if len(args) == argc {
+			err = serv.updateConfigRepos(args, func(config *Config) error {
+				return config.DeleteRepo(user, args[0])
+			})
+		}
+	case "rename":
+		argc = 2
+		if len(args) == argc {
+			err = serv.updateConfigRepos(args, func(config *Config) error {
+				return config.RenameRepo(user, args[0], args[1])
+			})
+		}
+	case "fork":
+		argc = 2
+		if len(args) == argc {
+			err = serv.updateConfigRepos(args, func(config *Config) error {
+				return config.ForkRepo(user, args[0], args[1])
+			})
+		}
+	case "set-head":
+		argc = 2
+		if len(args) == argc {
+			err = serv.updateConfigRepos(args[:1], func(config *Config) error {
+				return config.SetRepoHead(user, args[0], args[1])
+			})
+		}
+	default:
+		_ = writeStringFmt(s.Stderr(), "repo command %q not found\r\n", cmd[1])
+		return 1
+	}
+
+	if len(args) != argc {
+		_ = writeStringFmt(s.Stderr(), "Wrong number of arguments for repo %s\r\n", cmd[1])
+		return 1
+	}
+
+	if err != nil {
+		return writeRepoCommandError(ctx, s, err)
+	}
+
+	_ = writeStringFmt(s, "Done\r\n")
+
+	return 0
+}
+
+// writeRepoCommandError writes a user-friendly version of the given error to
+// the session. Unknown errors are logged, rather than displayed, because they
+// may leak information about the server.
+func writeRepoCommandError(ctx context.Context, s ssh.Session, err error) int {
+	switch {
+	case errors.Is(err, ErrRepoDoesNotExist), errors.Is(err, ErrInvalidRepoFormat):
+		_ = writeStringFmt(s.Stderr(), "Repo does not exist\r\n")
+	case errors.Is(err, ErrRepoExists), errors.Is(err, ErrConfigRepo),
+		errors.Is(err, ErrInvalidBranch), errors.Is(err, ErrBranchDoesNotExist),
+		errors.Is(err, ErrInvalidBranchConfig):
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", err)
+	default:
+		CtxLogger(ctx).Error().Err(err).Msg("Failed to run repo command")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+	}
+
+	return 1
+}
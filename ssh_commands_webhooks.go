@@ -0,0 +1,138 @@
+package gitdir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+func (serv *Server) cmdWebhooks(ctx context.Context, s ssh.Session, cmd []string) int {
+	if !CtxUser(ctx).IsAdmin {
+		_ = writeStringFmt(s.Stderr(), "Webhooks can only be managed by admins\r\n")
+		return 1
+	}
+
+	if len(cmd) < 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: webhooks <list|show|retry> <args>\r\n")
+		return 1
+	}
+
+	switch cmd[1] {
+	case "list":
+		return serv.cmdWebhooksList(ctx, s, cmd)
+	case "show":
+		return serv.cmdWebhooksShow(ctx, s, cmd)
+	case "retry":
+		return serv.cmdWebhooksRetry(ctx, s, cmd)
+	}
+
+	_ = writeStringFmt(s.Stderr(), "webhooks command %q not found\r\n", cmd[1])
+
+	return 1
+}
+
+func (serv *Server) cmdWebhooksList(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 2 {
+		_ = writeStringFmt(s.Stderr(), "Usage: webhooks list\r\n")
+		return 1
+	}
+
+	deliveries, err := serv.webhooks.List()
+	if err != nil {
+		return writeWebhooksCommandError(ctx, s, err)
+	}
+
+	for _, delivery := range deliveries {
+		status := "pending"
+		if delivery.Failed {
+			status = "failed"
+		}
+
+		_ = writeStringFmt(s, "%s %-7s %2d %-13s %s %s\r\n",
+			delivery.ID,
+			status,
+			delivery.Attempts,
+			delivery.Event,
+			delivery.Repo,
+			delivery.URL)
+	}
+
+	return 0
+}
+
+func (serv *Server) cmdWebhooksShow(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 3 {
+		_ = writeStringFmt(s.Stderr(), "Usage: webhooks show <id>\r\n")
+		return 1
+	}
+
+	delivery, err := serv.webhooks.Get(cmd[2])
+	if err != nil {
+		return writeWebhooksCommandError(ctx, s, err)
+	}
+
+	status := "pending"
+	if delivery.Failed {
+		status = "failed"
+	}
+
+	_ = writeStringFmt(s, "ID:           %s\r\n", delivery.ID)
+	_ = writeStringFmt(s, "Status:       %s\r\n", status)
+	_ = writeStringFmt(s, "URL:          %s\r\n", delivery.URL)
+	_ = writeStringFmt(s, "Event:        %s\r\n", delivery.Event)
+	_ = writeStringFmt(s, "Repo:         %s\r\n", delivery.Repo)
+	_ = writeStringFmt(s, "Created:      %s\r\n", delivery.Created.Format(time.RFC3339))
+	_ = writeStringFmt(s, "Attempts:     %d\r\n", delivery.Attempts)
+
+	if !delivery.Failed {
+		_ = writeStringFmt(s, "Next attempt: %s\r\n", delivery.NextAttempt.Format(time.RFC3339))
+	}
+
+	if delivery.LastError != "" {
+		_ = writeStringFmt(s, "Last error:   %s\r\n", delivery.LastError)
+	}
+
+	var body bytes.Buffer
+	if json.Indent(&body, []byte(delivery.Body), "", "  ") != nil {
+		body.Reset()
+		body.WriteString(delivery.Body)
+	}
+
+	_ = writeStringFmt(s, "\r\n%s\r\n", bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+
+	return 0
+}
+
+func (serv *Server) cmdWebhooksRetry(ctx context.Context, s ssh.Session, cmd []string) int {
+	if len(cmd) != 3 {
+		_ = writeStringFmt(s.Stderr(), "Usage: webhooks retry <id>\r\n")
+		return 1
+	}
+
+	err := serv.webhooks.Retry(cmd[2])
+	if err != nil {
+		return writeWebhooksCommandError(ctx, s, err)
+	}
+
+	_ = writeStringFmt(s, "Done\r\n")
+
+	return 0
+}
+
+// writeWebhooksCommandError writes a user-friendly version of the given error
+// to the session. Unknown errors are logged, rather than displayed, because
+// they may leak information about the server.
+func writeWebhooksCommandError(ctx context.Context, s ssh.Session, err error) int {
+	if errors.Is(err, ErrWebhookNotFound) {
+		_ = writeStringFmt(s.Stderr(), "%s\r\n", err)
+	} else {
+		CtxLogger(ctx).Error().Err(err).Msg("Failed to run webhooks command")
+		_ = writeStringFmt(s.Stderr(), "Internal error\r\n")
+	}
+
+	return 1
+}
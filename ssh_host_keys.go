@@ -0,0 +1,276 @@
+package gitdir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// These are OpenSSH extensions, described in PROTOCOL in the OpenSSH source,
+// which let clients learn all of our host keys so they can be rotated without
+// clients seeing a changed key.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+const contextKeyHostKeys = contextKey("gitdir-host-keys")
+
+// hostKeysProveTimeout is how long after advertising our host keys a session
+// will wait for the client to ask us to prove them.
+const hostKeysProveTimeout = 250 * time.Millisecond
+
+// hostKeySet is the set of host keys used for a single connection. This is
+// captured when the connection starts, so a reload can't change the keys in
+// the middle of a connection.
+type hostKeySet struct {
+	once       sync.Once
+	advertised time.Time
+
+	// proved is closed once the client has asked us to prove our host keys.
+	proved     chan struct{}
+	provedOnce sync.Once
+
+	// active keys are used for the key exchange.
+	active []gossh.Signer
+
+	// all keys are advertised to clients. This includes the active keys and
+	// any keys which are being rotated in.
+	all []gossh.Signer
+}
+
+// advertise sends all the host keys to the client.
+func (keys *hostKeySet) advertise(conn gossh.Conn) error {
+	var payload []byte
+
+	for _, signer := range keys.all {
+		payload = appendWireString(payload, signer.PublicKey().Marshal())
+	}
+
+	_, _, err := conn.SendRequest(hostKeysRequest, false, payload)
+
+	return err
+}
+
+// prove signs each of the requested host keys to prove we have the private
+// keys.
+func (keys *hostKeySet) prove(sessionID []byte, payload []byte) ([]byte, error) {
+	var ret []byte
+
+	r := &wireReader{data: payload}
+
+	for len(r.data) > 0 {
+		blob, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+
+		signer := keys.lookup(blob)
+		if signer == nil {
+			return nil, errors.New("unknown host key")
+		}
+
+		var data []byte
+		data = appendWireString(data, []byte(hostKeysProveRequest))
+		data = appendWireString(data, sessionID)
+		data = appendWireString(data, blob)
+
+		var sig *gossh.Signature
+
+		// RSA keys default to SHA-1 signatures, which modern clients won't
+		// accept.
+		if algSigner, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+			sig, err = algSigner.SignWithAlgorithm(rand.Reader, data, gossh.KeyAlgoRSASHA512)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = appendWireString(ret, gossh.Marshal(sig))
+	}
+
+	return ret, nil
+}
+
+// wait gives the client a chance to ask us to prove the host keys we
+// advertised before the session ends. Clients won't wait for the response
+// once the session has ended, so very short sessions would otherwise never
+// learn new keys. This only waits while new keys are being rotated in.
+func (keys *hostKeySet) wait() {
+	if keys.advertised.IsZero() || len(keys.all) == len(keys.active) {
+		return
+	}
+
+	timer := time.NewTimer(time.Until(keys.advertised.Add(hostKeysProveTimeout)))
+	defer timer.Stop()
+
+	select {
+	case <-keys.proved:
+	case <-timer.C:
+	}
+}
+
+func (keys *hostKeySet) lookup(blob []byte) gossh.Signer {
+	for _, signer := range keys.all {
+		if bytes.Equal(signer.PublicKey().Marshal(), blob) {
+			return signer
+		}
+	}
+
+	return nil
+}
+
+// sshServerConfig is used as the ServerConfigCallback. It adds the current
+// host keys to each connection.
+func (serv *Server) sshServerConfig(ctx ssh.Context) *gossh.ServerConfig {
+	state := serv.loadState()
+
+	keys := &hostKeySet{
+		active: state.hostKeys,
+		all:    state.advertisedHostKeys,
+		proved: make(chan struct{}),
+	}
+
+	ctx.SetValue(contextKeyHostKeys, keys)
+
+	config := &gossh.ServerConfig{}
+	for _, signer := range keys.active {
+		config.AddHostKey(signer)
+	}
+
+	return config
+}
+
+// handleSessionChannel advertises our host keys the first time a client opens
+// a session, which is after they've authenticated, then handles the session as
+// normal.
+func (serv *Server) handleSessionChannel(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	if keys, ok := ctx.Value(contextKeyHostKeys).(*hostKeySet); ok {
+		keys.once.Do(func() {
+			keys.advertised = time.Now()
+
+			if err := keys.advertise(conn); err != nil {
+				CtxLogger(ctx).Warn().Err(err).Msg("Failed to advertise host keys")
+			}
+		})
+	}
+
+	ssh.DefaultSessionHandler(srv, conn, newChan, ctx)
+}
+
+func (serv *Server) handleHostKeysProve(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	keys, ok := ctx.Value(contextKeyHostKeys).(*hostKeySet)
+	if !ok {
+		return false, nil
+	}
+
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return false, nil
+	}
+
+	defer keys.provedOnce.Do(func() { close(keys.proved) })
+
+	payload, err := keys.prove(conn.SessionID(), req.Payload)
+	if err != nil {
+		CtxLogger(ctx).Warn().Err(err).Msg("Failed to prove host keys")
+		return false, nil
+	}
+
+	return true, payload
+}
+
+// newServerState creates the server state for the given config, which
+// includes signers for all the host keys.
+func newServerState(config *Config) (*serverState, error) {
+	var hostKeys, advertisedHostKeys []gossh.Signer
+
+	for _, key := range config.PrivateKeys {
+		signer, err := gossh.NewSignerFromSigner(key)
+		if err != nil {
+			return nil, err
+		}
+
+		hostKeys = append(hostKeys, signer)
+	}
+
+	advertisedHostKeys = append(advertisedHostKeys, hostKeys...)
+
+	for _, key := range config.NextPrivateKeys {
+		signer, err := gossh.NewSignerFromSigner(key)
+		if err != nil {
+			return nil, err
+		}
+
+		advertisedHostKeys = append(advertisedHostKeys, signer)
+	}
+
+	return &serverState{
+		config:             config,
+		hostKeys:           hostKeys,
+		advertisedHostKeys: advertisedHostKeys,
+	}, nil
+}
+
+// scheduleHostKeyRotation schedules a reload for when any host key rotation in
+// the given config is finished.
+func (serv *Server) scheduleHostKeyRotation(config *Config) {
+	if serv.hostKeyTimer != nil {
+		serv.hostKeyTimer.Stop()
+		serv.hostKeyTimer = nil
+	}
+
+	if len(config.NextPrivateKeys) > 0 {
+		serv.hostKeyTimer = time.AfterFunc(time.Until(config.RotateHostKeysAt), func() {
+			if err := serv.Reload(); err != nil {
+				serv.log.Error().Err(err).Msg("Failed to finish host key rotation")
+			}
+		})
+	}
+}
+
+// RotateHostKeys generates a new set of host keys, which will replace the
+// current keys after the grace period.
+func (serv *Server) RotateHostKeys(user *User, grace time.Duration) error {
+	return serv.updateConfig(func(config *Config) error {
+		return config.RotateHostKeys(user, grace, time.Now())
+	})
+}
+
+// placeholderSigner is the only host key given to the ssh.Server directly. It
+// can't be used for anything. ssh.Server provides no way to remove host keys,
+// and generates its own if none are set, so the real keys are added in
+// sshServerConfig instead. Because it doesn't support any algorithms, it is
+// never offered to clients.
+type placeholderSigner struct{}
+
+func (placeholderSigner) PublicKey() gossh.PublicKey { return placeholderPublicKey{} }
+func (placeholderSigner) Algorithms() []string       { return nil }
+
+func (placeholderSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return nil, errors.New("placeholder host key can't sign")
+}
+
+func (placeholderSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	return nil, errors.New("placeholder host key can't sign")
+}
+
+type placeholderPublicKey struct{}
+
+func (placeholderPublicKey) Type() string { return "gitdir-placeholder" }
+func (placeholderPublicKey) Marshal() []byte {
+	return appendWireString(nil, []byte("gitdir-placeholder"))
+}
+
+func (placeholderPublicKey) Verify(data []byte, sig *gossh.Signature) error {
+	return errors.New("placeholder host key can't verify")
+}
@@ -0,0 +1,180 @@
+package gitdir
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+func hostKeyBlobs(t *testing.T, keys []models.PrivateKey) []string {
+	t.Helper()
+
+	ret := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		pk, err := gossh.NewPublicKey(key.Public())
+		require.NoError(t, err)
+
+		ret = append(ret, string(pk.Marshal()))
+	}
+
+	return ret
+}
+
+func TestRotateHostKeys(t *testing.T) {
+	t.Parallel()
+
+	fs := memfs.New()
+
+	serv, err := NewServer(fs)
+	require.NoError(t, err)
+
+	config := serv.GetAdminConfig()
+	currentKeys := hostKeyBlobs(t, config.PrivateKeys)
+
+	require.Len(t, currentKeys, 3)
+	assert.Empty(t, config.NextPrivateKeys)
+	assert.Len(t, serv.loadState().hostKeys, 3)
+	assert.Len(t, serv.loadState().advertisedHostKeys, 3)
+
+	// New keys should be advertised, but not used yet.
+	err = serv.RotateHostKeys(&User{Username: "an-admin"}, time.Hour)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { serv.hostKeyTimer.Stop() })
+
+	config = serv.GetAdminConfig()
+	nextKeys := hostKeyBlobs(t, config.NextPrivateKeys)
+
+	require.Len(t, nextKeys, 3)
+	assert.Equal(t, currentKeys, hostKeyBlobs(t, config.PrivateKeys))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), config.RotateHostKeysAt, time.Minute)
+	assert.Len(t, serv.loadState().hostKeys, 3)
+	assert.Len(t, serv.loadState().advertisedHostKeys, 6)
+
+	// Only one rotation can happen at a time.
+	err = serv.RotateHostKeys(&User{Username: "an-admin"}, time.Hour)
+	assert.ErrorIs(t, err, ErrHostKeyRotationPending)
+
+	adminRepo, err := git.EnsureRepo(fs, "admin/admin")
+	require.NoError(t, err)
+	require.NoError(t, adminRepo.Checkout(""))
+
+	// Nothing should change until the grace period is over.
+	c := NewConfig(fs)
+	require.NoError(t, c.ensureAdminHostKeys(adminRepo, time.Now()))
+	require.NoError(t, c.loadHostKeys(adminRepo))
+	assert.Equal(t, currentKeys, hostKeyBlobs(t, c.PrivateKeys))
+	assert.Equal(t, nextKeys, hostKeyBlobs(t, c.NextPrivateKeys))
+
+	// After that, the new keys should fully replace the old ones.
+	require.NoError(t, c.ensureAdminHostKeys(adminRepo, time.Now().Add(2*time.Hour)))
+	require.NoError(t, c.loadHostKeys(adminRepo))
+	assert.Equal(t, nextKeys, hostKeyBlobs(t, c.PrivateKeys))
+	assert.Empty(t, c.NextPrivateKeys)
+	assert.True(t, c.RotateHostKeysAt.IsZero())
+
+	// Removed keys shouldn't come back.
+	require.NoError(t, adminRepo.RemoveFile("ssh/id_rsa"))
+	require.NoError(t, c.ensureAdminHostKeys(adminRepo, time.Now()))
+	require.NoError(t, c.loadHostKeys(adminRepo))
+	assert.Equal(t, nextKeys[:2], hostKeyBlobs(t, c.PrivateKeys))
+}
+
+func TestRotateHostKeysLocked(t *testing.T) {
+	t.Parallel()
+
+	fs := osfs.New(t.TempDir())
+
+	_, err := NewServer(fs)
+	require.NoError(t, err)
+
+	// Another instance stands in for a running server holding the config
+	// lock.
+	unlock := newRepoLocks(fs).Lock(configLockPath)
+
+	done := make(chan error)
+
+	go func() {
+		done <- RotateHostKeys(fs, time.Hour, time.Now())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("host keys were rotated while the config was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	require.NoError(t, <-done)
+
+	c := NewConfig(fs)
+	require.NoError(t, c.Load())
+	assert.Len(t, c.NextPrivateKeys, 3)
+}
+
+func TestHostKeysProve(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	rsaSigner, err := gossh.NewSignerFromKey(rsaKey)
+	require.NoError(t, err)
+
+	activeSigner := newTestSigner(t)
+
+	keys := &hostKeySet{
+		active: []gossh.Signer{activeSigner},
+		all:    []gossh.Signer{activeSigner, rsaSigner},
+	}
+
+	sessionID := []byte("session-id")
+
+	var payload []byte
+	for _, signer := range keys.all {
+		payload = appendWireString(payload, signer.PublicKey().Marshal())
+	}
+
+	resp, err := keys.prove(sessionID, payload)
+	require.NoError(t, err)
+
+	r := &wireReader{data: resp}
+
+	for _, signer := range keys.all {
+		sigData, err := r.string()
+		require.NoError(t, err)
+
+		var sig gossh.Signature
+		require.NoError(t, gossh.Unmarshal(sigData, &sig))
+
+		var data []byte
+		data = appendWireString(data, []byte(hostKeysProveRequest))
+		data = appendWireString(data, sessionID)
+		data = appendWireString(data, signer.PublicKey().Marshal())
+
+		assert.NoError(t, signer.PublicKey().Verify(data, &sig))
+	}
+
+	assert.Empty(t, r.data)
+
+	// RSA keys should never be signed with SHA-1.
+	assert.Contains(t, string(resp), gossh.KeyAlgoRSASHA512)
+
+	// Keys we don't have can't be proven.
+	_, err = keys.prove(sessionID, appendWireString(nil, newTestSigner(t).PublicKey().Marshal()))
+	assert.Error(t, err)
+
+	_, err = keys.prove(sessionID, []byte{0, 0, 0, 10})
+	assert.Error(t, err)
+}
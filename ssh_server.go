@@ -3,7 +3,9 @@ package gitdir
 import (
 	"context"
 	"net"
-	"sync"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	billy "github.com/go-git/go-billy/v5"
@@ -16,32 +18,79 @@ import (
 
 // Server represents a gitdir server.
 type Server struct {
-	lock *sync.RWMutex
+	Addr        string
+	HTTPAddr    string
+	MetricsAddr string
 
-	Addr string
+	// Transport determines how git operations are served. If it is not set,
+	// TransportExec will be used.
+	Transport Transport
+
+	// Authenticator is used to look up users from their public keys. If it is
+	// not set, only keys defined in the config will be used. To use keys from
+	// other sources as well, use an AuthenticatorChain which includes a
+	// ConfigAuthenticator.
+	Authenticator Authenticator
 
 	// Internal state
-	log    zerolog.Logger
-	fs     billy.Filesystem
+	log      zerolog.Logger
+	fs       billy.Filesystem
+	state    atomic.Value
+	repos    *repoLocks
+	reloads  *reloadQueue
+	ssh      *ssh.Server
+	webhooks *webhookQueue
+	audit    *AuditLog
+	metrics  *serverMetrics
+
+	// hostKeyTimer reloads the config when a host key rotation is finished.
+	// It may only be changed while holding the config lock.
+	hostKeyTimer *time.Timer
+}
+
+// serverState is everything which is loaded from the config. It is never
+// modified once it has been stored, and is replaced all at once on reload, so
+// each connection sees a consistent snapshot even if the config changes while
+// it is running.
+type serverState struct {
 	config *Config
-	ssh    *ssh.Server
+
+	// hostKeys are used for the key exchange. advertisedHostKeys also
+	// includes any keys which are being rotated in.
+	hostKeys           []gossh.Signer
+	advertisedHostKeys []gossh.Signer
 }
 
 // NewServer configures a new gitdir server and attempts to load the config
 // from the admin repo.
 func NewServer(fs billy.Filesystem) (*Server, error) {
 	serv := &Server{
-		lock: &sync.RWMutex{},
-		log:  log.Logger,
-		fs:   fs,
+		log:      log.Logger,
+		fs:       fs,
+		repos:    newRepoLocks(fs),
+		webhooks: newWebhookQueue(fs),
+		audit:    newAuditLog(fs, auditMaxSize),
 	}
 
+	serv.metrics = newServerMetrics(serv.GetAdminConfig)
+
 	serv.ssh = &ssh.Server{
-		Handler:          serv.handleSession,
-		PublicKeyHandler: serv.handlePublicKey,
+		Handler:              serv.handleSession,
+		PublicKeyHandler:     serv.handlePublicKey,
+		ServerConfigCallback: serv.sshServerConfig,
+		ConnCallback:         serv.handleConn,
+		HostSigners:          []ssh.Signer{placeholderSigner{}},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session": serv.handleSessionChannel,
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			hostKeysProveRequest: serv.handleHostKeysProve,
+		},
 	}
 
-	// This will set serv.settings
+	serv.reloads = newReloadQueue(serv.reload)
+
+	// This will set serv.state
 	if err := serv.Reload(); err != nil {
 		return nil, err
 	}
@@ -50,8 +99,7 @@ func NewServer(fs billy.Filesystem) (*Server, error) {
 }
 
 func (serv *Server) EnsureAdminUser(username string, pubKey *models.PublicKey) error {
-	serv.lock.Lock()
-	defer serv.lock.Unlock()
+	defer serv.repos.Lock(configLockPath)()
 
 	// Create a new config object
 	config := NewConfig(serv.fs)
@@ -68,7 +116,7 @@ func (serv *Server) EnsureAdminUser(username string, pubKey *models.PublicKey) e
 		return err
 	}
 
-	// Load the config from master
+	// Load the config from HEAD
 	err = config.Load()
 	if err != nil {
 		return err
@@ -77,11 +125,23 @@ func (serv *Server) EnsureAdminUser(username string, pubKey *models.PublicKey) e
 	return serv.reloadUnlocked(config)
 }
 
-// Reload reloads the server config in a thread-safe way.
+// Reload reloads the server config in a thread-safe way. If a reload is
+// already running, this waits for it to finish and reloads again, but
+// concurrent calls share that second reload.
 func (serv *Server) Reload() error {
-	serv.lock.Lock()
-	defer serv.lock.Unlock()
+	return serv.reloads.Reload()
+}
+
+func (serv *Server) reload() error {
+	defer serv.repos.Lock(configLockPath)()
+
+	err := serv.reloadFromDisk()
+	serv.metrics.recordReload(err, time.Now())
 
+	return err
+}
+
+func (serv *Server) reloadFromDisk() error {
 	// Create a new config object
 	config := NewConfig(serv.fs)
 
@@ -91,7 +151,7 @@ func (serv *Server) Reload() error {
 		return err
 	}
 
-	// Load the config from master
+	// Load the config from HEAD
 	err = config.Load()
 	if err != nil {
 		return err
@@ -100,22 +160,33 @@ func (serv *Server) Reload() error {
 	return serv.reloadUnlocked(config)
 }
 
+// reloadUnlocked replaces the server state with one loaded from the given
+// config. The config lock must be held when calling this.
 func (serv *Server) reloadUnlocked(config *Config) error {
-	serv.config = config
+	state, err := newServerState(config)
+	if err != nil {
+		return err
+	}
 
-	// Load all ssh keys into the actual ssh server.
-	for _, key := range serv.config.PrivateKeys {
-		signer, err := gossh.NewSignerFromSigner(key)
-		if err != nil {
-			return err
-		}
+	serv.state.Store(state)
+	serv.scheduleHostKeyRotation(config)
 
-		serv.ssh.AddHostKey(signer)
+	// A repo with broken hooks shouldn't stop the config from loading, so
+	// this is only logged.
+	if err := config.installHooks(); err != nil {
+		serv.log.Warn().Err(err).Msg("Failed to install hooks")
 	}
 
 	return nil
 }
 
+// loadState returns the current server state. It must not be modified.
+func (serv *Server) loadState() *serverState {
+	state, _ := serv.state.Load().(*serverState)
+
+	return state
+}
+
 // Serve listens on the given listener for new SSH connections.
 func (serv *Server) Serve(l net.Listener) error {
 	return serv.ssh.Serve(l)
@@ -132,13 +203,81 @@ func (serv *Server) ListenAndServe() error {
 	return serv.ssh.ListenAndServe()
 }
 
+// AcceptInvite attempts to accept an invite for the given key and reloads the
+// server config if it succeeded.
+func (serv *Server) AcceptInvite(invite string, pk *models.PublicKey) (*User, error) {
+	var user *User
+
+	err := serv.updateConfig(func(config *Config) error {
+		var err error
+		user, err = config.AcceptInvite(invite, pk)
+
+		return err
+	})
+
+	return user, err
+}
+
+// updateConfig loads a fresh copy of the config, calls the given function to
+// modify it, and reloads the server config if it succeeded.
+func (serv *Server) updateConfig(cb func(*Config) error) error {
+	return serv.updateConfigRepos(nil, cb)
+}
+
+// updateConfigRepos is the same as updateConfig, but the given repos are also
+// locked while the config is being modified.
+func (serv *Server) updateConfigRepos(repoNames []string, cb func(*Config) error) error {
+	paths := []string{configLockPath}
+
+	for _, repoName := range repoNames {
+		if repo, err := serv.GetAdminConfig().parseRepoPath(repoName); err == nil {
+			paths = append(paths, repoLockPath(repo))
+		}
+	}
+
+	defer serv.repos.Lock(paths...)()
+
+	// Create a new config object
+	config := NewConfig(serv.fs)
+
+	// Load the config from HEAD
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	err = cb(config)
+	if err != nil {
+		return err
+	}
+
+	// Because the callback may have modified any of the config repos, we need
+	// to load a fresh copy of the config.
+	config = NewConfig(serv.fs)
+
+	err = config.Load()
+	if err == nil {
+		err = serv.reloadUnlocked(config)
+	}
+
+	serv.metrics.recordReload(err, time.Now())
+
+	return err
+}
+
 // GetAdminConfig returns the current admin config in a thread-safe manner. The
 // config should not be modified.
 func (serv *Server) GetAdminConfig() *Config {
-	serv.lock.RLock()
-	defer serv.lock.RUnlock()
+	return serv.loadState().config
+}
 
-	return serv.config
+// handleConn wraps every new connection so the result of authenticating is
+// counted in the server metrics.
+func (serv *Server) handleConn(ctx ssh.Context, conn net.Conn) net.Conn {
+	ac := &authConn{Conn: conn, ctx: ctx, metrics: serv.metrics}
+	ctx.SetValue(contextKeyAuthConn, ac)
+
+	return ac
 }
 
 func (serv *Server) handlePublicKey(ctx ssh.Context, incomingKey ssh.PublicKey) bool {
@@ -152,26 +291,84 @@ func (serv *Server) handlePublicKey(ctx ssh.Context, incomingKey ssh.PublicKey)
 
 	pk := models.PublicKey{PublicKey: incomingKey}
 
-	/*
-		if strings.HasPrefix(remoteUser, settings.Options.InvitePrefix) {
-			invite := remoteUser[len(settings.Options.InvitePrefix):]
+	audit := &AuditEvent{
+		Type:        AuditEventAuth,
+		Method:      "publickey",
+		RemoteAddr:  ctx.RemoteAddr().String(),
+		RemoteUser:  remoteUser,
+		Fingerprint: gossh.FingerprintSHA256(incomingKey),
+	}
+	defer serv.recordAudit(audit)
+
+	// Auth is counted once per connection, not once for every key offered.
+	if conn, ok := ctx.Value(contextKeyAuthConn).(*authConn); ok {
+		defer func() { conn.setMethod(audit.Method) }()
+	}
+
+	// If this is an invite, we only check that it's valid here. The invite is
+	// actually accepted when the session starts, because at this point the
+	// client may not have proven it owns the private key yet.
+	if config.Options.InvitePrefix != "" && strings.HasPrefix(remoteUser, config.Options.InvitePrefix) {
+		invite := strings.TrimPrefix(remoteUser, config.Options.InvitePrefix)
+
+		if _, err := config.LookupUserFromInvite(invite); err != nil {
+			slog.Warn().Err(err).Msg("Invalid invite")
+
+			audit.Reason = "invalid invite: " + auditReason(err)
+
+			return false
+		}
+
+		CtxSetUser(ctx, AnonymousUser)
+		CtxSetConfig(ctx, config)
+		CtxSetLogger(ctx, &slog)
+		CtxSetPublicKey(ctx, &pk)
+		CtxSetInvite(ctx, invite)
+
+		audit.Allowed = true
+		audit.Reason = "invite"
+
+		return true
+	}
+
+	var user *User
+
+	var err error
 
-			// Try to accept the invite. If this fails, bail out. Otherwise,
-			// continue looking up the user as normal.
-			if ok := serv.AcceptInvite(invite, models.PublicKey{incomingKey, ""}); !ok {
-				return false
-			}
+	// Certificates are only checked against the trusted CAs in the config, no
+	// matter which Authenticator is being used.
+	if cert, ok := incomingKey.(*gossh.Certificate); ok {
+		slog = slog.With().Str("key_id", cert.KeyId).Uint64("serial", cert.Serial).Logger()
+		audit.Method = "certificate"
 
-			// If it succeeded, we actually need to pull the refreshed admin config
-			// so the new user shows up.
-			settings = serv.GetAdminConfig()
+		user, err = config.LookupUserFromCert(cert, remoteUser, ctx.RemoteAddr())
+	} else {
+		// Deploy keys are also only defined in the config.
+		if _, ok := config.deployKeys[pk.RawMarshalAuthorizedKey()]; ok {
+			user, err = config.LookupUserFromKey(pk, remoteUser)
+		} else {
+			user, err = serv.authenticator().LookupUserFromKey(config, pk, remoteUser)
 		}
-	*/
 
-	user, err := config.LookupUserFromKey(pk, remoteUser)
+		// The remote address isn't available in hooks, so it can only be
+		// checked here.
+		if err == nil && !user.IsAnonymous {
+			err = config.CheckKeyAddr(pk, ctx.RemoteAddr())
+		}
+	}
+
 	if err != nil {
-		slog.Warn().Err(err).Msg("User not found")
-		return false
+		audit.Reason = auditReason(err)
+
+		// If anonymous access is disabled, there's nothing else we can try.
+		if !config.Options.AnonymousRead {
+			slog.Warn().Err(err).Msg("User not found")
+			return false
+		}
+
+		slog.Info().Msg("User not found, falling back to anonymous access")
+
+		user = AnonymousUser
 	}
 
 	// Update the context with what we discovered
@@ -180,9 +377,20 @@ func (serv *Server) handlePublicKey(ctx ssh.Context, incomingKey ssh.PublicKey)
 	CtxSetLogger(ctx, &slog)
 	CtxSetPublicKey(ctx, &pk)
 
+	audit.Allowed = true
+	audit.User = user.Username
+
 	return true
 }
 
+func (serv *Server) authenticator() Authenticator {
+	if serv.Authenticator == nil {
+		return ConfigAuthenticator{}
+	}
+
+	return serv.Authenticator
+}
+
 func (serv *Server) handleSession(s ssh.Session) {
 	var ctx context.Context = s.Context()
 
@@ -196,9 +404,29 @@ func (serv *Server) handleSession(s ssh.Session) {
 		handlePanic(slog)
 	}()
 
+	start := time.Now()
+
 	slog.Info().Msg("Starting session")
 	defer slog.Info().Msg("Session closed")
 
+	// If the user connected with an invite, we need to accept it before
+	// running any commands.
+	if invite := CtxInvite(ctx); invite != "" {
+		user, err := serv.AcceptInvite(invite, CtxPublicKey(ctx))
+		if err != nil {
+			slog.Warn().Err(err).Msg("Failed to accept invite")
+			_ = writeStringFmt(s.Stderr(), "Failed to accept invite\r\n")
+			_ = s.Exit(1)
+
+			return
+		}
+
+		slog.Info().Str("user", user.Username).Msg("Accepted invite")
+
+		CtxSetUser(s.Context(), user)
+		CtxSetConfig(s.Context(), serv.GetAdminConfig())
+	}
+
 	cmd := s.Command()
 
 	// If the user doesn't provide any arguments, we want to run the internal
@@ -212,19 +440,57 @@ func (serv *Server) handleSession(s ssh.Session) {
 	slog = &tmpLog
 	ctx = WithLogger(ctx, slog)
 
+	// Deploy keys and read-only keys can only run a few commands.
+	if !CtxUser(ctx).allowsCommand(cmd[0]) {
+		slog.Warn().Msg("Command not allowed for key")
+		_ = writeStringFmt(s.Stderr(), "command %q is not available to this key\r\n", cmd[0])
+		_ = s.Exit(1)
+
+		return
+	}
+
 	var exit int
 
+	command := cmd[0]
+
 	switch cmd[0] {
 	case "whoami":
 		exit = cmdWhoami(ctx, s, cmd)
+	case "info", "ls":
+		exit = cmdInfo(ctx, s, cmd)
+	case "keys":
+		exit = serv.cmdKeys(ctx, s, cmd)
+	case "repo":
+		exit = serv.cmdRepo(ctx, s, cmd)
+	case "webhooks":
+		exit = serv.cmdWebhooks(ctx, s, cmd)
+	case "audit":
+		exit = serv.cmdAudit(ctx, s, cmd)
+	case "rotate-host-keys":
+		exit = serv.cmdRotateHostKeys(ctx, s, cmd)
+	case "quota":
+		exit = cmdQuota(ctx, s, cmd)
+	case "mirrors":
+		exit = serv.cmdMirrors(ctx, s, cmd)
 	case "git-receive-pack":
 		exit = serv.cmdGitReceivePack(ctx, s, cmd)
 	case "git-upload-pack":
 		exit = serv.cmdGitUploadPack(ctx, s, cmd)
 	default:
 		exit = cmdNotFound(ctx, s, cmd)
+
+		// Unknown commands are grouped together so clients can't create
+		// arbitrary metrics.
+		command = "unknown"
 	}
 
 	slog.Info().Int("return_code", exit).Msg("Return code")
+
+	if keys, ok := ctx.Value(contextKeyHostKeys).(*hostKeySet); ok {
+		keys.wait()
+	}
+
 	_ = s.Exit(exit)
+
+	serv.metrics.recordSession(command, time.Since(start))
 }
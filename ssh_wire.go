@@ -0,0 +1,73 @@
+package gitdir
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errWireTruncated = errors.New("ssh: truncated data")
+
+// wireReader reads the basic data types used by the SSH wire protocol, as
+// described in RFC 4251.
+type wireReader struct {
+	data []byte
+}
+
+func (r *wireReader) uint64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, errWireTruncated
+	}
+
+	ret := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+
+	return ret, nil
+}
+
+func (r *wireReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errWireTruncated
+	}
+
+	ret := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+
+	return ret, nil
+}
+
+func (r *wireReader) byte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, errWireTruncated
+	}
+
+	ret := r.data[0]
+	r.data = r.data[1:]
+
+	return ret, nil
+}
+
+func (r *wireReader) string() ([]byte, error) {
+	length, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(len(r.data)) < length {
+		return nil, errWireTruncated
+	}
+
+	ret := r.data[:length]
+	r.data = r.data[length:]
+
+	return ret, nil
+}
+
+// appendWireString appends data to buf as an SSH string, which is prefixed
+// with its length.
+func appendWireString(buf []byte, data []byte) []byte {
+	var length [4]byte
+
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+	return append(append(buf, length[:]...), data...)
+}
@@ -0,0 +1,290 @@
+package gitdir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+// Transport determines how git-upload-pack and git-receive-pack are served.
+type Transport string
+
+const (
+	// TransportExec runs the services using the git binary. This is the
+	// default.
+	TransportExec Transport = "exec"
+
+	// TransportNative serves the services in-process using go-git, so git
+	// does not need to be installed. Hooks are run as Go functions rather
+	// than from the repo. Shallow clones are not supported.
+	TransportNative Transport = "native"
+)
+
+// ParseTransport converts a string to a Transport, returning an error if it is
+// not a known transport.
+func ParseTransport(raw string) (Transport, error) {
+	switch Transport(raw) {
+	case TransportExec, TransportNative:
+		return Transport(raw), nil
+	}
+
+	return "", fmt.Errorf("unknown transport %q", raw)
+}
+
+// parseGitProtocol validates the value of GIT_PROTOCOL sent by a client. It is
+// a colon separated list of keys with optional values. Anything which doesn't
+// fit that format is rejected so clients can't inject arbitrary data into
+// the environment of the git process.
+func parseGitProtocol(raw string) (string, bool) {
+	if raw == "" || len(raw) > 256 {
+		return "", false
+	}
+
+	for _, param := range strings.Split(raw, ":") {
+		parts := strings.SplitN(param, "=", 2)
+
+		if !isGitProtocolToken(parts[0], false) || (len(parts) == 2 && !isGitProtocolToken(parts[1], true)) {
+			return "", false
+		}
+	}
+
+	return raw, true
+}
+
+func isGitProtocolToken(token string, isValue bool) bool {
+	if token == "" {
+		return false
+	}
+
+	for _, c := range token {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		case isValue && c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// gitProtocolVersion returns the protocol version requested in the given
+// GIT_PROTOCOL value. If none was requested, this will be 0.
+func gitProtocolVersion(gitProtocol string) int {
+	version := 0
+
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if !strings.HasPrefix(param, "version=") {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(strings.TrimPrefix(param, "version="))
+		if err == nil && parsed > version {
+			version = parsed
+		}
+	}
+
+	return version
+}
+
+// negotiateGitProtocol validates the GIT_PROTOCOL value requested by a client
+// and logs the protocol version which will be used. An empty string is
+// returned if the value is invalid or nothing was requested.
+func negotiateGitProtocol(log *zerolog.Logger, raw string) string {
+	gitProtocol, ok := parseGitProtocol(raw)
+	if !ok && raw != "" {
+		log.Warn().Str("git_protocol", raw).Msg("Ignoring invalid git protocol")
+	}
+
+	log.Info().
+		Str("git_protocol", gitProtocol).
+		Int("protocol_version", gitProtocolVersion(gitProtocol)).
+		Msg("Negotiated git protocol")
+
+	return gitProtocol
+}
+
+// lookupEnv returns the last value of the given variable in the environment.
+func lookupEnv(environ []string, key string) string {
+	var ret string
+
+	for _, env := range environ {
+		if strings.HasPrefix(env, key+"=") {
+			ret = strings.TrimPrefix(env, key+"=")
+		}
+	}
+
+	return ret
+}
+
+// gitServiceRequest contains everything needed to run a git service on a
+// repo.
+type gitServiceRequest struct {
+	Service       string
+	Repo          *RepoLookup
+	RepoName      string
+	User          *User
+	PublicKey     *models.PublicKey
+	StatelessRPC  bool
+	AdvertiseRefs bool
+
+	// GitProtocol is the validated value of GIT_PROTOCOL sent by the client,
+	// if any.
+	GitProtocol string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// runGitService runs the requested git service using the configured transport
+// and returns the exit code.
+func (serv *Server) runGitService(log *zerolog.Logger, req *gitServiceRequest) int {
+	stdin := &countingReader{r: req.Stdin}
+	stdout := &countingWriter{w: req.Stdout}
+
+	defer func() {
+		serv.metrics.recordTransfer(req.Service, atomic.LoadInt64(&stdin.count), atomic.LoadInt64(&stdout.count))
+	}()
+
+	// Pushes to the same repo are serialized. Config repos share a lock, so
+	// a push to one of them can't race with other changes to the config.
+	if req.Service == "git-receive-pack" && !req.AdvertiseRefs {
+		defer serv.repos.Lock(repoLockPath(req.Repo))()
+	}
+
+	// Make a copy of the request so we don't modify the caller's copy.
+	tmp := *req
+	req = &tmp
+	req.Stdin = stdin
+	req.Stdout = stdout
+
+	if serv.Transport == TransportNative {
+		// The native transport only speaks protocol v0, which all clients
+		// fall back to when the server doesn't respond with v2.
+		if req.GitProtocol != "" {
+			log.Debug().Str("git_protocol", req.GitProtocol).Msg("Ignoring git protocol for native transport")
+		}
+
+		err := serv.runNativeGitService(req)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to run git service")
+			return 1
+		}
+
+		return 0
+	}
+
+	args := []string{req.Service}
+
+	if req.StatelessRPC {
+		args = append(args, "--stateless-rpc")
+	}
+
+	if req.AdvertiseRefs {
+		args = append(args, "--advertise-refs")
+	}
+
+	args = append(args, req.Repo.Path())
+
+	environ := serv.repoActionEnviron(req.RepoName, req.User, req.PublicKey)
+
+	if req.GitProtocol != "" {
+		environ = append(environ, "GIT_PROTOCOL="+req.GitProtocol)
+	}
+
+	return runCommand(log, serv.fs.Root(), req.Stdin, req.Stdout, req.Stderr, args, environ)
+}
+
+func (serv *Server) runNativeGitService(req *gitServiceRequest) error {
+	repo, err := git.Open(serv.fs, req.Repo.Path())
+	if err != nil {
+		return err
+	}
+
+	opts := git.TransportOptions{
+		StatelessRPC:  req.StatelessRPC,
+		AdvertiseRefs: req.AdvertiseRefs,
+		Messages:      req.Stderr,
+	}
+
+	switch req.Service {
+	case "git-upload-pack":
+		return repo.UploadPack(req.Stdin, req.Stdout, &opts)
+	case "git-receive-pack":
+		return repo.ReceivePack(req.Stdin, req.Stdout, &git.ReceivePackOptions{
+			TransportOptions: opts,
+			PreReceive: func(updates []*git.RefUpdate, messages io.Writer) error {
+				return serv.runNativeHook(req, "pre-receive", nil, formatRefUpdates(updates), messages)
+			},
+			Update: func(update *git.RefUpdate, messages io.Writer) error {
+				return serv.runNativeHook(req, "update", []string{
+					update.Name.String(),
+					update.OldHash.String(),
+					update.NewHash.String(),
+				}, "", messages)
+			},
+			PostReceive: func(updates []*git.RefUpdate, messages io.Writer) {
+				err := serv.runNativeHook(req, "post-receive", nil, formatRefUpdates(updates), messages)
+				if err != nil {
+					_, _ = fmt.Fprintf(messages, "error: %s\n", err)
+				}
+			},
+		})
+	}
+
+	return fmt.Errorf("unknown git service %q", req.Service)
+}
+
+// runNativeHook runs the given hook in-process, followed by any hooks from the
+// config installed in the repo. As with hooks run by git, a fresh copy of the
+// config is loaded for every hook, and all the hooks are run even if one fails.
+func (serv *Server) runNativeHook(req *gitServiceRequest, hook string, args []string, stdin string, messages io.Writer) error {
+	config := NewConfig(serv.fs)
+
+	err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	builtinErr := config.RunHook(hook, req.RepoName, req.User.Username, req.PublicKey, args, strings.NewReader(stdin))
+
+	timeout := git.DefaultHookTimeout
+	if config.Options.HookTimeout > 0 {
+		timeout = config.Options.HookTimeout
+	}
+
+	gitDir := filepath.Join(serv.fs.Root(), req.Repo.Path()+".git")
+	environ := append(serv.repoActionEnviron(req.RepoName, req.User, req.PublicKey), "GIT_DIR="+gitDir)
+
+	err = git.RunCustomHooks(
+		context.Background(), gitDir, hook, args, environ,
+		strings.NewReader(stdin), messages, messages, timeout,
+	)
+	if builtinErr != nil {
+		return builtinErr
+	}
+
+	return err
+}
+
+// formatRefUpdates formats the given updates in the same way git passes them
+// to the pre-receive and post-receive hooks.
+func formatRefUpdates(updates []*git.RefUpdate) string {
+	var b strings.Builder
+
+	for _, update := range updates {
+		fmt.Fprintf(&b, "%s %s %s\n", update.OldHash, update.NewHash, update.Name)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package gitdir
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+)
+
+func TestParseGitProtocol(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct { //nolint:gofumpt
+		Input   string
+		Valid   bool
+		Version int
+	}{
+		{"", false, 0},
+		{"version=2", true, 2},
+		{"version=1", true, 1},
+		{"version=2:object-format=sha256", true, 2},
+		{"object-format=sha256", true, 0},
+		{"flag", true, 0},
+		{"version=2 --upload-pack=evil", false, 0},
+		{"version=2\nPATH=/tmp", false, 0},
+		{"version=", false, 0},
+		{"=2", false, 0},
+		{"version=2::", false, 0},
+	}
+
+	for _, test := range tests {
+		gitProtocol, ok := parseGitProtocol(test.Input)
+		assert.Equal(t, test.Valid, ok, test.Input)
+
+		if ok {
+			assert.Equal(t, test.Input, gitProtocol)
+		}
+
+		assert.Equal(t, test.Version, gitProtocolVersion(gitProtocol), test.Input)
+	}
+}
+
+func TestLookupEnv(t *testing.T) {
+	t.Parallel()
+
+	environ := []string{"GIT_PROTOCOL=version=1", "OTHER=value", "GIT_PROTOCOL=version=2"}
+
+	assert.Equal(t, "version=2", lookupEnv(environ, "GIT_PROTOCOL"))
+	assert.Equal(t, "value", lookupEnv(environ, "OTHER"))
+	assert.Equal(t, "", lookupEnv(environ, "MISSING"))
+}
+
+// newTestPackRequest builds a receive-pack request which creates the given ref
+// pointing to a commit. The packfile only contains the commit and the given
+// objects.
+func newTestPackRequest(t *testing.T, ref string, objects ...plumbing.EncodedObject) (*bytes.Buffer, plumbing.Hash) {
+	t.Helper()
+
+	storage := memory.NewStorage()
+	hashes := make([]plumbing.Hash, 0, len(objects))
+
+	for _, obj := range objects {
+		hash, err := storage.SetEncodedObject(obj)
+		require.Nil(t, err)
+
+		hashes = append(hashes, hash)
+	}
+
+	var req bytes.Buffer
+
+	enc := pktline.NewEncoder(&req)
+	require.Nil(t, enc.Encodef("%s %s %s\x00report-status\n", plumbing.ZeroHash, hashes[0], ref))
+	require.Nil(t, enc.Flush())
+
+	_, err := packfile.NewEncoder(&req, storage, false).Encode(hashes, 10)
+	require.Nil(t, err)
+
+	return &req, hashes[0]
+}
+
+func encodeTestObject(t *testing.T, obj interface {
+	Encode(plumbing.EncodedObject) error
+}) plumbing.EncodedObject {
+	t.Helper()
+
+	encoded := &plumbing.MemoryObject{}
+	require.Nil(t, obj.Encode(encoded))
+
+	return encoded
+}
+
+func TestReceivePackConnectivity(t *testing.T) {
+	t.Parallel()
+
+	fs := osfs.New(t.TempDir())
+
+	repo, err := git.EnsureRepo(fs, "a-repo")
+	require.Nil(t, err)
+
+	sig := object.Signature{Name: "a-user", Email: "a-user@localhost", When: time.Now()}
+	emptyTree := encodeTestObject(t, &object.Tree{})
+
+	commit := func(treeHash plumbing.Hash) plumbing.EncodedObject {
+		return encodeTestObject(t, &object.Commit{
+			Author:    sig,
+			Committer: sig,
+			Message:   "A commit",
+			TreeHash:  treeHash,
+		})
+	}
+
+	opts := &git.ReceivePackOptions{TransportOptions: git.TransportOptions{StatelessRPC: true}}
+
+	// The tree is sent along with the commit, so this is complete.
+	req, hash := newTestPackRequest(t, "refs/heads/complete", commit(emptyTree.Hash()), emptyTree)
+
+	var out bytes.Buffer
+
+	require.Nil(t, repo.ReceivePack(req, &out, opts))
+	assert.Contains(t, out.String(), "ok refs/heads/complete")
+
+	ref, err := repo.Repo.Reference("refs/heads/complete", false)
+	require.Nil(t, err)
+	assert.Equal(t, hash, ref.Hash())
+
+	// The tree is missing, so the ref must not be created.
+	req, _ = newTestPackRequest(t, "refs/heads/missing", commit(plumbing.NewHash("1111111111111111111111111111111111111111")))
+	out.Reset()
+
+	require.Nil(t, repo.ReceivePack(req, &out, opts))
+	assert.Contains(t, out.String(), "ng refs/heads/missing missing necessary objects")
+
+	_, err = repo.Repo.Reference("refs/heads/missing", false)
+	assert.NotNil(t, err)
+}
+
+func TestUploadPackWants(t *testing.T) {
+	t.Parallel()
+
+	fs := osfs.New(t.TempDir())
+
+	repo, err := git.EnsureRepo(fs, "a-repo")
+	require.Nil(t, err)
+	require.Nil(t, repo.Checkout(""))
+
+	first := newTestCommit(t, repo, "first")
+	second := newTestCommit(t, repo, "second")
+	third := newTestCommit(t, repo, "third")
+
+	// Rewinding the branch leaves the third commit without any refs
+	// pointing to it.
+	require.Nil(t, repo.Repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", plumbing.NewHash(second))))
+
+	repo, err = git.Open(fs, "a-repo")
+	require.Nil(t, err)
+
+	// Stateless clients may also want commits which can be reached from
+	// the current refs, because the refs may have changed since they were
+	// advertised.
+	for _, test := range []struct {
+		Want      string
+		Stateless bool
+		Error     bool
+	}{
+		{second, true, false},
+		{second, false, false},
+		{first, true, false},
+		{first, false, true},
+		{third, true, true},
+		{third, false, true},
+	} {
+		var req, out bytes.Buffer
+
+		enc := pktline.NewEncoder(&req)
+		require.Nil(t, enc.Encodef("want %s\n", test.Want))
+		require.Nil(t, enc.Flush())
+		require.Nil(t, enc.EncodeString("done\n"))
+
+		err = repo.UploadPack(&req, &out, &git.TransportOptions{StatelessRPC: test.Stateless})
+		if test.Error {
+			assert.ErrorIs(t, err, git.ErrProtocol, test.Want)
+		} else {
+			assert.Nil(t, err, test.Want)
+			assert.Contains(t, out.String(), "PACK", test.Want)
+		}
+	}
+}
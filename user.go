@@ -1,9 +1,17 @@
 package gitdir
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/belak/go-gitdir/models"
 )
@@ -14,6 +22,31 @@ type User struct {
 	Username    string
 	IsAnonymous bool
 	IsAdmin     bool
+
+	// DeployKey is set if the session authenticated with a deploy key. These
+	// sessions can only access a single repo.
+	DeployKey *DeployKeyAccess
+
+	// ReadOnly is set if the session authenticated with a read-only key.
+	// These sessions only have read access to any repo.
+	ReadOnly bool
+}
+
+// readOnlyCommands are the only commands a read-only key may run.
+var readOnlyCommands = []string{"whoami", "info", "ls", "git-upload-pack"}
+
+// allowsCommand returns false if this user authenticated with a restricted
+// key which cannot run the given command.
+func (u *User) allowsCommand(command string) bool {
+	if u.DeployKey != nil && !listContainsStr(deployKeyCommands, command) {
+		return false
+	}
+
+	if u.ReadOnly && !listContainsStr(readOnlyCommands, command) {
+		return false
+	}
+
+	return true
 }
 
 // AnonymousUser is the user that is returned when no user is available.
@@ -49,6 +82,34 @@ func (c *Config) LookupUserFromUsername(username string) (*User, error) {
 
 // LookupUserFromKey looks up a user object given their PublicKey.
 func (c *Config) LookupUserFromKey(pk models.PublicKey, remoteUser string) (*User, error) {
+	// The anonymous username always results in an anonymous session, even if
+	// the key would otherwise match a user.
+	if c.Options.AnonymousRead && c.Options.AnonymousUser != "" && remoteUser == c.Options.AnonymousUser {
+		return AnonymousUser, nil
+	}
+
+	user, err := c.lookupUserFromKey(pk, remoteUser)
+	if err != nil {
+		return user, err
+	}
+
+	restrictions := c.keyRestrictions[pk.RawMarshalAuthorizedKey()]
+
+	if restrictions.Expired(time.Now()) {
+		log.Warn().Msg("key is expired")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	user.ReadOnly = restrictions.ReadOnly
+
+	return user, nil
+}
+
+func (c *Config) lookupUserFromKey(pk models.PublicKey, remoteUser string) (*User, error) {
+	if deployKey, ok := c.deployKeys[pk.RawMarshalAuthorizedKey()]; ok {
+		return c.lookupDeployKey(deployKey, remoteUser)
+	}
+
 	username, ok := c.publicKeys[pk.RawMarshalAuthorizedKey()]
 	if !ok {
 		log.Warn().Msg("key does not exist")
@@ -79,14 +140,195 @@ func (c *Config) LookupUserFromKey(pk models.PublicKey, remoteUser string) (*Use
 	}, nil
 }
 
+// ErrKeyAddrNotAllowed is returned from CheckKeyAddr when a key cannot be used
+// from the given address.
+var ErrKeyAddrNotAllowed = errors.New("key is not allowed from this address")
+
+// CheckKeyAddr returns ErrKeyAddrNotAllowed if the from option on the given
+// key in the config doesn't allow it to be used from addr.
+func (c *Config) CheckKeyAddr(pk models.PublicKey, addr net.Addr) error {
+	restrictions := c.keyRestrictions[pk.RawMarshalAuthorizedKey()]
+
+	if !restrictions.AllowsIP(addrIP(addr)) {
+		log.Warn().Msg("key is not allowed from this address")
+		return ErrKeyAddrNotAllowed
+	}
+
+	return nil
+}
+
+// addrIP returns the IP address of the given address, or nil if it doesn't
+// have one.
+func addrIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// certAllowsAddr checks the source-address critical option of the given
+// certificate. gossh.CertChecker skips this option because it expects the ssh
+// server to check it, so it needs to be checked here.
+func certAllowsAddr(cert *gossh.Certificate, addr net.Addr) bool {
+	value, ok := cert.CriticalOptions["source-address"]
+	if !ok {
+		return true
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, pattern := range strings.Split(value, ",") {
+		if !strings.Contains(pattern, "/") {
+			if net.ParseIP(pattern).Equal(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LookupUserFromCert looks up a user object given an SSH certificate signed by
+// one of the trusted user CAs. The principals in the certificate are usernames
+// and addr is where the client is connecting from.
+func (c *Config) LookupUserFromCert(cert *gossh.Certificate, remoteUser string, addr net.Addr) (*User, error) {
+	// The anonymous username always results in an anonymous session, even if
+	// the certificate would otherwise match a user.
+	if c.Options.AnonymousRead && c.Options.AnonymousUser != "" && remoteUser == c.Options.AnonymousUser {
+		return AnonymousUser, nil
+	}
+
+	if cert.CertType != gossh.UserCert {
+		log.Warn().Msg("certificate is not a user certificate")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	if !c.isTrustedUserCA(cert.SignatureKey) {
+		log.Warn().Msg("certificate is not signed by a trusted ca")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	// If they weren't the git user make sure their username is one of the
+	// principals, otherwise use the first principal which is a user.
+	username := ""
+
+	for _, principal := range cert.ValidPrincipals {
+		if remoteUser == principal || (remoteUser == c.Options.GitUser && c.Users[principal] != nil) {
+			username = principal
+			break
+		}
+	}
+
+	if username == "" {
+		log.Warn().Msg("certificate does not match a user")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	checker := &gossh.CertChecker{
+		IsRevoked: func(cert *gossh.Certificate) bool {
+			return c.revokedKeys.IsRevoked(cert)
+		},
+	}
+
+	if err := checker.CheckCert(username, cert); err != nil {
+		log.Warn().Err(err).Msg("certificate is not valid")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	if !certAllowsAddr(cert, addr) {
+		log.Warn().Msg("certificate is not allowed from this address")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	return c.LookupUserFromUsername(username)
+}
+
+func (c *Config) isTrustedUserCA(pk gossh.PublicKey) bool {
+	for _, ca := range c.Options.TrustedUserCAKeys {
+		if bytes.Equal(ca.Marshal(), pk.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LookupUserFromToken looks up a user object given an HTTP token. If the
+// username is empty or the git user, any user's tokens will match.
+func (c *Config) LookupUserFromToken(username, token string) (*User, error) {
+	if token == "" {
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	// If they weren't the git user, only check the tokens for that user.
+	if username != "" && username != c.Options.GitUser {
+		userConfig, ok := c.Users[username]
+		if !ok || !userHasToken(userConfig, token) {
+			log.Warn().Msg("token does not match user")
+			return AnonymousUser, ErrUserNotFound
+		}
+
+		return c.LookupUserFromUsername(username)
+	}
+
+	for username, userConfig := range c.Users {
+		if userHasToken(userConfig, token) {
+			return c.LookupUserFromUsername(username)
+		}
+	}
+
+	log.Warn().Msg("token does not exist")
+
+	return AnonymousUser, ErrUserNotFound
+}
+
+func userHasToken(userConfig *models.AdminConfigUser, token string) bool {
+	tokenHash := sha256.Sum256([]byte(token))
+	hashedToken := "sha256:" + hex.EncodeToString(tokenHash[:])
+
+	for _, userToken := range userConfig.Tokens {
+		if strings.HasPrefix(userToken, "sha256:") {
+			if subtle.ConstantTimeCompare([]byte(strings.ToLower(userToken)), []byte(hashedToken)) == 1 {
+				return true
+			}
+
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(userToken), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
 // LookupUserFromInvite looks up a user object given an invite code.
 func (c *Config) LookupUserFromInvite(invite string) (*User, error) {
-	username, ok := c.Invites[invite]
+	inviteConfig, ok := c.Invites[invite]
 	if !ok {
 		log.Warn().Msg("invite does not exist")
 		return AnonymousUser, ErrUserNotFound
 	}
 
+	if inviteConfig.Expired(time.Now()) {
+		log.Warn().Msg("invite is expired")
+		return AnonymousUser, ErrUserNotFound
+	}
+
+	username := inviteConfig.User
+
 	userConfig, ok := c.Users[username]
 	if !ok {
 		log.Warn().Msg("invite does not match a user")
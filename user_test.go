@@ -1,10 +1,14 @@
 package gitdir
 
 import (
+	"crypto/rand"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/belak/go-gitdir/models"
 )
@@ -117,6 +121,33 @@ func TestLookupUserFromKey(t *testing.T) { //nolint:funlen
 	}
 }
 
+func TestLookupUserFromKeyAnonymous(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConfig()
+	c.Options.AnonymousUser = "anonymous"
+
+	pk := mustParsePK("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILQGpcX2owFW6hdTWHa/CzbTwhUJlmI8gKAgnp/c0NK2 an-admin")
+
+	// When anonymous access is disabled, the anonymous username is just a
+	// normal username.
+	_, err := c.LookupUserFromKey(pk, "anonymous")
+	require.Equal(t, ErrUserNotFound, err)
+
+	c.Options.AnonymousRead = true
+
+	// The anonymous username should always return the anonymous user, even if
+	// the key is known.
+	user, err := c.LookupUserFromKey(pk, "anonymous")
+	require.Nil(t, err)
+	assert.Equal(t, AnonymousUser, user)
+
+	// Other usernames should still be looked up as normal.
+	user, err = c.LookupUserFromKey(pk, c.Options.GitUser)
+	require.Nil(t, err)
+	assert.Equal(t, "an-admin", user.Username)
+}
+
 func TestLookupUserFromInvite(t *testing.T) {
 	t.Parallel()
 
@@ -147,6 +178,16 @@ func TestLookupUserFromInvite(t *testing.T) {
 			"user-missing",
 			ErrUserNotFound,
 		},
+		{
+			"an-admin",
+			"expired",
+			ErrUserNotFound,
+		},
+		{
+			"an-admin",
+			"used-up",
+			ErrUserNotFound,
+		},
 	}
 
 	for _, test := range tests {
@@ -160,3 +201,161 @@ func TestLookupUserFromInvite(t *testing.T) {
 		}
 	}
 }
+
+func TestLookupUserFromCert(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	ca := newTestSigner(t)
+	untrustedCA := newTestSigner(t)
+
+	c := newTestConfig()
+	c.Options.TrustedUserCAKeys = []models.PublicKey{{PublicKey: ca.PublicKey()}}
+
+	var err error
+
+	c.revokedKeys, err = parseKRL(newTestKRL(
+		krlSection(krlSectionCertificates,
+			krlString(ca.PublicKey().Marshal()),
+			krlString(nil),
+			krlSection(krlSectionCertSerialList, krlUint64(42)),
+		),
+	))
+	require.NoError(t, err)
+
+	expired := newTestCert(t, ca, 0, "", "non-admin")
+	expired.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+	require.NoError(t, expired.SignCert(rand.Reader, ca))
+
+	hostCert := newTestCert(t, ca, 0, "", "non-admin")
+	hostCert.CertType = gossh.HostCert
+	require.NoError(t, hostCert.SignCert(rand.Reader, ca))
+
+	forceCommand := newTestCert(t, ca, 0, "", "non-admin")
+	forceCommand.CriticalOptions = map[string]string{"force-command": "true"}
+	require.NoError(t, forceCommand.SignCert(rand.Reader, ca))
+
+	// All the certs are used from this address.
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222}
+
+	otherNetwork := newTestCert(t, ca, 0, "", "non-admin")
+	otherNetwork.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8,192.0.2.2"}
+	require.NoError(t, otherNetwork.SignCert(rand.Reader, ca))
+
+	sameNetwork := newTestCert(t, ca, 0, "", "non-admin")
+	sameNetwork.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8,192.0.2.0/24"}
+	require.NoError(t, sameNetwork.SignCert(rand.Reader, ca))
+
+	var tests = []struct { //nolint:gofumpt
+		Name       string
+		Cert       *gossh.Certificate
+		RemoteUser string
+		Username   string
+	}{
+		{"valid", newTestCert(t, ca, 1, "", "non-admin"), "non-admin", "non-admin"},
+		{"git user", newTestCert(t, ca, 1, "", "non-admin"), "git", "non-admin"},
+		{"other principal", newTestCert(t, ca, 1, "", "non-admin", "an-admin"), "an-admin", "an-admin"},
+		{"first user principal", newTestCert(t, ca, 1, "", "missing-user", "an-admin", "non-admin"), "git", "an-admin"},
+		{"wrong principal", newTestCert(t, ca, 1, "", "non-admin"), "an-admin", ""},
+		{"no principals", newTestCert(t, ca, 1, ""), "git", ""},
+		{"missing user", newTestCert(t, ca, 1, "", "missing-user"), "missing-user", ""},
+		{"disabled user", newTestCert(t, ca, 1, "", "disabled"), "git", ""},
+		{"untrusted ca", newTestCert(t, untrustedCA, 1, "", "non-admin"), "git", ""},
+		{"revoked", newTestCert(t, ca, 42, "", "non-admin"), "git", ""},
+		{"expired", expired, "git", ""},
+		{"host cert", hostCert, "git", ""},
+		{"critical option", forceCommand, "git", ""},
+		{"source address", sameNetwork, "git", "non-admin"},
+		{"other source address", otherNetwork, "git", ""},
+	}
+
+	for _, test := range tests {
+		user, err := c.LookupUserFromCert(test.Cert, test.RemoteUser, addr)
+
+		if test.Username == "" {
+			assert.Equal(t, ErrUserNotFound, err, test.Name)
+			assert.Equal(t, AnonymousUser, user, test.Name)
+		} else {
+			require.NoError(t, err, test.Name)
+			assert.Equal(t, test.Username, user.Username, test.Name)
+		}
+	}
+
+	// The anonymous username should always return the anonymous user.
+	c.Options.AnonymousRead = true
+	c.Options.AnonymousUser = "anonymous"
+
+	user, err := c.LookupUserFromCert(newTestCert(t, ca, 1, "", "non-admin"), "anonymous", addr)
+	require.NoError(t, err)
+	assert.Equal(t, AnonymousUser, user)
+}
+
+func TestLookupUserFromKeyRestrictions(t *testing.T) {
+	t.Parallel()
+
+	const expiredKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ7+BNW+C5HHQ8C3QcJCYfUvxz+biXbxB0JtufT+P2AD"
+
+	c := newTestConfig()
+	c.Users["write-user"].Keys = []models.PublicKey{
+		mustParsePK(`read-only ` + testAuthKey),
+		mustParsePK(`from="10.0.0.0/8,!10.1.0.0/16,192.168.1.1",no-pty ` + testAuthOtherKey),
+		mustParsePK(`expiry-time="20200101Z" ` + expiredKey),
+	}
+	c.flatten()
+
+	// Read-only keys are capped at read access and can only run a few
+	// commands.
+	user, err := c.LookupUserFromKey(mustParsePK(testAuthKey), c.Options.GitUser)
+	require.Nil(t, err)
+	assert.True(t, user.ReadOnly)
+	assert.True(t, user.allowsCommand("git-upload-pack"))
+	assert.False(t, user.allowsCommand("git-receive-pack"))
+	assert.False(t, user.allowsCommand("keys"))
+
+	lookupAndCheck(t, c, user, "test-repo", AccessLevelRead)
+	lookupAndCheck(t, c, user, "admin", AccessLevelNone)
+
+	user, err = c.LookupUserFromKey(mustParsePK(testAuthOtherKey), c.Options.GitUser)
+	require.Nil(t, err)
+	assert.False(t, user.ReadOnly)
+	lookupAndCheck(t, c, user, "test-repo", AccessLevelWrite)
+
+	_, err = c.LookupUserFromKey(mustParsePK(expiredKey), c.Options.GitUser)
+	assert.Equal(t, ErrUserNotFound, err)
+
+	for _, test := range []struct {
+		Addr  string
+		Error error
+	}{
+		{"10.2.3.4", nil},
+		{"10.1.2.3", ErrKeyAddrNotAllowed},
+		{"192.168.1.1", nil},
+		{"192.168.1.2", ErrKeyAddrNotAllowed},
+		{"::1", ErrKeyAddrNotAllowed},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(test.Addr), Port: 2222}
+		assert.Equal(t, test.Error, c.CheckKeyAddr(mustParsePK(testAuthOtherKey), addr), test.Addr)
+		assert.Nil(t, c.CheckKeyAddr(mustParsePK(testAuthKey), addr), test.Addr)
+	}
+}
+
+func TestParseKeyRestrictions(t *testing.T) {
+	t.Parallel()
+
+	pk, err := models.ParsePublicKey([]byte(`read-only,expiry-time="202001021504" ` + testAuthKey + " comment"))
+	require.Nil(t, err)
+	assert.True(t, pk.Restrictions.ReadOnly)
+	assert.Equal(t, time.Date(2020, 1, 2, 15, 4, 0, 0, time.Local), pk.Restrictions.ExpiresAt)
+	assert.Equal(t, `read-only,expiry-time="202001021504" `+testAuthKey+" comment", pk.MarshalAuthorizedKey())
+	assert.Equal(t, testAuthKey, pk.RawMarshalAuthorizedKey())
+
+	for _, options := range []string{
+		`command="ls"`,
+		`from="*.example.com"`,
+		`from="10.0.0.0/33"`,
+		`expiry-time="2020"`,
+		`expiry-time="2020130100"`,
+	} {
+		_, err := models.ParsePublicKey([]byte(options + " " + testAuthKey))
+		assert.NotNil(t, err, options)
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 
-	"github.com/gliderlabs/ssh"
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/rs/zerolog"
 )
 
@@ -56,6 +59,51 @@ func listContainsStr(list []string, target string) bool {
 	return false
 }
 
+// copyDir recursively copies the src directory to dst.
+func copyDir(fs billy.Filesystem, src, dst string) error {
+	return util.Walk(fs, src, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, filename)
+		if err != nil {
+			return err
+		}
+
+		target := fs.Join(dst, rel)
+
+		if info.IsDir() {
+			return fs.MkdirAll(target, info.Mode())
+		}
+
+		return copyFile(fs, fs, target, filename, info.Mode())
+	})
+}
+
+// copyFile streams a single file between filesystems so large files, like
+// packfiles, don't need to fit in memory.
+func copyFile(dstFS, srcFS billy.Filesystem, dst, src string, mode os.FileMode) error {
+	in, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dstFS.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
 func handlePanic(logger *zerolog.Logger) {
 	if r := recover(); r != nil {
 		logger.Error().Err(fmt.Errorf("%s", r)).Msg("Caught panic")
@@ -85,11 +133,23 @@ func sanitize(in string) string {
 	return strings.ToLower(in)
 }
 
+// sanitizeRepoName cleans up a repo name provided by a client.
+//   - Trim all slashes from beginning and end
+//   - Add a root slash (so path.Clean works correctly)
+//   - path.Clean
+//   - Remove the initial slash
+//   - Sanitize the name
+func sanitizeRepoName(in string) string {
+	return sanitize(path.Clean("/" + strings.Trim(in, "/"))[1:])
+}
+
 // TODO: see if this can be cleaned up.
 func runCommand( //nolint:funlen
 	log *zerolog.Logger,
 	cwd string,
-	session ssh.Session,
+	stdinSource io.Reader,
+	stdoutTarget io.Writer,
+	stderrTarget io.Writer,
 	args []string,
 	environ []string,
 ) int {
@@ -130,7 +190,7 @@ func runCommand( //nolint:funlen
 	go func() {
 		defer stdin.Close()
 
-		if _, stdinErr := io.Copy(stdin, session); stdinErr != nil {
+		if _, stdinErr := io.Copy(stdin, stdinSource); stdinErr != nil {
 			log.Error().Err(err).Msg("Failed to write session to stdin")
 		}
 	}()
@@ -138,7 +198,7 @@ func runCommand( //nolint:funlen
 	go func() {
 		defer wg.Done()
 
-		if _, stdoutErr := io.Copy(session, stdout); stdoutErr != nil {
+		if _, stdoutErr := io.Copy(stdoutTarget, stdout); stdoutErr != nil {
 			log.Error().Err(err).Msg("Failed to write stdout to session")
 		}
 	}()
@@ -146,7 +206,7 @@ func runCommand( //nolint:funlen
 	go func() {
 		defer wg.Done()
 
-		if _, stderrErr := io.Copy(session.Stderr(), stderr); stderrErr != nil {
+		if _, stderrErr := io.Copy(stderrTarget, stderr); stderrErr != nil {
 			log.Error().Err(err).Msg("Failed to write stderr to session")
 		}
 	}()
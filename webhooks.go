@@ -0,0 +1,609 @@
+package gitdir
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/rs/zerolog"
+
+	"github.com/belak/go-gitdir/models"
+)
+
+// Webhook deliveries are stored on disk under the base dir so they survive
+// restarts. Anything which is still being retried is in the queue dir and
+// anything which has run out of attempts is moved to the failed dir.
+const (
+	webhookQueueDir  = "webhooks/queue"
+	webhookFailedDir = "webhooks/failed"
+)
+
+const (
+	// webhookMaxAttempts is the number of times a delivery will be attempted
+	// before it is marked as failed.
+	webhookMaxAttempts = 10
+
+	// webhookInitialBackoff is how long to wait after the first failure. This
+	// doubles for every following failure.
+	webhookInitialBackoff = 30 * time.Second
+
+	// webhookMaxBackoff is the longest we will wait between attempts.
+	webhookMaxBackoff = time.Hour
+
+	// webhookTimeout is how long a single delivery attempt may take.
+	webhookTimeout = 10 * time.Second
+
+	// webhookPollInterval is how often the queue is checked for deliveries
+	// which are ready to be sent.
+	webhookPollInterval = 5 * time.Second
+)
+
+// ErrWebhookNotFound is returned when a webhook delivery does not exist.
+var ErrWebhookNotFound = errors.New("webhook delivery not found")
+
+// WebhookRef is a single ref update included in a webhook payload.
+type WebhookRef struct {
+	Ref    string `json:"ref"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// WebhookPayload is the JSON body sent to webhook URLs.
+type WebhookPayload struct {
+	Event  string        `json:"event"`
+	Repo   string        `json:"repo"`
+	Pusher string        `json:"pusher"`
+	Refs   []*WebhookRef `json:"refs"`
+}
+
+// WebhookDelivery is a single payload which needs to be sent to a webhook
+// URL, along with the state of any previous attempts.
+type WebhookDelivery struct {
+	ID      string            `json:"id"`
+	URL     string            `json:"url"`
+	Event   string            `json:"event"`
+	Repo    string            `json:"repo"`
+	Headers map[string]string `json:"headers"`
+
+	// Body is stored as a string rather than as raw JSON so the signature
+	// will always match the exact bytes which are sent.
+	Body string `json:"body"`
+
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Delivered   bool      `json:"-"`
+	Failed      bool      `json:"-"`
+}
+
+// signWebhookBody returns the value of the signature header for the given
+// body.
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookID returns a new delivery ID. IDs start with the current time so
+// sorting them also sorts deliveries by when they were created.
+func newWebhookID(now time.Time) (string, error) {
+	buf := make([]byte, 4)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(buf)), nil
+}
+
+// newWebhookDelivery builds a signed delivery for the given webhook and
+// payload.
+func newWebhookDelivery(hook *models.Webhook, payload *WebhookPayload, now time.Time) (*WebhookDelivery, error) {
+	id, err := newWebhookID(now)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"Content-Type":      "application/json",
+		"User-Agent":        "gitdir-webhook",
+		"X-Gitdir-Event":    payload.Event,
+		"X-Gitdir-Delivery": id,
+	}
+
+	if hook.Secret != "" {
+		headers["X-Gitdir-Signature-256"] = signWebhookBody(hook.Secret, body)
+	}
+
+	return &WebhookDelivery{
+		ID:          id,
+		URL:         hook.URL,
+		Event:       payload.Event,
+		Repo:        payload.Repo,
+		Headers:     headers,
+		Body:        string(body),
+		Created:     now,
+		NextAttempt: now,
+	}, nil
+}
+
+// webhookEvents returns the events which a single ref update triggers.
+func webhookEvents(ref *WebhookRef) []string {
+	var (
+		isCreate = isZeroHash(ref.Before)
+		isDelete = isZeroHash(ref.After)
+	)
+
+	switch {
+	case strings.HasPrefix(ref.Ref, "refs/tags/"):
+		return []string{models.WebhookEventTag}
+	case !strings.HasPrefix(ref.Ref, "refs/heads/"):
+		return nil
+	case isDelete:
+		return []string{models.WebhookEventBranchDelete}
+	case isCreate:
+		return []string{models.WebhookEventBranchCreate, models.WebhookEventPush}
+	}
+
+	return []string{models.WebhookEventPush}
+}
+
+func isZeroHash(hash string) bool {
+	return strings.Trim(hash, "0") == ""
+}
+
+// parseWebhookRefs parses the ref updates passed to the post-receive hook.
+func parseWebhookRefs(stdin io.Reader) ([]*WebhookRef, error) {
+	var refs []*WebhookRef
+
+	scanner := bufio.NewScanner(stdin)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ref update %q", scanner.Text())
+		}
+
+		refs = append(refs, &WebhookRef{
+			Before: fields[0],
+			After:  fields[1],
+			Ref:    fields[2],
+		})
+	}
+
+	return refs, scanner.Err()
+}
+
+// lookupWebhooks returns all the webhooks which apply to the given repo. Org
+// webhooks apply to every repo in that org.
+func (c *Config) lookupWebhooks(repo *RepoLookup) []*models.Webhook {
+	var ret []*models.Webhook
+
+	if repoConfig := c.lookupRepoConfig(repo); repoConfig != nil {
+		ret = append(ret, repoConfig.Webhooks...)
+	}
+
+	if repo.Type == RepoTypeOrg {
+		if org, ok := c.Orgs[repo.PathParts[0]]; ok {
+			ret = append(ret, org.Webhooks...)
+		}
+	}
+
+	return ret
+}
+
+// runPostReceiveHook queues a delivery for every webhook and event triggered
+// by the given ref updates.
+func (c *Config) runPostReceiveHook(repo *RepoLookup, user *User, stdin io.Reader) error {
+	webhooks := c.lookupWebhooks(repo)
+	if len(webhooks) == 0 || stdin == nil {
+		return nil
+	}
+
+	refs, err := parseWebhookRefs(stdin)
+	if err != nil {
+		return err
+	}
+
+	// Group the refs by event, keeping track of the order events were first
+	// seen in so deliveries are queued in a predictable order.
+	var (
+		events      []string
+		refsByEvent = make(map[string][]*WebhookRef)
+	)
+
+	for _, ref := range refs {
+		for _, event := range webhookEvents(ref) {
+			if _, ok := refsByEvent[event]; !ok {
+				events = append(events, event)
+			}
+
+			refsByEvent[event] = append(refsByEvent[event], ref)
+		}
+	}
+
+	queue := newWebhookQueue(c.fs)
+	now := time.Now()
+
+	for _, hook := range webhooks {
+		for _, event := range events {
+			if !hook.WantsEvent(event) {
+				continue
+			}
+
+			// Each delivery is created slightly later than the last so
+			// sorting by ID keeps them in the order they were queued.
+			now = now.Add(time.Nanosecond)
+
+			delivery, err := newWebhookDelivery(hook, &WebhookPayload{
+				Event:  event,
+				Repo:   c.RepoName(repo),
+				Pusher: user.Username,
+				Refs:   refsByEvent[event],
+			}, now)
+			if err != nil {
+				return err
+			}
+
+			err = queue.Enqueue(delivery)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// webhookQueue manages webhook deliveries stored on disk. Deliveries are
+// queued by the post-receive hook, which may be run in a separate process, so
+// all state is kept in files which are replaced atomically.
+type webhookQueue struct {
+	lock   sync.Mutex
+	fs     billy.Filesystem
+	client *http.Client
+	now    func() time.Time
+}
+
+func newWebhookQueue(fs billy.Filesystem) *webhookQueue {
+	return &webhookQueue{
+		fs:     fs,
+		client: &http.Client{Timeout: webhookTimeout},
+		now:    time.Now,
+	}
+}
+
+// Enqueue stores a new delivery to be sent by the worker.
+func (q *webhookQueue) Enqueue(delivery *WebhookDelivery) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.write(webhookQueueDir, delivery)
+}
+
+func (q *webhookQueue) write(dir string, delivery *WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	err = q.fs.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename it so readers never see a partially
+	// written delivery.
+	tmpName := path.Join(dir, "."+delivery.ID+".tmp")
+
+	err = util.WriteFile(q.fs, tmpName, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return q.fs.Rename(tmpName, path.Join(dir, delivery.ID+".json"))
+}
+
+func (q *webhookQueue) read(dir string, id string) (*WebhookDelivery, error) {
+	data, err := util.ReadFile(q.fs, path.Join(dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrWebhookNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var delivery WebhookDelivery
+
+	err = json.Unmarshal(data, &delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Failed = dir == webhookFailedDir
+
+	return &delivery, nil
+}
+
+// listIDs returns the IDs of all deliveries in the given dir, oldest first.
+func (q *webhookQueue) listIDs(dir string) ([]string, error) {
+	entries, err := q.fs.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// List returns all pending deliveries followed by all failed deliveries.
+func (q *webhookQueue) List() ([]*WebhookDelivery, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var ret []*WebhookDelivery
+
+	for _, dir := range []string{webhookQueueDir, webhookFailedDir} {
+		ids, err := q.listIDs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			delivery, err := q.read(dir, id)
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, delivery)
+		}
+	}
+
+	return ret, nil
+}
+
+// Get returns the delivery with the given ID, whether it is pending or has
+// failed.
+func (q *webhookQueue) Get(id string) (*WebhookDelivery, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.get(id)
+}
+
+func (q *webhookQueue) get(id string) (*WebhookDelivery, error) {
+	// IDs come from users, so make sure they can't point outside the queue.
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return nil, ErrWebhookNotFound
+	}
+
+	delivery, err := q.read(webhookQueueDir, id)
+	if !errors.Is(err, ErrWebhookNotFound) {
+		return delivery, err
+	}
+
+	return q.read(webhookFailedDir, id)
+}
+
+// Retry resets the given delivery so it will be sent on the next run of the
+// worker, even if it had already failed.
+func (q *webhookQueue) Retry(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delivery, err := q.get(id)
+	if err != nil {
+		return err
+	}
+
+	delivery.Attempts = 0
+	delivery.NextAttempt = q.now()
+
+	err = q.write(webhookQueueDir, delivery)
+	if err != nil {
+		return err
+	}
+
+	if delivery.Failed {
+		return q.fs.Remove(path.Join(webhookFailedDir, id+".json"))
+	}
+
+	return nil
+}
+
+// DeliverPending attempts to send every delivery which is ready. Deliveries
+// are sent one at a time, oldest first.
+func (q *webhookQueue) DeliverPending(ctx context.Context, log *zerolog.Logger) error {
+	q.lock.Lock()
+	ids, err := q.listIDs(webhookQueueDir)
+	q.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		q.lock.Lock()
+		delivery, err := q.read(webhookQueueDir, id)
+		q.lock.Unlock()
+
+		if errors.Is(err, ErrWebhookNotFound) {
+			// This was removed since we listed the queue.
+			continue
+		} else if err != nil {
+			log.Error().Err(err).Str("delivery", id).Msg("Failed to read webhook delivery")
+			continue
+		}
+
+		if q.now().Before(delivery.NextAttempt) {
+			continue
+		}
+
+		sendErr := q.send(ctx, delivery)
+
+		err = q.recordAttempt(delivery, sendErr)
+		if err != nil {
+			log.Error().Err(err).Str("delivery", id).Msg("Failed to update webhook delivery")
+			continue
+		}
+
+		switch {
+		case delivery.Delivered:
+			log.Info().Str("delivery", id).Str("url", delivery.URL).Msg("Delivered webhook")
+		case delivery.Failed:
+			log.Warn().Err(sendErr).Str("delivery", id).Str("url", delivery.URL).Msg("Webhook delivery failed")
+		default:
+			log.Info().Err(sendErr).Str("delivery", id).Str("url", delivery.URL).
+				Time("next_attempt", delivery.NextAttempt).Msg("Webhook delivery will be retried")
+		}
+	}
+
+	return nil
+}
+
+func (q *webhookQueue) send(ctx context.Context, delivery *WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, strings.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+
+	for key, value := range delivery.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	// Drain some of the body so the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// recordAttempt updates the delivery on disk based on the result of sending
+// it. Successful deliveries are removed, deliveries which have run out of
+// attempts are moved to the failed dir, and everything else is scheduled to
+// be retried.
+func (q *webhookQueue) recordAttempt(delivery *WebhookDelivery, sendErr error) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queuePath := path.Join(webhookQueueDir, delivery.ID+".json")
+
+	delivery.Attempts++
+
+	if sendErr == nil {
+		delivery.Delivered = true
+		return q.fs.Remove(queuePath)
+	}
+
+	delivery.LastError = sendErr.Error()
+
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Failed = true
+
+		err := q.write(webhookFailedDir, delivery)
+		if err != nil {
+			return err
+		}
+
+		return q.fs.Remove(queuePath)
+	}
+
+	delivery.NextAttempt = q.now().Add(webhookBackoff(delivery.Attempts))
+
+	return q.write(webhookQueueDir, delivery)
+}
+
+// webhookBackoff returns how long to wait before the next attempt, given the
+// number of attempts which have already failed.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookInitialBackoff
+
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+
+	return backoff
+}
+
+// RunWebhooks delivers queued webhooks until the given context is cancelled.
+func (serv *Server) RunWebhooks(ctx context.Context) {
+	serv.log.Info().Msg("Starting webhook worker")
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := serv.webhooks.DeliverPending(ctx, &serv.log)
+		if err != nil && ctx.Err() == nil {
+			serv.log.Error().Err(err).Msg("Failed to deliver webhooks")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
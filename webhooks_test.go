@@ -0,0 +1,281 @@
+package gitdir
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/belak/go-gitdir/internal/git"
+	"github.com/belak/go-gitdir/models"
+)
+
+const (
+	testOldHash  = "1111111111111111111111111111111111111111"
+	testNewHash  = "2222222222222222222222222222222222222222"
+	testZeroHash = "0000000000000000000000000000000000000000"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct { //nolint:gofumpt
+		Ref    string
+		Before string
+		After  string
+		Events []string
+	}{
+		{"refs/heads/master", testOldHash, testNewHash, []string{"push"}},
+		{"refs/heads/master", testZeroHash, testNewHash, []string{"branch_create", "push"}},
+		{"refs/heads/master", testOldHash, testZeroHash, []string{"branch_delete"}},
+		{"refs/tags/v1.0.0", testZeroHash, testNewHash, []string{"tag"}},
+		{"refs/tags/v1.0.0", testOldHash, testZeroHash, []string{"tag"}},
+		{"refs/notes/commits", testOldHash, testNewHash, nil},
+	}
+
+	for _, test := range tests {
+		events := webhookEvents(&WebhookRef{Ref: test.Ref, Before: test.Before, After: test.After})
+		assert.Equal(t, test.Events, events, test.Ref)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 30*time.Second, webhookBackoff(1))
+	assert.Equal(t, time.Minute, webhookBackoff(2))
+	assert.Equal(t, 4*time.Minute, webhookBackoff(4))
+	assert.Equal(t, time.Hour, webhookBackoff(8))
+	assert.Equal(t, time.Hour, webhookBackoff(100))
+}
+
+type webhookRecorder struct {
+	sync.Mutex
+
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, string(body))
+
+	w.WriteHeader(wr.status)
+}
+
+func TestWebhookDelivery(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	log := zerolog.Nop()
+	recorder := &webhookRecorder{status: http.StatusOK}
+
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	c := newTestConfig()
+	c.Orgs["an-org"].Webhooks = []*models.Webhook{
+		{URL: server.URL + "/org", Events: []string{"branch_delete"}},
+	}
+	c.Orgs["an-org"].Repos["test-repo"].Webhooks = []*models.Webhook{
+		{URL: server.URL + "/repo", Secret: "hunter2"},
+	}
+
+	stdin := strings.Join([]string{
+		testOldHash + " " + testNewHash + " refs/heads/master",
+		testOldHash + " " + testZeroHash + " refs/heads/old-branch",
+	}, "\n") + "\n"
+
+	err := c.RunHook("post-receive", "@an-org/test-repo", "org-write", nil, nil, strings.NewReader(stdin))
+	require.NoError(t, err)
+
+	// Repos without webhooks shouldn't queue anything.
+	err = c.RunHook("post-receive", "test-repo", "an-admin", nil, nil, strings.NewReader(stdin))
+	require.NoError(t, err)
+
+	queue := newWebhookQueue(c.fs)
+
+	deliveries, err := queue.List()
+	require.NoError(t, err)
+	require.Len(t, deliveries, 3)
+
+	err = queue.DeliverPending(context.Background(), &log)
+	require.NoError(t, err)
+
+	deliveries, err = queue.List()
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	recorder.Lock()
+	defer recorder.Unlock()
+
+	require.Len(t, recorder.requests, 3)
+
+	payloads := make(map[string]WebhookPayload)
+
+	for i, req := range recorder.requests {
+		var payload WebhookPayload
+
+		require.NoError(t, json.Unmarshal([]byte(recorder.bodies[i]), &payload))
+		assert.Equal(t, "@an-org/test-repo", payload.Repo)
+		assert.Equal(t, "org-write", payload.Pusher)
+		assert.Equal(t, payload.Event, req.Header.Get("X-Gitdir-Event"))
+		assert.NotEmpty(t, req.Header.Get("X-Gitdir-Delivery"))
+
+		if req.URL.Path == "/repo" {
+			assert.Equal(t, signWebhookBody("hunter2", []byte(recorder.bodies[i])), req.Header.Get("X-Gitdir-Signature-256"))
+		} else {
+			assert.Empty(t, req.Header.Get("X-Gitdir-Signature-256"))
+		}
+
+		payloads[req.URL.Path+" "+payload.Event] = payload
+	}
+
+	assert.Equal(t, []*WebhookRef{
+		{Ref: "refs/heads/master", Before: testOldHash, After: testNewHash},
+	}, payloads["/repo push"].Refs)
+	assert.Equal(t, []*WebhookRef{
+		{Ref: "refs/heads/old-branch", Before: testOldHash, After: testZeroHash},
+	}, payloads["/repo branch_delete"].Refs)
+	assert.Equal(t, []*WebhookRef{
+		{Ref: "refs/heads/old-branch", Before: testOldHash, After: testZeroHash},
+	}, payloads["/org branch_delete"].Refs)
+}
+
+func TestWebhookUserConfig(t *testing.T) {
+	t.Parallel()
+
+	log := zerolog.Nop()
+	recorder := &webhookRecorder{status: http.StatusOK}
+
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	// Webhooks can only be configured by admins.
+	c := newTestConfig()
+	c.Options.UserConfigRepos = true
+
+	userRepo, err := git.EnsureRepo(c.fs, "admin/user-non-admin")
+	require.NoError(t, err)
+	require.NoError(t, userRepo.Checkout(""))
+	require.NoError(t, userRepo.CreateFile("config.yml", []byte("repos:\n  a-repo:\n    webhooks:\n      - url: "+server.URL+"\n")))
+	require.NoError(t, userRepo.Commit("Added webhook", nil))
+
+	require.NoError(t, c.loadUserConfig("non-admin"))
+	require.NotNil(t, c.Users["non-admin"].Repos["a-repo"])
+	assert.Empty(t, c.Users["non-admin"].Repos["a-repo"].Webhooks)
+
+	stdin := testOldHash + " " + testNewHash + " refs/heads/master\n"
+
+	err = c.RunHook("post-receive", "~non-admin/a-repo", "non-admin", nil, nil, strings.NewReader(stdin))
+	require.NoError(t, err)
+
+	queue := newWebhookQueue(c.fs)
+	require.NoError(t, queue.DeliverPending(context.Background(), &log))
+
+	recorder.Lock()
+	defer recorder.Unlock()
+
+	assert.Empty(t, recorder.requests)
+}
+
+func TestWebhookRetry(t *testing.T) { //nolint:funlen
+	t.Parallel()
+
+	log := zerolog.Nop()
+	recorder := &webhookRecorder{status: http.StatusInternalServerError}
+
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	c := newTestConfig()
+	c.Repos["test-repo"].Webhooks = []*models.Webhook{
+		{URL: server.URL, Events: []string{"tag"}},
+	}
+
+	stdin := testZeroHash + " " + testNewHash + " refs/tags/v1.0.0\n"
+
+	err := c.RunHook("post-receive", "test-repo", "an-admin", nil, nil, strings.NewReader(stdin))
+	require.NoError(t, err)
+
+	now := time.Now()
+	queue := newWebhookQueue(c.fs)
+	queue.now = func() time.Time { return now }
+
+	err = queue.DeliverPending(context.Background(), &log)
+	require.NoError(t, err)
+
+	deliveries, err := queue.List()
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	delivery := deliveries[0]
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.False(t, delivery.Failed)
+	assert.Equal(t, "unexpected status: 500 Internal Server Error", delivery.LastError)
+	assert.True(t, delivery.NextAttempt.Equal(now.Add(webhookInitialBackoff)))
+
+	// Nothing should be sent before the backoff has passed.
+	err = queue.DeliverPending(context.Background(), &log)
+	require.NoError(t, err)
+
+	recorder.Lock()
+	assert.Len(t, recorder.requests, 1)
+	recorder.Unlock()
+
+	// Keep moving time forward until it runs out of attempts.
+	for i := 1; i < webhookMaxAttempts; i++ {
+		now = now.Add(webhookMaxBackoff)
+
+		err = queue.DeliverPending(context.Background(), &log)
+		require.NoError(t, err)
+	}
+
+	delivery, err = queue.Get(delivery.ID)
+	require.NoError(t, err)
+	assert.True(t, delivery.Failed)
+	assert.Equal(t, webhookMaxAttempts, delivery.Attempts)
+
+	// Failed deliveries are no longer attempted.
+	now = now.Add(webhookMaxBackoff)
+
+	err = queue.DeliverPending(context.Background(), &log)
+	require.NoError(t, err)
+
+	recorder.Lock()
+	assert.Len(t, recorder.requests, webhookMaxAttempts)
+	recorder.status = http.StatusNoContent
+	recorder.Unlock()
+
+	// Retrying it should move it back to the queue and it should be sent
+	// right away.
+	err = queue.Retry(delivery.ID)
+	require.NoError(t, err)
+
+	err = queue.DeliverPending(context.Background(), &log)
+	require.NoError(t, err)
+
+	deliveries, err = queue.List()
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	_, err = queue.Get(delivery.ID)
+	assert.ErrorIs(t, err, ErrWebhookNotFound)
+
+	_, err = queue.Get("../../admin/admin")
+	assert.ErrorIs(t, err, ErrWebhookNotFound)
+}